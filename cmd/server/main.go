@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"godash/internal/caddy"
 	"godash/internal/config"
 	"godash/internal/handlers"
 	"godash/internal/middleware"
+	"godash/internal/models"
 	"godash/internal/services"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -20,12 +26,53 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
+	// Maintenance subcommands run instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+
+	// Cancelled on SIGINT/SIGTERM to stop background work and the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Background subsystems, stopped in reverse order on shutdown
+	var shutdownHooks []func()
+
+	// Create data directory
+	dataDir := "data"
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Printf("Warning: Could not create data directory: %v", err)
+	}
+
 	// Initialize services
-	userService := services.NewUserService()
+	userService, rbac, err := newUserService(cfg, dataDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize user store: %v", err)
+	}
+	password, created, err := userService.Bootstrap(cfg.Auth.AdminUsername, cfg.Auth.AdminEmail, cfg.Auth.AdminPassword)
+	if err != nil {
+		log.Fatalf("Failed to create the first admin: %v", err)
+	}
+	if created && password != "" {
+		path, err := writeBootstrapPassword(dataDir, password)
+		if err != nil {
+			log.Fatalf("Failed to save the password of the first admin: %v; set AUTH_ADMIN_PASSWORD or run \"godash user reset-password %s\"", err, cfg.Auth.AdminUsername)
+		}
+		log.Printf("Created admin user %q; its password is in %s and must be changed at the first login, then delete the file", cfg.Auth.AdminUsername, path)
+	} else if created {
+		log.Printf("Created admin user %q with AUTH_ADMIN_PASSWORD; it must be changed at the first login", cfg.Auth.AdminUsername)
+	}
+	tokenService, err := services.NewTokenService(filepath.Join(dataDir, "tokens.json"))
+	if err != nil {
+		log.Fatalf("Failed to initialize API tokens: %v", err)
+	}
 	dashboardService := services.NewDashboardService()
 
 	// Initialize middleware
 	authMiddleware := middleware.NewAuthMiddleware(cfg.Session.SecretKey, userService)
+	authMiddleware.SetRBAC(rbac)
+	authMiddleware.SetTokenService(tokenService)
+	authMiddleware.SetRememberDevice(time.Duration(cfg.Auth.RememberDeviceDays) * 24 * time.Hour)
 
 	// Parse templates
 	templates, err := template.ParseGlob("web/templates/*.html")
@@ -36,12 +83,6 @@ func main() {
 	// Initialize Caddy services
 	var h *handlers.Handlers
 
-	// Create data directory
-	dataDir := "data"
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		log.Printf("Warning: Could not create data directory: %v", err)
-	}
-
 	// Initialize instance store
 	instanceStore, err := caddy.NewInstanceStore(filepath.Join(dataDir, "instances.json"))
 	if err != nil {
@@ -49,11 +90,31 @@ func main() {
 		log.Println("Caddy features will be unavailable")
 		h, _ = handlers.New(userService, dashboardService, authMiddleware)
 	} else {
+		// Local log files can only be tailed from the log directory
+		instanceStore.SetLogDir(cfg.Caddy.LogDir)
+
+		// Role bindings scoped to tags apply to the instances carrying them
+		authMiddleware.SetInstanceTags(func(id string) ([]string, bool) {
+			inst, err := instanceStore.Get(id)
+			if err != nil {
+				return nil, false
+			}
+			return inst.Tags, true
+		})
+
 		// Initialize analytics store
 		analyticsStore, err := caddy.NewAnalyticsStore(filepath.Join(dataDir, "analytics"))
 		if err != nil {
 			log.Printf("Warning: Could not initialize analytics store: %v", err)
 			log.Println("Analytics features will be unavailable")
+		} else {
+			analyticsStore.SetRetention(caddy.RetentionPolicy{
+				Raw:    cfg.Caddy.MetricsRetention,
+				Minute: cfg.Caddy.RollupRetentionMinute,
+				Hour:   cfg.Caddy.RollupRetentionHour,
+				Day:    cfg.Caddy.RollupRetentionDay,
+			})
+			shutdownHooks = append(shutdownHooks, func() { analyticsStore.Close() })
 		}
 
 		// Initialize handlers with Caddy services
@@ -61,8 +122,86 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to initialize handlers: %v", err)
 		}
+
+		// Snapshot instance configs around every change
+		configHistory, err := caddy.NewConfigHistory(filepath.Join(dataDir, "config-history"), cfg.Caddy.ConfigHistoryMax)
+		if err != nil {
+			log.Printf("Warning: Could not initialize config history: %v", err)
+		} else {
+			h.SetConfigHistory(configHistory)
+		}
+
+		// Site templates: the built-in ones plus JSON files teams add
+		h.SetSiteTemplates(caddy.NewSiteTemplates(filepath.Join(dataDir, "site-templates")))
+
+		// Record instance operations in the audit log
+		if cfg.Caddy.AuditEnabled {
+			auditStore, err := caddy.NewAuditStore(filepath.Join(dataDir, "logs"), cfg.Caddy.AuditMaxEntries)
+			if err != nil {
+				log.Printf("Warning: Could not initialize audit log: %v", err)
+			} else {
+				auditStore.SetRotation(cfg.Caddy.AuditMaxSize, cfg.Caddy.AuditMaxAge)
+				if cfg.Caddy.AuditKeyFile != "" {
+					key, err := caddy.LoadAuditKey(cfg.Caddy.AuditKeyFile)
+					if err != nil {
+						log.Fatalf("Failed to load audit signing key: %v", err)
+					}
+					auditStore.SetSigningKey(key)
+				}
+				if cfg.Caddy.AuditSyslog != "" {
+					forwarder, err := caddy.NewSyslogForwarder(caddy.SyslogOptions{
+						Address:       cfg.Caddy.AuditSyslog,
+						CAFile:        cfg.Caddy.AuditSyslogCAFile,
+						Facility:      cfg.Caddy.AuditSyslogFacility,
+						QueueDir:      filepath.Join(dataDir, "logs", "syslog-queue"),
+						QueueMaxBytes: cfg.Caddy.AuditSyslogQueueMax,
+					})
+					if err != nil {
+						log.Printf("Warning: Could not start audit forwarding: %v", err)
+					} else {
+						auditStore.AddSink(forwarder)
+						log.Printf("Forwarding audit entries to syslog at %s", cfg.Caddy.AuditSyslog)
+					}
+				}
+				shutdownHooks = append(shutdownHooks, func() { auditStore.Close() })
+				h.SetAuditStore(auditStore)
+			}
+		}
+
+		// Start the log sink for Caddy's net log writer and local log files
+		logSink := caddy.NewLogSink(instanceStore, cfg.Caddy.LogBufferSize)
+		if cfg.Caddy.LogListen != "" {
+			for _, addr := range strings.Split(cfg.Caddy.LogListen, ",") {
+				if err := logSink.Listen(strings.TrimSpace(addr)); err != nil {
+					log.Printf("Warning: Could not start log listener on %s: %v", addr, err)
+				} else {
+					log.Printf("Receiving Caddy logs on %s", addr)
+				}
+			}
+		}
+		logSink.Start()
+		h.SetLogSink(logSink)
+		shutdownHooks = append(shutdownHooks, func() { logSink.Close() })
+
+		// Start the background metrics collector
+		if cfg.Caddy.MetricsInterval > 0 {
+			configService := caddy.NewConfigService(caddy.NewInstanceService(instanceStore), analyticsStore)
+			collector := caddy.NewCollector(configService, analyticsStore, caddy.CollectorOptions{
+				Interval:  cfg.Caddy.MetricsInterval,
+				Timeout:   cfg.Caddy.MetricsTimeout,
+				Workers:   cfg.Caddy.MetricsWorkers,
+				Retention: cfg.Caddy.MetricsRetention,
+			})
+			collector.Start(ctx)
+			h.SetCollector(collector)
+			shutdownHooks = append(shutdownHooks, collector.Stop)
+			log.Printf("Collecting Caddy metrics every %s (retention %s)", cfg.Caddy.MetricsInterval, cfg.Caddy.MetricsRetention)
+		}
 	}
 
+	h.SetRBAC(rbac)
+	h.SetTokenService(tokenService)
+
 	// Setup routes
 	r := mux.NewRouter()
 
@@ -91,10 +230,39 @@ func main() {
 		templates.ExecuteTemplate(w, "config-editor.html", data)
 	}))).Methods("GET")
 
+	r.Handle("/admin/users", authMiddleware.RequireGlobalPermission(models.PermUsersManage)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetCurrentUser(r)
+		data := struct {
+			User interface{}
+		}{User: user}
+		templates.ExecuteTemplate(w, "users.html", data)
+	}))).Methods("GET")
+
+	r.Handle(middleware.TwoFactorPath, authMiddleware.RequireAuth(http.HandlerFunc(h.TwoFactorHandler))).Methods("GET")
+
+	r.Handle("/account", authMiddleware.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetCurrentUser(r)
+		data := struct {
+			User interface{}
+		}{User: user}
+		templates.ExecuteTemplate(w, "profile.html", data)
+	}))).Methods("GET")
+
+	r.Handle("/caddy/instances/{id}/logs", authMiddleware.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetCurrentUser(r)
+		data := struct {
+			User interface{}
+		}{User: user}
+		templates.ExecuteTemplate(w, "logs.html", data)
+	}))).Methods("GET")
+
 	// Public routes
 	r.HandleFunc("/", h.HomeHandler)
 	r.HandleFunc("/login", h.LoginHandler)
+	r.HandleFunc("/login/2fa", h.TwoFactorLoginHandler).Methods("GET", "POST")
 	r.HandleFunc("/logout", h.LogoutHandler)
+	r.HandleFunc("/invite/{token}", h.AcceptInviteHandler).Methods("GET", "POST")
+	r.Handle(middleware.ChangePasswordPath, authMiddleware.RequireAuth(http.HandlerFunc(h.ChangePasswordHandler))).Methods("GET", "POST")
 
 	// Static files
 	r.PathPrefix("/static/").HandlerFunc(h.StaticFileHandler)
@@ -108,40 +276,119 @@ func main() {
 
 	api.HandleFunc("/dashboard", h.APIDashboardDataHandler).Methods("GET")
 	api.HandleFunc("/stats", h.APISystemStatsHandler).Methods("GET")
-	api.HandleFunc("/users", h.APIUsersHandler).Methods("GET")
+	api.Handle("/users", authMiddleware.RequireGlobalPermission(models.PermUsersManage)(http.HandlerFunc(h.APIUsersHandler))).Methods("GET")
+	api.HandleFunc("/account", h.APIAccountHandler).Methods("GET")
+	api.HandleFunc("/account/permissions", h.APIAccountPermissionsHandler).Methods("GET")
+	api.Handle("/account", authMiddleware.RequireSession(http.HandlerFunc(h.APIUpdateAccountHandler))).Methods("PUT")
+	api.Handle("/account/password", authMiddleware.RequireSession(http.HandlerFunc(h.APIChangePasswordHandler))).Methods("POST")
+	api.Handle("/account/tokens", authMiddleware.RequireSession(http.HandlerFunc(h.APIAccountTokensHandler))).Methods("GET")
+	api.Handle("/account/tokens", authMiddleware.RequireSession(http.HandlerFunc(h.APICreateAccountTokenHandler))).Methods("POST")
+	api.Handle("/account/tokens/{tid}", authMiddleware.RequireSession(http.HandlerFunc(h.APIRevokeAccountTokenHandler))).Methods("DELETE")
+	api.Handle("/account/2fa", authMiddleware.RequireSession(http.HandlerFunc(h.APIAccount2FAHandler))).Methods("GET")
+	api.Handle("/account/2fa/setup", authMiddleware.RequireSession(http.HandlerFunc(h.APIAccount2FASetupHandler))).Methods("POST")
+	api.Handle("/account/2fa/enable", authMiddleware.RequireSession(http.HandlerFunc(h.APIAccount2FAEnableHandler))).Methods("POST")
+	api.Handle("/account/2fa/disable", authMiddleware.RequireSession(http.HandlerFunc(h.APIAccount2FADisableHandler))).Methods("POST")
+	api.Handle("/account/2fa/recovery-codes", authMiddleware.RequireSession(http.HandlerFunc(h.APIAccountRecoveryCodesHandler))).Methods("POST")
+	api.Handle("/account/2fa/forget-devices", authMiddleware.RequireSession(http.HandlerFunc(h.APIAccountForgetDevicesHandler))).Methods("POST")
 
-	// Caddy API routes
+	// Caddy API routes. Each requires a permission, held on the instance in
+	// the path if there is one.
 	caddyAPI := api.PathPrefix("/caddy").Subrouter()
+	perm := func(p models.Permission, handler http.HandlerFunc) http.Handler {
+		return authMiddleware.RequirePermission(p)(handler)
+	}
+	globalPerm := func(p models.Permission, handler http.HandlerFunc) http.Handler {
+		return authMiddleware.RequireGlobalPermission(p)(handler)
+	}
 
 	// Instance management
-	caddyAPI.HandleFunc("/instances", h.APIListInstancesHandler).Methods("GET")
-	caddyAPI.HandleFunc("/instances", h.APICreateInstanceHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}", h.APIGetInstanceHandler).Methods("GET")
-	caddyAPI.HandleFunc("/instances/{id}", h.APIUpdateInstanceHandler).Methods("PUT")
-	caddyAPI.HandleFunc("/instances/{id}", h.APIDeleteInstanceHandler).Methods("DELETE")
-	caddyAPI.HandleFunc("/instances/{id}/test", h.APITestInstanceHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}/refresh", h.APIRefreshInstanceHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}/health", h.APIInstanceHealthHandler).Methods("GET")
+	caddyAPI.Handle("/instances", perm(models.PermInstanceRead, h.APIListInstancesHandler)).Methods("GET")
+	caddyAPI.Handle("/instances", globalPerm(models.PermInstanceManage, h.APICreateInstanceHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}", perm(models.PermInstanceRead, h.APIGetInstanceHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}", perm(models.PermInstanceManage, h.APIUpdateInstanceHandler)).Methods("PUT")
+	caddyAPI.Handle("/instances/{id}", perm(models.PermInstanceManage, h.APIDeleteInstanceHandler)).Methods("DELETE")
+	caddyAPI.Handle("/instances/{id}/test", perm(models.PermInstanceRead, h.APITestInstanceHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/refresh", perm(models.PermInstanceRead, h.APIRefreshInstanceHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/health", perm(models.PermInstanceRead, h.APIInstanceHealthHandler)).Methods("GET")
+	caddyAPI.Handle("/collector", perm(models.PermInstanceRead, h.APICollectorStatusHandler)).Methods("GET")
 
 	// Instance operations
-	caddyAPI.HandleFunc("/instances/{id}/metrics", h.APIInstanceMetricsHandler).Methods("GET")
-	caddyAPI.HandleFunc("/instances/{id}/config", h.APIInstanceConfigHandler).Methods("GET")
-	caddyAPI.HandleFunc("/instances/{id}/config/json", h.APIInstanceConfigHandler).Methods("GET")
-	caddyAPI.HandleFunc("/instances/{id}/config/caddyfile", h.APIInstanceCaddyfileHandler).Methods("GET")
-	caddyAPI.HandleFunc("/instances/{id}/reload", h.APIInstanceReloadHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}/start", h.APIInstanceStartHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}/stop", h.APIInstanceStopHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}/restart", h.APIInstanceRestartHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}/logs", h.APIInstanceLogsHandler).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/metrics", perm(models.PermInstanceRead, h.APIInstanceMetricsHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/rates", perm(models.PermInstanceRead, h.APIInstanceRatesHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/latency", perm(models.PermInstanceRead, h.APIInstanceLatencyHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config", perm(models.PermConfigRead, h.APIInstanceConfigHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config/json", perm(models.PermConfigRead, h.APIInstanceConfigHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config/caddyfile", perm(models.PermConfigRead, h.APIInstanceCaddyfileHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config/caddyfile", perm(models.PermConfigWrite, h.APIInstanceUpdateCaddyfileHandler)).Methods("PUT")
+	caddyAPI.Handle("/instances/{id}/config/caddyfile/adapt", perm(models.PermConfigRead, h.APIInstanceAdaptCaddyfileHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/config/caddyfile/format", perm(models.PermConfigRead, h.APIFormatCaddyfileHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/config/caddyfile/lint", perm(models.PermConfigRead, h.APILintCaddyfileHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/config/versions", perm(models.PermConfigRead, h.APIInstanceConfigVersionsHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config/versions/{version}", perm(models.PermConfigRead, h.APIInstanceConfigVersionHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config/versions/{version}/rollback", perm(models.PermConfigWrite, h.APIInstanceConfigRollbackHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/config/diff", perm(models.PermConfigRead, h.APIInstanceConfigDiffHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config/plan", perm(models.PermConfigRead, h.APIInstanceConfigPlanHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/config/{path:.+}", perm(models.PermConfigRead, h.APIInstanceConfigPathHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/config/{path:.+}", perm(models.PermConfigWrite, h.APIInstanceEditConfigPathHandler)).Methods("PUT", "PATCH", "POST", "DELETE")
+	caddyAPI.Handle("/instances/{id}/reload", perm(models.PermServerReload, h.APIInstanceReloadHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/start", perm(models.PermServerStop, h.APIInstanceStartHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/stop", perm(models.PermServerStop, h.APIInstanceStopHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/restart", perm(models.PermServerStop, h.APIInstanceRestartHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/logs", perm(models.PermLogsRead, h.APIInstanceLogsHandler)).Methods("GET")
+
+	// Analytics
+	caddyAPI.Handle("/analytics", perm(models.PermInstanceRead, h.APIAnalyticsHandler)).Methods("GET")
+	caddyAPI.Handle("/analytics/{id}", perm(models.PermInstanceRead, h.APIInstanceAnalyticsHandler)).Methods("GET")
+	caddyAPI.Handle("/analytics/{id}/metrics", perm(models.PermInstanceRead, h.APIInstanceAnalyticsHandler)).Methods("GET")
+	caddyAPI.Handle("/analytics/{id}/traffic", perm(models.PermInstanceRead, h.APIInstanceTrafficHandler)).Methods("GET")
+	caddyAPI.Handle("/analytics/{id}/sites", perm(models.PermInstanceRead, h.APIInstanceSiteAnalyticsHandler)).Methods("GET")
+	caddyAPI.Handle("/analytics/{id}/errors", perm(models.PermInstanceRead, h.APIInstanceErrorAnalyticsHandler)).Methods("GET")
 
 	// Site management
-	caddyAPI.HandleFunc("/instances/{id}/sites", h.APIInstanceSitesHandler).Methods("GET")
-	caddyAPI.HandleFunc("/instances/{id}/sites", h.APIInstanceCreateSiteHandler).Methods("POST")
-	caddyAPI.HandleFunc("/instances/{id}/sites/{site}", h.APIInstanceDeleteSiteHandler).Methods("DELETE")
+	caddyAPI.Handle("/instances/{id}/sites", perm(models.PermInstanceRead, h.APIInstanceSitesHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/sites", perm(models.PermConfigWrite, h.APIInstanceCreateSiteHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/sites/preview", perm(models.PermConfigRead, h.APIInstancePreviewSiteHandler)).Methods("POST")
+	caddyAPI.Handle("/site-templates", perm(models.PermConfigRead, h.APISiteTemplatesHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/sites/{site}", perm(models.PermConfigWrite, h.APIInstanceDeleteSiteHandler)).Methods("DELETE")
+	caddyAPI.Handle("/instances/{id}/sites/{site}/routes", perm(models.PermConfigRead, h.APIInstanceRoutesHandler)).Methods("GET")
+	caddyAPI.Handle("/instances/{id}/sites/{site}/routes", perm(models.PermConfigWrite, h.APIInstanceAddRouteHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/sites/{site}/routes/{index}", perm(models.PermConfigWrite, h.APIInstanceUpdateRouteHandler)).Methods("PUT")
+	caddyAPI.Handle("/instances/{id}/sites/{site}/routes/{index}", perm(models.PermConfigWrite, h.APIInstanceDeleteRouteHandler)).Methods("DELETE")
+	caddyAPI.Handle("/instances/{id}/sites/{site}/routes/{index}/move", perm(models.PermConfigWrite, h.APIInstanceMoveRouteHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/sites/{site}/routes/{index}/enable", perm(models.PermConfigWrite, h.APIInstanceEnableRouteHandler)).Methods("POST")
+	caddyAPI.Handle("/instances/{id}/sites/{site}/routes/{index}/disable", perm(models.PermConfigWrite, h.APIInstanceDisableRouteHandler)).Methods("POST")
 
-	// Admin API routes (admin only)
+	// Admin API routes (audit.read and users.manage)
 	adminAPI := api.PathPrefix("/admin").Subrouter()
-	adminAPI.Use(authMiddleware.RequireAdmin)
+	auditRead := authMiddleware.RequireGlobalPermission(models.PermAuditRead)
+	usersManage := authMiddleware.RequireGlobalPermission(models.PermUsersManage)
+
+	adminAPI.Handle("/audit", auditRead(http.HandlerFunc(h.APIAdminAuditHandler))).Methods("GET")
+	adminAPI.Handle("/audit/verify", auditRead(http.HandlerFunc(h.APIAdminAuditVerifyHandler))).Methods("GET")
+	adminAPI.Handle("/audit/export", auditRead(http.HandlerFunc(h.APIAdminAuditExportHandler))).Methods("GET")
+
+	// User management
+	adminAPI.Handle("/users", usersManage(http.HandlerFunc(h.APIAdminUsersHandler))).Methods("GET")
+	adminAPI.Handle("/users", usersManage(http.HandlerFunc(h.APIAdminCreateUserHandler))).Methods("POST")
+	adminAPI.Handle("/users/{uid}", usersManage(http.HandlerFunc(h.APIAdminGetUserHandler))).Methods("GET")
+	adminAPI.Handle("/users/{uid}", usersManage(http.HandlerFunc(h.APIAdminUpdateUserHandler))).Methods("PUT")
+	adminAPI.Handle("/users/{uid}/deactivate", usersManage(http.HandlerFunc(h.APIAdminDeactivateUserHandler))).Methods("POST")
+	adminAPI.Handle("/users/{uid}/activate", usersManage(http.HandlerFunc(h.APIAdminActivateUserHandler))).Methods("POST")
+	adminAPI.Handle("/users/{uid}/reset-password", usersManage(http.HandlerFunc(h.APIAdminResetPasswordHandler))).Methods("POST")
+	adminAPI.Handle("/users/{uid}/invite", usersManage(http.HandlerFunc(h.APIAdminReinviteUserHandler))).Methods("POST")
+	adminAPI.Handle("/users/{uid}/reset-2fa", usersManage(http.HandlerFunc(h.APIAdminReset2FAHandler))).Methods("POST")
+	adminAPI.Handle("/users/{uid}/bindings", usersManage(http.HandlerFunc(h.APIAdminUserBindingsHandler))).Methods("GET")
+	adminAPI.Handle("/users/{uid}/bindings", usersManage(http.HandlerFunc(h.APIAdminAddBindingHandler))).Methods("POST")
+	adminAPI.Handle("/bindings/{bid}", usersManage(http.HandlerFunc(h.APIAdminDeleteBindingHandler))).Methods("DELETE")
+
+	adminAPI.Handle("/tokens", usersManage(http.HandlerFunc(h.APIAdminTokensHandler))).Methods("GET")
+	adminAPI.Handle("/tokens/{tid}", usersManage(http.HandlerFunc(h.APIAdminRevokeTokenHandler))).Methods("DELETE")
+
+	// Roles
+	adminAPI.Handle("/roles", usersManage(http.HandlerFunc(h.APIAdminRolesHandler))).Methods("GET")
+	adminAPI.Handle("/roles", usersManage(http.HandlerFunc(h.APIAdminSaveRoleHandler))).Methods("POST")
+	adminAPI.Handle("/roles/{name}", usersManage(http.HandlerFunc(h.APIAdminSaveRoleHandler))).Methods("PUT")
+	adminAPI.Handle("/roles/{name}", usersManage(http.HandlerFunc(h.APIAdminDeleteRoleHandler))).Methods("DELETE")
 
 	// Start server
 	addr := fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.Server.Port)
@@ -149,10 +396,70 @@ func main() {
 	log.Printf("Dashboard available at: http://%s/dashboard", addr)
 	log.Printf("Caddy Instances: http://%s/caddy/instances", addr)
 	log.Printf("Caddy Analytics: http://%s/caddy/analytics", addr)
-	log.Printf("Default credentials: admin / password")
 	log.Printf("Caddy API available at: http://%s/api/caddy", addr)
 
-	if err := http.ListenAndServe(addr, r); err != nil {
+	server := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed to start: %v", err)
 	}
+
+	for i := len(shutdownHooks) - 1; i >= 0; i-- {
+		shutdownHooks[i]()
+	}
+}
+
+// newUserService opens the user store in dataDir with the configured
+// password policy, along with the roles and role bindings next to it
+func newUserService(cfg *config.Config, dataDir string) (*services.UserService, *services.RBACService, error) {
+	store, err := services.NewFileUserStore(filepath.Join(dataDir, "users.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	rbac, err := services.NewRBACService(filepath.Join(dataDir, "rbac.json"), store)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userService := services.NewUserService(store, services.PasswordPolicy{
+		MinLength:     cfg.Auth.PasswordMinLength,
+		RequireUpper:  cfg.Auth.PasswordRequireUpper,
+		RequireLower:  cfg.Auth.PasswordRequireLower,
+		RequireDigit:  cfg.Auth.PasswordRequireDigit,
+		RequireSymbol: cfg.Auth.PasswordRequireSymbol,
+	})
+	userService.SetRBAC(rbac)
+	userService.SetRequireTOTP(cfg.Auth.RequireTwoFactor)
+	return userService, rbac, nil
+}
+
+// bootstrapPasswordFile holds the generated password of the first admin, so
+// it never appears in logs, which are often collected and kept elsewhere
+const bootstrapPasswordFile = "initial-admin-password"
+
+// writeBootstrapPassword saves the generated password of the first admin in
+// dataDir, readable by the owner only, and returns the file's path
+func writeBootstrapPassword(dataDir, password string) (string, error) {
+	path := filepath.Join(dataDir, bootstrapPasswordFile)
+
+	// A file left from an earlier installation may have looser permissions
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(password + "\n"); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
 }
@@ -3,28 +3,77 @@ package caddy
 import (
 	"encoding/json"
 	"fmt"
+	"godash/internal/tsdb"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-// AnalyticsStore provides file-based storage for analytics data
+// rawSegmentDuration is the time window covered by each raw segment file
+const rawSegmentDuration = 6 * time.Hour
+
+// AnalyticsStore stores collected metrics in a per-instance time-series
+// database under metricsDir/{instanceID}/raw, rolled up into 1m, 1h and 1d
+// tiers alongside it
 type AnalyticsStore struct {
 	metricsDir string
-	mu         sync.RWMutex
+	mu         sync.Mutex
+	dbs        map[string]*instanceDB
+	retention  RetentionPolicy
 }
 
-// NewAnalyticsStore creates a new analytics store
+// NewAnalyticsStore creates a new analytics store, migrating metrics left
+// in the old one-JSON-file-per-sample layout
 func NewAnalyticsStore(metricsDir string) (*AnalyticsStore, error) {
 	// Ensure directory exists
 	if err := os.MkdirAll(metricsDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create metrics directory: %w", err)
 	}
 
-	return &AnalyticsStore{
+	store := &AnalyticsStore{
 		metricsDir: metricsDir,
-	}, nil
+		dbs:        make(map[string]*instanceDB),
+		retention:  DefaultRetentionPolicy,
+	}
+
+	if err := store.migrateJSON(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Close flushes and closes every open database
+func (s *AnalyticsStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for id, inst := range s.dbs {
+		if err := inst.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.dbs, id)
+	}
+	return firstErr
+}
+
+// SetRetention sets how long raw samples and each rollup tier are kept
+func (s *AnalyticsStore) SetRetention(policy RetentionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention = policy
+}
+
+// Retention returns the current retention policy
+func (s *AnalyticsStore) Retention() RetentionPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retention
 }
 
 // instanceDir returns the directory for an instance's metrics
@@ -32,131 +81,146 @@ func (s *AnalyticsStore) instanceDir(instanceID string) string {
 	return filepath.Join(s.metricsDir, instanceID)
 }
 
-// SaveMetrics saves metrics for an instance
-func (s *AnalyticsStore) SaveMetrics(instanceID string, metrics *InstanceMetrics) error {
+// db returns the databases of an instance. Without create, a missing
+// database yields nil rather than an empty one on disk.
+func (s *AnalyticsStore) db(instanceID string, create bool) (*instanceDB, error) {
+	if instanceID == "" || instanceID != filepath.Base(instanceID) || instanceID == ".." {
+		return nil, fmt.Errorf("invalid instance ID %q", instanceID)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Create instance directory if needed
-	instDir := s.instanceDir(instanceID)
-	if err := os.MkdirAll(instDir, 0755); err != nil {
-		return fmt.Errorf("failed to create instance directory: %w", err)
+	if inst, ok := s.dbs[instanceID]; ok {
+		return inst, nil
 	}
 
-	// Use timestamp as filename
-	filename := fmt.Sprintf("%s.json", metrics.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
-	filePath := filepath.Join(instDir, filename)
+	dir := s.instanceDir(instanceID)
+	if !create {
+		if _, err := os.Stat(filepath.Join(dir, "raw")); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
 
-	data, err := json.MarshalIndent(metrics, "", "  ")
+	inst, err := openInstanceDB(dir, instanceID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metrics: %w", err)
+		return nil, fmt.Errorf("failed to open metrics database: %w", err)
 	}
+	s.dbs[instanceID] = inst
+	return inst, nil
+}
 
-	return os.WriteFile(filePath, data, 0644)
+// SaveMetrics saves metrics for an instance
+func (s *AnalyticsStore) SaveMetrics(instanceID string, metrics *InstanceMetrics) error {
+	inst, err := s.db(instanceID, true)
+	if err != nil {
+		return err
+	}
+	if err := inst.append(toSample(metrics)); err != nil {
+		return fmt.Errorf("failed to save metrics: %w", err)
+	}
+	return nil
 }
 
 // GetMetrics returns metrics for an instance within a time range
 func (s *AnalyticsStore) GetMetrics(instanceID string, start, end time.Time) ([]*InstanceMetrics, error) {
-	instDir := s.instanceDir(instanceID)
+	return s.queryMetrics(instanceID, start, end, nil)
+}
 
-	entries, err := os.ReadDir(instDir)
+// queryMetrics reads metrics within a time range, decoding only the series
+// accepted by filter (nil for all)
+func (s *AnalyticsStore) queryMetrics(instanceID string, start, end time.Time, filter func(string) bool) ([]*InstanceMetrics, error) {
+	inst, err := s.db(instanceID, false)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []*InstanceMetrics{}, nil
-		}
-		return nil, fmt.Errorf("failed to read metrics directory: %w", err)
+		return nil, err
 	}
-
-	var metrics []*InstanceMetrics
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-
-		// Parse timestamp from filename
-		timestamp, err := time.Parse("2006-01-02T15:04:05Z07:00", entry.Name()[:len("2006-01-02T15:04:05Z07:00")])
-		if err != nil {
-			continue // Skip files with invalid names
-		}
-
-		// Check if within range
-		if timestamp.Before(start) || timestamp.After(end) {
-			continue
-		}
-
-		// Read and parse metrics
-		data, err := os.ReadFile(filepath.Join(instDir, entry.Name()))
-		if err != nil {
-			continue
-		}
-
-		var m InstanceMetrics
-		if err := json.Unmarshal(data, &m); err != nil {
-			continue
-		}
-
-		metrics = append(metrics, &m)
+	if inst == nil {
+		return []*InstanceMetrics{}, nil
 	}
 
+	metrics := []*InstanceMetrics{}
+	err = inst.raw.QuerySeries(start, end, filter, func(sample tsdb.Sample) bool {
+		metrics = append(metrics, fromSample(instanceID, sample))
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics: %w", err)
+	}
 	return metrics, nil
 }
 
 // GetLatestMetrics returns the most recent metrics for an instance
 func (s *AnalyticsStore) GetLatestMetrics(instanceID string) (*InstanceMetrics, error) {
-	instDir := s.instanceDir(instanceID)
-
-	entries, err := os.ReadDir(instDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("failed to read metrics directory: %w", err)
+	inst, err := s.db(instanceID, false)
+	if err != nil || inst == nil {
+		return nil, err
 	}
 
-	if len(entries) == 0 {
+	sample, ok := inst.raw.Last()
+	if !ok {
 		return nil, nil
 	}
+	return fromSample(instanceID, sample), nil
+}
+
+// CleanupOldMetrics removes raw samples older than maxAge and rollups older
+// than their tier's retention. Storage is reclaimed a whole segment at a
+// time, so data up to one segment window past a cutoff may remain until the
+// next cleanup.
+func (s *AnalyticsStore) CleanupOldMetrics(maxAge time.Duration) error {
+	now := time.Now()
+	retention := s.Retention()
+
+	entries, err := os.ReadDir(s.metricsDir)
+	if err != nil {
+		return fmt.Errorf("failed to read metrics directory: %w", err)
+	}
 
-	// Find the latest file
-	var latestFile string
-	var latestTime time.Time
+	var firstErr error
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if !entry.IsDir() {
 			continue
 		}
 
-		timestamp, err := time.Parse("2006-01-02T15:04:05Z07:00", entry.Name()[:len("2006-01-02T15:04:05Z07:00")])
-		if err != nil {
+		inst, err := s.db(entry.Name(), false)
+		if err != nil || inst == nil {
 			continue
 		}
-
-		if timestamp.After(latestTime) {
-			latestTime = timestamp
-			latestFile = entry.Name()
+		if maxAge > 0 {
+			if err := inst.raw.DeleteBefore(now.Add(-maxAge)); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to remove old metrics: %w", err)
+			}
+		}
+		for i, t := range inst.tiers {
+			keep := retention.tier(i)
+			if keep <= 0 {
+				continue
+			}
+			if err := t.db.DeleteBefore(now.Add(-keep)); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to remove old %s rollups: %w", t.tier.Name, err)
+			}
 		}
 	}
 
-	if latestFile == "" {
-		return nil, nil
-	}
+	return firstErr
+}
 
-	data, err := os.ReadFile(filepath.Join(instDir, latestFile))
-	if err != nil {
-		return nil, fmt.Errorf("failed to read metrics file: %w", err)
+// parseMetricsFilename returns the sample time encoded in a legacy metrics filename
+func parseMetricsFilename(name string) (time.Time, bool) {
+	if !strings.HasSuffix(name, ".json") {
+		return time.Time{}, false
 	}
-
-	var metrics InstanceMetrics
-	if err := json.Unmarshal(data, &metrics); err != nil {
-		return nil, fmt.Errorf("failed to parse metrics: %w", err)
+	timestamp, err := time.Parse(time.RFC3339, strings.TrimSuffix(name, ".json"))
+	if err != nil {
+		return time.Time{}, false
 	}
-
-	return &metrics, nil
+	return timestamp, true
 }
 
-// CleanupOldMetrics removes metrics older than the specified duration
-func (s *AnalyticsStore) CleanupOldMetrics(maxAge time.Duration) error {
-	cutoff := time.Now().Add(-maxAge)
-
+// migrateJSON imports metrics stored one JSON file per sample into the
+// database and removes the files. Samples already in the database are
+// skipped, so an interrupted migration resumes where it stopped.
+func (s *AnalyticsStore) migrateJSON() error {
 	entries, err := os.ReadDir(s.metricsDir)
 	if err != nil {
 		return fmt.Errorf("failed to read metrics directory: %w", err)
@@ -166,48 +230,226 @@ func (s *AnalyticsStore) CleanupOldMetrics(maxAge time.Duration) error {
 		if !entry.IsDir() {
 			continue
 		}
+		instanceID := entry.Name()
+		instDir := s.instanceDir(instanceID)
 
-		instDir := filepath.Join(s.metricsDir, entry.Name())
-		instEntries, err := os.ReadDir(instDir)
+		files, err := os.ReadDir(instDir)
 		if err != nil {
 			continue
 		}
 
-		for _, instEntry := range instEntries {
-			if instEntry.IsDir() {
+		type legacyFile struct {
+			name string
+			time time.Time
+		}
+		var legacy []legacyFile
+		for _, f := range files {
+			if f.IsDir() {
 				continue
 			}
+			if timestamp, ok := parseMetricsFilename(f.Name()); ok {
+				legacy = append(legacy, legacyFile{name: f.Name(), time: timestamp})
+			}
+		}
+		if len(legacy) == 0 {
+			continue
+		}
+		sort.Slice(legacy, func(i, j int) bool { return legacy[i].time.Before(legacy[j].time) })
+
+		// Write without per-sample fsync; the database is synced on close
+		// before any JSON file is removed
+		db, err := tsdb.Open(filepath.Join(instDir, "raw"), tsdb.Options{
+			SegmentDuration: rawSegmentDuration,
+			NoSync:          true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate metrics for %s: %w", instanceID, err)
+		}
+
+		var after time.Time
+		if last, ok := db.Last(); ok {
+			after = last.Time
+		}
 
-			timestamp, err := time.Parse("2006-01-02T15:04:05Z07:00", instEntry.Name()[:len("2006-01-02T15:04:05Z07:00")])
+		imported := 0
+		for _, f := range legacy {
+			data, err := os.ReadFile(filepath.Join(instDir, f.name))
 			if err != nil {
 				continue
 			}
-
-			if timestamp.Before(cutoff) {
-				os.Remove(filepath.Join(instDir, instEntry.Name()))
+			var m InstanceMetrics
+			if err := json.Unmarshal(data, &m); err != nil {
+				continue
+			}
+			if !m.Timestamp.After(after) {
+				continue
 			}
+			if err := db.Append(toSample(&m)); err != nil {
+				continue
+			}
+			after = m.Timestamp
+			imported++
+		}
+
+		if err := db.Close(); err != nil {
+			return fmt.Errorf("failed to migrate metrics for %s: %w", instanceID, err)
+		}
+		for _, f := range legacy {
+			os.Remove(filepath.Join(instDir, f.name))
 		}
+		log.Printf("Migrated %d metrics samples for instance %s", imported, instanceID)
 	}
 
 	return nil
 }
 
-// GetAggregatedMetrics returns aggregated metrics across all instances
+// tierFor picks the resolution to answer a query from: the coarsest rollup
+// tier whose buckets still fit within step, moving to coarser tiers while
+// the chosen one no longer reaches back to start. It returns -1 for raw
+// samples.
+func (s *AnalyticsStore) tierFor(start time.Time, step time.Duration) int {
+	retention := s.Retention()
+	covers := func(keep time.Duration) bool {
+		return keep <= 0 || !start.Before(time.Now().Add(-keep))
+	}
+
+	tier := -1
+	for i, t := range rollupTiers {
+		if t.Width <= step {
+			tier = i
+		}
+	}
+	if tier < 0 {
+		if covers(retention.Raw) {
+			return -1
+		}
+		tier = 0
+	}
+	for tier < len(rollupTiers)-1 && !covers(retention.tier(tier)) {
+		tier++
+	}
+	return tier
+}
+
+// tierName returns the name of a resolution picked by tierFor
+func tierName(tier int) string {
+	if tier < 0 {
+		return "raw"
+	}
+	return rollupTiers[tier].Name
+}
+
+// queryHistory reads metrics at the resolution tierFor picks for step,
+// starting lookback before start so the first bucket has an interval to
+// draw from. Rollup buckets are returned as their last values.
+func (s *AnalyticsStore) queryHistory(instanceID string, start, end time.Time, step, lookback time.Duration, filter func(string) bool) ([]*InstanceMetrics, string, error) {
+	tier := s.tierFor(start, step)
+	if tier < 0 {
+		history, err := s.queryMetrics(instanceID, start.Add(-lookback), end, filter)
+		return history, tierName(tier), err
+	}
+
+	// Buckets are stored at their start, so reach back far enough to
+	// include the bucket in progress at start
+	lookback = max(lookback, rollupTiers[tier].Width)
+
+	rollups, err := s.GetRollups(instanceID, tier, start.Add(-lookback), end, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	history := make([]*InstanceMetrics, 0, len(rollups))
+	for _, r := range rollups {
+		history = append(history, r.Metrics(instanceID))
+	}
+	return history, tierName(tier), nil
+}
+
+// GetRollups returns the buckets of rollup tier i (0 = 1m, 1 = 1h, 2 = 1d)
+// starting within [start, end], including the buckets still in progress.
+// Only series accepted by filter (nil for all) are included.
+func (s *AnalyticsStore) GetRollups(instanceID string, tier int, start, end time.Time, filter func(string) bool) ([]*Rollup, error) {
+	if tier < 0 || tier >= len(rollupTiers) {
+		return nil, fmt.Errorf("invalid rollup tier %d", tier)
+	}
+	inst, err := s.db(instanceID, false)
+	if err != nil {
+		return nil, err
+	}
+	if inst == nil {
+		return []*Rollup{}, nil
+	}
+
+	rollups, err := inst.queryTier(tier, start, end, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s rollups: %w", rollupTiers[tier].Name, err)
+	}
+	return rollups, nil
+}
+
+// GetRates returns the bucketed rate of a counter (see ParseCounter) for an
+// instance. Samples from just before the range are included so the first
+// bucket has an interval to draw from.
+func (s *AnalyticsStore) GetRates(instanceID, metric string, opts RateOptions) (*RateSeries, error) {
+	counter, err := ParseCounter(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	lookback := opts.MaxGap
+	if lookback <= 0 {
+		lookback = max(opts.Step, 5*time.Minute)
+	}
+	history, source, err := s.queryHistory(instanceID, opts.Start, opts.End, opts.Step, lookback, func(name string) bool {
+		return !isHistogramSeries(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	series := ComputeRates(history, counter, opts)
+	series.Metric = metric
+	series.Source = source
+	return series, nil
+}
+
+// GetLatency returns percentiles and a heatmap of a stored histogram (see
+// ParseHistogram) for an instance over a time window
+func (s *AnalyticsStore) GetLatency(instanceID, metric string, opts LatencyOptions) (*LatencyReport, error) {
+	lookback := max(opts.Step, 5*time.Minute)
+	history, source, err := s.queryHistory(instanceID, opts.Start, opts.End, opts.Step, lookback, nil)
+	if err != nil {
+		return nil, err
+	}
+	report, err := ComputeLatency(history, metric, opts)
+	if err != nil {
+		return nil, err
+	}
+	report.Source = source
+	return report, nil
+}
+
+// GetAggregatedMetrics returns aggregated metrics across all instances.
+// Totals are the counter increases within the range, not raw counter values,
+// read from the coarsest rollup tier that still resolves the range.
 func (s *AnalyticsStore) GetAggregatedMetrics(instances []*CaddyInstance, start, end time.Time) (*AnalyticsResponse, error) {
 	var totalReqs int64
 	var totalBytes int64
 	var history []*InstanceMetrics
 
+	requests, _ := ParseCounter("requests")
+	bytes, _ := ParseCounter("bytes")
+
+	step := end.Sub(start) / 100
 	for _, inst := range instances {
-		metrics, err := s.GetMetrics(inst.ID, start, end)
+		metrics, _, err := s.queryHistory(inst.ID, start, end, step, 0, func(name string) bool {
+			return name == "uptime" || name == "num_requests" || name == "total_bytes"
+		})
 		if err != nil {
 			continue
 		}
 
-		for _, m := range metrics {
-			totalReqs += m.NumRequests
-			totalBytes += m.TotalTraffic
-		}
+		totalReqs += int64(TotalIncrease(metrics, requests))
+		totalBytes += int64(TotalIncrease(metrics, bytes))
 
 		// Get latest metrics for each instance
 		if latest, err := s.GetLatestMetrics(inst.ID); err == nil && latest != nil {
@@ -1,9 +1,18 @@
 package caddy
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,19 +21,57 @@ import (
 type AuditAction string
 
 const (
-	ActionCreateInstance AuditAction = "create_instance"
-	ActionUpdateInstance AuditAction = "update_instance"
-	ActionDeleteInstance AuditAction = "delete_instance"
-	ActionTestConnection AuditAction = "test_connection"
-	ActionRefreshStatus  AuditAction = "refresh_status"
-	ActionReloadConfig   AuditAction = "reload_config"
-	ActionStopServer     AuditAction = "stop_server"
-	ActionStartServer    AuditAction = "start_server"
-	ActionRestartServer  AuditAction = "restart_server"
-	ActionCreateSite     AuditAction = "create_site"
-	ActionDeleteSite     AuditAction = "delete_site"
-	ActionViewConfig     AuditAction = "view_config"
-	ActionViewLogs       AuditAction = "view_logs"
+	ActionCreateInstance  AuditAction = "create_instance"
+	ActionUpdateInstance  AuditAction = "update_instance"
+	ActionDeleteInstance  AuditAction = "delete_instance"
+	ActionTestConnection  AuditAction = "test_connection"
+	ActionRefreshStatus   AuditAction = "refresh_status"
+	ActionReloadConfig    AuditAction = "reload_config"
+	ActionRollbackConfig  AuditAction = "rollback_config"
+	ActionUpdateCaddyfile AuditAction = "update_caddyfile"
+	ActionEditConfigPath  AuditAction = "edit_config_path"
+	ActionStopServer      AuditAction = "stop_server"
+	ActionStartServer     AuditAction = "start_server"
+	ActionRestartServer   AuditAction = "restart_server"
+	ActionCreateSite      AuditAction = "create_site"
+	ActionDeleteSite      AuditAction = "delete_site"
+	ActionAddRoute        AuditAction = "add_route"
+	ActionUpdateRoute     AuditAction = "update_route"
+	ActionMoveRoute       AuditAction = "move_route"
+	ActionEnableRoute     AuditAction = "enable_route"
+	ActionDisableRoute    AuditAction = "disable_route"
+	ActionDeleteRoute     AuditAction = "delete_route"
+	ActionViewConfig      AuditAction = "view_config"
+	ActionViewLogs        AuditAction = "view_logs"
+
+	// User management; the target user is named in Details
+	ActionCreateUser     AuditAction = "create_user"
+	ActionInviteUser     AuditAction = "invite_user"
+	ActionAcceptInvite   AuditAction = "accept_invite"
+	ActionUpdateUser     AuditAction = "update_user"
+	ActionDeactivateUser AuditAction = "deactivate_user"
+	ActionActivateUser   AuditAction = "activate_user"
+	ActionResetPassword  AuditAction = "reset_password"
+	ActionChangePassword AuditAction = "change_password"
+
+	// Roles and role bindings; the role is named in Details
+	ActionSaveRole      AuditAction = "save_role"
+	ActionDeleteRole    AuditAction = "delete_role"
+	ActionAddBinding    AuditAction = "add_role_binding"
+	ActionDeleteBinding AuditAction = "delete_role_binding"
+
+	// API tokens; the token is named in Details
+	ActionCreateToken AuditAction = "create_api_token"
+	ActionRevokeToken AuditAction = "revoke_api_token"
+
+	// Two-factor authentication; the user is named in Details
+	ActionLogin2FA           AuditAction = "login_2fa"
+	ActionUseRecoveryCode    AuditAction = "use_recovery_code"
+	ActionEnable2FA          AuditAction = "enable_2fa"
+	ActionDisable2FA         AuditAction = "disable_2fa"
+	ActionReset2FA           AuditAction = "reset_2fa"
+	ActionRegenerateRecovery AuditAction = "regenerate_recovery_codes"
+	ActionForgetDevices      AuditAction = "forget_devices"
 )
 
 // AuditEntry represents a single audit log entry
@@ -33,6 +80,8 @@ type AuditEntry struct {
 	Timestamp    time.Time   `json:"timestamp"`
 	UserID       int         `json:"user_id"`
 	Username     string      `json:"username,omitempty"`
+	TokenID      string      `json:"token_id,omitempty"`   // API token the request was made with
+	TokenName    string      `json:"token_name,omitempty"` // Its name at the time
 	InstanceID   string      `json:"instance_id,omitempty"`
 	InstanceName string      `json:"instance_name,omitempty"`
 	Action       AuditAction `json:"action"`
@@ -40,26 +89,155 @@ type AuditEntry struct {
 	IPAddress    string      `json:"ip_address"`
 	Success      bool        `json:"success"`
 	ErrorMsg     string      `json:"error_msg,omitempty"`
+
+	// Hash chain: each entry's hash covers its content and the previous
+	// entry's hash, so editing or removing an entry breaks every later link
+	Seq       uint64 `json:"seq,omitempty"`
+	PrevHash  string `json:"prev_hash,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Signature string `json:"signature,omitempty"` // HMAC-SHA256 of Hash under the server key
+}
+
+// computeHash returns the SHA-256 of the entry with its hash and signature
+// cleared. PrevHash is part of the hashed content.
+func (e *AuditEntry) computeHash() (string, error) {
+	c := *e
+	c.Hash = ""
+	c.Signature = ""
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
 }
 
-// AuditStore provides file-based audit logging
+func signAuditHash(key []byte, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrInvalidCursor is returned by Query for a cursor it didn't issue
+var ErrInvalidCursor = errors.New("invalid audit cursor")
+
+// AuditStore provides file-based audit logging. Entries are appended to
+// audit.log, which is compressed into a segment once it reaches maxEntries,
+// maxSize bytes or maxAge; see auditlog.go for the file layout.
 type AuditStore struct {
+	logDir     string
 	logFile    string
 	mu         sync.Mutex
-	maxEntries int // Maximum number of entries to keep
+	maxEntries int           // Entries per log file before it is archived
+	maxSize    int64         // Bytes per log file before it is archived (0 = no limit)
+	maxAge     time.Duration // Age of a log file's first entry before it is archived (0 = no limit)
+	key        []byte        // HMAC signing key (nil disables signing)
+	segments   []auditSegment
+	sinks      []AuditSink
+
+	lastSeq     uint64 // Chain position of the newest entry
+	lastHash    string
+	signedFrom  uint64 // Seq of the first signed entry (0 = none yet)
+	active      int    // Entries in the active file
+	activeSize  int64
+	activeStart time.Time // Time of the active file's first entry
 }
 
-// NewAuditStore creates a new audit store
+// NewAuditStore creates a new audit store, resuming the hash chain from the
+// newest stored entry
 func NewAuditStore(logDir string, maxEntries int) (*AuditStore, error) {
 	// Ensure directory exists
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return nil, err
 	}
 
-	return &AuditStore{
-		logFile:    filepath.Join(logDir, "audit.log"),
+	s := &AuditStore{
+		logDir:     logDir,
+		logFile:    filepath.Join(logDir, auditActiveFile),
 		maxEntries: maxEntries,
-	}, nil
+	}
+	if err := s.openSegments(); err != nil {
+		return nil, err
+	}
+	if err := s.loadChainState(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetSigningKey enables HMAC signing of new entries
+func (s *AuditStore) SetSigningKey(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+}
+
+// SetRotation sets the size and age limits of the active log file in
+// addition to the entry limit. Zero disables a limit.
+func (s *AuditStore) SetRotation(maxSize int64, maxAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxSize = maxSize
+	s.maxAge = maxAge
+}
+
+// LoadAuditKey reads an audit signing key from a file
+func LoadAuditKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit key: %w", err)
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("audit key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// loadChainState reads the active file and finds the newest chained entry,
+// falling back to the newest segment that has one
+func (s *AuditStore) loadChainState() error {
+	signing, err := readAuditSigning(s.logDir)
+	if err != nil {
+		return err
+	}
+	s.signedFrom = signing.SignedFrom
+
+	err = scanAuditFile(s.logFile, func(_ int, entry *AuditEntry, _ error) bool {
+		if entry == nil {
+			return true
+		}
+		if s.active == 0 {
+			s.activeStart = entry.Timestamp
+		}
+		if entry.Hash != "" {
+			s.lastSeq, s.lastHash = entry.Seq, entry.Hash
+		}
+		s.active++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.logFile); err == nil {
+		s.activeSize = info.Size()
+	}
+
+	for i := len(s.segments) - 1; i >= 0 && s.lastHash == ""; i-- {
+		if s.segments[i].LastSeq == 0 {
+			continue
+		}
+		err := scanAuditFile(filepath.Join(s.logDir, s.segments[i].File), func(_ int, entry *AuditEntry, _ error) bool {
+			if entry != nil && entry.Hash != "" {
+				s.lastSeq, s.lastHash = entry.Seq, entry.Hash
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Log records an audit entry
@@ -69,6 +247,25 @@ func (s *AuditStore) Log(entry *AuditEntry) error {
 
 	entry.ID = generateAuditID()
 	entry.Timestamp = time.Now()
+	entry.Seq = s.lastSeq + 1
+	entry.PrevHash = s.lastHash
+	entry.Hash = ""
+	entry.Signature = ""
+
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	if s.key != nil {
+		entry.Signature = signAuditHash(s.key, hash)
+		if s.signedFrom == 0 {
+			if err := writeAuditSigning(s.logDir, auditSigning{SignedFrom: entry.Seq}); err != nil {
+				return err
+			}
+			s.signedFrom = entry.Seq
+		}
+	}
 
 	data, err := json.Marshal(entry)
 	if err != nil {
@@ -82,36 +279,160 @@ func (s *AuditStore) Log(entry *AuditEntry) error {
 	}
 	defer f.Close()
 
-	if _, err := f.WriteString(string(data) + "\n"); err != nil {
+	if _, err := f.Write(append(data, '\n')); err != nil {
 		return err
 	}
+	s.lastSeq, s.lastHash = entry.Seq, entry.Hash
+	if s.active == 0 {
+		s.activeStart = entry.Timestamp
+	}
+	s.active++
+	s.activeSize += int64(len(data)) + 1
+
+	for _, sink := range s.sinks {
+		if err := sink.Write(entry); err != nil {
+			log.Printf("Warning: audit sink: %v", err)
+		}
+	}
 
 	// Rotate if needed
 	return s.rotateIfNeeded()
 }
 
-// GetEntries returns audit entries, optionally filtered
+// GetEntries returns audit entries newest first, optionally filtered by
+// instance_id, user_id, username, action or success ("true"/"false").
+// A limit of 0 returns every match.
 func (s *AuditStore) GetEntries(filters map[string]string, limit int) ([]*AuditEntry, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	entries, err := s.readEntries()
+	snap, err := s.snapshot()
+	s.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	defer snap.Close()
 
-	// Apply filters
-	var filtered []*AuditEntry
-	for _, entry := range entries {
+	filtered := []*AuditEntry{}
+	err = snap.walkNewestFirst(nil, func(entry *AuditEntry) bool {
 		if s.matchesFilters(entry, filters) {
 			filtered = append(filtered, entry)
 		}
-		if len(filtered) >= limit {
-			break
+		return limit <= 0 || len(filtered) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filtered, nil
+}
+
+// AuditQuery filters and pages through audit entries. Zero values match
+// everything.
+type AuditQuery struct {
+	UserID     int
+	Username   string
+	InstanceID string
+	Action     AuditAction
+	Success    *bool
+	Since      time.Time // Inclusive
+	Until      time.Time // Exclusive
+	Cursor     string    // NextCursor of the previous page
+	Limit      int       // Page size (default 50)
+}
+
+// AuditPage is one page of audit entries, newest first
+type AuditPage struct {
+	Entries    []*AuditEntry `json:"entries"`
+	NextCursor string        `json:"next_cursor,omitempty"` // Empty on the last page
+}
+
+// Query returns the page of entries matching q that follows q.Cursor
+func (s *AuditStore) Query(q AuditQuery) (*AuditPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = 50
+	}
+
+	// The cursor is the seq of the last entry already returned, or its ID
+	// for entries from before chaining, which all precede seq 1
+	var cursorSeq uint64
+	var cursorID string
+	if q.Cursor != "" {
+		if id, ok := strings.CutPrefix(q.Cursor, "id:"); ok {
+			cursorID = id
+		} else {
+			seq, err := strconv.ParseUint(q.Cursor, 10, 64)
+			if err != nil || seq == 0 {
+				return nil, ErrInvalidCursor
+			}
+			cursorSeq = seq
 		}
 	}
 
-	return filtered, nil
+	skip := func(seg auditSegment) bool {
+		switch {
+		case cursorSeq > 0 && seg.FirstSeq >= cursorSeq,
+			!q.Since.IsZero() && seg.LastTime.Before(q.Since),
+			!q.Until.IsZero() && !seg.FirstTime.Before(q.Until):
+			return true
+		}
+		return false
+	}
+
+	s.mu.Lock()
+	snap, err := s.snapshot()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	page := &AuditPage{Entries: []*AuditEntry{}}
+	past := q.Cursor == ""
+	err = snap.walkNewestFirst(skip, func(entry *AuditEntry) bool {
+		if !past {
+			if cursorID != "" {
+				past = entry.Seq == 0 && entry.ID == cursorID
+				return true
+			}
+			if entry.Seq >= cursorSeq {
+				return true
+			}
+			past = true
+		}
+		if !q.matches(entry) {
+			return true
+		}
+		if len(page.Entries) == q.Limit {
+			page.NextCursor = auditCursor(page.Entries[len(page.Entries)-1])
+			return false
+		}
+		page.Entries = append(page.Entries, entry)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// auditCursor returns the Query cursor that resumes after entry
+func auditCursor(entry *AuditEntry) string {
+	if entry.Seq > 0 {
+		return strconv.FormatUint(entry.Seq, 10)
+	}
+	return "id:" + entry.ID
+}
+
+func (q AuditQuery) matches(entry *AuditEntry) bool {
+	switch {
+	case q.UserID != 0 && entry.UserID != q.UserID,
+		q.Username != "" && entry.Username != q.Username,
+		q.InstanceID != "" && entry.InstanceID != q.InstanceID,
+		q.Action != "" && entry.Action != q.Action,
+		q.Success != nil && entry.Success != *q.Success,
+		!q.Since.IsZero() && entry.Timestamp.Before(q.Since),
+		!q.Until.IsZero() && !entry.Timestamp.Before(q.Until):
+		return false
+	}
+	return true
 }
 
 // GetEntriesForInstance returns all entries for a specific instance
@@ -121,7 +442,7 @@ func (s *AuditStore) GetEntriesForInstance(instanceID string, limit int) ([]*Aud
 
 // GetEntriesForUser returns all entries for a specific user
 func (s *AuditStore) GetEntriesForUser(userID int, limit int) ([]*AuditEntry, error) {
-	return s.GetEntries(map[string]string{"user_id": string(rune(userID))}, limit)
+	return s.GetEntries(map[string]string{"user_id": strconv.Itoa(userID)}, limit)
 }
 
 // GetRecentEntries returns the most recent entries
@@ -129,42 +450,13 @@ func (s *AuditStore) GetRecentEntries(limit int) ([]*AuditEntry, error) {
 	return s.GetEntries(nil, limit)
 }
 
-// Clear clears the audit log
+// Clear starts a new, empty log file. Existing entries are archived rather
+// than deleted so the hash chain stays verifiable.
 func (s *AuditStore) Clear() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return os.WriteFile(s.logFile, []byte{}, 0644)
-}
-
-func (s *AuditStore) readEntries() ([]*AuditEntry, error) {
-	data, err := os.ReadFile(s.logFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []*AuditEntry{}, nil
-		}
-		return nil, err
-	}
-
-	var entries []*AuditEntry
-	lines := string(data)
-	for _, line := range splitLines(lines) {
-		if line == "" {
-			continue
-		}
-		var entry AuditEntry
-		if err := json.Unmarshal([]byte(line), &entry); err != nil {
-			continue
-		}
-		entries = append(entries, &entry)
-	}
-
-	// Reverse to get newest first
-	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
-		entries[i], entries[j] = entries[j], entries[i]
-	}
-
-	return entries, nil
+	return s.archiveActive()
 }
 
 func (s *AuditStore) matchesFilters(entry *AuditEntry, filters map[string]string) bool {
@@ -175,8 +467,11 @@ func (s *AuditStore) matchesFilters(entry *AuditEntry, filters map[string]string
 				return false
 			}
 		case "user_id":
-			// Convert user_id to string for comparison
-			if entry.UserID != 0 && string(rune(entry.UserID)) != value {
+			if strconv.Itoa(entry.UserID) != value {
+				return false
+			}
+		case "username":
+			if entry.Username != value {
 				return false
 			}
 		case "action":
@@ -184,65 +479,185 @@ func (s *AuditStore) matchesFilters(entry *AuditEntry, filters map[string]string
 				return false
 			}
 		case "success":
-			// Parse boolean string
-			return false
+			success, err := strconv.ParseBool(value)
+			if err != nil || entry.Success != success {
+				return false
+			}
 		}
 	}
 	return true
 }
 
-func (s *AuditStore) rotateIfNeeded() error {
-	entries, err := s.readEntries()
+// AuditVerification is the result of checking the audit hash chain
+type AuditVerification struct {
+	OK        bool        `json:"ok"`
+	Entries   int         `json:"entries"`   // Entries checked
+	Unchained int         `json:"unchained"` // Entries from before hash chaining, which can't be verified
+	Signed    int         `json:"signed"`    // Entries whose signature was verified
+	LastSeq   uint64      `json:"last_seq"`
+	LastHash  string      `json:"last_hash"` // Record this elsewhere to detect later truncation
+	Break     *AuditBreak `json:"break,omitempty"`
+}
+
+// AuditBreak locates the first entry that fails verification
+type AuditBreak struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Seq     uint64 `json:"seq,omitempty"`
+	EntryID string `json:"entry_id,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// Verify checks the hash chain of every stored entry. The entries logged
+// while it runs aren't checked.
+func (s *AuditStore) Verify() (*AuditVerification, error) {
+	s.mu.Lock()
+	snap, err := s.snapshot()
+	key := s.key
+	s.mu.Unlock()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer snap.Close()
 
-	if len(entries) <= s.maxEntries {
-		return nil
+	return verifyAuditSnapshot(snap, key)
+}
+
+// VerifyAuditLog checks the hash chain across the archived and active audit
+// files in logDir and reports the first broken link. With a key, entry
+// signatures are checked too: every entry from the one signing started at,
+// and every entry after a signed one, must be signed, and a chain without
+// any signed entry fails. Entries written before chaining was introduced are
+// skipped as long as they precede the chain.
+func VerifyAuditLog(logDir string, key []byte) (*AuditVerification, error) {
+	archives, err := listAuditArchives(logDir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]auditSegment, len(archives))
+	for i, path := range archives {
+		segments[i].File = filepath.Base(path)
 	}
+	snap, err := openAuditSnapshot(logDir, segments)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
 
-	// Keep only the most recent entries
-	kept := entries[len(entries)-s.maxEntries:]
+	return verifyAuditSnapshot(snap, key)
+}
 
-	// Rewrite file
-	f, err := os.Create(s.logFile)
+// verifyAuditSnapshot is VerifyAuditLog for a snapshot of the log
+func verifyAuditSnapshot(snap *auditSnapshot, key []byte) (*AuditVerification, error) {
+	signing, err := readAuditSigning(snap.logDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
 
-	for _, entry := range kept {
-		data, _ := json.Marshal(entry)
-		f.WriteString(string(data) + "\n")
+	result := &AuditVerification{}
+	chained, signed := false, false
+	var last AuditBreak // Position of the newest chained entry
+	for i := 0; i <= len(snap.segments); i++ {
+		var seg *auditSegment
+		file := auditActiveFile
+		if i < len(snap.segments) {
+			seg = &snap.segments[i]
+			file = seg.File
+		}
+		fail := func(line int, entry *AuditEntry, reason string) {
+			result.Break = &AuditBreak{File: file, Line: line, Reason: reason}
+			if entry != nil {
+				result.Break.Seq = entry.Seq
+				result.Break.EntryID = entry.ID
+			}
+		}
+
+		err := snap.scan(seg, func(line int, entry *AuditEntry, parseErr error) bool {
+			result.Entries++
+			if parseErr != nil {
+				fail(line, nil, "unreadable entry: "+parseErr.Error())
+				return false
+			}
+
+			if entry.Hash == "" {
+				if chained {
+					fail(line, entry, "entry has no hash")
+					return false
+				}
+				result.Unchained++
+				return true
+			}
+
+			switch {
+			case !chained && (entry.Seq != 1 || entry.PrevHash != ""):
+				fail(line, entry, fmt.Sprintf("chain starts at seq %d; earlier entries are missing", entry.Seq))
+				return false
+			case chained && entry.Seq != result.LastSeq+1:
+				fail(line, entry, fmt.Sprintf("expected seq %d; entries are missing or reordered", result.LastSeq+1))
+				return false
+			case chained && entry.PrevHash != result.LastHash:
+				fail(line, entry, "previous hash doesn't match the preceding entry")
+				return false
+			}
+
+			hash, err := entry.computeHash()
+			if err != nil || hash != entry.Hash {
+				fail(line, entry, "hash mismatch; the entry was modified")
+				return false
+			}
+
+			if key != nil {
+				if entry.Signature == "" {
+					if signed || (signing.SignedFrom > 0 && entry.Seq >= signing.SignedFrom) {
+						fail(line, entry, "entry is not signed")
+						return false
+					}
+				} else if !hmac.Equal([]byte(entry.Signature), []byte(signAuditHash(key, entry.Hash))) {
+					fail(line, entry, "invalid signature")
+					return false
+				} else {
+					signed = true
+					result.Signed++
+				}
+			}
+
+			chained = true
+			result.LastSeq, result.LastHash = entry.Seq, entry.Hash
+			last = AuditBreak{File: file, Line: line, Seq: entry.Seq, EntryID: entry.ID}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.Break != nil {
+			return result, nil
+		}
 	}
 
-	return nil
+	// Stripping every signature and rehashing leaves a valid chain, but
+	// not one a key can verify
+	if key != nil && chained && result.Signed == 0 {
+		last.Reason = "no entry is signed although a key was given; signatures may have been stripped"
+		result.Break = &last
+		return result, nil
+	}
+
+	result.OK = true
+	return result, nil
 }
 
 func generateAuditID() string {
 	return time.Now().Format("20060102150405") + "-" + randomString(8)
 }
 
+// randomString returns n random alphanumeric characters. Audit IDs are used
+// as pagination cursors, so they must not repeat.
 func randomString(n int) string {
 	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, n)
+	rand.Read(b)
 	for i := range b {
-		b[i] = letters[time.Now().UnixNano()%int64(len(letters))]
+		b[i] = letters[int(b[i])%len(letters)]
 	}
 	return string(b)
 }
-
-func splitLines(s string) []string {
-	var lines []string
-	start := 0
-	for i := 0; i < len(s); i++ {
-		if s[i] == '\n' {
-			lines = append(lines, s[start:i])
-			start = i + 1
-		}
-	}
-	if start < len(s) {
-		lines = append(lines, s[start:])
-	}
-	return lines
-}
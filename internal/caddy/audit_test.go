@@ -0,0 +1,541 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAuditLog writes n signed entries to a fresh audit store, archiving
+// every maxEntries of them
+func newTestAuditLog(t *testing.T, n, maxEntries int, key []byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := NewAuditStore(dir, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetSigningKey(key)
+	for i := 0; i < n; i++ {
+		if err := s.Log(&AuditEntry{UserID: 1, Username: "admin", Action: ActionReloadConfig, Success: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// editAuditLines rewrites the lines of the active audit file
+func editAuditLines(t *testing.T, dir string, edit func([]string) []string) {
+	t.Helper()
+	path := filepath.Join(dir, auditActiveFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := edit(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// editAuditEntry changes the entry on line i and, with rehash, gives it a
+// matching hash and signature
+func editAuditEntry(t *testing.T, lines []string, i int, key []byte, rehash bool, edit func(*AuditEntry)) {
+	t.Helper()
+	var e AuditEntry
+	if err := json.Unmarshal([]byte(lines[i]), &e); err != nil {
+		t.Fatal(err)
+	}
+	edit(&e)
+	if rehash {
+		hash, err := e.computeHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Hash, e.Signature = hash, signAuditHash(key, hash)
+	}
+	data, err := json.Marshal(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines[i] = string(data)
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	key := []byte("test-key")
+
+	tests := []struct {
+		name   string
+		key    []byte // Key used to verify
+		tamper func(t *testing.T, lines []string) []string
+		line   int    // Line of the expected break, 0 if the log is intact
+		reason string // Expected start of the break reason
+		signed int    // Signatures verified in an intact log
+	}{
+		{name: "intact", key: key, signed: 5},
+		{name: "intact without key", key: nil, signed: 0},
+		{
+			name: "edited entry",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				editAuditEntry(t, lines, 2, key, false, func(e *AuditEntry) { e.Username = "mallory" })
+				return lines
+			},
+			line:   3,
+			reason: "hash mismatch",
+		},
+		{
+			name: "edited entry with recomputed hash",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				editAuditEntry(t, lines, 2, key, true, func(e *AuditEntry) { e.Success = false })
+				return lines
+			},
+			line:   4,
+			reason: "previous hash doesn't match",
+		},
+		{
+			name: "edited entry resigned with another key",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				editAuditEntry(t, lines, 4, []byte("other-key"), true, func(e *AuditEntry) { e.Details = "x" })
+				return lines
+			},
+			line:   5,
+			reason: "invalid signature",
+		},
+		{
+			name: "signature stripped",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				editAuditEntry(t, lines, 3, key, false, func(e *AuditEntry) { e.Signature = "" })
+				return lines
+			},
+			line:   4,
+			reason: "entry is not signed",
+		},
+		{
+			name: "hash stripped",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				editAuditEntry(t, lines, 1, key, false, func(e *AuditEntry) { e.Hash = "" })
+				return lines
+			},
+			line:   2,
+			reason: "entry has no hash",
+		},
+		{
+			name: "entry removed",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				return append(lines[:2], lines[3:]...)
+			},
+			line:   3,
+			reason: "expected seq 3",
+		},
+		{
+			name: "entries swapped",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			line:   2,
+			reason: "expected seq 2",
+		},
+		{
+			name: "first entry removed",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				return lines[1:]
+			},
+			line:   1,
+			reason: "chain starts at seq 2",
+		},
+		{
+			name: "unreadable line",
+			key:  key,
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[3] = "{not json"
+				return lines
+			},
+			line:   4,
+			reason: "unreadable entry",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestAuditLog(t, 5, 100, key)
+			if tt.tamper != nil {
+				editAuditLines(t, dir, func(lines []string) []string { return tt.tamper(t, lines) })
+			}
+
+			result, err := VerifyAuditLog(dir, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.line == 0 {
+				if !result.OK || result.Break != nil {
+					t.Fatalf("intact log failed verification: %+v", result.Break)
+				}
+				if result.Entries != 5 || result.LastSeq != 5 {
+					t.Errorf("verified %d entries up to seq %d, want 5", result.Entries, result.LastSeq)
+				}
+				if result.Signed != tt.signed {
+					t.Errorf("verified %d signatures, want %d", result.Signed, tt.signed)
+				}
+				return
+			}
+
+			if result.OK || result.Break == nil {
+				t.Fatal("tampered log passed verification")
+			}
+			if result.Break.File != auditActiveFile || result.Break.Line != tt.line {
+				t.Errorf("break at %s:%d, want %s:%d", result.Break.File, result.Break.Line, auditActiveFile, tt.line)
+			}
+			if !strings.HasPrefix(result.Break.Reason, tt.reason) {
+				t.Errorf("reason %q, want %q", result.Break.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditLogAcrossSegments(t *testing.T) {
+	key := []byte("test-key")
+	dir := newTestAuditLog(t, 10, 4, key)
+
+	archives, err := listAuditArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 2 {
+		t.Fatalf("got %d archives, want 2", len(archives))
+	}
+
+	result, err := VerifyAuditLog(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK || result.Entries != 10 || result.LastSeq != 10 {
+		t.Fatalf("intact log: ok=%v entries=%d last seq=%d break=%+v", result.OK, result.Entries, result.LastSeq, result.Break)
+	}
+
+	// Dropping the oldest segment cuts the start off the chain
+	if err := os.Remove(archives[0]); err != nil {
+		t.Fatal(err)
+	}
+	result, err = VerifyAuditLog(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OK || result.Break == nil || result.Break.File != filepath.Base(archives[1]) ||
+		!strings.HasPrefix(result.Break.Reason, "chain starts at seq 5") {
+		t.Errorf("log without its oldest segment: ok=%v break=%+v", result.OK, result.Break)
+	}
+}
+
+// stripSignatures removes the signatures of the entries from line i on and
+// rehashes the chain from there, as someone without the key could
+func stripSignatures(t *testing.T, lines []string, from int) []string {
+	t.Helper()
+	var prev string
+	for i := range lines {
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(lines[i]), &e); err != nil {
+			t.Fatal(err)
+		}
+		if i >= from {
+			e.PrevHash, e.Signature = prev, ""
+			hash, err := e.computeHash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Hash = hash
+			data, err := json.Marshal(&e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[i] = string(data)
+		}
+		prev = e.Hash
+	}
+	return lines
+}
+
+func TestVerifyAuditLogStrippedSignatures(t *testing.T) {
+	key := []byte("test-key")
+
+	// Two entries from before signing was enabled, then three signed ones
+	newLog := func(t *testing.T) string {
+		dir := newTestAuditLog(t, 2, 100, nil)
+		s, err := NewAuditStore(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetSigningKey(key)
+		for i := 0; i < 3; i++ {
+			if err := s.Log(&AuditEntry{UserID: 1, Action: ActionReloadConfig, Success: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	tests := []struct {
+		name        string
+		from        int  // First line whose signature is stripped, -1 for none
+		keepSigning bool // Keep the record of where signing started
+		line        int
+		reason      string
+	}{
+		{name: "intact", from: -1, keepSigning: true},
+		{name: "all stripped", from: 0, keepSigning: true, line: 3, reason: "entry is not signed"},
+		{name: "stripped from where signing started", from: 2, keepSigning: true, line: 3, reason: "entry is not signed"},
+		{name: "stripped from the last entry", from: 4, keepSigning: true, line: 5, reason: "entry is not signed"},
+		{name: "all stripped and signing record removed", from: 0, line: 5, reason: "no entry is signed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newLog(t)
+			if tt.from >= 0 {
+				editAuditLines(t, dir, func(lines []string) []string { return stripSignatures(t, lines, tt.from) })
+			}
+			if !tt.keepSigning {
+				if err := os.Remove(filepath.Join(dir, auditSigningFile)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := VerifyAuditLog(dir, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.line == 0 {
+				if !result.OK || result.Signed != 3 || result.Entries != 5 {
+					t.Fatalf("ok=%v signed=%d entries=%d break=%+v", result.OK, result.Signed, result.Entries, result.Break)
+				}
+				return
+			}
+			if result.OK || result.Break == nil {
+				t.Fatal("log with stripped signatures passed verification")
+			}
+			if result.Break.Line != tt.line || !strings.HasPrefix(result.Break.Reason, tt.reason) {
+				t.Errorf("break at line %d: %q, want line %d: %q", result.Break.Line, result.Break.Reason, tt.line, tt.reason)
+			}
+
+			// Without the key the rehashed chain is intact
+			if result, err := VerifyAuditLog(dir, nil); err != nil || !result.OK {
+				t.Errorf("without key: %+v, %v", result, err)
+			}
+		})
+	}
+}
+
+func TestAuditSnapshot(t *testing.T) {
+	key := []byte("test-key")
+	dir := t.TempDir()
+	s, err := NewAuditStore(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetSigningKey(key)
+	logEntries := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := s.Log(&AuditEntry{UserID: 1, Action: ActionReloadConfig, Success: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	logEntries(6)
+
+	s.mu.Lock()
+	snap, err := s.snapshot()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	// Entries logged after the snapshot, rotating its active file away,
+	// aren't part of it
+	logEntries(5)
+
+	result, err := verifyAuditSnapshot(snap, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK || result.Entries != 6 || result.LastSeq != 6 {
+		t.Fatalf("snapshot: ok=%v entries=%d last seq=%d break=%+v", result.OK, result.Entries, result.LastSeq, result.Break)
+	}
+
+	result, err = s.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK || result.Entries != 11 || result.LastSeq != 11 {
+		t.Fatalf("store: ok=%v entries=%d last seq=%d break=%+v", result.OK, result.Entries, result.LastSeq, result.Break)
+	}
+}
+
+// newTestAuditQueryLog logs twelve entries, archiving every four, and
+// returns the store with the timestamps of the entries by seq. Entry i is
+// made by user 1, 2 or 12 on i%3 = 0, 1 or 2, on inst-a for even i, is a
+// reload every fourth entry and fails every fifth.
+func newTestAuditQueryLog(t *testing.T) (*AuditStore, map[uint64]time.Time) {
+	t.Helper()
+	s, err := NewAuditStore(t.TempDir(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []int{1, 2, 12}
+	times := make(map[uint64]time.Time)
+	for i := 1; i <= 12; i++ {
+		entry := &AuditEntry{
+			UserID:     users[i%3],
+			Username:   fmt.Sprintf("user%d", users[i%3]),
+			InstanceID: "inst-b",
+			Action:     ActionStopServer,
+			Success:    i%5 != 0,
+		}
+		if i%2 == 0 {
+			entry.InstanceID = "inst-a"
+		}
+		if i%4 == 0 {
+			entry.Action = ActionReloadConfig
+		}
+		if err := s.Log(entry); err != nil {
+			t.Fatal(err)
+		}
+		times[entry.Seq] = entry.Timestamp
+	}
+	return s, times
+}
+
+// auditSeqs returns the seqs of entries
+func auditSeqs(entries []*AuditEntry) []uint64 {
+	seqs := []uint64{}
+	for _, e := range entries {
+		seqs = append(seqs, e.Seq)
+	}
+	return seqs
+}
+
+func TestAuditQuery(t *testing.T) {
+	s, times := newTestAuditQueryLog(t)
+	failed := false
+
+	tests := []struct {
+		name  string
+		query AuditQuery
+		want  []uint64
+	}{
+		{"everything", AuditQuery{}, []uint64{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		{"user", AuditQuery{UserID: 12}, []uint64{11, 8, 5, 2}},
+		{"other user", AuditQuery{UserID: 1}, []uint64{12, 9, 6, 3}},
+		{"username and instance", AuditQuery{Username: "user2", InstanceID: "inst-b"}, []uint64{7, 1}},
+		{"instance and action", AuditQuery{InstanceID: "inst-a", Action: ActionReloadConfig}, []uint64{12, 8, 4}},
+		{"failures", AuditQuery{Success: &failed}, []uint64{10, 5}},
+		{"time range", AuditQuery{Since: times[3], Until: times[6]}, []uint64{5, 4, 3}},
+		{"time range in one segment", AuditQuery{Since: times[9], Until: times[11]}, []uint64{10, 9}},
+		{"no match", AuditQuery{UserID: 7}, []uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := s.Query(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := auditSeqs(page.Entries); !slices.Equal(got, tt.want) {
+				t.Errorf("got seqs %v, want %v", got, tt.want)
+			}
+			if page.NextCursor != "" {
+				t.Errorf("single page has next cursor %q", page.NextCursor)
+			}
+		})
+	}
+}
+
+func TestAuditQueryPages(t *testing.T) {
+	s, _ := newTestAuditQueryLog(t)
+
+	tests := []struct {
+		name  string
+		query AuditQuery
+		pages [][]uint64
+	}{
+		{"across segments", AuditQuery{Limit: 5}, [][]uint64{{12, 11, 10, 9, 8}, {7, 6, 5, 4, 3}, {2, 1}}},
+		{"exact pages", AuditQuery{Limit: 4}, [][]uint64{{12, 11, 10, 9}, {8, 7, 6, 5}, {4, 3, 2, 1}}},
+		{"filtered", AuditQuery{UserID: 12, Limit: 2}, [][]uint64{{11, 8}, {5, 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			for i, want := range tt.pages {
+				page, err := s.Query(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := auditSeqs(page.Entries); !slices.Equal(got, want) {
+					t.Fatalf("page %d: got seqs %v, want %v", i, got, want)
+				}
+				last := i == len(tt.pages)-1
+				if (page.NextCursor == "") != last {
+					t.Fatalf("page %d: next cursor %q", i, page.NextCursor)
+				}
+				q.Cursor = page.NextCursor
+			}
+		})
+	}
+
+	for _, cursor := range []string{"abc", "0", "-3"} {
+		if _, err := s.Query(AuditQuery{Cursor: cursor}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("cursor %q: got %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+	if page, err := s.Query(AuditQuery{Cursor: "id:unknown"}); err != nil || len(page.Entries) != 0 {
+		t.Errorf("unknown legacy cursor: %d entries, %v", len(page.Entries), err)
+	}
+}
+
+func TestAuditGetEntries(t *testing.T) {
+	s, _ := newTestAuditQueryLog(t)
+
+	tests := []struct {
+		name string
+		get  func() ([]*AuditEntry, error)
+		want []uint64
+	}{
+		{"recent", func() ([]*AuditEntry, error) { return s.GetRecentEntries(3) }, []uint64{12, 11, 10}},
+		{"user with a two-digit id", func() ([]*AuditEntry, error) { return s.GetEntriesForUser(12, 0) }, []uint64{11, 8, 5, 2}},
+		{"user with a limit", func() ([]*AuditEntry, error) { return s.GetEntriesForUser(1, 2) }, []uint64{12, 9}},
+		{"instance", func() ([]*AuditEntry, error) { return s.GetEntriesForInstance("inst-a", 3) }, []uint64{12, 10, 8}},
+		{"success filter", func() ([]*AuditEntry, error) {
+			return s.GetEntries(map[string]string{"success": "false", "instance_id": "inst-b"}, 0)
+		}, []uint64{5}},
+		{"action filter", func() ([]*AuditEntry, error) {
+			return s.GetEntries(map[string]string{"action": string(ActionReloadConfig), "username": "user2"}, 0)
+		}, []uint64{4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := tt.get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := auditSeqs(entries); !slices.Equal(got, tt.want) {
+				t.Errorf("got seqs %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
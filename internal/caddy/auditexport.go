@@ -0,0 +1,198 @@
+package caddy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit export formats
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+	ExportCEF   = "cef"
+)
+
+// Export writes the entries matching q to w oldest first, in jsonl, csv or
+// cef format. The cursor is ignored; a positive limit caps the number of
+// entries. Archived segments are streamed from disk after a snapshot of the
+// active file is taken, so logging isn't blocked while the export runs.
+func (s *AuditStore) Export(w io.Writer, q AuditQuery, format string) error {
+	var write func(*AuditEntry) error
+	var flush func() error
+	switch format {
+	case ExportJSONL:
+		enc := json.NewEncoder(w)
+		write = func(e *AuditEntry) error { return enc.Encode(e) }
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(auditCSVHeader); err != nil {
+			return err
+		}
+		write = func(e *AuditEntry) error { return cw.Write(auditCSVRecord(e)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case ExportCEF:
+		write = func(e *AuditEntry) error {
+			_, err := io.WriteString(w, formatCEF(e)+"\n")
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported export format: %s", format)
+	}
+
+	s.mu.Lock()
+	segments := append([]auditSegment(nil), s.segments...)
+	active, err := readAuditFile(s.logFile)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	written := 0
+	emit := func(entry *AuditEntry) bool {
+		if !q.matches(entry) {
+			return true
+		}
+		if err = write(entry); err != nil {
+			return false
+		}
+		written++
+		return q.Limit <= 0 || written < q.Limit
+	}
+
+	done := false
+	for _, seg := range segments {
+		if !q.Since.IsZero() && seg.LastTime.Before(q.Since) ||
+			!q.Until.IsZero() && !seg.FirstTime.Before(q.Until) {
+			continue
+		}
+		scanErr := scanAuditFile(filepath.Join(s.logDir, seg.File), func(_ int, entry *AuditEntry, _ error) bool {
+			if entry == nil {
+				return true
+			}
+			done = !emit(entry)
+			return !done
+		})
+		if err != nil {
+			return err
+		}
+		if scanErr != nil {
+			return scanErr
+		}
+		if done {
+			break
+		}
+	}
+	for _, entry := range active {
+		if done || !emit(entry) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if flush != nil {
+		return flush()
+	}
+	return nil
+}
+
+var auditCSVHeader = []string{
+	"id", "seq", "timestamp", "user_id", "username", "token_id", "instance_id", "instance_name",
+	"action", "details", "ip_address", "success", "error_msg", "hash",
+}
+
+func auditCSVRecord(e *AuditEntry) []string {
+	record := []string{
+		e.ID,
+		strconv.FormatUint(e.Seq, 10),
+		e.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(e.UserID),
+		e.Username,
+		e.TokenID,
+		e.InstanceID,
+		e.InstanceName,
+		string(e.Action),
+		e.Details,
+		e.IPAddress,
+		strconv.FormatBool(e.Success),
+		e.ErrorMsg,
+		e.Hash,
+	}
+	for i, cell := range record {
+		record[i] = csvSafe(cell)
+	}
+	return record
+}
+
+// csvSafe keeps a spreadsheet from running a cell as a formula. Usernames,
+// details and error messages come from requests, so a cell starting with a
+// formula character is prefixed with a quote, which shows it as text.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// formatCEF renders an entry as an ArcSight Common Event Format line.
+// Failed operations get severity 6, others 3.
+func formatCEF(e *AuditEntry) string {
+	severity := 3
+	outcome := "success"
+	if !e.Success {
+		severity = 6
+		outcome = "failure"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|godash|godash|1.0|%s|%s|%d|",
+		cefHeaderEscaper.Replace(string(e.Action)),
+		cefHeaderEscaper.Replace(strings.ReplaceAll(string(e.Action), "_", " ")),
+		severity)
+
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		b.WriteString(key + "=" + cefExtensionEscaper.Replace(value) + " ")
+	}
+	addCustom := func(key, label, value string) {
+		if value != "" {
+			add(key+"Label", label)
+			add(key, value)
+		}
+	}
+
+	add("rt", strconv.FormatInt(e.Timestamp.UnixMilli(), 10))
+	add("externalId", e.ID)
+	add("act", string(e.Action))
+	add("outcome", outcome)
+	add("suid", strconv.Itoa(e.UserID))
+	add("suser", e.Username)
+	add("src", e.IPAddress)
+	add("msg", e.Details)
+	add("reason", e.ErrorMsg)
+	addCustom("cs1", "instanceId", e.InstanceID)
+	addCustom("cs2", "instanceName", e.InstanceName)
+	addCustom("cs3", "hash", e.Hash)
+	addCustom("cs4", "apiToken", e.TokenID)
+	if e.Seq > 0 {
+		addCustom("cn1", "seq", strconv.FormatUint(e.Seq, 10))
+	}
+	return strings.TrimSuffix(b.String(), " ")
+}
@@ -0,0 +1,50 @@
+package caddy
+
+import "testing"
+
+func TestCSVSafe(t *testing.T) {
+	tests := []struct {
+		cell string
+		want string
+	}{
+		{"", ""},
+		{"admin", "admin"},
+		{"=HYPERLINK(\"http://x\")", "'=HYPERLINK(\"http://x\")"},
+		{"+1+1", "'+1+1"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"a=1", "a=1"},
+		{"'quoted", "'quoted"},
+	}
+	for _, tt := range tests {
+		if got := csvSafe(tt.cell); got != tt.want {
+			t.Errorf("csvSafe(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestAuditCSVRecord(t *testing.T) {
+	e := &AuditEntry{
+		Username:  "=cmd",
+		Details:   "+details",
+		ErrorMsg:  "-error",
+		IPAddress: "@ip",
+	}
+	record := auditCSVRecord(e)
+	if len(record) != len(auditCSVHeader) {
+		t.Fatalf("record has %d cells, header has %d", len(record), len(auditCSVHeader))
+	}
+	want := map[string]string{
+		"username":   "'=cmd",
+		"details":    "'+details",
+		"error_msg":  "'-error",
+		"ip_address": "'@ip",
+	}
+	for i, name := range auditCSVHeader {
+		if w, ok := want[name]; ok && record[i] != w {
+			t.Errorf("%s = %q, want %q", name, record[i], w)
+		}
+	}
+}
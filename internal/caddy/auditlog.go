@@ -0,0 +1,450 @@
+package caddy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit log files in logDir:
+//
+//	audit.log                  active file, one JSON entry per line
+//	audit-{last seq}.log.gz    archived segments, written once and never changed
+//	audit-index.json           sequence and time range of every segment
+//	audit-signing.json         sequence of the first signed entry
+//
+// Rotation compresses the active file into a new segment, so entries are
+// never rewritten and the hash chain runs unbroken from the oldest segment
+// into audit.log. Readers walk segments newest first and only hold one
+// segment in memory at a time.
+const (
+	auditActiveFile  = "audit.log"
+	auditIndexFile   = "audit-index.json"
+	auditSigningFile = "audit-signing.json"
+	auditSegmentExt  = ".log.gz"
+)
+
+// auditSegment describes one archived segment in the index
+type auditSegment struct {
+	File      string    `json:"file"`
+	FirstSeq  uint64    `json:"first_seq"` // 0 if the segment starts with entries from before chaining
+	LastSeq   uint64    `json:"last_seq"`
+	FirstTime time.Time `json:"first_time"`
+	LastTime  time.Time `json:"last_time"`
+	Entries   int       `json:"entries"`
+}
+
+// auditSigning records where signing started. Verification requires every
+// entry from there on to be signed, so signatures can't be stripped and the
+// chain rehashed to look like entries from before signing was enabled.
+type auditSigning struct {
+	SignedFrom uint64 `json:"signed_from"` // Seq of the first signed entry (0 = never signed)
+}
+
+// readAuditSigning returns the signing state of logDir, which is zero if
+// nothing was signed yet
+func readAuditSigning(logDir string) (auditSigning, error) {
+	var st auditSigning
+	data, err := os.ReadFile(filepath.Join(logDir, auditSigningFile))
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("invalid %s: %w", auditSigningFile, err)
+	}
+	return st, nil
+}
+
+// writeAuditSigning atomically replaces the signing state
+func writeAuditSigning(logDir string, st auditSigning) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(logDir, auditSigningFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write audit signing state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write audit signing state: %w", err)
+	}
+	return nil
+}
+
+// auditArchiveSeq returns the sequence number in an archive's filename
+func auditArchiveSeq(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "audit-") {
+		return 0, false
+	}
+	base := strings.TrimPrefix(name, "audit-")
+	if b, ok := strings.CutSuffix(base, auditSegmentExt); ok {
+		base = b
+	} else if b, ok := strings.CutSuffix(base, ".log"); ok {
+		base = b
+	} else {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(base, 10, 64)
+	return seq, err == nil
+}
+
+// listAuditArchives returns archived segments oldest first. Uncompressed
+// archives left by older versions are included.
+func listAuditArchives(logDir string) ([]string, error) {
+	files, err := os.ReadDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type archive struct {
+		path string
+		seq  uint64
+	}
+	var archives []archive
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if seq, ok := auditArchiveSeq(f.Name()); ok {
+			archives = append(archives, archive{path: filepath.Join(logDir, f.Name()), seq: seq})
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].seq < archives[j].seq })
+
+	paths := make([]string, len(archives))
+	for i, a := range archives {
+		paths[i] = a.path
+	}
+	return paths, nil
+}
+
+// scanAuditFile calls fn for every non-empty line of an audit file with its
+// 1-based line number and either the parsed entry or the parse error,
+// stopping early if fn returns false. Gzip segments are decompressed.
+func scanAuditFile(path string, fn func(line int, entry *AuditEntry, err error) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return scanAuditReader(r, fn)
+}
+
+// scanAuditReader is scanAuditFile for uncompressed entries read from r
+func scanAuditReader(r io.Reader, fn func(line int, entry *AuditEntry, err error) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			if !fn(line, nil, err) {
+				return nil
+			}
+			continue
+		}
+		if !fn(line, &entry, nil) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// readAuditFile returns the readable entries of one file, oldest first
+func readAuditFile(path string) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := scanAuditFile(path, func(_ int, entry *AuditEntry, _ error) bool {
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	return entries, err
+}
+
+// summarizeAuditFile builds the index entry of a segment by reading it
+func summarizeAuditFile(path string) (auditSegment, error) {
+	seg := auditSegment{File: filepath.Base(path)}
+	err := scanAuditFile(path, func(_ int, entry *AuditEntry, _ error) bool {
+		if entry == nil {
+			return true
+		}
+		if seg.Entries == 0 {
+			seg.FirstSeq = entry.Seq
+			seg.FirstTime = entry.Timestamp
+		}
+		if entry.Seq > seg.LastSeq {
+			seg.LastSeq = entry.Seq
+		}
+		seg.LastTime = entry.Timestamp
+		seg.Entries++
+		return true
+	})
+	return seg, err
+}
+
+// openSegments loads the segment index, compressing archives left
+// uncompressed by older versions and indexing segments missing from it
+func (s *AuditStore) openSegments() error {
+	indexed := make(map[string]auditSegment)
+	if data, err := os.ReadFile(filepath.Join(s.logDir, auditIndexFile)); err == nil {
+		var segments []auditSegment
+		if err := json.Unmarshal(data, &segments); err == nil {
+			for _, seg := range segments {
+				indexed[seg.File] = seg
+			}
+		}
+	}
+
+	archives, err := listAuditArchives(s.logDir)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	s.segments = nil
+	for _, path := range archives {
+		if !strings.HasSuffix(path, ".gz") {
+			compressed := strings.TrimSuffix(path, ".log") + auditSegmentExt
+			if err := writeGzipFile(path, compressed); err != nil {
+				return fmt.Errorf("failed to compress audit archive: %w", err)
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			path = compressed
+		}
+
+		seg, ok := indexed[filepath.Base(path)]
+		if !ok {
+			if seg, err = summarizeAuditFile(path); err != nil {
+				return err
+			}
+			changed = true
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	if changed || len(indexed) != len(s.segments) {
+		return s.saveIndex()
+	}
+	return nil
+}
+
+// saveIndex atomically replaces the segment index
+func (s *AuditStore) saveIndex() error {
+	data, err := json.MarshalIndent(s.segments, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.logDir, auditIndexFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write audit index: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write audit index: %w", err)
+	}
+	return nil
+}
+
+// writeGzipFile compresses src into dst, making dst visible only once it is
+// complete and synced
+func writeGzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if syncErr := out.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// rotateIfNeeded archives the active file once it reaches the entry or
+// size limit, or once its first entry is older than the age limit
+func (s *AuditStore) rotateIfNeeded() error {
+	switch {
+	case s.active == 0:
+		return nil
+	case s.maxEntries > 0 && s.active >= s.maxEntries,
+		s.maxSize > 0 && s.activeSize >= s.maxSize,
+		s.maxAge > 0 && time.Since(s.activeStart) >= s.maxAge:
+		return s.archiveActive()
+	}
+	return nil
+}
+
+// archiveActive compresses the active file into a new segment and starts a
+// new active file
+func (s *AuditStore) archiveActive() error {
+	if s.active == 0 {
+		return nil
+	}
+
+	seg, err := summarizeAuditFile(s.logFile)
+	if err != nil {
+		return err
+	}
+	seg.File = fmt.Sprintf("audit-%012d%s", s.lastSeq, auditSegmentExt)
+	path := filepath.Join(s.logDir, seg.File)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("audit segment %s already exists", seg.File)
+	}
+
+	if err := writeGzipFile(s.logFile, path); err != nil {
+		return fmt.Errorf("failed to archive audit log: %w", err)
+	}
+	s.segments = append(s.segments, seg)
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.logFile); err != nil {
+		return fmt.Errorf("failed to archive audit log: %w", err)
+	}
+
+	s.active = 0
+	s.activeSize = 0
+	s.activeStart = time.Time{}
+	return nil
+}
+
+// auditSnapshot is the audit log as of one moment: the archived segments
+// and the active file, kept open and read only up to its size at that
+// moment. Segments never change and an open file stays readable after
+// rotation removes it, so a snapshot is read without holding the store's
+// lock.
+type auditSnapshot struct {
+	logDir   string
+	segments []auditSegment // Oldest first
+	active   *os.File       // nil if there was no active file
+	size     int64
+}
+
+// openAuditSnapshot takes a snapshot of the active file in logDir, which
+// follows segments
+func openAuditSnapshot(logDir string, segments []auditSegment) (*auditSnapshot, error) {
+	snap := &auditSnapshot{logDir: logDir, segments: segments}
+	f, err := os.Open(filepath.Join(logDir, auditActiveFile))
+	if os.IsNotExist(err) {
+		return snap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	snap.active, snap.size = f, info.Size()
+	return snap, nil
+}
+
+// snapshot takes a snapshot of the log; callers must hold s.mu, and close
+// the snapshot once they have read it
+func (s *AuditStore) snapshot() (*auditSnapshot, error) {
+	return openAuditSnapshot(s.logDir, slices.Clone(s.segments))
+}
+
+// Close releases the active file
+func (snap *auditSnapshot) Close() error {
+	if snap.active == nil {
+		return nil
+	}
+	return snap.active.Close()
+}
+
+// scan calls fn for the entries of a segment, or of the active file for a
+// nil segment, like scanAuditFile
+func (snap *auditSnapshot) scan(seg *auditSegment, fn func(line int, entry *AuditEntry, err error) bool) error {
+	if seg != nil {
+		return scanAuditFile(filepath.Join(snap.logDir, seg.File), fn)
+	}
+	if snap.active == nil {
+		return nil
+	}
+	return scanAuditReader(io.NewSectionReader(snap.active, 0, snap.size), fn)
+}
+
+// walkNewestFirst calls fn for every entry of the snapshot, newest first,
+// until it returns false. Segments for which skip returns true aren't read.
+func (snap *auditSnapshot) walkNewestFirst(skip func(auditSegment) bool, fn func(*AuditEntry) bool) error {
+	segments := []*auditSegment{nil}
+	for i := len(snap.segments) - 1; i >= 0; i-- {
+		if skip != nil && skip(snap.segments[i]) {
+			continue
+		}
+		segments = append(segments, &snap.segments[i])
+	}
+
+	for _, seg := range segments {
+		var entries []*AuditEntry
+		err := snap.scan(seg, func(_ int, entry *AuditEntry, _ error) bool {
+			if entry != nil {
+				entries = append(entries, entry)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if !fn(entries[i]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
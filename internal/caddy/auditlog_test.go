@@ -0,0 +1,265 @@
+package caddy
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readAuditIndex returns the segments recorded in the index of dir
+func readAuditIndex(t *testing.T, dir string) []auditSegment {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, auditIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments []auditSegment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+func TestAuditRotation(t *testing.T) {
+	type segment struct {
+		file        string
+		first, last uint64
+		entries     int
+	}
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxSize    int64
+		log        func(t *testing.T, s *AuditStore, logEntries func(int))
+		segments   []segment
+		active     int
+	}{
+		{
+			name:       "entry limit",
+			maxEntries: 4,
+			log:        func(t *testing.T, s *AuditStore, logEntries func(int)) { logEntries(10) },
+			segments:   []segment{{"audit-000000000004.log.gz", 1, 4, 4}, {"audit-000000000008.log.gz", 5, 8, 4}},
+			active:     2,
+		},
+		{
+			name:     "size limit",
+			maxSize:  1,
+			log:      func(t *testing.T, s *AuditStore, logEntries func(int)) { logEntries(2) },
+			segments: []segment{{"audit-000000000001.log.gz", 1, 1, 1}, {"audit-000000000002.log.gz", 2, 2, 1}},
+		},
+		{
+			name: "age limit",
+			log: func(t *testing.T, s *AuditStore, logEntries func(int)) {
+				s.SetRotation(0, time.Hour)
+				logEntries(2)
+				s.mu.Lock()
+				s.activeStart = s.activeStart.Add(-2 * time.Hour)
+				s.mu.Unlock()
+				logEntries(2)
+			},
+			segments: []segment{{"audit-000000000003.log.gz", 1, 3, 3}},
+			active:   1,
+		},
+		{
+			name: "cleared",
+			log: func(t *testing.T, s *AuditStore, logEntries func(int)) {
+				logEntries(3)
+				if err := s.Clear(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			segments: []segment{{"audit-000000000003.log.gz", 1, 3, 3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewAuditStore(dir, tt.maxEntries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetRotation(tt.maxSize, 0)
+			tt.log(t, s, func(n int) {
+				for i := 0; i < n; i++ {
+					if err := s.Log(&AuditEntry{UserID: 1, Action: ActionReloadConfig, Success: true}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			index := readAuditIndex(t, dir)
+			if len(index) != len(tt.segments) {
+				t.Fatalf("index has %d segments, want %d", len(index), len(tt.segments))
+			}
+			for i, want := range tt.segments {
+				got := index[i]
+				if got.File != want.file || got.FirstSeq != want.first || got.LastSeq != want.last || got.Entries != want.entries {
+					t.Errorf("segment %d: %+v, want %+v", i, got, want)
+				}
+				if got.FirstTime.IsZero() || got.LastTime.Before(got.FirstTime) {
+					t.Errorf("segment %d covers %v to %v", i, got.FirstTime, got.LastTime)
+				}
+				entries, err := readAuditFile(filepath.Join(dir, got.File))
+				if err != nil || len(entries) != want.entries {
+					t.Errorf("segment %d holds %d entries, %v", i, len(entries), err)
+				}
+			}
+
+			active, err := readAuditFile(filepath.Join(dir, auditActiveFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(active) != tt.active || s.active != tt.active {
+				t.Errorf("active file holds %d entries, store counts %d, want %d", len(active), s.active, tt.active)
+			}
+
+			if result, err := s.Verify(); err != nil || !result.OK {
+				t.Errorf("rotated log failed verification: %+v, %v", result, err)
+			}
+		})
+	}
+}
+
+func TestAuditReopen(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, dir string)
+		seq     uint64 // Seq of the next entry
+	}{
+		{name: "intact", seq: 11},
+		{
+			name: "index missing",
+			seq:  11,
+			prepare: func(t *testing.T, dir string) {
+				if err := os.Remove(filepath.Join(dir, auditIndexFile)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "uncompressed archive",
+			seq:  11,
+			prepare: func(t *testing.T, dir string) {
+				// Archives written by older versions were plain files
+				gzPath := filepath.Join(dir, "audit-000000000004.log.gz")
+				f, err := os.Open(gzPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(gz)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "audit-000000000004.log"), data, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(gzPath); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(filepath.Join(dir, auditIndexFile)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// The chain resumes from the newest segment
+			name: "active file removed",
+			seq:  9,
+			prepare: func(t *testing.T, dir string) {
+				if err := os.Remove(filepath.Join(dir, auditActiveFile)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := []byte("test-key")
+			dir := newTestAuditLog(t, 10, 4, key)
+			want := readAuditIndex(t, dir)
+			if tt.prepare != nil {
+				tt.prepare(t, dir)
+			}
+
+			s, err := NewAuditStore(dir, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetSigningKey(key)
+			if got := readAuditIndex(t, dir); !slices.Equal(got, want) {
+				t.Errorf("index %+v, want %+v", got, want)
+			}
+			if archives, err := listAuditArchives(dir); err != nil || len(archives) != 2 || filepath.Ext(archives[0]) != ".gz" {
+				t.Errorf("archives %v, %v", archives, err)
+			}
+
+			// The chain continues from the newest stored entry
+			entry := &AuditEntry{UserID: 1, Action: ActionReloadConfig, Success: true}
+			if err := s.Log(entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.Seq != tt.seq {
+				t.Errorf("new entry has seq %d, want %d", entry.Seq, tt.seq)
+			}
+			if result, err := s.Verify(); err != nil || !result.OK || result.LastSeq != tt.seq {
+				t.Errorf("reopened log: %+v, %v", result, err)
+			}
+		})
+	}
+}
+
+func TestAuditQuerySkipsSegments(t *testing.T) {
+	// The log has segments for seqs 1-4, 5-8 and 9-12. Segments the query
+	// can rule out from the index are never opened, so queries still work
+	// with them unreadable.
+	tests := []struct {
+		name         string
+		corrupt      string
+		since, until uint64 // Seqs whose times bound the range, 0 for none
+		cursor       string
+		limit        int
+		want         []uint64
+		err          bool
+	}{
+		{name: "older than the range", corrupt: "audit-000000000004.log.gz", since: 6, want: []uint64{12, 11, 10, 9, 8, 7, 6}},
+		{name: "newer than the range", corrupt: "audit-000000000012.log.gz", until: 5, want: []uint64{4, 3, 2, 1}},
+		{name: "newer than the cursor", corrupt: "audit-000000000012.log.gz", cursor: "9", limit: 3, want: []uint64{8, 7, 6}},
+		{name: "in the range", corrupt: "audit-000000000004.log.gz", since: 3, err: true},
+		{name: "whole log", corrupt: "audit-000000000008.log.gz", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, times := newTestAuditQueryLog(t)
+			if err := os.WriteFile(filepath.Join(s.logDir, tt.corrupt), []byte("not gzip"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			page, err := s.Query(AuditQuery{Since: times[tt.since], Until: times[tt.until], Cursor: tt.cursor, Limit: tt.limit})
+			if tt.err {
+				if err == nil {
+					t.Fatal("read the corrupt segment without an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := auditSeqs(page.Entries); !slices.Equal(got, tt.want) {
+				t.Errorf("got seqs %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
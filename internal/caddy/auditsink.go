@@ -0,0 +1,541 @@
+package caddy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditSink receives every audit entry once it has been written to the log.
+// Write is called with the audit store locked, so it must not block.
+type AuditSink interface {
+	Write(entry *AuditEntry) error
+	Close() error
+}
+
+// AddSink forwards every new entry to sink
+func (s *AuditStore) AddSink(sink AuditSink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sinks = append(s.sinks, sink)
+}
+
+// Close closes every sink
+func (s *AuditStore) Close() error {
+	s.mu.Lock()
+	sinks := s.sinks
+	s.sinks = nil
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+const (
+	syslogFacilityAudit = 13 // "log audit"
+	syslogWriteTimeout  = 10 * time.Second
+	syslogMaxRetry      = 5 * time.Minute
+	syslogBatchSize     = 100
+
+	// Structured data ID of audit fields; 32473 is the enterprise number
+	// reserved for documentation (RFC 5612)
+	syslogSDID = "audit@32473"
+)
+
+// SyslogOptions configures forwarding of audit entries to a syslog collector
+type SyslogOptions struct {
+	Address       string        // "udp/host:514", "tcp/host:601" or "tls/host:6514"; tcp if no network is given
+	CAFile        string        // PEM CA bundle for tls (empty uses the system roots)
+	Facility      int           // Syslog facility (0 uses 13, log audit)
+	Hostname      string        // HOSTNAME field (default os.Hostname)
+	AppName       string        // APP-NAME field (default "godash")
+	QueueDir      string        // Directory of the retry queue
+	QueueMaxBytes int64         // Queue size after which new entries are dropped (0 = no limit)
+	RetryInterval time.Duration // Delay before the first retry after a failure, doubling up to 5m (default 5s)
+}
+
+// SyslogForwarder is an AuditSink that sends entries to a syslog collector
+// as RFC 5424 messages, over UDP, TCP or TLS with octet-counting framing
+// (RFC 6587). Entries pass through a queue on disk, so they survive
+// collector outages and restarts; delivery is at least once.
+type SyslogForwarder struct {
+	opts      SyslogOptions
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	queue     *auditQueue
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSyslogForwarder creates a forwarder and starts delivering, beginning
+// with any entries left in its queue
+func NewSyslogForwarder(opts SyslogOptions) (*SyslogForwarder, error) {
+	network, addr := "tcp", opts.Address
+	if i := strings.Index(opts.Address, "/"); i >= 0 {
+		network, addr = opts.Address[:i], opts.Address[i+1:]
+	}
+
+	f := &SyslogForwarder{
+		opts:    opts,
+		network: network,
+		addr:    addr,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	switch network {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	case "tls":
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog address: %w", err)
+		}
+		f.network = "tcp"
+		f.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if opts.CAFile != "" {
+			pem, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read syslog CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+			}
+			f.tlsConfig.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog network: %s", network)
+	}
+
+	if f.opts.Facility <= 0 {
+		f.opts.Facility = syslogFacilityAudit
+	}
+	if f.opts.Hostname == "" {
+		f.opts.Hostname, _ = os.Hostname()
+	}
+	if f.opts.AppName == "" {
+		f.opts.AppName = "godash"
+	}
+	if f.opts.RetryInterval <= 0 {
+		f.opts.RetryInterval = 5 * time.Second
+	}
+
+	queue, err := openAuditQueue(opts.QueueDir, opts.QueueMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	f.queue = queue
+
+	f.wg.Add(1)
+	go f.run()
+	return f, nil
+}
+
+// Write queues an entry for delivery
+func (f *SyslogForwarder) Write(entry *AuditEntry) error {
+	if err := f.queue.push(entry); err != nil {
+		return fmt.Errorf("syslog %s: %w", f.opts.Address, err)
+	}
+	f.notify()
+	return nil
+}
+
+// Close stops delivery. Undelivered entries stay queued for the next start.
+func (f *SyslogForwarder) Close() error {
+	select {
+	case <-f.done:
+		return nil
+	default:
+	}
+	close(f.done)
+	f.wg.Wait()
+	f.disconnect()
+	return nil
+}
+
+func (f *SyslogForwarder) notify() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued entries whenever new ones arrive, backing off while
+// the collector is unreachable
+func (f *SyslogForwarder) run() {
+	defer f.wg.Done()
+
+	backoff := f.opts.RetryInterval
+	failing := false
+	for {
+		if err := f.flush(); err != nil {
+			f.disconnect()
+			if !failing {
+				log.Printf("Warning: audit forwarding to %s failed, queueing entries: %v", f.opts.Address, err)
+				failing = true
+			}
+
+			select {
+			case <-f.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, syslogMaxRetry)
+			continue
+		}
+
+		if failing {
+			log.Printf("Audit forwarding to %s resumed", f.opts.Address)
+			failing = false
+		}
+		backoff = f.opts.RetryInterval
+
+		select {
+		case <-f.done:
+			return
+		case <-f.wake:
+		}
+	}
+}
+
+// flush sends queued entries until the queue is empty
+func (f *SyslogForwarder) flush() error {
+	for {
+		batch, end, err := f.queue.peek(syslogBatchSize)
+		if err != nil {
+			return err
+		}
+		if end == 0 {
+			return nil
+		}
+
+		if len(batch) > 0 {
+			conn, err := f.connect()
+			if err != nil {
+				return err
+			}
+			for _, entry := range batch {
+				conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+				if _, err := conn.Write(f.frame(formatSyslog(entry, f.opts.Facility, f.opts.Hostname, f.opts.AppName))); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := f.queue.ack(end); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *SyslogForwarder) connect() (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		return f.conn, nil
+	}
+
+	dialer := &net.Dialer{Timeout: syslogWriteTimeout}
+	var conn net.Conn
+	var err error
+	if f.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, f.network, f.addr, f.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(f.network, f.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.conn = conn
+	return conn, nil
+}
+
+func (f *SyslogForwarder) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// frame prefixes stream messages with their length; datagrams carry one
+// message each and need no framing
+func (f *SyslogForwarder) frame(msg []byte) []byte {
+	if strings.HasPrefix(f.network, "udp") {
+		return msg
+	}
+	return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+}
+
+// formatSyslog renders an entry as an RFC 5424 message. Failed operations
+// are logged at warning severity, others at notice. The message body is the
+// entry's JSON, and the main fields are repeated as structured data.
+func formatSyslog(entry *AuditEntry, facility int, hostname, appName string) []byte {
+	severity := 5
+	if !entry.Success {
+		severity = 4
+	}
+	body, _ := json.Marshal(entry)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s - %s [%s",
+		facility*8+severity,
+		entry.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(hostname, 255),
+		syslogHeaderField(appName, 48),
+		syslogHeaderField(string(entry.Action), 32),
+		syslogSDID)
+
+	seq := ""
+	if entry.Seq > 0 {
+		seq = strconv.FormatUint(entry.Seq, 10)
+	}
+	params := [][2]string{
+		{"id", entry.ID},
+		{"seq", seq},
+		{"userId", strconv.Itoa(entry.UserID)},
+		{"user", entry.Username},
+		{"token", entry.TokenID},
+		{"instance", entry.InstanceID},
+		{"ip", entry.IPAddress},
+		{"success", strconv.FormatBool(entry.Success)},
+	}
+	for _, p := range params {
+		if p[1] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ` %s="%s"`, p[0], syslogParamEscaper.Replace(p[1]))
+	}
+	b.WriteString("] ")
+	b.Write(body)
+	return []byte(b.String())
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField restricts a header field to printable ASCII and its
+// maximum length, using "-" for an empty value
+func syslogHeaderField(value string, maxLen int) string {
+	field := []byte(value)
+	for i, c := range field {
+		if c < 33 || c > 126 {
+			field[i] = '_'
+		}
+	}
+	if len(field) > maxLen {
+		field = field[:maxLen]
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+var errQueueFull = errors.New("audit forwarding queue is full")
+
+// auditQueueCompactBytes is how large the delivered start of the queue file
+// may grow before the file is rewritten without it. While entries come in
+// as fast as they are delivered, the queue never drains completely.
+const auditQueueCompactBytes = 1 << 20
+
+// auditQueue is a file of entries awaiting delivery, one JSON entry per
+// line, plus the offset of the first undelivered one. Once everything has
+// been delivered both are reset, and once compactAt bytes have been
+// delivered the rest is moved to the start of a new file.
+type auditQueue struct {
+	path      string
+	posPath   string
+	maxBytes  int64
+	compactAt int64
+
+	mu   sync.Mutex
+	pos  int64 // Offset of the first undelivered entry
+	size int64
+}
+
+func openAuditQueue(dir string, maxBytes int64) (*auditQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &auditQueue{
+		path:      filepath.Join(dir, "queue.log"),
+		posPath:   filepath.Join(dir, "queue.pos"),
+		maxBytes:  maxBytes,
+		compactAt: auditQueueCompactBytes,
+	}
+
+	if info, err := os.Stat(q.path); err == nil {
+		q.size = info.Size()
+	}
+	if data, err := os.ReadFile(q.posPath); err == nil {
+		q.pos, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if q.pos < 0 || q.pos > q.size {
+		q.pos = 0
+	}
+	return q, nil
+}
+
+func (q *auditQueue) push(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes > 0 && q.size-q.pos+int64(len(data)) > q.maxBytes {
+		return errQueueFull
+	}
+
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	q.size += int64(len(data))
+	return nil
+}
+
+// peek returns up to max undelivered entries and the offset just past them.
+// Unreadable lines are skipped. An end of 0 means the queue is empty.
+func (q *auditQueue) peek(max int) ([]*AuditEntry, int64, error) {
+	q.mu.Lock()
+	pos, size := q.pos, q.size
+	q.mu.Unlock()
+	if pos >= size {
+		return nil, 0, nil
+	}
+
+	f, err := os.Open(q.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	var entries []*AuditEntry
+	end := pos
+	r := bufio.NewReader(io.LimitReader(f, size-pos))
+	for len(entries) < max {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		end += int64(len(line))
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Warning: skipping unreadable entry in audit forwarding queue: %v", err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	if end == pos {
+		return nil, 0, nil
+	}
+	return entries, end, nil
+}
+
+// ack marks everything before end as delivered
+func (q *auditQueue) ack(end int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pos = end
+	switch {
+	case q.pos >= q.size:
+		if err := os.Truncate(q.path, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.pos, q.size = 0, 0
+	case q.pos >= q.compactAt:
+		if err := q.compact(); err != nil {
+			log.Printf("Warning: failed to compact audit forwarding queue: %v", err)
+		}
+	}
+	return q.writePos()
+}
+
+// compact rewrites the queue file without its delivered entries; callers
+// must hold q.mu. The saved offset is reset before the new file replaces
+// the old one, so a crash in between delivers entries twice rather than
+// skipping any.
+func (q *auditQueue) compact() error {
+	src, err := os.Open(q.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(q.pos, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp := q.path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, q.size-q.pos))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	pos := q.pos
+	q.pos = 0
+	if err := q.writePos(); err != nil {
+		q.pos = pos
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		q.pos = pos
+		os.Remove(tmp)
+		return err
+	}
+	q.size = n
+	return nil
+}
+
+// writePos saves the offset of the first undelivered entry; callers must
+// hold q.mu
+func (q *auditQueue) writePos() error {
+	tmp := q.posPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(q.pos, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.posPath)
+}
@@ -0,0 +1,81 @@
+package caddy
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestAuditQueueCompaction(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openAuditQueue(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.compactAt = 1000
+
+	pushed := 0
+	push := func(n int) {
+		for i := 0; i < n; i++ {
+			pushed++
+			if err := q.push(&AuditEntry{ID: fmt.Sprintf("entry-%03d", pushed), Action: ActionReloadConfig}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fileSize := func() int64 {
+		info, err := os.Stat(q.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	// Deliver in batches while new entries keep coming, so the queue never
+	// drains and is only ever shortened by compaction
+	next := 1
+	var largest int64
+	push(5)
+	for round := 0; round < 40; round++ {
+		push(2)
+		batch, end, err := q.peek(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range batch {
+			if want := fmt.Sprintf("entry-%03d", next); e.ID != want {
+				t.Fatalf("round %d: delivered %s, want %s", round, e.ID, want)
+			}
+			next++
+		}
+		if err := q.ack(end); err != nil {
+			t.Fatal(err)
+		}
+		largest = max(largest, fileSize())
+		if q.pos >= q.compactAt {
+			t.Fatalf("round %d: %d delivered bytes left in the file", round, q.pos)
+		}
+	}
+
+	// Only the undelivered entries and less than compactAt delivered bytes
+	// stay on disk, far less than everything pushed
+	if size := fileSize(); size != q.size || size-q.pos > int64(pushed-next+1)*200 {
+		t.Errorf("file is %d bytes with %d undelivered entries", size, pushed-next+1)
+	}
+	if largest > 3000 {
+		t.Errorf("file grew to %d bytes", largest)
+	}
+
+	// A reopened queue continues with the next undelivered entry
+	reopened, err := openAuditQueue(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, _, err := reopened.peek(pushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != pushed-next+1 || batch[0].ID != fmt.Sprintf("entry-%03d", next) {
+		t.Errorf("reopened queue starts with %d entries from %s, want %d from entry-%03d", len(batch), batch[0].ID, pushed-next+1, next)
+	}
+}
@@ -0,0 +1,1276 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RenderCaddyfile converts a JSON config into an equivalent Caddyfile. The
+// http app's servers become site blocks, with the common matchers and
+// handlers written as directives and TLS automation policies as tls
+// directives or global options. Anything that can't be expressed is kept as
+// a "not rendered" comment rather than dropped.
+func RenderCaddyfile(configJSON []byte) (string, error) {
+	var doc any
+	if err := unmarshalJSONDoc(configJSON, &doc); err != nil {
+		return "", fmt.Errorf("invalid config: %w", err)
+	}
+	root := jsonObject(doc)
+	if len(root) == 0 {
+		return "# The instance has no config\n", nil
+	}
+
+	r := &caddyfileRenderer{sitesByAddress: map[string]*siteBlock{}}
+	for _, key := range sortedObjectKeys(root) {
+		value := root[key]
+		switch key {
+		case "admin":
+			r.renderAdmin(jsonObject(value))
+		case "storage":
+			r.renderStorage(value)
+		case "apps":
+			apps := jsonObject(value)
+			for _, name := range sortedObjectKeys(apps) {
+				switch name {
+				case "http":
+					r.renderHTTP(jsonObject(apps[name]))
+				case "tls":
+					r.collectTLS(jsonObject(apps[name]))
+				default:
+					r.globals.notRendered(fmt.Sprintf("app %q", name), apps[name])
+				}
+			}
+		default:
+			r.globals.notRendered(key, value)
+		}
+	}
+	r.renderTLS()
+	r.renderAutoHTTPS()
+
+	return r.String(), nil
+}
+
+// caddyfileRenderer collects the global options and site blocks of a
+// Caddyfile while walking a JSON config
+type caddyfileRenderer struct {
+	globals        caddyfileWriter
+	sites          []*siteBlock
+	sitesByAddress map[string]*siteBlock
+	policies       []map[string]any  // TLS automation policies
+	autoHTTPS      map[string]string // Server name -> "off", "disable_redirects" or ""
+}
+
+// siteBlock is one site of the Caddyfile
+type siteBlock struct {
+	addresses []string
+	hosts     []string
+	matchers  caddyfileWriter // Named matcher definitions
+	header    caddyfileWriter // tls, bind and log, written before the routes
+	body      caddyfileWriter
+	errors    caddyfileWriter // Contents of handle_errors
+	matcherN  int
+}
+
+func (r *caddyfileRenderer) String() string {
+	var b strings.Builder
+	b.WriteString("# Rendered by Godash from the instance's JSON config\n\n")
+
+	if len(r.globals.lines) > 0 {
+		b.WriteString("{\n")
+		for _, line := range r.globals.lines {
+			b.WriteString(indentLine(line, 1) + "\n")
+		}
+		b.WriteString("}\n\n")
+	}
+
+	for _, site := range r.sites {
+		b.WriteString(strings.Join(site.addresses, ", ") + " {\n")
+		sections := []caddyfileWriter{site.matchers, site.header, site.body}
+		if len(site.errors.lines) > 0 {
+			var w caddyfileWriter
+			w.open("handle_errors")
+			w.embed(&site.errors)
+			w.close()
+			sections = append(sections, w)
+		}
+		first := true
+		for _, section := range sections {
+			if len(section.lines) == 0 {
+				continue
+			}
+			if !first {
+				b.WriteString("\n")
+			}
+			first = false
+			for _, line := range section.lines {
+				b.WriteString(indentLine(line, 1) + "\n")
+			}
+		}
+		b.WriteString("}\n\n")
+	}
+
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
+
+func (r *caddyfileRenderer) renderAdmin(admin map[string]any) {
+	for _, key := range sortedObjectKeys(admin) {
+		switch key {
+		case "disabled":
+			if admin[key] == true {
+				r.globals.line("admin", "off")
+			}
+		case "listen":
+			if admin["disabled"] != true {
+				r.globals.line("admin", jsonString(admin[key]))
+			}
+		default:
+			r.globals.notRendered("admin "+key, admin[key])
+		}
+	}
+}
+
+func (r *caddyfileRenderer) renderStorage(value any) {
+	storage := jsonObject(value)
+	if storage["module"] == "file_system" && len(storage) == 2 && jsonString(storage["root"]) != "" {
+		r.globals.line("storage", "file_system", jsonString(storage["root"]))
+		return
+	}
+	r.globals.notRendered("storage", value)
+}
+
+func (r *caddyfileRenderer) renderHTTP(app map[string]any) {
+	for _, key := range sortedObjectKeys(app) {
+		value := app[key]
+		switch key {
+		case "http_port", "https_port":
+			r.globals.line(key, jsonString(value))
+		case "grace_period":
+			r.globals.line(key, formatCaddyDuration(value))
+		case "servers":
+			servers := jsonObject(value)
+			for _, name := range sortedObjectKeys(servers) {
+				r.renderServer(name, jsonObject(servers[name]))
+			}
+		default:
+			r.globals.notRendered("http "+key, value)
+		}
+	}
+}
+
+// renderServer turns each top-level route of a server into a site block,
+// merging routes for the same addresses
+func (r *caddyfileRenderer) renderServer(name string, srv map[string]any) {
+	listen := jsonStrings(srv["listen"])
+	port, bind := serverPort(listen)
+
+	var own []*siteBlock
+	sitesOf := func(route map[string]any) (*siteBlock, []any) {
+		hosts, rest := splitHostMatch(jsonArray(route["match"]))
+		var addresses []string
+		if len(hosts) == 0 {
+			for _, l := range listen {
+				_, p := listenHostPort(l)
+				addresses = append(addresses, ":"+p)
+			}
+			if len(addresses) == 0 {
+				addresses = []string{":443"}
+			}
+		} else {
+			for _, h := range hosts {
+				addresses = append(addresses, siteAddress(h, port))
+			}
+		}
+		site := r.site(addresses, hosts, bind)
+		for _, o := range own {
+			if o == site {
+				return site, rest
+			}
+		}
+		own = append(own, site)
+		return site, rest
+	}
+
+	routes := jsonArray(srv["routes"])
+	if len(routes) == 0 && len(listen) > 0 {
+		sitesOf(map[string]any{})
+	}
+	for _, rt := range routes {
+		route := jsonObject(rt)
+		site, rest := sitesOf(route)
+		r.renderSiteRoute(site, &site.body, route, rest)
+	}
+
+	r.collectAutoHTTPS(name, jsonObject(srv["automatic_https"]))
+	for _, key := range sortedObjectKeys(srv) {
+		value := srv[key]
+		switch key {
+		case "listen", "routes", "automatic_https":
+		case "errors":
+			errs := jsonObject(value)
+			for _, rt := range jsonArray(errs["routes"]) {
+				route := jsonObject(rt)
+				site, rest := sitesOf(route)
+				r.renderSiteRoute(site, &site.errors, route, rest)
+			}
+			for _, k := range sortedObjectKeys(errs) {
+				if k != "routes" {
+					r.globals.notRendered(fmt.Sprintf("server %s errors %s", name, k), errs[k])
+				}
+			}
+		case "tls_connection_policies":
+			// The Caddyfile adapter emits an empty policy for every HTTPS server
+			for _, p := range jsonArray(value) {
+				if len(jsonObject(p)) > 0 {
+					r.globals.notRendered(fmt.Sprintf("server %s tls_connection_policies", name), value)
+					break
+				}
+			}
+		case "logs":
+			r.renderServerLogs(name, own, jsonObject(value))
+		default:
+			r.globals.notRendered(fmt.Sprintf("server %s %s", name, key), value)
+		}
+	}
+}
+
+// site returns the site block for addresses, creating it if needed
+func (r *caddyfileRenderer) site(addresses, hosts []string, bind string) *siteBlock {
+	key := strings.Join(addresses, ",")
+	if site, ok := r.sitesByAddress[key]; ok {
+		return site
+	}
+	site := &siteBlock{addresses: addresses, hosts: hosts}
+	if bind != "" {
+		site.header.line("bind", bind)
+	}
+	r.sitesByAddress[key] = site
+	r.sites = append(r.sites, site)
+	return site
+}
+
+// renderSiteRoute renders a top-level route into a site. The subroute the
+// Caddyfile adapter wraps every site in is unwrapped; matchers left over
+// after taking out the hosts wrap the route in a route block.
+func (r *caddyfileRenderer) renderSiteRoute(site *siteBlock, w *caddyfileWriter, route map[string]any, rest []any) {
+	if len(rest) > 0 {
+		inner := map[string]any{}
+		for k, v := range route {
+			inner[k] = v
+		}
+		inner["match"] = rest
+		r.renderRoute(site, w, inner)
+		return
+	}
+
+	handles := jsonArray(route["handle"])
+	if len(handles) == 1 && jsonObject(handles[0])["handler"] == "subroute" {
+		r.renderSubroute(site, w, jsonObject(handles[0]))
+	} else {
+		for _, h := range handles {
+			r.renderHandler(site, w, "", jsonObject(h))
+		}
+	}
+	notRenderedKeys(w, "route", route, "match", "handle", "group", "terminal")
+}
+
+// renderRoute renders a route nested in a site. A grouped subroute becomes
+// a handle block and any other subroute a route block; other handlers
+// become directives sharing the route's matcher.
+func (r *caddyfileRenderer) renderRoute(site *siteBlock, w *caddyfileWriter, route map[string]any) {
+	tok, ok := site.matcher(jsonArray(route["match"]))
+	if !ok {
+		w.notRendered("route matching any of several matcher sets", route)
+		return
+	}
+
+	handles := jsonArray(route["handle"])
+	if len(handles) == 1 && jsonObject(handles[0])["handler"] == "subroute" {
+		name := "route"
+		if _, grouped := route["group"]; grouped {
+			name = "handle"
+		}
+		w.open(directiveTokens(name, tok)...)
+		r.renderSubroute(site, w, jsonObject(handles[0]))
+		w.close()
+	} else {
+		for _, h := range handles {
+			r.renderHandler(site, w, tok, jsonObject(h))
+		}
+	}
+	notRenderedKeys(w, "route", route, "match", "handle", "group", "terminal")
+}
+
+func (r *caddyfileRenderer) renderSubroute(site *siteBlock, w *caddyfileWriter, h map[string]any) {
+	for _, rt := range jsonArray(h["routes"]) {
+		r.renderRoute(site, w, jsonObject(rt))
+	}
+	notRenderedKeys(w, "subroute", h, "handler", "routes")
+}
+
+// matcher returns the token a directive uses for a list of matcher sets,
+// defining a named matcher if needed. Caddyfile matchers can't express
+// several alternative sets, for which it returns false.
+func (s *siteBlock) matcher(sets []any) (string, bool) {
+	switch len(sets) {
+	case 0:
+		return "", true
+	case 1:
+	default:
+		return "", false
+	}
+
+	set := jsonObject(sets[0])
+	if len(set) == 0 {
+		return "", true
+	}
+	if paths := jsonStrings(set["path"]); len(set) == 1 && len(paths) == 1 && strings.HasPrefix(paths[0], "/") {
+		return paths[0], true
+	}
+
+	s.matcherN++
+	name := fmt.Sprintf("@match%d", s.matcherN)
+	var def caddyfileWriter
+	renderMatcherSet(&def, set)
+	if len(def.lines) == 1 && !strings.HasPrefix(def.lines[0], "#") && !strings.HasSuffix(def.lines[0], "{") {
+		s.matchers.raw(name + " " + def.lines[0])
+	} else {
+		s.matchers.open(name)
+		s.matchers.embed(&def)
+		s.matchers.close()
+	}
+	return name, true
+}
+
+// renderMatcherSet writes the matchers of one set, which must all match
+func renderMatcherSet(w *caddyfileWriter, set map[string]any) {
+	for _, key := range sortedObjectKeys(set) {
+		value := set[key]
+		switch key {
+		case "host", "path", "method":
+			w.line(append([]string{key}, jsonStrings(value)...)...)
+		case "protocol":
+			w.line(key, jsonString(value))
+		case "remote_ip", "client_ip":
+			w.line(append([]string{key}, jsonStrings(jsonObject(value)["ranges"])...)...)
+		case "header":
+			fields := jsonObject(value)
+			for _, field := range sortedObjectKeys(fields) {
+				values := jsonStrings(fields[field])
+				if len(values) == 0 {
+					w.line(key, field)
+				}
+				for _, v := range values {
+					w.line(key, field, v)
+				}
+			}
+		case "query":
+			params := jsonObject(value)
+			for _, param := range sortedObjectKeys(params) {
+				for _, v := range jsonStrings(params[param]) {
+					w.line(key, param+"="+v)
+				}
+			}
+		case "path_regexp":
+			re := jsonObject(value)
+			w.line(withOptional(key, jsonString(re["name"]), jsonString(re["pattern"]))...)
+		case "header_regexp":
+			fields := jsonObject(value)
+			for _, field := range sortedObjectKeys(fields) {
+				re := jsonObject(fields[field])
+				w.line(withOptional(key, jsonString(re["name"]), field, jsonString(re["pattern"]))...)
+			}
+		case "expression":
+			if expr, ok := value.(string); ok {
+				w.line(key, expr)
+			} else {
+				w.line(key, jsonString(jsonObject(value)["expr"]))
+			}
+		case "file":
+			file := jsonObject(value)
+			w.open(key)
+			for _, k := range sortedObjectKeys(file) {
+				switch k {
+				case "root", "try_policy":
+					w.line(k, jsonString(file[k]))
+				case "try_files", "split_path":
+					w.line(append([]string{k}, jsonStrings(file[k])...)...)
+				default:
+					w.notRendered("file "+k, file[k])
+				}
+			}
+			w.close()
+		case "not":
+			for _, inner := range jsonArray(value) {
+				w.open(key)
+				renderMatcherSet(w, jsonObject(inner))
+				w.close()
+			}
+		default:
+			w.notRendered("matcher "+key, value)
+		}
+	}
+}
+
+// renderHandler writes a handler as the equivalent directive
+func (r *caddyfileRenderer) renderHandler(site *siteBlock, w *caddyfileWriter, tok string, h map[string]any) {
+	name := jsonString(h["handler"])
+	switch name {
+	case "reverse_proxy":
+		renderReverseProxy(w, tok, h)
+	case "file_server":
+		renderFileServer(w, tok, h)
+	case "static_response":
+		renderStaticResponse(w, tok, h)
+	case "headers":
+		renderHeaders(w, tok, h)
+	case "encode":
+		renderEncode(w, tok, h)
+	case "rewrite":
+		renderRewrite(w, tok, h)
+	case "authentication":
+		renderBasicAuth(w, tok, h)
+	case "vars":
+		renderVars(w, tok, h)
+	case "subroute":
+		w.open(directiveTokens("route", tok)...)
+		r.renderSubroute(site, w, h)
+		w.close()
+	case "templates":
+		w.line(directiveTokens("templates", tok)...)
+		notRenderedKeys(w, "templates", h, "handler")
+	case "error":
+		w.line(directiveTokens("error", tok, withOptional(jsonString(h["error"]), jsonString(h["status_code"]))...)...)
+		notRenderedKeys(w, "error", h, "handler", "error", "status_code")
+	default:
+		w.notRendered(fmt.Sprintf("handler %q", name), h)
+	}
+}
+
+func renderReverseProxy(w *caddyfileWriter, tok string, h map[string]any) {
+	var upstreams []string
+	var sub caddyfileWriter
+	for _, u := range jsonArray(h["upstreams"]) {
+		upstream := jsonObject(u)
+		upstreams = append(upstreams, jsonString(upstream["dial"]))
+		notRenderedKeys(&sub, "upstream", upstream, "dial")
+	}
+
+	for _, key := range sortedObjectKeys(h) {
+		value := h[key]
+		switch key {
+		case "handler", "upstreams":
+		case "load_balancing":
+			lb := jsonObject(value)
+			for _, k := range sortedObjectKeys(lb) {
+				switch k {
+				case "selection_policy":
+					policy := jsonObject(lb[k])
+					sub.line("lb_policy", jsonString(policy["policy"]))
+					notRenderedKeys(&sub, "selection_policy", policy, "policy")
+				case "try_duration", "try_interval":
+					sub.line("lb_"+k, formatCaddyDuration(lb[k]))
+				case "retries":
+					sub.line("lb_retries", jsonString(lb[k]))
+				default:
+					sub.notRendered("load_balancing "+k, lb[k])
+				}
+			}
+		case "health_checks":
+			checks := jsonObject(value)
+			for _, kind := range sortedObjectKeys(checks) {
+				check := jsonObject(checks[kind])
+				for _, k := range sortedObjectKeys(check) {
+					switch {
+					case kind == "active" && (k == "uri" || k == "path"):
+						sub.line("health_uri", jsonString(check[k]))
+					case kind == "active" && k == "port":
+						sub.line("health_port", jsonString(check[k]))
+					case kind == "active" && (k == "interval" || k == "timeout"):
+						sub.line("health_"+k, formatCaddyDuration(check[k]))
+					case kind == "passive" && k == "fail_duration":
+						sub.line(k, formatCaddyDuration(check[k]))
+					case kind == "passive" && k == "max_fails":
+						sub.line(k, jsonString(check[k]))
+					default:
+						sub.notRendered(fmt.Sprintf("health_checks %s %s", kind, k), check[k])
+					}
+				}
+			}
+		case "headers":
+			ops := jsonObject(value)
+			for _, k := range sortedObjectKeys(ops) {
+				switch k {
+				case "request":
+					for _, op := range headerOps(&sub, jsonObject(ops[k])) {
+						sub.line(append([]string{"header_up"}, op...)...)
+					}
+				case "response":
+					for _, op := range headerOps(&sub, jsonObject(ops[k])) {
+						sub.line(append([]string{"header_down"}, op...)...)
+					}
+				default:
+					sub.notRendered("headers "+k, ops[k])
+				}
+			}
+		case "transport":
+			renderTransport(&sub, jsonObject(value))
+		case "flush_interval":
+			sub.line(key, formatCaddyDuration(value))
+		default:
+			sub.notRendered("reverse_proxy "+key, value)
+		}
+	}
+
+	w.block(directiveTokens("reverse_proxy", tok, upstreams...), &sub)
+}
+
+func renderTransport(w *caddyfileWriter, transport map[string]any) {
+	if transport["protocol"] != "http" {
+		w.notRendered("transport", transport)
+		return
+	}
+
+	var sub caddyfileWriter
+	for _, key := range sortedObjectKeys(transport) {
+		value := transport[key]
+		switch key {
+		case "protocol":
+		case "tls":
+			sub.line("tls")
+			tls := jsonObject(value)
+			for _, k := range sortedObjectKeys(tls) {
+				switch k {
+				case "insecure_skip_verify":
+					if tls[k] == true {
+						sub.line("tls_insecure_skip_verify")
+					}
+				case "server_name":
+					sub.line("tls_server_name", jsonString(tls[k]))
+				default:
+					sub.notRendered("tls "+k, tls[k])
+				}
+			}
+		case "dial_timeout", "read_timeout", "write_timeout", "response_header_timeout":
+			sub.line(key, formatCaddyDuration(value))
+		case "versions":
+			sub.line(append([]string{key}, jsonStrings(value)...)...)
+		default:
+			sub.notRendered("transport "+key, value)
+		}
+	}
+	if len(sub.lines) > 0 {
+		w.open("transport", "http")
+		w.embed(&sub)
+		w.close()
+	}
+}
+
+func renderFileServer(w *caddyfileWriter, tok string, h map[string]any) {
+	var args []string
+	var sub caddyfileWriter
+	for _, key := range sortedObjectKeys(h) {
+		value := h[key]
+		switch key {
+		case "handler":
+		case "browse":
+			if tmpl := jsonString(jsonObject(value)["template_file"]); tmpl != "" {
+				sub.line("browse", tmpl)
+			} else {
+				args = append(args, "browse")
+			}
+		case "root":
+			sub.line("root", jsonString(value))
+		case "hide":
+			sub.line(append([]string{"hide"}, jsonStrings(value)...)...)
+		case "index_names":
+			sub.line(append([]string{"index"}, jsonStrings(value)...)...)
+		case "precompressed_order":
+			sub.line(append([]string{"precompressed"}, jsonStrings(value)...)...)
+		case "canonical_uris":
+			if value == false {
+				sub.line("disable_canonical_uris")
+			}
+		case "pass_thru":
+			if value == true {
+				sub.line("pass_thru")
+			}
+		case "status_code":
+			sub.line("status", jsonString(value))
+		case "precompressed":
+			// Listed in precompressed_order
+		default:
+			sub.notRendered("file_server "+key, value)
+		}
+	}
+	if len(sub.lines) > 0 && len(args) > 0 {
+		sub.lines = append([]string{"browse"}, sub.lines...)
+		args = nil
+	}
+	w.block(directiveTokens("file_server", tok, args...), &sub)
+}
+
+func renderStaticResponse(w *caddyfileWriter, tok string, h map[string]any) {
+	if h["abort"] == true {
+		w.line(directiveTokens("abort", tok)...)
+		return
+	}
+
+	status := jsonString(h["status_code"])
+	body := jsonString(h["body"])
+	headers := jsonObject(h["headers"])
+
+	// The Caddyfile adapter writes redir as a 3xx response with a Location header
+	location := jsonStrings(headers["Location"])
+	if strings.HasPrefix(status, "3") && body == "" && len(headers) == 1 && len(location) == 1 {
+		args := []string{location[0]}
+		if status != "302" {
+			args = append(args, status)
+		}
+		w.line(directiveTokens("redir", tok, args...)...)
+		notRenderedKeys(w, "static_response", h, "handler", "status_code", "headers")
+		return
+	}
+
+	for _, field := range sortedObjectKeys(headers) {
+		for i, v := range jsonStrings(headers[field]) {
+			name := field
+			if i > 0 {
+				name = "+" + field
+			}
+			w.line(directiveTokens("header", tok, name, v)...)
+		}
+	}
+
+	var args []string
+	if body != "" {
+		args = append(args, body)
+	}
+	if status != "" {
+		args = append(args, status)
+	}
+	var sub caddyfileWriter
+	if h["close"] == true {
+		sub.line("close")
+	}
+	w.block(directiveTokens("respond", tok, args...), &sub)
+	notRenderedKeys(w, "static_response", h, "handler", "status_code", "body", "headers", "close", "abort")
+}
+
+func renderHeaders(w *caddyfileWriter, tok string, h map[string]any) {
+	for _, key := range sortedObjectKeys(h) {
+		value := h[key]
+		switch key {
+		case "handler":
+		case "request":
+			// request_header takes a single operation per directive
+			for _, op := range headerOps(w, jsonObject(value)) {
+				w.line(directiveTokens("request_header", tok, op...)...)
+			}
+		case "response":
+			response := jsonObject(value)
+			ops := headerOps(w, response)
+			if response["deferred"] == true && len(jsonStrings(response["delete"])) == 0 {
+				ops = append(ops, []string{"defer"})
+			}
+			if len(ops) == 1 {
+				w.line(directiveTokens("header", tok, ops[0]...)...)
+			} else if len(ops) > 1 {
+				w.open(directiveTokens("header", tok)...)
+				for _, op := range ops {
+					w.line(op...)
+				}
+				w.close()
+			}
+		default:
+			w.notRendered("headers "+key, value)
+		}
+	}
+}
+
+// headerOps returns the header manipulations of a header_up, header_down,
+// header or request_header as argument lists
+func headerOps(w *caddyfileWriter, ops map[string]any) [][]string {
+	var out [][]string
+	for _, key := range sortedObjectKeys(ops) {
+		value := ops[key]
+		switch key {
+		case "set", "add":
+			fields := jsonObject(value)
+			for _, field := range sortedObjectKeys(fields) {
+				for i, v := range jsonStrings(fields[field]) {
+					name := field
+					if key == "add" || i > 0 {
+						name = "+" + field
+					}
+					out = append(out, []string{name, v})
+				}
+			}
+		case "delete":
+			for _, field := range jsonStrings(value) {
+				out = append(out, []string{"-" + field})
+			}
+		case "replace":
+			fields := jsonObject(value)
+			for _, field := range sortedObjectKeys(fields) {
+				for _, rep := range jsonArray(fields[field]) {
+					replacement := jsonObject(rep)
+					search := jsonString(replacement["search"])
+					if search == "" {
+						search = jsonString(replacement["search_regexp"])
+					}
+					out = append(out, []string{field, search, jsonString(replacement["replace"])})
+				}
+			}
+		case "deferred":
+			// Implied by deletions; handled by the caller otherwise
+		default:
+			w.notRendered("header "+key, value)
+		}
+	}
+	return out
+}
+
+func renderEncode(w *caddyfileWriter, tok string, h map[string]any) {
+	encodings := jsonObject(h["encodings"])
+	names := jsonStrings(h["prefer"])
+	for _, name := range sortedObjectKeys(encodings) {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	var sub caddyfileWriter
+	configured := false
+	for _, name := range names {
+		options := jsonObject(encodings[name])
+		if level, ok := options["level"]; ok {
+			sub.line(name, jsonString(level))
+			configured = true
+		} else {
+			sub.line(name)
+		}
+		notRenderedKeys(&sub, "encoding "+name, options, "level")
+	}
+	for _, key := range sortedObjectKeys(h) {
+		switch key {
+		case "handler", "encodings", "prefer":
+		case "minimum_length":
+			sub.line(key, jsonString(h[key]))
+			configured = true
+		default:
+			sub.notRendered("encode "+key, h[key])
+			configured = true
+		}
+	}
+
+	if configured {
+		w.block(directiveTokens("encode", tok), &sub)
+	} else {
+		w.line(directiveTokens("encode", tok, names...)...)
+	}
+}
+
+func renderRewrite(w *caddyfileWriter, tok string, h map[string]any) {
+	for _, key := range sortedObjectKeys(h) {
+		value := h[key]
+		switch key {
+		case "handler":
+		case "uri":
+			w.line(directiveTokens("rewrite", tok, jsonString(value))...)
+		case "strip_path_prefix":
+			w.line(directiveTokens("uri", tok, "strip_prefix", jsonString(value))...)
+		case "strip_path_suffix":
+			w.line(directiveTokens("uri", tok, "strip_suffix", jsonString(value))...)
+		case "uri_substring":
+			for _, s := range jsonArray(value) {
+				sub := jsonObject(s)
+				args := []string{"replace", jsonString(sub["find"]), jsonString(sub["replace"])}
+				if limit := jsonString(sub["limit"]); limit != "" && limit != "0" {
+					args = append(args, limit)
+				}
+				w.line(directiveTokens("uri", tok, args...)...)
+			}
+		case "path_regexp":
+			for _, s := range jsonArray(value) {
+				sub := jsonObject(s)
+				w.line(directiveTokens("uri", tok, "path_regexp", jsonString(sub["find"]), jsonString(sub["replace"]))...)
+			}
+		default:
+			w.notRendered("rewrite "+key, value)
+		}
+	}
+}
+
+func renderBasicAuth(w *caddyfileWriter, tok string, h map[string]any) {
+	providers := jsonObject(h["providers"])
+	for _, name := range sortedObjectKeys(providers) {
+		if name != "http_basic" {
+			w.notRendered(fmt.Sprintf("authentication provider %q", name), providers[name])
+			continue
+		}
+
+		basic := jsonObject(providers[name])
+		var args []string
+		algorithm := jsonString(jsonObject(basic["hash"])["algorithm"])
+		realm := jsonString(basic["realm"])
+		if realm != "" {
+			if algorithm == "" {
+				algorithm = "bcrypt"
+			}
+			args = []string{algorithm, realm}
+		} else if algorithm != "" && algorithm != "bcrypt" {
+			args = []string{algorithm}
+		}
+
+		var sub caddyfileWriter
+		for _, a := range jsonArray(basic["accounts"]) {
+			account := jsonObject(a)
+			sub.line(jsonString(account["username"]), jsonString(account["password"]))
+		}
+		notRenderedKeys(&sub, "http_basic", basic, "accounts", "hash", "realm")
+		w.open(directiveTokens("basicauth", tok, args...)...)
+		w.embed(&sub)
+		w.close()
+	}
+	notRenderedKeys(w, "authentication", h, "handler", "providers")
+}
+
+func renderVars(w *caddyfileWriter, tok string, h map[string]any) {
+	var sub caddyfileWriter
+	for _, key := range sortedObjectKeys(h) {
+		switch key {
+		case "handler":
+		case "root":
+			// The Caddyfile adapter writes root as a variable
+			w.line(directiveTokens("root", tok, jsonString(h[key]))...)
+		default:
+			sub.line(key, jsonString(h[key]))
+		}
+	}
+	if len(sub.lines) > 0 {
+		w.open(directiveTokens("vars", tok)...)
+		w.embed(&sub)
+		w.close()
+	}
+}
+
+// renderServerLogs adds log to the server's sites that have access logging.
+// Where the logs go is part of the logging config, which isn't rendered.
+func (r *caddyfileRenderer) renderServerLogs(name string, sites []*siteBlock, logs map[string]any) {
+	loggers := jsonObject(logs["logger_names"])
+	_, hasDefault := logs["default_logger_name"]
+	for _, site := range sites {
+		logged := hasDefault
+		for _, host := range site.hosts {
+			if _, ok := loggers[host]; ok {
+				logged = true
+			}
+		}
+		if logged {
+			site.header.line("log")
+		}
+	}
+	notRenderedKeys(&r.globals, "server "+name+" logs", logs, "logger_names", "default_logger_name")
+}
+
+func (r *caddyfileRenderer) collectAutoHTTPS(server string, auto map[string]any) {
+	if r.autoHTTPS == nil {
+		r.autoHTTPS = map[string]string{}
+	}
+	mode := ""
+	if auto["disable"] == true {
+		mode = "off"
+	} else if auto["disable_redirects"] == true {
+		mode = "disable_redirects"
+	}
+	r.autoHTTPS[server] = mode
+	notRenderedKeys(&r.globals, "server "+server+" automatic_https", auto, "disable", "disable_redirects")
+}
+
+// renderAutoHTTPS writes auto_https when all servers agree on it, the only
+// way the Caddyfile can express it
+func (r *caddyfileRenderer) renderAutoHTTPS() {
+	modes := map[string]bool{}
+	for _, mode := range r.autoHTTPS {
+		modes[mode] = true
+	}
+	if len(modes) == 0 {
+		return
+	}
+	if len(modes) == 1 {
+		for mode := range modes {
+			if mode != "" {
+				r.globals.line("auto_https", mode)
+			}
+		}
+		return
+	}
+	r.globals.notRendered("automatic_https differing per server", r.autoHTTPS)
+}
+
+func (r *caddyfileRenderer) collectTLS(app map[string]any) {
+	for _, key := range sortedObjectKeys(app) {
+		if key != "automation" {
+			r.globals.notRendered("tls "+key, app[key])
+			continue
+		}
+
+		automation := jsonObject(app[key])
+		for _, k := range sortedObjectKeys(automation) {
+			switch k {
+			case "policies":
+				for _, p := range jsonArray(automation[k]) {
+					r.policies = append(r.policies, jsonObject(p))
+				}
+			case "on_demand":
+				onDemand := jsonObject(automation[k])
+				if ask := jsonString(onDemand["ask"]); ask != "" {
+					r.globals.open("on_demand_tls")
+					r.globals.line("ask", ask)
+					r.globals.close()
+				}
+				notRenderedKeys(&r.globals, "tls on_demand", onDemand, "ask")
+			default:
+				r.globals.notRendered("tls automation "+k, automation[k])
+			}
+		}
+	}
+}
+
+// renderTLS attaches each automation policy to the sites of its subjects as
+// a tls directive; policies without subjects become global options
+func (r *caddyfileRenderer) renderTLS() {
+	for _, policy := range r.policies {
+		subjects := jsonStrings(policy["subjects"])
+		if len(subjects) == 0 {
+			renderTLSPolicy(&r.globals, policy, true)
+			continue
+		}
+
+		used := false
+		for _, site := range r.sites {
+			for _, host := range site.hosts {
+				if containsString(subjects, host) {
+					renderTLSPolicy(&site.header, policy, false)
+					used = true
+					break
+				}
+			}
+		}
+		if !used {
+			r.globals.notRendered("tls policy for "+strings.Join(subjects, " "), policy)
+		}
+	}
+}
+
+// renderTLSPolicy writes a policy as a site's tls directive or, for a
+// global policy, as global options
+func renderTLSPolicy(w *caddyfileWriter, policy map[string]any, global bool) {
+	var internal bool
+	var email, ca string
+	var sub caddyfileWriter
+	for _, i := range jsonArray(policy["issuers"]) {
+		issuer := jsonObject(i)
+		switch issuer["module"] {
+		case "internal":
+			internal = true
+			notRenderedKeys(&sub, "internal issuer", issuer, "module")
+		case "acme", "zerossl":
+			if e := jsonString(issuer["email"]); e != "" {
+				email = e
+			}
+			if c := jsonString(issuer["ca"]); c != "" {
+				ca = c
+			}
+			notRenderedKeys(&sub, jsonString(issuer["module"])+" issuer", issuer, "module", "email", "ca")
+		default:
+			sub.notRendered("issuer", issuer)
+		}
+	}
+
+	if global {
+		if internal {
+			w.line("local_certs")
+		}
+		if email != "" {
+			w.line("email", email)
+		}
+		if ca != "" {
+			w.line("acme_ca", ca)
+		}
+		if keyType := jsonString(policy["key_type"]); keyType != "" {
+			w.line("key_type", keyType)
+		}
+		notRenderedKeys(w, "tls policy", policy, "subjects", "issuers", "key_type")
+		w.embed(&sub)
+		return
+	}
+
+	if ca != "" {
+		sub.line("ca", ca)
+	}
+	if keyType := jsonString(policy["key_type"]); keyType != "" {
+		sub.line("key_type", keyType)
+	}
+	if policy["on_demand"] == true {
+		sub.line("on_demand")
+	}
+	notRenderedKeys(&sub, "tls policy", policy, "subjects", "issuers", "key_type", "on_demand")
+
+	var args []string
+	switch {
+	case internal:
+		args = []string{"internal"}
+	case email != "":
+		args = []string{email}
+	}
+	if len(args) == 0 && len(sub.lines) == 0 {
+		return // Default automation
+	}
+	w.block(append([]string{"tls"}, args...), &sub)
+}
+
+// splitHostMatch takes the hosts out of a site route's matcher sets. It
+// returns the hosts and whatever matchers remain.
+func splitHostMatch(sets []any) ([]string, []any) {
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	var hosts []string
+	for _, s := range sets {
+		set := jsonObject(s)
+		if _, ok := set["host"]; !ok || (len(sets) > 1 && len(set) > 1) {
+			return nil, sets
+		}
+		hosts = append(hosts, jsonStrings(set["host"])...)
+	}
+
+	rest := map[string]any{}
+	for k, v := range jsonObject(sets[0]) {
+		if k != "host" {
+			rest[k] = v
+		}
+	}
+	if len(rest) == 0 {
+		return hosts, nil
+	}
+	return hosts, []any{rest}
+}
+
+// serverPort returns the port and bind address of a server with a single
+// listener
+func serverPort(listen []string) (port, bind string) {
+	if len(listen) != 1 {
+		return "", ""
+	}
+	host, port := listenHostPort(listen[0])
+	return port, host
+}
+
+func listenHostPort(addr string) (string, string) {
+	addr = strings.TrimPrefix(addr, "tcp/")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", strings.TrimPrefix(addr, ":")
+	}
+	return host, port
+}
+
+// siteAddress writes a host as a site address for a server's port
+func siteAddress(host, port string) string {
+	switch port {
+	case "", "443":
+		return host
+	case "80":
+		return "http://" + host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// directiveTokens returns a directive with its matcher token and arguments.
+// A first argument starting with "/" would be read as a path matcher, so
+// such directives get the "*" matcher when they have none.
+func directiveTokens(name, tok string, args ...string) []string {
+	if tok == "" && len(args) > 0 && strings.HasPrefix(args[0], "/") {
+		tok = "*"
+	}
+	tokens := []string{name}
+	if tok != "" {
+		tokens = append(tokens, tok)
+	}
+	return append(tokens, args...)
+}
+
+// withOptional returns tokens with any empty leading optional ones removed
+func withOptional(tokens ...string) []string {
+	out := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		if t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// notRenderedKeys comments out the keys of obj other than the known ones
+func notRenderedKeys(w *caddyfileWriter, what string, obj map[string]any, known ...string) {
+	for _, key := range sortedObjectKeys(obj) {
+		if !containsString(known, key) {
+			w.notRendered(what+" "+key, obj[key])
+		}
+	}
+}
+
+// caddyfileWriter builds tab-indented Caddyfile lines
+type caddyfileWriter struct {
+	lines []string
+	depth int
+}
+
+func (w *caddyfileWriter) line(tokens ...string) {
+	w.raw(joinCaddyfileTokens(tokens))
+}
+
+func (w *caddyfileWriter) raw(text string) {
+	w.lines = append(w.lines, indentLine(text, w.depth))
+}
+
+func (w *caddyfileWriter) open(tokens ...string) {
+	w.raw(joinCaddyfileTokens(tokens) + " {")
+	w.depth++
+}
+
+func (w *caddyfileWriter) close() {
+	w.depth--
+	w.raw("}")
+}
+
+// block writes tokens with body as its block, or as a single line if body
+// is empty
+func (w *caddyfileWriter) block(tokens []string, body *caddyfileWriter) {
+	if len(body.lines) == 0 {
+		w.line(tokens...)
+		return
+	}
+	w.open(tokens...)
+	w.embed(body)
+	w.close()
+}
+
+func (w *caddyfileWriter) embed(other *caddyfileWriter) {
+	for _, line := range other.lines {
+		w.lines = append(w.lines, indentLine(line, w.depth))
+	}
+}
+
+// notRendered records part of the config as a comment, truncating long values
+func (w *caddyfileWriter) notRendered(what string, value any) {
+	data, _ := json.Marshal(value)
+	text := string(data)
+	if len(text) > 200 {
+		text = text[:200] + "..."
+	}
+	w.raw("# not rendered: " + what + ": " + text)
+}
+
+func indentLine(line string, depth int) string {
+	if line == "" {
+		return ""
+	}
+	return strings.Repeat("\t", depth) + line
+}
+
+func joinCaddyfileTokens(tokens []string) string {
+	quoted := make([]string, len(tokens))
+	for i, t := range tokens {
+		quoted[i] = quoteCaddyfileToken(t)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quoteCaddyfileToken quotes a token that would otherwise be split, taken
+// as a block delimiter or read as a comment
+func quoteCaddyfileToken(s string) string {
+	if s != "" && s != "{" && s != "}" && !strings.HasPrefix(s, "#") && !strings.ContainsAny(s, " \t\r\n\"`") {
+		return s
+	}
+	if strings.Contains(s, `"`) && !strings.Contains(s, "`") {
+		return "`" + s + "`"
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// formatCaddyDuration formats a Caddy duration, which JSON holds either as
+// nanoseconds or as a duration string
+func formatCaddyDuration(v any) string {
+	switch n := v.(type) {
+	case float64:
+		return time.Duration(int64(n)).String()
+	case json.Number:
+		if ns, err := n.Int64(); err == nil {
+			return time.Duration(ns).String()
+		}
+	}
+	return jsonString(v)
+}
+
+func jsonObject(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+func jsonArray(v any) []any {
+	a, _ := v.([]any)
+	return a
+}
+
+// jsonString returns a scalar as a string; other values are JSON-encoded
+func jsonString(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func jsonStrings(v any) []string {
+	if s, ok := v.(string); ok {
+		return []string{s}
+	}
+	var out []string
+	for _, item := range jsonArray(v) {
+		out = append(out, jsonString(item))
+	}
+	return out
+}
+
+func sortedObjectKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
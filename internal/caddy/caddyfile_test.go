@@ -0,0 +1,196 @@
+package caddy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRenderCaddyfile(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "empty",
+			config: `{}`,
+			want:   "# The instance has no config\n",
+		},
+		{
+			name:   "admin disabled",
+			config: `{"admin":{"disabled":true,"listen":"localhost:2019"}}`,
+			want: `# Rendered by Godash from the instance's JSON config
+
+{
+	admin off
+}
+`,
+		},
+		{
+			// As adapted from a Caddyfile: sites wrapped in subroutes, root
+			// as a variable and redir as a static response
+			name: "adapted sites",
+			config: `{"apps":{"http":{"servers":{"srv0":{"listen":[":443"],"routes":[
+				{"match":[{"host":["www.example.com"]}],"handle":[{"handler":"subroute","routes":[{"handle":[{"handler":"static_response","headers":{"Location":["https://example.com{http.request.uri}"]},"status_code":301}]}]}],"terminal":true},
+				{"match":[{"host":["example.com"]}],"handle":[{"handler":"subroute","routes":[
+					{"handle":[{"handler":"vars","root":"/srv/www"}]},
+					{"handle":[{"handler":"encode","encodings":{"gzip":{},"zstd":{}},"prefer":["zstd","gzip"]}]},
+					{"match":[{"path":["/api/*"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:8080"},{"dial":"10.0.0.2:8080"}],"load_balancing":{"selection_policy":{"policy":"round_robin"}},"transport":{"protocol":"http","dial_timeout":5000000000}}]},
+					{"match":[{"method":["POST"],"path":["/upload"]}],"handle":[{"handler":"authentication","providers":{"http_basic":{"accounts":[{"username":"admin","password":"$2a$14$hash"}],"hash":{"algorithm":"bcrypt"}}}}]},
+					{"handle":[{"handler":"headers","response":{"set":{"X-Frame-Options":["DENY"]},"delete":["Server"],"deferred":true}}]},
+					{"handle":[{"handler":"file_server","hide":["./Caddyfile"]}]}
+				]}],"terminal":true}
+				]}}},
+				"tls":{"automation":{"policies":[{"subjects":["example.com","www.example.com"],"issuers":[{"module":"acme","email":"ops@example.com"}]}]}}}}`,
+			want: `# Rendered by Godash from the instance's JSON config
+
+www.example.com {
+	tls ops@example.com
+
+	redir https://example.com{http.request.uri} 301
+}
+
+example.com {
+	@match1 {
+		method POST
+		path /upload
+	}
+
+	tls ops@example.com
+
+	root * /srv/www
+	encode zstd gzip
+	reverse_proxy /api/* 10.0.0.1:8080 10.0.0.2:8080 {
+		lb_policy round_robin
+		transport http {
+			dial_timeout 5s
+		}
+	}
+	basicauth @match1 {
+		admin $2a$14$hash
+	}
+	header {
+		-Server
+		X-Frame-Options DENY
+	}
+	file_server {
+		hide ./Caddyfile
+	}
+}
+`,
+		},
+		{
+			name: "global options and unrendered parts",
+			config: `{"admin":{"listen":"localhost:2019"},"apps":{"pki":{"certificate_authorities":{}},"http":{"grace_period":10000000000,"http_port":8080,"servers":{
+				"srv0":{"listen":[":80"],"automatic_https":{"disable":true},"routes":[
+				{"match":[{"host":["example.com"]}],"handle":[{"handler":"static_response","body":"hello","status_code":200}]},
+				{"match":[{"path":["/a"]},{"path":["/b"]}],"handle":[{"handler":"static_response","status_code":404}]},
+				{"handle":[{"handler":"custom_thing","x":1}]}
+				],"errors":{"routes":[{"match":[{"host":["example.com"]}],"handle":[{"handler":"static_response","body":"oops"}]}]}},
+				"srv1":{"listen":["127.0.0.1:9000"],"automatic_https":{"disable":true}}
+				}},
+				"tls":{"automation":{"policies":[{"issuers":[{"module":"internal"}]}]}}}}`,
+			want: `# Rendered by Godash from the instance's JSON config
+
+{
+	admin localhost:2019
+	grace_period 10s
+	http_port 8080
+	# not rendered: app "pki": {"certificate_authorities":{}}
+	local_certs
+	auto_https off
+}
+
+http://example.com {
+	respond hello 200
+
+	handle_errors {
+		respond oops
+	}
+}
+
+:80 {
+	# not rendered: route matching any of several matcher sets: {"handle":[{"handler":"static_response","status_code":404}],"match":[{"path":["/a"]},{"path":["/b"]}]}
+	# not rendered: handler "custom_thing": {"handler":"custom_thing","x":1}
+}
+
+:9000 {
+	bind 127.0.0.1
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderCaddyfile([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := RenderCaddyfile([]byte(`{"apps":`)); err == nil {
+		t.Error("rendered an invalid config")
+	}
+}
+
+func TestQuoteCaddyfileToken(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"example.com", "example.com"},
+		{"{http.request.uri}", "{http.request.uri}"},
+		{"", `""`},
+		{"{", `"{"`},
+		{"#tag", `"#tag"`},
+		{"hello world", `"hello world"`},
+		{`say "hi"`, "`say \"hi\"`"},
+		{"`a` \"b\"", `"` + "`a` \\\"b\\\"" + `"`},
+	}
+	for _, tt := range tests {
+		if got := quoteCaddyfileToken(tt.token); got != tt.want {
+			t.Errorf("quoteCaddyfileToken(%q) = %s, want %s", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCaddyDuration(t *testing.T) {
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{json.Number("5000000000"), "5s"},
+		{json.Number("90000000000"), "1m30s"},
+		{float64(1500000000), "1.5s"},
+		{"2m", "2m"},
+		{json.Number("1.5"), "1.5"},
+	}
+	for _, tt := range tests {
+		if got := formatCaddyDuration(tt.value); got != tt.want {
+			t.Errorf("formatCaddyDuration(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSiteAddress(t *testing.T) {
+	tests := []struct {
+		host, port string
+		want       string
+	}{
+		{"example.com", "", "example.com"},
+		{"example.com", "443", "example.com"},
+		{"example.com", "80", "http://example.com"},
+		{"example.com", "8443", "example.com:8443"},
+		{"::1", "8443", "[::1]:8443"},
+	}
+	for _, tt := range tests {
+		if got := siteAddress(tt.host, tt.port); got != tt.want {
+			t.Errorf("siteAddress(%q, %q) = %s, want %s", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +19,10 @@ type Client struct {
 	apiKey     string
 	httpClient *http.Client
 	timeout    time.Duration
+	logs       *LogBuffer
+
+	mu    sync.Mutex
+	etags map[string]string // ETag of the last read of each config path
 }
 
 // NewClient creates a new Caddy client
@@ -25,6 +32,7 @@ func NewClient(baseURL, apiKey string, timeout time.Duration) *Client {
 		apiKey:     apiKey,
 		httpClient: &http.Client{Timeout: timeout},
 		timeout:    timeout,
+		etags:      make(map[string]string),
 	}
 }
 
@@ -85,6 +93,22 @@ func (c *Client) GetServerInfo() (*ServerInfo, error) {
 
 // GetConfig returns the current Caddy configuration
 func (c *Client) GetConfig() (*Config, error) {
+	body, err := c.GetRawConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	return &config, nil
+}
+
+// GetRawConfig returns the current Caddy configuration exactly as the admin
+// API serves it, including sections Config doesn't model
+func (c *Client) GetRawConfig() ([]byte, error) {
 	req, err := http.NewRequest("GET", c.baseURL+"/config/", nil)
 	if err != nil {
 		return nil, err
@@ -105,12 +129,7 @@ func (c *Client) GetConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to get config: %s", string(body))
 	}
 
-	var config Config
-	if err := json.Unmarshal(body, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
-	}
-
-	return &config, nil
+	return body, nil
 }
 
 // ReloadConfig reloads the Caddy configuration
@@ -137,6 +156,78 @@ func (c *Client) ReloadConfig(configJSON []byte) error {
 	return nil
 }
 
+// AdaptError is returned when Caddy can't adapt a Caddyfile
+type AdaptError struct {
+	Message string
+	Line    int // Line of the Caddyfile the error refers to, if known
+}
+
+func (e *AdaptError) Error() string {
+	return "caddyfile adapt failed: " + e.Message
+}
+
+// adaptErrorLine matches the file:line prefix Caddy puts on Caddyfile errors,
+// e.g. "Caddyfile:12 - Error during parsing: ..."
+var adaptErrorLine = regexp.MustCompile(`^\S+:(\d+)\b`)
+
+// Adapt converts a Caddyfile to JSON config with the instance's /adapt
+// endpoint, without loading it
+func (c *Client) Adapt(caddyfile []byte) (*AdaptResult, error) {
+	req, err := http.NewRequest("POST", c.baseURL+"/adapt", bytes.NewReader(caddyfile))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/caddyfile")
+
+	resp, err := c.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		msg := apiErrorMessage(body)
+		if resp.StatusCode != http.StatusBadRequest {
+			return nil, fmt.Errorf("adapt request failed: status %d: %s", resp.StatusCode, msg)
+		}
+		adaptErr := &AdaptError{Message: msg}
+		if m := adaptErrorLine.FindStringSubmatch(msg); m != nil {
+			adaptErr.Line, _ = strconv.Atoi(m[1])
+		}
+		return nil, adaptErr
+	}
+
+	var result struct {
+		Result   json.RawMessage `json:"result"`
+		Warnings []AdaptWarning  `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse adapt response: %w", err)
+	}
+	if result.Warnings == nil {
+		result.Warnings = []AdaptWarning{}
+	}
+
+	return &AdaptResult{Config: result.Result, Warnings: result.Warnings}, nil
+}
+
+// apiErrorMessage returns the message of an admin API error response, which
+// is reported as {"error": "..."}
+func apiErrorMessage(body []byte) string {
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+		return apiErr.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
 // Stop stops the Caddy server
 func (c *Client) Stop() error {
 	req, err := http.NewRequest("POST", c.baseURL+"/stop", nil)
@@ -164,6 +255,8 @@ func (c *Client) GetMetrics() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// Prefer OpenMetrics so exemplars are included
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
 
 	resp, err := c.doRequest(req)
 	if err != nil {
@@ -183,11 +276,19 @@ func (c *Client) GetMetrics() (string, error) {
 	return string(body), nil
 }
 
+// UseLogBuffer attaches the buffer that receives this instance's logs
+func (c *Client) UseLogBuffer(buf *LogBuffer) {
+	c.logs = buf
+}
+
 // GetLogs retrieves recent logs from Caddy
-func (c *Client) GetLogs(tailLines int) ([]LogEntry, error) {
-	// For now, return empty - proper implementation would use WebSocket
-	// Caddy's /admin/log endpoint supports WebSocket for real-time logs
-	return []LogEntry{}, nil
+func (c *Client) GetLogs(tailLines int, minLevel string) ([]LogEntry, error) {
+	// Caddy's admin API has no log endpoint; logs are shipped to the
+	// LogSink by Caddy's net writer or tailed from a local file
+	if c.logs == nil {
+		return []LogEntry{}, nil
+	}
+	return c.logs.Tail(tailLines, minLevel), nil
 }
 
 // GetSites returns the list of configured sites
@@ -213,6 +314,13 @@ func (c *Client) GetSites() ([]Site, error) {
 						site.Listen = append(site.Listen, fmt.Sprintf("%v", l))
 					}
 				}
+				site.Hosts = []string{}
+				if raw, err := json.Marshal(srvMap["routes"]); err == nil {
+					if routes, err := parseRoutes(raw); err == nil {
+						site.Routes = routes
+						site.Hosts = siteHosts(routes)
+					}
+				}
 				sites = append(sites, site)
 			}
 		}
@@ -296,70 +404,3 @@ func (c *Client) doRequest(req *http.Request) (*http.Response, error) {
 
 	return resp, nil
 }
-
-// ParsePrometheusMetrics parses Prometheus metrics format into structured data
-func ParsePrometheusMetrics(metricsText string) (*PrometheusMetrics, error) {
-	pm := &PrometheusMetrics{
-		ResponseSizes:    make(map[string]float64),
-		RequestDurations: make(map[string]float64),
-		RequestsByCode:   make(map[string]float64),
-		RequestsByHost:   make(map[string]float64),
-	}
-
-	lines := strings.Split(metricsText, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		// Parse metric line: metric_name{labels} value
-		parts := strings.SplitN(line, " ", 2)
-		if len(parts) != 2 {
-			continue
-		}
-
-		metricName := parts[0]
-		valueStr := parts[1]
-
-		var value float64
-		if _, err := fmt.Sscanf(valueStr, "%f", &value); err != nil {
-			continue
-		}
-
-		switch {
-		case strings.HasSuffix(metricName, "_total") && strings.Contains(metricName, "requests"):
-			pm.RequestsTotal = value
-			// Try to extract labels
-			if strings.Contains(metricName, "code=") {
-				code := extractLabel(metricName, "code")
-				pm.RequestsByCode[code] = value
-			}
-			if strings.Contains(metricName, "host=") {
-				host := extractLabel(metricName, "host")
-				pm.RequestsByHost[host] = value
-			}
-		case strings.Contains(metricName, "response_size"):
-			pm.ResponseSizes["total"] = value
-		case strings.Contains(metricName, "request_duration"):
-			pm.RequestDurations["total"] = value
-		}
-	}
-
-	return pm, nil
-}
-
-// extractLabel extracts a label value from a metric name
-func extractLabel(metricName, label string) string {
-	pattern := label + "=\""
-	start := strings.Index(metricName, pattern)
-	if start == -1 {
-		return ""
-	}
-	start += len(pattern)
-	end := strings.Index(metricName[start:], "\"")
-	if end == -1 {
-		return ""
-	}
-	return metricName[start : start+end]
-}
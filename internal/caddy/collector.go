@@ -0,0 +1,283 @@
+package caddy
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CollectorOptions configures the background metrics collector
+type CollectorOptions struct {
+	Interval  time.Duration // Time between scrapes of each instance
+	Timeout   time.Duration // Per-instance scrape timeout
+	Workers   int           // Maximum concurrent scrapes
+	Retention time.Duration // Age after which raw samples are removed (0 keeps them); rollups follow the store's RetentionPolicy
+}
+
+// CollectorStatus reports the scrape health of one instance
+type CollectorStatus struct {
+	InstanceID       string    `json:"instance_id"`
+	LastScrape       time.Time `json:"last_scrape,omitempty"`
+	LastSuccess      time.Time `json:"last_success,omitempty"`
+	LastError        string    `json:"last_error,omitempty"`
+	ScrapeDurationMs float64   `json:"scrape_duration_ms"`
+	Failures         int       `json:"consecutive_failures"`
+	Scraping         bool      `json:"scraping"`
+}
+
+// Collector periodically scrapes every registered instance and stores the
+// results in the analytics store
+type Collector struct {
+	configSvc *ConfigService
+	store     *AnalyticsStore
+	opts      CollectorOptions
+
+	mu     sync.RWMutex
+	status map[string]*CollectorStatus
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCollector creates a collector; call Start to begin scraping
+func NewCollector(configSvc *ConfigService, store *AnalyticsStore, opts CollectorOptions) *Collector {
+	if opts.Interval <= 0 {
+		opts.Interval = 60 * time.Second
+	}
+	if opts.Timeout <= 0 || opts.Timeout > opts.Interval {
+		opts.Timeout = min(10*time.Second, opts.Interval)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+
+	return &Collector{
+		configSvc: configSvc,
+		store:     store,
+		opts:      opts,
+		status:    make(map[string]*CollectorStatus),
+	}
+}
+
+// Start launches the scheduler, worker pool and retention loop
+func (c *Collector) Start(ctx context.Context) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	jobs := make(chan string)
+
+	for i := 0; i < c.opts.Workers; i++ {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for id := range jobs {
+				c.scrape(id)
+			}
+		}()
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(jobs)
+		c.schedule(ctx, jobs)
+	}()
+
+	if c.store != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.enforceRetention(ctx)
+		}()
+	}
+}
+
+// Stop cancels scheduling and waits for in-flight scrapes to finish
+func (c *Collector) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wg.Wait()
+}
+
+// Status returns the scrape status of every known instance
+func (c *Collector) Status() []CollectorStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	result := make([]CollectorStatus, 0, len(c.status))
+	for _, st := range c.status {
+		result = append(result, *st)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].InstanceID < result[j].InstanceID })
+	return result
+}
+
+// InstanceStatus returns the scrape status of one instance
+func (c *Collector) InstanceStatus(instanceID string) (CollectorStatus, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	st, ok := c.status[instanceID]
+	if !ok {
+		return CollectorStatus{}, false
+	}
+	return *st, true
+}
+
+// schedule dispatches every instance once per interval. Each round is
+// spread over a random offset of up to a fifth of the interval so scrapes
+// of many instances don't all start on the same tick.
+func (c *Collector) schedule(ctx context.Context, jobs chan<- string) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.dispatchRound(ctx, jobs)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Collector) dispatchRound(ctx context.Context, jobs chan<- string) {
+	instances := c.configSvc.instanceService.List()
+	c.forgetRemoved(instances)
+
+	type job struct {
+		id     string
+		offset time.Duration
+	}
+	jitter := int64(c.opts.Interval / 5)
+	round := make([]job, 0, len(instances))
+	for _, inst := range instances {
+		var offset time.Duration
+		if jitter > 0 {
+			offset = time.Duration(rand.Int63n(jitter))
+		}
+		round = append(round, job{id: inst.ID, offset: offset})
+	}
+	sort.Slice(round, func(i, j int) bool { return round[i].offset < round[j].offset })
+
+	start := time.Now()
+	for _, j := range round {
+		if wait := j.offset - time.Since(start); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		// Skip instances whose previous scrape is still running
+		if !c.markScraping(j.id) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			c.clearScraping(j.id)
+			return
+		case jobs <- j.id:
+		}
+	}
+}
+
+func (c *Collector) scrape(instanceID string) {
+	started := time.Now()
+	_, err := c.configSvc.collectMetrics(instanceID, c.opts.Timeout)
+	elapsed := time.Since(started)
+
+	c.mu.Lock()
+	st := c.status[instanceID]
+	wasFailing := st.Failures > 0
+	st.Scraping = false
+	st.LastScrape = started
+	st.ScrapeDurationMs = float64(elapsed) / float64(time.Millisecond)
+	if err != nil {
+		st.LastError = err.Error()
+		st.Failures++
+	} else {
+		st.LastError = ""
+		st.LastSuccess = started
+		st.Failures = 0
+	}
+	c.mu.Unlock()
+
+	// Reflect reachability in the instance status when it changes
+	inst, getErr := c.configSvc.instanceService.Get(instanceID)
+	if getErr != nil {
+		return
+	}
+	switch {
+	case err != nil && inst.Status != StatusOffline:
+		if !wasFailing {
+			log.Printf("Collector: scrape of %s failed: %v", inst.Name, err)
+		}
+		c.configSvc.instanceService.store.UpdateStatus(instanceID, StatusOffline)
+	case err == nil && inst.Status != StatusOnline:
+		c.configSvc.instanceService.store.UpdateStatus(instanceID, StatusOnline)
+	}
+}
+
+func (c *Collector) markScraping(instanceID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, ok := c.status[instanceID]
+	if !ok {
+		st = &CollectorStatus{InstanceID: instanceID}
+		c.status[instanceID] = st
+	}
+	if st.Scraping {
+		return false
+	}
+	st.Scraping = true
+	return true
+}
+
+func (c *Collector) clearScraping(instanceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if st, ok := c.status[instanceID]; ok {
+		st.Scraping = false
+	}
+}
+
+func (c *Collector) forgetRemoved(instances []*CaddyInstance) {
+	known := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		known[inst.ID] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, st := range c.status {
+		if !known[id] && !st.Scraping {
+			delete(c.status, id)
+		}
+	}
+}
+
+// enforceRetention removes expired samples on start and then hourly
+func (c *Collector) enforceRetention(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := c.store.CleanupOldMetrics(c.opts.Retention); err != nil {
+			log.Printf("Collector: metrics cleanup failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
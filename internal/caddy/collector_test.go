@@ -0,0 +1,191 @@
+package caddy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewCollectorDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CollectorOptions
+		want CollectorOptions
+	}{
+		{name: "zero", want: CollectorOptions{Interval: time.Minute, Timeout: 10 * time.Second, Workers: 4}},
+		{name: "short interval caps the timeout", opts: CollectorOptions{Interval: 5 * time.Second},
+			want: CollectorOptions{Interval: 5 * time.Second, Timeout: 5 * time.Second, Workers: 4}},
+		{name: "timeout longer than the interval", opts: CollectorOptions{Interval: 30 * time.Second, Timeout: time.Minute, Workers: 2},
+			want: CollectorOptions{Interval: 30 * time.Second, Timeout: 10 * time.Second, Workers: 2}},
+		{name: "kept", opts: CollectorOptions{Interval: time.Hour, Timeout: 3 * time.Second, Workers: 8, Retention: 24 * time.Hour},
+			want: CollectorOptions{Interval: time.Hour, Timeout: 3 * time.Second, Workers: 8, Retention: 24 * time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewCollector(nil, nil, tt.opts).opts; got != tt.want {
+				t.Errorf("options %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestCollector returns a collector over a fresh instance store and
+// analytics store
+func newTestCollector(t *testing.T, opts CollectorOptions) (*Collector, *InstanceService, *AnalyticsStore) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := NewInstanceStore(filepath.Join(dir, "instances.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	analytics, err := NewAnalyticsStore(filepath.Join(dir, "metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { analytics.Close() })
+	instances := NewInstanceService(store)
+	return NewCollector(NewConfigService(instances, analytics), analytics, opts), instances, analytics
+}
+
+func TestCollectorScrapes(t *testing.T) {
+	var healthyScrapes atomic.Int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyScrapes.Add(1)
+		w.Write([]byte(caddyMetricsSample))
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	c, instances, analytics := newTestCollector(t, CollectorOptions{Interval: 20 * time.Millisecond, Timeout: time.Second, Workers: 2})
+	up, err := instances.Create(&InstanceRequest{Name: "up", URL: healthy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := instances.Create(&InstanceRequest{Name: "down", URL: broken.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Start(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		upStatus, _ := c.InstanceStatus(up.ID)
+		downStatus, _ := c.InstanceStatus(down.ID)
+		if healthyScrapes.Load() >= 3 && downStatus.Failures >= 3 && !upStatus.LastSuccess.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Stop()
+			t.Fatalf("scrapes didn't happen: %d healthy, status %+v and %+v", healthyScrapes.Load(), upStatus, downStatus)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Stop()
+
+	statuses := c.Status()
+	if len(statuses) != 2 || statuses[0].InstanceID > statuses[1].InstanceID {
+		t.Fatalf("status %+v, want both instances sorted by ID", statuses)
+	}
+	upStatus, _ := c.InstanceStatus(up.ID)
+	if upStatus.Failures != 0 || upStatus.LastError != "" || upStatus.Scraping {
+		t.Errorf("healthy instance: %+v", upStatus)
+	}
+	downStatus, _ := c.InstanceStatus(down.ID)
+	if downStatus.LastError == "" || !downStatus.LastSuccess.IsZero() || downStatus.Scraping {
+		t.Errorf("failing instance: %+v", downStatus)
+	}
+
+	// Reachability is reflected in the instance status
+	for id, want := range map[string]InstanceStatus{up.ID: StatusOnline, down.ID: StatusOffline} {
+		inst, err := instances.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst.Status != want {
+			t.Errorf("instance %s is %s, want %s", inst.Name, inst.Status, want)
+		}
+	}
+
+	// Scraped metrics are stored
+	latest, err := analytics.GetLatestMetrics(up.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.NumRequests != 12 {
+		t.Errorf("latest stored metrics %+v, want 12 requests", latest)
+	}
+}
+
+func TestCollectorStop(t *testing.T) {
+	release := make(chan struct{})
+	var scrapes atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapes.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	c, instances, _ := newTestCollector(t, CollectorOptions{Interval: 10 * time.Millisecond, Timeout: 10 * time.Millisecond, Workers: 1})
+	if _, err := instances.Create(&InstanceRequest{Name: "slow", URL: slow.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Start(ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector didn't stop after its context was cancelled")
+	}
+	if scrapes.Load() == 0 {
+		t.Error("instance was never scraped")
+	}
+}
+
+func TestCollectorSkipsRunningScrapes(t *testing.T) {
+	c := NewCollector(nil, nil, CollectorOptions{})
+
+	if !c.markScraping("a") {
+		t.Fatal("first scrape of a wasn't started")
+	}
+	if c.markScraping("a") {
+		t.Error("second scrape of a started while the first runs")
+	}
+	if !c.markScraping("b") {
+		t.Error("scrape of b blocked by a")
+	}
+
+	// Removed instances are forgotten, except while they are scraped
+	c.clearScraping("b")
+	c.forgetRemoved(nil)
+	if _, ok := c.InstanceStatus("a"); !ok {
+		t.Error("instance a forgotten during its scrape")
+	}
+	if _, ok := c.InstanceStatus("b"); ok {
+		t.Error("removed instance b still has a status")
+	}
+
+	c.clearScraping("a")
+	if !c.markScraping("a") {
+		t.Error("a can't be scraped again after its scrape finished")
+	}
+}
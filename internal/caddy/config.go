@@ -1,17 +1,25 @@
 package caddy
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"time"
 )
 
+// ErrHistoryDisabled is returned by the config history methods when no
+// history has been set
+var ErrHistoryDisabled = errors.New("config history not enabled")
+
 // ConfigService provides configuration management operations
 type ConfigService struct {
 	instanceService *InstanceService
 	metricsStore    *AnalyticsStore
+	logSink         *LogSink
+	history         *ConfigHistory
+	templates       *SiteTemplates
 }
 
 // NewConfigService creates a new config service
@@ -22,6 +30,16 @@ func NewConfigService(instanceService *InstanceService, metricsStore *AnalyticsS
 	}
 }
 
+// SetLogSink sets the sink that collects instance logs
+func (s *ConfigService) SetLogSink(sink *LogSink) {
+	s.logSink = sink
+}
+
+// SetHistory enables config snapshots around every change
+func (s *ConfigService) SetHistory(history *ConfigHistory) {
+	s.history = history
+}
+
 // GetConfig retrieves the current configuration from an instance
 func (s *ConfigService) GetConfig(instanceID string) (*Config, error) {
 	inst, err := s.instanceService.Get(instanceID)
@@ -38,87 +56,181 @@ func (s *ConfigService) GetConfig(instanceID string) (*Config, error) {
 }
 
 // ReloadConfig reloads configuration on an instance
-func (s *ConfigService) ReloadConfig(instanceID string, configJSON []byte) error {
+func (s *ConfigService) ReloadConfig(instanceID string, configJSON []byte, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeReload, change, 30*time.Second, func(client *Client) error {
+		return client.ReloadConfig(configJSON)
+	})
+}
+
+// applyChange runs op against an instance and, with a history set, records
+// the instance's config before and after it. Failing to record the history
+// is logged but doesn't fail the change.
+func (s *ConfigService) applyChange(instanceID, action string, change ConfigChange, timeout time.Duration, op func(*Client) error) error {
 	inst, err := s.instanceService.Get(instanceID)
 	if err != nil {
 		return err
 	}
 
-	client, err := NewClientFromInstance(inst, 30*time.Second)
+	client, err := NewClientFromInstance(inst, timeout)
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
 
-	return client.ReloadConfig(configJSON)
+	var before []byte
+	if s.history != nil {
+		if before, err = client.GetRawConfig(); err != nil {
+			log.Printf("Warning: could not snapshot config of %s before %s: %v", instanceID, action, err)
+		}
+	}
+
+	if err := op(client); err != nil {
+		return err
+	}
+
+	if s.history != nil {
+		after, err := client.GetRawConfig()
+		if err != nil {
+			log.Printf("Warning: could not snapshot config of %s after %s: %v", instanceID, action, err)
+			return nil
+		}
+		if _, err := s.history.Record(instanceID, action, change, before, after); err != nil {
+			log.Printf("Warning: could not record config history of %s: %v", instanceID, err)
+		}
+	}
+	return nil
 }
 
-// GetCaddyfile returns the configuration as a Caddyfile format
-func (s *ConfigService) GetCaddyfile(instanceID string) (string, error) {
-	config, err := s.GetConfig(instanceID)
+// ConfigVersions returns the saved config versions of an instance, newest first
+func (s *ConfigService) ConfigVersions(instanceID string) ([]*ConfigVersion, error) {
+	if err := s.checkHistory(instanceID); err != nil {
+		return nil, err
+	}
+	return s.history.List(instanceID)
+}
+
+// ConfigVersion returns one saved config version of an instance, including the config
+func (s *ConfigService) ConfigVersion(instanceID string, version int) (*ConfigVersion, error) {
+	if err := s.checkHistory(instanceID); err != nil {
+		return nil, err
+	}
+	return s.history.Get(instanceID, version)
+}
+
+// DiffConfigVersions compares two saved config versions of an instance
+func (s *ConfigService) DiffConfigVersions(instanceID string, from, to int) (*ConfigDiff, error) {
+	if err := s.checkHistory(instanceID); err != nil {
+		return nil, err
+	}
+	return s.history.Diff(instanceID, from, to)
+}
+
+// RollbackConfig loads a saved config version back onto an instance. The
+// rollback is itself recorded as a new version.
+func (s *ConfigService) RollbackConfig(instanceID string, version int, change ConfigChange) error {
+	v, err := s.ConfigVersion(instanceID, version)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if change.Message == "" {
+		change.Message = fmt.Sprintf("Roll back to version %d", v.Version)
 	}
 
-	// Convert JSON config to Caddyfile format
-	// This is a simplified version - a full implementation would use Caddy's JSON-to-Caddyfile conversion
-	return convertConfigToCaddyfile(config), nil
+	return s.applyChange(instanceID, ChangeRollback, change, 30*time.Second, func(client *Client) error {
+		return client.ReloadConfig(v.Config)
+	})
 }
 
-// UpdateCaddyfile parses and applies a Caddyfile
-func (s *ConfigService) UpdateCaddyfile(instanceID string, caddyfile string) error {
-	// Parse Caddyfile using Caddy's adapter
-	// For now, we expect the Caddyfile to be converted to JSON externally
-	// In a full implementation, we'd use caddy.Module.IDToPath etc.
-	return fmt.Errorf("Caddyfile parsing not implemented - please provide JSON config")
+// checkHistory verifies that history is enabled and the instance exists
+func (s *ConfigService) checkHistory(instanceID string) error {
+	if s.history == nil {
+		return ErrHistoryDisabled
+	}
+	_, err := s.instanceService.Get(instanceID)
+	return err
 }
 
-// GetSites returns all sites configured on an instance
-func (s *ConfigService) GetSites(instanceID string) ([]Site, error) {
+// GetCaddyfile returns the configuration rendered as a Caddyfile
+func (s *ConfigService) GetCaddyfile(instanceID string) (string, error) {
 	inst, err := s.instanceService.Get(instanceID)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	client, err := NewClientFromInstance(inst, 10*time.Second)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create client: %w", err)
+		return "", fmt.Errorf("failed to create client: %w", err)
 	}
 
-	return client.GetSites()
+	// The raw config keeps sections Config doesn't model, so they can at
+	// least be noted in the output
+	config, err := client.GetRawConfig()
+	if err != nil {
+		return "", err
+	}
+	return RenderCaddyfile(config)
 }
 
-// CreateSite creates or updates a site
-func (s *ConfigService) CreateSite(instanceID string, siteName string, config map[string]interface{}) error {
+// AdaptCaddyfile converts a Caddyfile to JSON config using the instance's
+// Caddyfile adapter, without applying it
+func (s *ConfigService) AdaptCaddyfile(instanceID string, caddyfile []byte) (*AdaptResult, error) {
 	inst, err := s.instanceService.Get(instanceID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	client, err := NewClientFromInstance(inst, 10*time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to create client: %w", err)
+		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
-	return client.CreateSite(siteName, config)
+	return client.Adapt(caddyfile)
 }
 
-// DeleteSite removes a site
-func (s *ConfigService) DeleteSite(instanceID string, siteName string) error {
+// UpdateCaddyfile adapts a Caddyfile to JSON and loads the result, returning
+// the adapter's output and warnings
+func (s *ConfigService) UpdateCaddyfile(instanceID string, caddyfile []byte, change ConfigChange) (*AdaptResult, error) {
+	result, err := s.AdaptCaddyfile(instanceID, caddyfile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ReloadConfig(instanceID, result.Config, change); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// GetSites returns all sites configured on an instance
+func (s *ConfigService) GetSites(instanceID string) ([]Site, error) {
 	inst, err := s.instanceService.Get(instanceID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	client, err := NewClientFromInstance(inst, 10*time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to create client: %w", err)
+		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
-	return client.DeleteSite(siteName)
+	return client.GetSites()
 }
 
-// GetLogs retrieves logs from an instance
-func (s *ConfigService) GetLogs(instanceID string, tailLines int) ([]LogEntry, error) {
+// CreateSite creates or updates a site
+func (s *ConfigService) CreateSite(instanceID string, siteName string, config map[string]interface{}, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeCreateSite, change, 10*time.Second, func(client *Client) error {
+		return client.CreateSite(siteName, config)
+	})
+}
+
+// DeleteSite removes a site
+func (s *ConfigService) DeleteSite(instanceID string, siteName string, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeDeleteSite, change, 10*time.Second, func(client *Client) error {
+		return client.DeleteSite(siteName)
+	})
+}
+
+// GetLogs retrieves the newest logs at or above minLevel from an instance
+func (s *ConfigService) GetLogs(instanceID string, tailLines int, minLevel string) ([]LogEntry, error) {
 	inst, err := s.instanceService.Get(instanceID)
 	if err != nil {
 		return nil, err
@@ -129,17 +241,39 @@ func (s *ConfigService) GetLogs(instanceID string, tailLines int) ([]LogEntry, e
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
 
-	return client.GetLogs(tailLines)
+	if s.logSink != nil {
+		client.UseLogBuffer(s.logSink.Buffer(instanceID))
+	}
+
+	return client.GetLogs(tailLines, minLevel)
+}
+
+// FollowLogs subscribes to new log entries from an instance
+func (s *ConfigService) FollowLogs(instanceID string) (<-chan LogEntry, func(), error) {
+	if _, err := s.instanceService.Get(instanceID); err != nil {
+		return nil, nil, err
+	}
+	if s.logSink == nil {
+		return nil, nil, fmt.Errorf("log sink not running")
+	}
+
+	ch, cancel := s.logSink.Buffer(instanceID).Subscribe()
+	return ch, cancel, nil
 }
 
 // CollectMetrics collects and stores metrics from an instance
 func (s *ConfigService) CollectMetrics(instanceID string) (*InstanceMetrics, error) {
+	return s.collectMetrics(instanceID, 10*time.Second)
+}
+
+// collectMetrics scrapes an instance with the given request timeout
+func (s *ConfigService) collectMetrics(instanceID string, timeout time.Duration) (*InstanceMetrics, error) {
 	inst, err := s.instanceService.Get(instanceID)
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := NewClientFromInstance(inst, 10*time.Second)
+	client, err := NewClientFromInstance(inst, timeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client: %w", err)
 	}
@@ -152,53 +286,21 @@ func (s *ConfigService) CollectMetrics(instanceID string) (*InstanceMetrics, err
 
 	pm, err := ParsePrometheusMetrics(metricsText)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to parse metrics: %w", err)
 	}
 
-	metrics := &InstanceMetrics{
-		InstanceID:   instanceID,
-		Timestamp:    time.Now(),
-		Uptime:       0, // Would need to calculate from server info
-		NumRequests:  int64(pm.RequestsTotal),
-		TotalTraffic: 0, // Would need to calculate from response size metrics
-		StatusCodes:  make(map[int]int64),
-	}
-
-	// Convert status codes
-	for codeStr, count := range pm.RequestsByCode {
-		var code int
-		fmt.Sscanf(codeStr, "%d", &code)
-		metrics.StatusCodes[code] = int64(count)
-	}
+	metrics := NewInstanceMetrics(instanceID, pm, time.Now())
 
 	// Store metrics if store is available
 	if s.metricsStore != nil {
-		s.metricsStore.SaveMetrics(instanceID, metrics)
+		if err := s.metricsStore.SaveMetrics(instanceID, metrics); err != nil {
+			return metrics, fmt.Errorf("failed to save metrics: %w", err)
+		}
 	}
 
 	return metrics, nil
 }
 
-// convertConfigToCaddyfile converts JSON config to Caddyfile format
-func convertConfigToCaddyfile(config *Config) string {
-	var buf bytes.Buffer
-
-	// Add global options
-	buf.WriteString("{\n")
-	buf.WriteString("    admin off\n")
-	if config.Admin != nil {
-		buf.WriteString(fmt.Sprintf("    admin %s\n", config.Admin.Listen))
-	}
-	buf.WriteString("}\n\n")
-
-	// This is a simplified conversion - a full implementation would properly
-	// convert all JSON config options to their Caddyfile equivalents
-	buf.WriteString("# Configuration converted from JSON\n")
-	buf.WriteString("# See https://caddyserver.com/docs/ for full documentation\n")
-
-	return buf.String()
-}
-
 // StopServer stops a Caddy server
 func (s *ConfigService) StopServer(instanceID string) error {
 	inst, err := s.instanceService.Get(instanceID)
@@ -255,11 +357,11 @@ func (s *ConfigService) ExportConfig(instanceID string) (string, error) {
 }
 
 // ImportConfig imports configuration from JSON
-func (s *ConfigService) ImportConfig(instanceID string, configJSON io.Reader) error {
+func (s *ConfigService) ImportConfig(instanceID string, configJSON io.Reader, change ConfigChange) error {
 	data, err := io.ReadAll(configJSON)
 	if err != nil {
 		return fmt.Errorf("failed to read config: %w", err)
 	}
 
-	return s.ReloadConfig(instanceID, data)
+	return s.ReloadConfig(instanceID, data, change)
 }
@@ -0,0 +1,152 @@
+package caddy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAdapter serves /adapt like Caddy's Caddyfile adapter, failing on
+// Caddyfiles with a "bogus" directive on line 3 or containing "crash", and
+// records the configs posted to /load, rejecting ones containing "reject"
+type fakeAdapter struct {
+	mu     sync.Mutex
+	loaded []string
+}
+
+func (a *fakeAdapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	switch r.URL.Path {
+	case "/adapt":
+		if r.Header.Get("Content-Type") != "text/caddyfile" {
+			http.Error(w, `{"error":"unexpected content type"}`, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case strings.Contains(string(body), "bogus"):
+			http.Error(w, `{"error":"Caddyfile:3 - Error during parsing: unrecognized directive: bogus"}`, http.StatusBadRequest)
+		case strings.Contains(string(body), "crash"):
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		case strings.Contains(string(body), "header"):
+			w.Write([]byte(`{"result":{"apps":{"http":{}}},"warnings":[{"file":"Caddyfile","line":2,"directive":"header","message":"deprecated"}]}`))
+		default:
+			w.Write([]byte(`{"result":{"apps":{"http":{}},"note":"` + strings.TrimSpace(string(body)) + `"}}`))
+		}
+	case "/load":
+		if strings.Contains(string(body), "reject") {
+			http.Error(w, `{"error":"loading rejected"}`, http.StatusBadRequest)
+			return
+		}
+		a.mu.Lock()
+		a.loaded = append(a.loaded, string(body))
+		a.mu.Unlock()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestAdaptCaddyfile(t *testing.T) {
+	adapter := &fakeAdapter{}
+	s, inst := newTestConfigService(t, adapter)
+
+	tests := []struct {
+		name      string
+		caddyfile string
+		config    string
+		warnings  []AdaptWarning
+		errLine   int  // Line of the expected AdaptError
+		err       bool // Any other error
+	}{
+		{
+			name:      "adapted",
+			caddyfile: "example.com",
+			config:    `{"apps":{"http":{}},"note":"example.com"}`,
+			warnings:  []AdaptWarning{},
+		},
+		{
+			name:      "warnings",
+			caddyfile: "example.com {\n\theader X-Test 1\n}",
+			config:    `{"apps":{"http":{}}}`,
+			warnings:  []AdaptWarning{{File: "Caddyfile", Line: 2, Directive: "header", Message: "deprecated"}},
+		},
+		{name: "syntax error", caddyfile: "example.com {\n\n\tbogus\n}", errLine: 3},
+		{name: "adapter failure", caddyfile: "crash", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.AdaptCaddyfile(inst.ID, []byte(tt.caddyfile))
+			var adaptErr *AdaptError
+			switch {
+			case tt.errLine > 0:
+				if !errors.As(err, &adaptErr) || adaptErr.Line != tt.errLine {
+					t.Fatalf("got %v, want an adapt error on line %d", err, tt.errLine)
+				}
+				return
+			case tt.err:
+				if err == nil || errors.As(err, &adaptErr) {
+					t.Fatalf("got %v, want a request error", err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			if string(result.Config) != tt.config {
+				t.Errorf("config %s, want %s", result.Config, tt.config)
+			}
+			if result.Warnings == nil || len(result.Warnings) != len(tt.warnings) {
+				t.Fatalf("warnings %#v, want %v", result.Warnings, tt.warnings)
+			}
+			for i := range tt.warnings {
+				if result.Warnings[i] != tt.warnings[i] {
+					t.Errorf("warning %d: %+v, want %+v", i, result.Warnings[i], tt.warnings[i])
+				}
+			}
+		})
+	}
+
+	if len(adapter.loaded) != 0 {
+		t.Errorf("adapting loaded %d configs", len(adapter.loaded))
+	}
+}
+
+func TestUpdateCaddyfile(t *testing.T) {
+	tests := []struct {
+		name      string
+		caddyfile string
+		loaded    []string
+		result    bool // A result is returned along with any error
+		err       bool
+	}{
+		{name: "loaded", caddyfile: "example.com", loaded: []string{`{"apps":{"http":{}},"note":"example.com"}`}, result: true},
+		{name: "not adapted", caddyfile: "example.com {\n\n\tbogus\n}", err: true},
+		{name: "load rejected", caddyfile: "reject.example.com", result: true, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &fakeAdapter{}
+			s, inst := newTestConfigService(t, adapter)
+
+			result, err := s.UpdateCaddyfile(inst.ID, []byte(tt.caddyfile), ConfigChange{Author: "admin"})
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if (result != nil) != tt.result {
+				t.Errorf("got result %v, want result %v", result != nil, tt.result)
+			}
+			if len(adapter.loaded) != len(tt.loaded) {
+				t.Fatalf("loaded %q, want %q", adapter.loaded, tt.loaded)
+			}
+			for i := range tt.loaded {
+				if adapter.loaded[i] != tt.loaded[i] {
+					t.Errorf("loaded %s, want %s", adapter.loaded[i], tt.loaded[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package caddy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrConfigConflict is returned when a change carried the ETag of an earlier
+// read and the config at that path has changed since
+var ErrConfigConflict = errors.New("config was changed by someone else since it was read")
+
+// PathError is a request on a config path that the admin API rejected
+type PathError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *PathError) Error() string {
+	if e.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Sprintf("%s %s: %v", e.Method, e.Path, ErrConfigConflict)
+	}
+	return fmt.Sprintf("%s %s failed: %s", e.Method, e.Path, e.Message)
+}
+
+// Unwrap makes a failed If-Match precondition match ErrConfigConflict
+func (e *PathError) Unwrap() error {
+	if e.StatusCode == http.StatusPreconditionFailed {
+		return ErrConfigConflict
+	}
+	return nil
+}
+
+// configPathURL returns the admin API URL of a config path. A path starting
+// with @ addresses an object by its @id, e.g. "@api/upstreams"; any other
+// path is relative to the config root, e.g. "apps/http/servers/srv0".
+func (c *Client) configPathURL(path string) (string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return c.baseURL + "/config/", nil
+	}
+
+	segments := strings.Split(path, "/")
+	id := ""
+	if strings.HasPrefix(segments[0], "@") {
+		id = strings.TrimPrefix(segments[0], "@")
+		if id == "" {
+			return "", fmt.Errorf("invalid config path %q", path)
+		}
+		segments[0] = id
+	}
+	for i, seg := range segments {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("invalid config path %q", path)
+		}
+		segments[i] = url.PathEscape(seg)
+	}
+
+	if id != "" {
+		return c.baseURL + "/id/" + strings.Join(segments, "/"), nil
+	}
+	return c.baseURL + "/config/" + strings.Join(segments, "/"), nil
+}
+
+// GetPath returns the JSON value at a config path and its ETag. Later changes
+// to the same path through this client send the ETag as If-Match.
+func (c *Client) GetPath(path string) ([]byte, string, error) {
+	value, etag, err := c.readPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	c.mu.Lock()
+	c.etags[strings.Trim(path, "/")] = etag
+	c.mu.Unlock()
+
+	return value, etag, nil
+}
+
+// readPath returns the JSON value at a config path and its ETag without
+// remembering the ETag
+func (c *Client) readPath(path string) ([]byte, string, error) {
+	target, err := c.configPathURL(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := c.doRequest(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &PathError{Method: "GET", Path: path, StatusCode: resp.StatusCode, Message: apiErrorMessage(body)}
+	}
+
+	return bytes.TrimSpace(body), resp.Header.Get("ETag"), nil
+}
+
+// SetPath sets the value at a config path, creating it or replacing what is
+// there. An array at the path is replaced as a whole; AppendPath and
+// InsertAt add to one. An empty etag sends the ETag of this client's last
+// read of the path, if any.
+func (c *Client) SetPath(path string, value []byte, etag string) error {
+	// The admin API's POST appends to arrays and PUT refuses existing keys,
+	// so an existing value is replaced with PATCH and a missing one created
+	// with PUT. Reading a missing key of an existing object returns null.
+	method := "PUT"
+	if current, _, err := c.readPath(path); err == nil && string(current) != "null" {
+		method = "PATCH"
+	}
+	return c.changePath(method, path, path, value, etag)
+}
+
+// PatchPath replaces the existing value at a config path; it fails if there
+// is none
+func (c *Client) PatchPath(path string, value []byte, etag string) error {
+	return c.changePath("PATCH", path, path, value, etag)
+}
+
+// AppendPath appends a value to the array at a config path
+func (c *Client) AppendPath(path string, value []byte, etag string) error {
+	// The /... suffix appends each element of an array body, so wrapping the
+	// value in one fails cleanly if path isn't an array
+	body := append(append([]byte("["), bytes.TrimSpace(value)...), ']')
+	return c.changePath("POST", path, strings.TrimRight(path, "/")+"/...", body, etag)
+}
+
+// InsertAt inserts a value into the array at a config path before index
+func (c *Client) InsertAt(path string, index int, value []byte, etag string) error {
+	if index < 0 {
+		return fmt.Errorf("invalid array index %d", index)
+	}
+	return c.changePath("PUT", path, strings.TrimRight(path, "/")+"/"+strconv.Itoa(index), value, etag)
+}
+
+// DeletePath removes the value at a config path
+func (c *Client) DeletePath(path string, etag string) error {
+	return c.changePath("DELETE", path, path, nil, etag)
+}
+
+// changePath sends a change to target, guarded by the ETag read for path
+func (c *Client) changePath(method, path, target string, value []byte, etag string) error {
+	key := strings.Trim(path, "/")
+	if etag == "" {
+		c.mu.Lock()
+		etag = c.etags[key]
+		c.mu.Unlock()
+	}
+
+	u, err := c.configPathURL(target)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if value != nil {
+		body = bytes.NewReader(value)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return &PathError{Method: method, Path: path, StatusCode: resp.StatusCode, Message: apiErrorMessage(respBody)}
+	}
+
+	// The change made ETags read above or below the path stale
+	c.mu.Lock()
+	for read := range c.etags {
+		if read == key || key == "" || read == "" || strings.HasPrefix(read, key+"/") || strings.HasPrefix(key, read+"/") {
+			delete(c.etags, read)
+		}
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// GetConfigPath returns the JSON value at a config path of an instance and
+// its ETag
+func (s *ConfigService) GetConfigPath(instanceID, path string) ([]byte, string, error) {
+	inst, err := s.instanceService.Get(instanceID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := NewClientFromInstance(inst, 10*time.Second)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create client: %w", err)
+	}
+
+	return client.GetPath(path)
+}
+
+// SetConfigPath sets the value at a config path of an instance. A non-empty
+// etag makes the change fail with ErrConfigConflict if the path has changed
+// since it was read; the same goes for the other path changes.
+func (s *ConfigService) SetConfigPath(instanceID, path string, value []byte, etag string, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeEditPath, change, 10*time.Second, func(client *Client) error {
+		return client.SetPath(path, value, etag)
+	})
+}
+
+// PatchConfigPath replaces the existing value at a config path of an instance
+func (s *ConfigService) PatchConfigPath(instanceID, path string, value []byte, etag string, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeEditPath, change, 10*time.Second, func(client *Client) error {
+		return client.PatchPath(path, value, etag)
+	})
+}
+
+// AppendConfigPath appends a value to the array at a config path of an instance
+func (s *ConfigService) AppendConfigPath(instanceID, path string, value []byte, etag string, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeEditPath, change, 10*time.Second, func(client *Client) error {
+		return client.AppendPath(path, value, etag)
+	})
+}
+
+// InsertConfigPath inserts a value into the array at a config path of an
+// instance before index
+func (s *ConfigService) InsertConfigPath(instanceID, path string, index int, value []byte, etag string, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeEditPath, change, 10*time.Second, func(client *Client) error {
+		return client.InsertAt(path, index, value, etag)
+	})
+}
+
+// DeleteConfigPath removes the value at a config path of an instance
+func (s *ConfigService) DeleteConfigPath(instanceID, path string, etag string, change ConfigChange) error {
+	return s.applyChange(instanceID, ChangeEditPath, change, 10*time.Second, func(client *Client) error {
+		return client.DeletePath(path, etag)
+	})
+}
@@ -0,0 +1,578 @@
+package caddy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAdmin serves the config endpoints of Caddy's admin API from an
+// in-memory config: GET, PUT, PATCH, POST and DELETE on /config/ paths,
+// the same on /id/ paths, and POST /load. Like Caddy, it sends the ETag
+// "<path> <hash of the value>" and rejects changes whose If-Match names a
+// path whose value has changed since.
+type fakeAdmin struct {
+	mu       sync.Mutex
+	config   any
+	requests []string // Method, path and If-Match of every change
+}
+
+// newFakeAdmin returns a fake admin API serving config, and its URL
+func newFakeAdmin(t *testing.T, config string) (*fakeAdmin, string) {
+	t.Helper()
+	a := &fakeAdmin{}
+	if err := json.Unmarshal([]byte(config), &a.config); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(a)
+	t.Cleanup(srv.Close)
+	return a, srv.URL
+}
+
+// get returns the JSON value at a config path of the fake
+func (a *fakeAdmin) get(t *testing.T, path string) string {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	v, _ := jsonValueAt(a.config, splitConfigPath(path))
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// set replaces the config of the fake, as a change by someone else
+func (a *fakeAdmin) set(t *testing.T, config string) {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := json.Unmarshal([]byte(config), &a.config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (a *fakeAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fail := func(status int, format string, args ...any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf(format, args...)})
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var value any
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &value); err != nil {
+			fail(http.StatusBadRequest, "decoding request body: %v", err)
+			return
+		}
+	}
+
+	if r.URL.Path == "/load" && r.Method == http.MethodPost {
+		a.requests = append(a.requests, "POST /load")
+		a.config = value
+		return
+	}
+
+	var segs []string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/config/"):
+		segs = splitConfigPath(strings.TrimPrefix(r.URL.Path, "/config/"))
+	case strings.HasPrefix(r.URL.Path, "/id/"):
+		rest := splitConfigPath(strings.TrimPrefix(r.URL.Path, "/id/"))
+		idPath, ok := findConfigID(a.config, rest[0], nil)
+		if !ok {
+			fail(http.StatusNotFound, "unknown object ID '%s'", rest[0])
+			return
+		}
+		segs = append(idPath, rest[1:]...)
+	default:
+		fail(http.StatusNotFound, "not found")
+		return
+	}
+	path := "/config/" + strings.Join(segs, "/")
+
+	if r.Method == http.MethodGet {
+		cur, _ := jsonValueAt(a.config, segs)
+		data, _ := json.Marshal(cur)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", fakeETag(path, cur))
+		w.Write(data)
+		return
+	}
+
+	a.requests = append(a.requests, strings.TrimSpace(r.Method+" "+path+" "+r.Header.Get("If-Match")))
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		parts := strings.Fields(strings.Trim(ifMatch, `"`))
+		if len(parts) != 2 {
+			fail(http.StatusBadRequest, "malformed If-Match header")
+			return
+		}
+		cur, _ := jsonValueAt(a.config, splitConfigPath(strings.TrimPrefix(parts[0], "/config/")))
+		if fakeETag(parts[0], cur) != ifMatch {
+			fail(http.StatusPreconditionFailed, "If-Match header did not match current config hash")
+			return
+		}
+	}
+
+	_, exists := jsonValueAt(a.config, segs)
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		// PUT inserts into arrays and refuses to replace object keys
+		if len(segs) > 0 {
+			parentPath, last := segs[:len(segs)-1], segs[len(segs)-1]
+			if parent, _ := jsonValueAt(a.config, parentPath); parent != nil {
+				if _, isArray := parent.([]any); isArray {
+					a.config, err = jsonReplaceAt(a.config, parentPath, func(v any) (any, error) {
+						arr := v.([]any)
+						idx, err := strconv.Atoi(last)
+						if err != nil || idx < 0 || idx > len(arr) {
+							return nil, fmt.Errorf("invalid index %q", last)
+						}
+						return slices.Insert(slices.Clone(arr), idx, value), nil
+					})
+					break
+				}
+			}
+		}
+		if exists {
+			fail(http.StatusConflict, "key already exists: %s", path)
+			return
+		}
+		a.config, err = jsonReplaceAt(a.config, segs, func(any) (any, error) { return value, nil })
+	case http.MethodPatch:
+		if !exists {
+			fail(http.StatusNotFound, "key does not exist: %s", path)
+			return
+		}
+		a.config, err = jsonReplaceAt(a.config, segs, func(any) (any, error) { return value, nil })
+	case http.MethodPost:
+		if len(segs) > 0 && segs[len(segs)-1] == "..." {
+			elems, ok := value.([]any)
+			if !ok {
+				fail(http.StatusBadRequest, "body must be an array")
+				return
+			}
+			a.config, err = jsonReplaceAt(a.config, segs[:len(segs)-1], func(v any) (any, error) {
+				arr, ok := v.([]any)
+				if !ok {
+					return nil, fmt.Errorf("not an array")
+				}
+				return append(slices.Clone(arr), elems...), nil
+			})
+			break
+		}
+		a.config, err = jsonReplaceAt(a.config, segs, func(v any) (any, error) {
+			if arr, ok := v.([]any); ok {
+				return append(slices.Clone(arr), value), nil
+			}
+			return value, nil
+		})
+	case http.MethodDelete:
+		if !exists || len(segs) == 0 {
+			fail(http.StatusNotFound, "key does not exist: %s", path)
+			return
+		}
+		last := segs[len(segs)-1]
+		a.config, err = jsonReplaceAt(a.config, segs[:len(segs)-1], func(v any) (any, error) {
+			switch c := v.(type) {
+			case map[string]any:
+				delete(c, last)
+				return c, nil
+			case []any:
+				idx, _ := strconv.Atoi(last)
+				return slices.Delete(slices.Clone(c), idx, idx+1), nil
+			}
+			return nil, fmt.Errorf("not a container")
+		})
+	default:
+		fail(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err != nil {
+		fail(http.StatusBadRequest, "%s %s: %v", r.Method, path, err)
+	}
+}
+
+func fakeETag(path string, value any) string {
+	data, _ := json.Marshal(value)
+	return fmt.Sprintf(`"%s %x"`, path, sha256.Sum256(data))
+}
+
+func splitConfigPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// jsonValueAt returns the value at segs and whether it exists
+func jsonValueAt(v any, segs []string) (any, bool) {
+	for _, seg := range segs {
+		switch c := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = c[seg]; !ok {
+				return nil, false
+			}
+		case []any:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(c) {
+				return nil, false
+			}
+			v = c[idx]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonReplaceAt replaces the value at segs, which may be a missing key of
+// an existing object, with fn of the current value
+func jsonReplaceAt(v any, segs []string, fn func(any) (any, error)) (any, error) {
+	if len(segs) == 0 {
+		return fn(v)
+	}
+	switch c := v.(type) {
+	case map[string]any:
+		if _, ok := c[segs[0]]; !ok && len(segs) > 1 {
+			return nil, fmt.Errorf("path %s doesn't exist", strings.Join(segs, "/"))
+		}
+		child, err := jsonReplaceAt(c[segs[0]], segs[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[segs[0]] = child
+		return c, nil
+	case []any:
+		idx, err := strconv.Atoi(segs[0])
+		if err != nil || idx < 0 || idx >= len(c) {
+			return nil, fmt.Errorf("invalid index %q", segs[0])
+		}
+		child, err := jsonReplaceAt(c[idx], segs[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[idx] = child
+		return c, nil
+	}
+	return nil, fmt.Errorf("path %s doesn't exist", strings.Join(segs, "/"))
+}
+
+// findConfigID returns the path of the object with the given @id
+func findConfigID(v any, id string, path []string) ([]string, bool) {
+	switch c := v.(type) {
+	case map[string]any:
+		if c["@id"] == id {
+			return path, true
+		}
+		for k, child := range c {
+			if p, ok := findConfigID(child, id, append(slices.Clone(path), k)); ok {
+				return p, true
+			}
+		}
+	case []any:
+		for i, child := range c {
+			if p, ok := findConfigID(child, id, append(slices.Clone(path), strconv.Itoa(i))); ok {
+				return p, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// configPathBase is the config the config path tests start from
+const configPathBase = `{"apps": {
+	"http": {"servers": {"srv0": {"listen": [":443"], "routes": [
+		{"@id": "api", "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.1:80"}]}]}
+	]}}},
+	"tls": {"automation": {}}
+}}`
+
+func TestConfigPathURL(t *testing.T) {
+	c := NewClient("http://localhost:2019/", "", 0)
+	tests := []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{path: "", want: "http://localhost:2019/config/"},
+		{path: "/", want: "http://localhost:2019/config/"},
+		{path: "apps/http/servers/srv0", want: "http://localhost:2019/config/apps/http/servers/srv0"},
+		{path: "/apps/http/", want: "http://localhost:2019/config/apps/http"},
+		{path: "apps/http/servers/my server", want: "http://localhost:2019/config/apps/http/servers/my%20server"},
+		{path: "@api", want: "http://localhost:2019/id/api"},
+		{path: "@api/upstreams/0", want: "http://localhost:2019/id/api/upstreams/0"},
+		{path: "@", err: true},
+		{path: "apps//http", err: true},
+		{path: "apps/../admin", err: true},
+		{path: "apps/./http", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := c.configPathURL(tt.path)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientConfigPaths(t *testing.T) {
+	listen := "apps/http/servers/srv0/listen"
+
+	tests := []struct {
+		name    string
+		change  func(c *Client) error
+		request string // Method and path of the change sent, "" if none
+		status  int    // Status of the expected PathError
+		err     bool   // Any other error
+		path    string // Config path to check afterwards
+		want    string
+	}{
+		{
+			name:    "set creates a missing key",
+			change:  func(c *Client) error { return c.SetPath("apps/http/grace_period", []byte(`"5s"`), "") },
+			request: "PUT /config/apps/http/grace_period",
+			path:    "apps/http/grace_period",
+			want:    `"5s"`,
+		},
+		{
+			name:    "set replaces an existing value",
+			change:  func(c *Client) error { return c.SetPath(listen, []byte(`[":8443"]`), "") },
+			request: "PATCH /config/" + listen,
+			path:    listen,
+			want:    `[":8443"]`,
+		},
+		{
+			name:    "patch of a missing key",
+			change:  func(c *Client) error { return c.PatchPath("apps/http/grace_period", []byte(`"5s"`), "") },
+			request: "PATCH /config/apps/http/grace_period",
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "append",
+			change:  func(c *Client) error { return c.AppendPath(listen, []byte(`":80"`), "") },
+			request: "POST /config/" + listen + "/...",
+			path:    listen,
+			want:    `[":443",":80"]`,
+		},
+		{
+			name:    "append to an object",
+			change:  func(c *Client) error { return c.AppendPath("apps/http/servers", []byte(`{}`), "") },
+			request: "POST /config/apps/http/servers/...",
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "insert",
+			change:  func(c *Client) error { return c.InsertAt(listen, 0, []byte(`":80"`), "") },
+			request: "PUT /config/" + listen + "/0",
+			path:    listen,
+			want:    `[":80",":443"]`,
+		},
+		{
+			name:   "insert at a negative index",
+			change: func(c *Client) error { return c.InsertAt(listen, -1, []byte(`":80"`), "") },
+			err:    true,
+		},
+		{
+			name:    "delete",
+			change:  func(c *Client) error { return c.DeletePath("apps/tls", "") },
+			request: "DELETE /config/apps/tls",
+			path:    "apps/tls",
+			want:    `null`,
+		},
+		{
+			name:    "delete a missing key",
+			change:  func(c *Client) error { return c.DeletePath("apps/pki", "") },
+			request: "DELETE /config/apps/pki",
+			status:  http.StatusNotFound,
+		},
+		{
+			name: "by id",
+			change: func(c *Client) error {
+				return c.SetPath("@api/handle/0/upstreams", []byte(`[{"dial":"10.0.0.2:80"}]`), "")
+			},
+			request: "PATCH /config/apps/http/servers/srv0/routes/0/handle/0/upstreams",
+			path:    "apps/http/servers/srv0/routes/0/handle/0/upstreams",
+			want:    `[{"dial":"10.0.0.2:80"}]`,
+		},
+		{
+			name:   "invalid path",
+			change: func(c *Client) error { return c.DeletePath("apps/../admin", "") },
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin, url := newFakeAdmin(t, configPathBase)
+			err := tt.change(NewClient(url, "", 0))
+
+			var pathErr *PathError
+			switch {
+			case tt.status != 0:
+				if !errors.As(err, &pathErr) || pathErr.StatusCode != tt.status {
+					t.Errorf("got %v, want a path error with status %d", err, tt.status)
+				}
+			case tt.err:
+				if err == nil || errors.As(err, &pathErr) {
+					t.Errorf("got %v, want an error before any request", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			var requests []string
+			if tt.request != "" {
+				requests = []string{tt.request}
+			}
+			if !slices.Equal(admin.requests, requests) {
+				t.Errorf("requests %q, want %q", admin.requests, requests)
+			}
+			if tt.path != "" {
+				if got := admin.get(t, tt.path); got != tt.want {
+					t.Errorf("%s is %s, want %s", tt.path, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientConfigPathETags(t *testing.T) {
+	listen := "apps/http/servers/srv0/listen"
+
+	t.Run("changed since read", func(t *testing.T) {
+		admin, url := newFakeAdmin(t, configPathBase)
+		c := NewClient(url, "", 0)
+		if _, _, err := c.GetPath(listen); err != nil {
+			t.Fatal(err)
+		}
+		other := NewClient(url, "", 0)
+		if err := other.SetPath(listen, []byte(`[":8443"]`), ""); err != nil {
+			t.Fatal(err)
+		}
+
+		err := c.SetPath(listen, []byte(`[":9443"]`), "")
+		var pathErr *PathError
+		if !errors.Is(err, ErrConfigConflict) || !errors.As(err, &pathErr) || pathErr.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("got %v, want a conflict", err)
+		}
+		if got := admin.get(t, listen); got != `[":8443"]` {
+			t.Errorf("listen is %s after the conflict", got)
+		}
+	})
+
+	t.Run("unrelated change since read", func(t *testing.T) {
+		admin, url := newFakeAdmin(t, configPathBase)
+		c := NewClient(url, "", 0)
+		_, etag, err := c.GetPath(listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewClient(url, "", 0).DeletePath("apps/tls", ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AppendPath(listen, []byte(`":80"`), ""); err != nil {
+			t.Fatal(err)
+		}
+		want := "POST /config/" + listen + "/... " + etag
+		if last := admin.requests[len(admin.requests)-1]; last != want {
+			t.Errorf("sent %q, want %q", last, want)
+		}
+	})
+
+	t.Run("explicit etag", func(t *testing.T) {
+		_, url := newFakeAdmin(t, configPathBase)
+		_, etag, err := NewClient(url, "", 0).GetPath(listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewClient(url, "", 0)
+		if err := c.PatchPath(listen, []byte(`[":8443"]`), etag); err != nil {
+			t.Fatal(err)
+		}
+		// The ETag is stale now
+		if err := c.PatchPath(listen, []byte(`[":9443"]`), etag); !errors.Is(err, ErrConfigConflict) {
+			t.Errorf("got %v, want a conflict", err)
+		}
+	})
+
+	t.Run("changes forget overlapping reads", func(t *testing.T) {
+		admin, url := newFakeAdmin(t, configPathBase)
+		c := NewClient(url, "", 0)
+		for _, path := range []string{"apps/http", listen, "apps/tls", "/apps/http/servers/srv0/"} {
+			if _, _, err := c.GetPath(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.PatchPath("apps/http/servers/srv0", []byte(`{"listen":[":443"]}`), ""); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.etags) != 1 || c.etags["apps/tls"] == "" {
+			t.Errorf("remembered ETags %v, want only apps/tls", c.etags)
+		}
+
+		// Without a remembered read the next change isn't guarded
+		if err := c.AppendPath(listen, []byte(`":80"`), ""); err != nil {
+			t.Fatal(err)
+		}
+		if last := admin.requests[len(admin.requests)-1]; last != "POST /config/"+listen+"/..." {
+			t.Errorf("sent %q without If-Match", last)
+		}
+
+		// A change of the whole config forgets everything
+		if err := c.SetPath("", []byte(`{}`), ""); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.etags) != 0 {
+			t.Errorf("remembered ETags %v after replacing the config", c.etags)
+		}
+	})
+}
+
+func TestConfigServicePaths(t *testing.T) {
+	admin, _ := newFakeAdmin(t, configPathBase)
+	s, inst := newTestConfigService(t, admin)
+	listen := "apps/http/servers/srv0/listen"
+
+	value, etag, err := s.GetConfigPath(inst.ID, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != `[":443"]` || etag == "" {
+		t.Fatalf("got %s with ETag %q", value, etag)
+	}
+
+	change := ConfigChange{Author: "admin"}
+	if err := s.InsertConfigPath(inst.ID, listen, 1, []byte(`":80"`), etag, change); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetConfigPath(inst.ID, listen, []byte(`[]`), etag, change); !errors.Is(err, ErrConfigConflict) {
+		t.Errorf("change with a stale ETag: got %v, want a conflict", err)
+	}
+	if got := admin.get(t, listen); got != `[":443",":80"]` {
+		t.Errorf("listen is %s", got)
+	}
+}
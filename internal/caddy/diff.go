@@ -0,0 +1,148 @@
+package caddy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of JSON change
+const (
+	DiffAdd    = "add"
+	DiffRemove = "remove"
+	DiffChange = "change"
+)
+
+// JSONChange is one difference between two JSON documents
+type JSONChange struct {
+	Op   string `json:"op"`   // add, remove or change
+	Path string `json:"path"` // JSON Pointer (RFC 6901), e.g. /apps/http/servers/srv0/listen/0; "" is the whole document
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+// DiffJSON compares two JSON documents structurally. Objects are compared
+// key by key and arrays element by element, so a change deep inside a
+// server is reported at its own path rather than as a changed server.
+// Changes are ordered by path.
+func DiffJSON(a, b []byte) ([]JSONChange, error) {
+	var av, bv any
+	if err := unmarshalJSONDoc(a, &av); err != nil {
+		return nil, fmt.Errorf("invalid old document: %w", err)
+	}
+	if err := unmarshalJSONDoc(b, &bv); err != nil {
+		return nil, fmt.Errorf("invalid new document: %w", err)
+	}
+
+	changes := []JSONChange{}
+	diffValues("", av, bv, &changes)
+	return changes, nil
+}
+
+// unmarshalJSONDoc decodes a document into v, treating empty input as null.
+// Numbers are kept as json.Number, so large integers in a config aren't
+// rounded through float64 and pass through unchanged.
+func unmarshalJSONDoc(data []byte, v any) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("null")
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the JSON document")
+	}
+	return nil
+}
+
+func diffValues(path string, a, b any, changes *[]JSONChange) {
+	switch av := a.(type) {
+	case map[string]any:
+		if bv, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(av)+len(bv))
+			for k := range av {
+				keys = append(keys, k)
+			}
+			for k := range bv {
+				if _, ok := av[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				p := path + "/" + escapeJSONPointer(k)
+				oldVal, inOld := av[k]
+				newVal, inNew := bv[k]
+				switch {
+				case !inOld:
+					*changes = append(*changes, JSONChange{Op: DiffAdd, Path: p, New: newVal})
+				case !inNew:
+					*changes = append(*changes, JSONChange{Op: DiffRemove, Path: p, Old: oldVal})
+				default:
+					diffValues(p, oldVal, newVal, changes)
+				}
+			}
+			return
+		}
+	case []any:
+		if bv, ok := b.([]any); ok {
+			for i := 0; i < max(len(av), len(bv)); i++ {
+				p := path + "/" + strconv.Itoa(i)
+				switch {
+				case i >= len(av):
+					*changes = append(*changes, JSONChange{Op: DiffAdd, Path: p, New: bv[i]})
+				case i >= len(bv):
+					*changes = append(*changes, JSONChange{Op: DiffRemove, Path: p, Old: av[i]})
+				default:
+					diffValues(p, av[i], bv[i], changes)
+				}
+			}
+			return
+		}
+	}
+
+	if !equalJSONValues(a, b) {
+		switch {
+		case a == nil:
+			*changes = append(*changes, JSONChange{Op: DiffAdd, Path: path, New: b})
+		case b == nil:
+			*changes = append(*changes, JSONChange{Op: DiffRemove, Path: path, Old: a})
+		default:
+			*changes = append(*changes, JSONChange{Op: DiffChange, Path: path, Old: a, New: b})
+		}
+	}
+}
+
+// equalJSONValues compares two decoded values. Integers are compared
+// exactly; other numbers are equal if they have the same value however they
+// are written, e.g. 1.5 and 15e-1.
+func equalJSONValues(a, b any) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if !aok || !bok || an == bn {
+		return reflect.DeepEqual(a, b)
+	}
+	ai, aerr := an.Int64()
+	bi, berr := bn.Int64()
+	if aerr == nil && berr == nil {
+		return ai == bi
+	}
+	af, aerr := an.Float64()
+	bf, berr := bn.Float64()
+	return aerr == nil && berr == nil && af == bf
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapeJSONPointer(key string) string {
+	return jsonPointerEscaper.Replace(key)
+}
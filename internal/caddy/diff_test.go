@@ -0,0 +1,43 @@
+package caddy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string // changes as JSON
+	}{
+		{"equal", `{"a":[1,2]}`, `{"a":[1,2]}`, `[]`},
+		{"empty is null", ``, `{"a":1}`, `[{"op":"add","path":"","new":{"a":1}}]`},
+		{"added key", `{}`, `{"a/b":1}`, `[{"op":"add","path":"/a~1b","new":1}]`},
+		{"removed element", `[1,2]`, `[1]`, `[{"op":"remove","path":"/1","old":2}]`},
+		{"large integers keep precision", `{"n":9007199254740993}`, `{"n":9007199254740992}`,
+			`[{"op":"change","path":"/n","old":9007199254740993,"new":9007199254740992}]`},
+		{"same number written differently", `{"n":1.5,"m":1}`, `{"n":15e-1,"m":1.0}`, `[]`},
+		{"number to string", `{"n":1}`, `{"n":"1"}`, `[{"op":"change","path":"/n","old":1,"new":"1"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := DiffJSON([]byte(tt.a), []byte(tt.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(changes)
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffJSONInvalid(t *testing.T) {
+	for _, doc := range []string{`{`, `{"a":1} {"b":2}`, `[1,]`} {
+		if _, err := DiffJSON([]byte(doc), []byte(`{}`)); err == nil {
+			t.Errorf("DiffJSON(%q) succeeded", doc)
+		}
+	}
+}
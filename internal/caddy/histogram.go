@@ -0,0 +1,374 @@
+package caddy
+
+import (
+	"fmt"
+	"godash/internal/models"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// HistogramSnapshot stores the cumulative buckets of a histogram at
+// collection time. The +Inf bucket is implied by Count, which keeps the
+// snapshot JSON-encodable.
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"` // Finite upper bounds, ascending
+	Counts []float64 `json:"counts"` // Cumulative count per bound
+	Sum    float64   `json:"sum"`
+	Count  float64   `json:"count"`
+}
+
+// mergeHistograms adds up labelled histogram series into one snapshot.
+// Series with different bucket layouts are merged on the union of bounds.
+func mergeHistograms(series []Histogram) *HistogramSnapshot {
+	if len(series) == 0 {
+		return nil
+	}
+
+	boundSet := make(map[float64]bool)
+	for _, h := range series {
+		for _, b := range h.Buckets {
+			if !math.IsInf(b.UpperBound, 1) {
+				boundSet[b.UpperBound] = true
+			}
+		}
+	}
+	bounds := make([]float64, 0, len(boundSet))
+	for b := range boundSet {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+
+	snap := &HistogramSnapshot{Bounds: bounds, Counts: make([]float64, len(bounds))}
+	for _, h := range series {
+		snap.Sum += h.Sum
+		snap.Count += h.Count
+		for i, bound := range bounds {
+			snap.Counts[i] += cumulativeAt(h.Buckets, bound)
+		}
+	}
+	return snap
+}
+
+// cumulativeAt returns the cumulative count of the largest bucket at or below bound
+func cumulativeAt(buckets []Bucket, bound float64) float64 {
+	var count float64
+	for _, b := range buckets {
+		if b.UpperBound > bound {
+			break
+		}
+		count = b.Count
+	}
+	return count
+}
+
+// groupHistograms merges histogram series by the value of label
+func groupHistograms(series []Histogram, label string) map[string]*HistogramSnapshot {
+	grouped := make(map[string][]Histogram)
+	for _, h := range series {
+		if v, ok := h.Labels[label]; ok {
+			grouped[v] = append(grouped[v], h)
+		}
+	}
+	result := make(map[string]*HistogramSnapshot, len(grouped))
+	for name, hs := range grouped {
+		result[name] = mergeHistograms(hs)
+	}
+	return result
+}
+
+// sameLayout reports whether two snapshots share bucket bounds
+func (h *HistogramSnapshot) sameLayout(other *HistogramSnapshot) bool {
+	if len(h.Bounds) != len(other.Bounds) {
+		return false
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// increaseSince returns the observations added since prev. A shrinking
+// count or a changed bucket layout means the histogram was reset, in which
+// case the whole snapshot is the increase.
+func (h *HistogramSnapshot) increaseSince(prev *HistogramSnapshot, restarted bool) *HistogramSnapshot {
+	if prev == nil || restarted || h.Count < prev.Count || !h.sameLayout(prev) {
+		return h.clone()
+	}
+	inc := &HistogramSnapshot{
+		Bounds: h.Bounds,
+		Counts: make([]float64, len(h.Counts)),
+		Sum:    h.Sum - prev.Sum,
+		Count:  h.Count - prev.Count,
+	}
+	for i := range h.Counts {
+		inc.Counts[i] = math.Max(0, h.Counts[i]-prev.Counts[i])
+	}
+	return inc
+}
+
+// add accumulates other into h; layouts must match
+func (h *HistogramSnapshot) add(other *HistogramSnapshot) {
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+}
+
+func (h *HistogramSnapshot) clone() *HistogramSnapshot {
+	c := *h
+	c.Counts = append([]float64(nil), h.Counts...)
+	return &c
+}
+
+// Quantile estimates the q-quantile (0..1) by linear interpolation within
+// the bucket it falls into, the same way Prometheus' histogram_quantile
+// does. Observations above the largest bound are reported as that bound.
+func (h *HistogramSnapshot) Quantile(q float64) float64 {
+	if h == nil || h.Count == 0 || len(h.Bounds) == 0 {
+		return math.NaN()
+	}
+
+	rank := q * h.Count
+	lower, below := 0.0, 0.0
+	for i, bound := range h.Bounds {
+		if h.Counts[i] >= rank {
+			inBucket := h.Counts[i] - below
+			if inBucket <= 0 {
+				return bound
+			}
+			return lower + (bound-lower)*(rank-below)/inBucket
+		}
+		lower, below = bound, h.Counts[i]
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// Mean returns the average observation
+func (h *HistogramSnapshot) Mean() float64 {
+	if h == nil || h.Count == 0 {
+		return math.NaN()
+	}
+	return h.Sum / h.Count
+}
+
+// HistogramFunc selects a stored histogram from a sample
+type HistogramFunc func(*InstanceMetrics) *HistogramSnapshot
+
+// ParseHistogram resolves a histogram name used by the latency API:
+// "duration" (the default) or "response_size", optionally narrowed with
+// ":host=", ":server=" or ":handler=" like ParseCounter.
+func ParseHistogram(metric string) (HistogramFunc, error) {
+	name, key, value, err := parseMetricSelector(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	var pick func(*InstanceMetrics) *HistogramSnapshot
+	var pickSite func(SiteMetrics) *HistogramSnapshot
+	switch name {
+	case "", "duration":
+		pick = func(m *InstanceMetrics) *HistogramSnapshot { return m.Latency }
+		pickSite = func(s SiteMetrics) *HistogramSnapshot { return s.Latency }
+	case "response_size":
+		pick = func(m *InstanceMetrics) *HistogramSnapshot { return m.ResponseSize }
+		pickSite = func(s SiteMetrics) *HistogramSnapshot { return s.ResponseSize }
+	default:
+		return nil, fmt.Errorf("unknown histogram %q", name)
+	}
+
+	switch key {
+	case "":
+		return pick, nil
+	case "host", "server", "handler":
+		return func(m *InstanceMetrics) *HistogramSnapshot {
+			group := m.Sites
+			switch key {
+			case "server":
+				group = m.Servers
+			case "handler":
+				group = m.Handlers
+			}
+			return pickSite(group[value])
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown selector %q", key)
+}
+
+// histogramDelta returns the observations recorded between two samples,
+// accounting for resets. It returns nil when the histogram isn't present.
+func histogramDelta(prev, cur *InstanceMetrics, pick HistogramFunc) *HistogramSnapshot {
+	h := pick(cur)
+	if h == nil {
+		return nil
+	}
+	return h.increaseSince(pick(prev), processRestarted(prev, cur))
+}
+
+// Percentiles summarises a histogram window
+type Percentiles struct {
+	Count float64  `json:"count"`
+	Mean  *float64 `json:"mean"`
+	P50   *float64 `json:"p50"`
+	P90   *float64 `json:"p90"`
+	P99   *float64 `json:"p99"`
+}
+
+// percentilesOf computes percentiles scaled by unit; empty windows yield nulls
+func percentilesOf(h *HistogramSnapshot, unit float64) Percentiles {
+	value := func(v float64) *float64 {
+		if math.IsNaN(v) {
+			return nil
+		}
+		v *= unit
+		return &v
+	}
+	p := Percentiles{
+		Mean: value(h.Mean()),
+		P50:  value(h.Quantile(0.5)),
+		P90:  value(h.Quantile(0.9)),
+		P99:  value(h.Quantile(0.99)),
+	}
+	if h != nil {
+		p.Count = h.Count
+	}
+	return p
+}
+
+// LatencyOptions controls a histogram window query
+type LatencyOptions struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration // Heatmap column width
+}
+
+// LatencyReport holds percentiles for a window plus heatmap-ready buckets
+type LatencyReport struct {
+	Metric      string             `json:"metric"`
+	Unit        string             `json:"unit"`
+	Source      string             `json:"source"` // Resolution read: raw, 1m, 1h or 1d
+	Start       time.Time          `json:"start"`
+	End         time.Time          `json:"end"`
+	Summary     Percentiles        `json:"summary"`
+	Series      []Percentiles      `json:"series"` // One entry per heatmap column
+	Heatmap     models.HeatmapData `json:"heatmap"`
+	Percentiles models.ChartData   `json:"percentiles"` // p50/p90/p99 per column
+}
+
+// ComputeLatency turns histogram history into window percentiles and a
+// heatmap with one column per step. Each sampling interval's increase is
+// placed in the column containing its end.
+func ComputeLatency(history []*InstanceMetrics, metric string, opts LatencyOptions) (*LatencyReport, error) {
+	pick, err := ParseHistogram(metric)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Step <= 0 {
+		opts.Step = 5 * time.Minute
+	}
+
+	// Durations are reported in milliseconds, sizes in bytes
+	unit, unitName := 1.0, "bytes"
+	if name, _, _, _ := parseMetricSelector(metric); name == "" || name == "duration" {
+		unit, unitName = 1000, "ms"
+	}
+
+	start := opts.Start.Truncate(opts.Step)
+	n := int(math.Ceil(float64(opts.End.Sub(start)) / float64(opts.Step)))
+	columns := make([]*HistogramSnapshot, max(n, 0))
+
+	var total *HistogramSnapshot
+	for i := 1; i < len(history); i++ {
+		t := history[i].Timestamp
+		if !t.After(opts.Start) || t.After(opts.End) {
+			continue
+		}
+		inc := histogramDelta(history[i-1], history[i], pick)
+		if inc == nil {
+			continue
+		}
+
+		if total == nil || !total.sameLayout(inc) {
+			total = inc.clone()
+		} else {
+			total.add(inc)
+		}
+
+		col := int(t.Sub(start) / opts.Step)
+		if col < 0 || col >= len(columns) {
+			continue
+		}
+		if columns[col] == nil || !columns[col].sameLayout(inc) {
+			columns[col] = inc.clone()
+		} else {
+			columns[col].add(inc)
+		}
+	}
+
+	report := &LatencyReport{
+		Metric:  metric,
+		Unit:    unitName,
+		Start:   start,
+		End:     opts.End,
+		Summary: percentilesOf(total, unit),
+		Series:  make([]Percentiles, len(columns)),
+	}
+
+	var bounds []float64
+	if total != nil {
+		bounds = total.Bounds
+	}
+	report.Heatmap = models.HeatmapData{
+		XLabels: make([]string, len(columns)),
+		YLabels: make([]string, 0, len(bounds)+1),
+		Values:  make([][]float64, len(columns)),
+		Unit:    unitName,
+	}
+	for _, b := range bounds {
+		report.Heatmap.YLabels = append(report.Heatmap.YLabels, "≤"+formatBound(b*unit))
+	}
+	if len(bounds) > 0 {
+		report.Heatmap.YLabels = append(report.Heatmap.YLabels, ">"+formatBound(bounds[len(bounds)-1]*unit))
+	}
+
+	p50 := make([]float64, len(columns))
+	p90 := make([]float64, len(columns))
+	p99 := make([]float64, len(columns))
+	for i, col := range columns {
+		report.Heatmap.XLabels[i] = start.Add(time.Duration(i) * opts.Step).Format(time.RFC3339)
+		report.Heatmap.Values[i] = make([]float64, len(report.Heatmap.YLabels))
+		report.Series[i] = percentilesOf(col, unit)
+
+		if col != nil && col.sameLayout(total) {
+			below := 0.0
+			for j, c := range col.Counts {
+				report.Heatmap.Values[i][j] = c - below
+				below = c
+			}
+			report.Heatmap.Values[i][len(col.Counts)] = col.Count - below
+		}
+		if s := report.Series[i]; s.P50 != nil {
+			p50[i], p90[i], p99[i] = *s.P50, *s.P90, *s.P99
+		}
+	}
+
+	report.Percentiles = models.ChartData{
+		Labels: report.Heatmap.XLabels,
+		Datasets: []models.Dataset{
+			{Label: "p50", Data: p50, BorderColor: "#10b981"},
+			{Label: "p90", Data: p90, BorderColor: "#f59e0b"},
+			{Label: "p99", Data: p99, BorderColor: "#ef4444"},
+		},
+	}
+
+	return report, nil
+}
+
+// formatBound renders a bucket bound without trailing zeros
+func formatBound(v float64) string {
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
@@ -0,0 +1,183 @@
+package caddy
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMergeHistograms(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name   string
+		series []Histogram
+		want   *HistogramSnapshot
+	}{
+		{name: "none"},
+		{
+			name: "same layout",
+			series: []Histogram{
+				{Buckets: []Bucket{{0.1, 2}, {1, 5}, {inf, 6}}, Sum: 3, Count: 6},
+				{Buckets: []Bucket{{0.1, 1}, {1, 1}, {inf, 4}}, Sum: 9, Count: 4},
+			},
+			want: &HistogramSnapshot{Bounds: []float64{0.1, 1}, Counts: []float64{3, 6}, Sum: 12, Count: 10},
+		},
+		{
+			// A series without a bound counts what it has below it there
+			name: "different layouts",
+			series: []Histogram{
+				{Buckets: []Bucket{{0.1, 2}, {1, 5}, {inf, 6}}, Sum: 3, Count: 6},
+				{Buckets: []Bucket{{0.5, 3}, {inf, 4}}, Sum: 2, Count: 4},
+			},
+			want: &HistogramSnapshot{Bounds: []float64{0.1, 0.5, 1}, Counts: []float64{2, 5, 8}, Sum: 5, Count: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeHistograms(tt.series)
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("got %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || !slices.Equal(got.Bounds, tt.want.Bounds) || !slices.Equal(got.Counts, tt.want.Counts) ||
+				got.Sum != tt.want.Sum || got.Count != tt.want.Count {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	// 10 observations up to 0.1, 30 more up to 0.5, 50 more up to 1 and
+	// 10 above
+	h := &HistogramSnapshot{Bounds: []float64{0.1, 0.5, 1}, Counts: []float64{10, 40, 90}, Sum: 60, Count: 100}
+
+	tests := []struct {
+		name string
+		h    *HistogramSnapshot
+		q    float64
+		want float64
+	}{
+		{name: "within first bucket", h: h, q: 0.05, want: 0.05},
+		{name: "bucket edge", h: h, q: 0.1, want: 0.1},
+		{name: "interpolated", h: h, q: 0.25, want: 0.3},
+		{name: "median", h: h, q: 0.5, want: 0.6},
+		{name: "above the largest bound", h: h, q: 0.99, want: 1},
+		{name: "empty bucket", h: &HistogramSnapshot{Bounds: []float64{1, 2}, Counts: []float64{0, 0}, Count: 0}, q: 0.5, want: math.NaN()},
+		{name: "all in the first bucket", h: &HistogramSnapshot{Bounds: []float64{1, 2}, Counts: []float64{4, 4}, Count: 4}, q: 0.5, want: 0.5},
+		{name: "nil", q: 0.5, want: math.NaN()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.h.Quantile(tt.q)
+			if math.IsNaN(tt.want) {
+				if !math.IsNaN(got) {
+					t.Errorf("got %v, want NaN", got)
+				}
+				return
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if mean := h.Mean(); mean != 0.6 {
+		t.Errorf("mean %v, want 0.6", mean)
+	}
+}
+
+func TestHistogramIncreaseSince(t *testing.T) {
+	prev := &HistogramSnapshot{Bounds: []float64{0.1, 1}, Counts: []float64{2, 5}, Sum: 2, Count: 6}
+	cur := &HistogramSnapshot{Bounds: []float64{0.1, 1}, Counts: []float64{3, 9}, Sum: 5, Count: 11}
+
+	tests := []struct {
+		name      string
+		prev      *HistogramSnapshot
+		cur       *HistogramSnapshot
+		restarted bool
+		want      *HistogramSnapshot
+	}{
+		{name: "growing", prev: prev, cur: cur, want: &HistogramSnapshot{Bounds: cur.Bounds, Counts: []float64{1, 4}, Sum: 3, Count: 5}},
+		{name: "first sample", cur: cur, want: cur},
+		{name: "process restarted", prev: prev, cur: cur, restarted: true, want: cur},
+		{name: "count went down", prev: cur, cur: prev, want: prev},
+		{name: "layout changed", prev: &HistogramSnapshot{Bounds: []float64{0.5}, Counts: []float64{1}, Count: 1}, cur: cur, want: cur},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cur.increaseSince(tt.prev, tt.restarted)
+			if !slices.Equal(got.Counts, tt.want.Counts) || got.Sum != tt.want.Sum || got.Count != tt.want.Count {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got == tt.cur || len(got.Counts) > 0 && &got.Counts[0] == &tt.cur.Counts[0] {
+				t.Error("the increase shares its counts with the current snapshot")
+			}
+		})
+	}
+}
+
+func TestComputeLatency(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bounds := []float64{0.1, 0.5}
+	sample := func(offset time.Duration, counts []float64, sum, count float64) *InstanceMetrics {
+		return &InstanceMetrics{
+			Timestamp: base.Add(offset),
+			Latency:   &HistogramSnapshot{Bounds: bounds, Counts: counts, Sum: sum, Count: count},
+			Sites: map[string]SiteMetrics{"example.com": {
+				Latency: &HistogramSnapshot{Bounds: bounds, Counts: counts, Sum: sum, Count: count},
+			}},
+		}
+	}
+	history := []*InstanceMetrics{
+		sample(0, []float64{0, 0}, 0, 0),
+		sample(time.Minute, []float64{8, 10}, 1, 10),     // 8 fast, 2 medium
+		sample(2*time.Minute, []float64{8, 10}, 1, 10),   // Nothing
+		sample(6*time.Minute, []float64{10, 18}, 4, 20),  // 2 fast, 6 medium, 2 slow
+		sample(12*time.Minute, []float64{10, 18}, 4, 20), // Outside the window
+	}
+
+	for _, metric := range []string{"duration", "duration:host=example.com"} {
+		t.Run(metric, func(t *testing.T) {
+			report, err := ComputeLatency(history, metric, LatencyOptions{Start: base, End: base.Add(10 * time.Minute), Step: 5 * time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Unit != "ms" || report.Summary.Count != 20 {
+				t.Fatalf("unit %s count %v, want ms and 20", report.Unit, report.Summary.Count)
+			}
+			if report.Summary.Mean == nil || *report.Summary.Mean != 200 {
+				t.Errorf("mean %v, want 200ms", report.Summary.Mean)
+			}
+
+			wantLabels := []string{"≤100", "≤500", ">500"}
+			if !slices.Equal(report.Heatmap.YLabels, wantLabels) {
+				t.Errorf("heatmap rows %v, want %v", report.Heatmap.YLabels, wantLabels)
+			}
+			wantCells := [][]float64{{8, 2, 0}, {2, 6, 2}}
+			if len(report.Heatmap.Values) != len(wantCells) {
+				t.Fatalf("got %d heatmap columns, want %d", len(report.Heatmap.Values), len(wantCells))
+			}
+			for i, want := range wantCells {
+				if !slices.Equal(report.Heatmap.Values[i], want) {
+					t.Errorf("column %d: %v, want %v", i, report.Heatmap.Values[i], want)
+				}
+			}
+
+			// The median of the first column lies in the fast bucket
+			if p50 := report.Series[0].P50; p50 == nil || math.Abs(*p50-62.5) > 1e-9 {
+				t.Errorf("first column p50 %v, want 62.5ms", p50)
+			}
+		})
+	}
+
+	if _, err := ComputeLatency(history, "latency", LatencyOptions{Start: base, End: base.Add(time.Hour)}); err == nil {
+		t.Error("unknown histogram accepted")
+	}
+}
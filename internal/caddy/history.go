@@ -0,0 +1,295 @@
+package caddy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Config change actions recorded in the history
+const (
+	ChangeReload     = "reload"
+	ChangeCreateSite = "create_site"
+	ChangeDeleteSite = "delete_site"
+	ChangeRollback   = "rollback"
+	ChangeEditPath   = "edit_path"
+	ChangeEditRoutes = "edit_routes"
+)
+
+// ConfigChange describes who made a config change and why
+type ConfigChange struct {
+	Author  string `json:"author,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ConfigVersion is a saved snapshot of an instance's full config
+type ConfigVersion struct {
+	Version    int             `json:"version"` // Increasing per instance, starting at 1
+	InstanceID string          `json:"instance_id"`
+	Timestamp  time.Time       `json:"timestamp"`
+	Author     string          `json:"author,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Action     string          `json:"action"` // reload, create_site, delete_site, rollback, edit_path or edit_routes
+	Stage      string          `json:"stage"`  // "before" or "after" the change
+	Hash       string          `json:"hash"`   // SHA-256 of the compacted config
+	Size       int             `json:"size"`
+	Config     json.RawMessage `json:"config,omitempty"` // Only set by Get
+}
+
+// ConfigDiff is the structural difference between two versions
+type ConfigDiff struct {
+	From    *ConfigVersion `json:"from"`
+	To      *ConfigVersion `json:"to"`
+	Changes []JSONChange   `json:"changes"`
+}
+
+// ConfigHistory stores config snapshots per instance:
+//
+//	{dir}/{instance id}/versions.jsonl   one ConfigVersion per line, without the config
+//	{dir}/{instance id}/{version}.json   the config of that version
+type ConfigHistory struct {
+	dir         string
+	maxVersions int // Versions kept per instance (0 keeps all)
+	mu          sync.Mutex
+}
+
+// NewConfigHistory creates a config history store
+func NewConfigHistory(dir string, maxVersions int) (*ConfigHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create config history directory: %w", err)
+	}
+	return &ConfigHistory{dir: dir, maxVersions: maxVersions}, nil
+}
+
+// Record saves the config before and after a change. A snapshot identical
+// to the newest stored version is skipped, so the "before" of a change
+// normally only appears when the config was changed outside of godash, and
+// a change that had no effect adds nothing. It returns the newest version.
+func (h *ConfigHistory) Record(instanceID, action string, change ConfigChange, before, after []byte) (*ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions, err := h.readVersions(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *ConfigVersion
+	if len(versions) > 0 {
+		latest = versions[len(versions)-1]
+	}
+	for _, snap := range []struct {
+		stage  string
+		config []byte
+	}{{"before", before}, {"after", after}} {
+		if snap.config == nil {
+			continue
+		}
+		v, err := h.writeVersion(instanceID, latest, action, snap.stage, change, snap.config)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			versions = append(versions, v)
+			latest = v
+		}
+	}
+
+	if h.maxVersions > 0 && len(versions) > h.maxVersions {
+		if err := h.prune(instanceID, versions); err != nil {
+			return nil, err
+		}
+	}
+	return latest, nil
+}
+
+// writeVersion stores config as the version after latest, unless it is
+// identical to latest
+func (h *ConfigHistory) writeVersion(instanceID string, latest *ConfigVersion, action, stage string, change ConfigChange, config []byte) (*ConfigVersion, error) {
+	config = bytes.TrimSpace(config)
+	if len(config) == 0 {
+		config = []byte("null") // An instance with no config
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, config); err != nil {
+		return nil, fmt.Errorf("invalid config snapshot: %w", err)
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	hash := hex.EncodeToString(sum[:])
+	if latest != nil && latest.Hash == hash {
+		return nil, nil
+	}
+
+	v := &ConfigVersion{
+		Version:    1,
+		InstanceID: instanceID,
+		Timestamp:  time.Now(),
+		Author:     change.Author,
+		Message:    change.Message,
+		Action:     action,
+		Stage:      stage,
+		Hash:       hash,
+		Size:       compact.Len(),
+	}
+	if latest != nil {
+		v.Version = latest.Version + 1
+	}
+
+	dir := filepath.Join(h.dir, instanceID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var pretty bytes.Buffer
+	json.Indent(&pretty, compact.Bytes(), "", "  ")
+	if err := os.WriteFile(h.configPath(instanceID, v.Version), pretty.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write config snapshot: %w", err)
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "versions.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// prune removes the oldest versions beyond maxVersions
+func (h *ConfigHistory) prune(instanceID string, versions []*ConfigVersion) error {
+	drop := versions[:len(versions)-h.maxVersions]
+	keep := versions[len(versions)-h.maxVersions:]
+
+	var buf bytes.Buffer
+	for _, v := range keep {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	path := filepath.Join(h.dir, instanceID, "versions.jsonl")
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	for _, v := range drop {
+		os.Remove(h.configPath(instanceID, v.Version))
+	}
+	return nil
+}
+
+// List returns an instance's versions newest first, without their configs
+func (h *ConfigHistory) List(instanceID string) ([]*ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions, err := h.readVersions(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+// Get returns one version including its config. A version of 0 is the newest.
+func (h *ConfigHistory) Get(instanceID string, version int) (*ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions, err := h.readVersions(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no config history for instance %s", instanceID)
+	}
+
+	var v *ConfigVersion
+	if version == 0 {
+		v = versions[len(versions)-1]
+	} else {
+		for _, candidate := range versions {
+			if candidate.Version == version {
+				v = candidate
+				break
+			}
+		}
+	}
+	if v == nil {
+		return nil, fmt.Errorf("config version not found: %d", version)
+	}
+
+	config, err := os.ReadFile(h.configPath(instanceID, v.Version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config snapshot: %w", err)
+	}
+	v.Config = config
+	return v, nil
+}
+
+// Diff compares two versions of an instance's config. A version of 0 is
+// the newest.
+func (h *ConfigHistory) Diff(instanceID string, from, to int) (*ConfigDiff, error) {
+	fromVersion, err := h.Get(instanceID, from)
+	if err != nil {
+		return nil, err
+	}
+	toVersion, err := h.Get(instanceID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := DiffJSON(fromVersion.Config, toVersion.Config)
+	if err != nil {
+		return nil, err
+	}
+	fromVersion.Config = nil
+	toVersion.Config = nil
+	return &ConfigDiff{From: fromVersion, To: toVersion, Changes: changes}, nil
+}
+
+// readVersions returns an instance's versions oldest first; callers must hold h.mu
+func (h *ConfigHistory) readVersions(instanceID string) ([]*ConfigVersion, error) {
+	f, err := os.Open(filepath.Join(h.dir, instanceID, "versions.jsonl"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*ConfigVersion{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	versions := []*ConfigVersion{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var v ConfigVersion
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			continue
+		}
+		versions = append(versions, &v)
+	}
+	return versions, scanner.Err()
+}
+
+func (h *ConfigHistory) configPath(instanceID string, version int) string {
+	return filepath.Join(h.dir, instanceID, fmt.Sprintf("%06d.json", version))
+}
@@ -2,16 +2,24 @@ package caddy
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
+// ErrLogFileNotAllowed is returned for an instance log file outside the log
+// directory
+var ErrLogFileNotAllowed = errors.New("log file must be inside the log directory")
+
 // InstanceStore provides file-based storage for Caddy instances
 type InstanceStore struct {
 	filePath  string
+	logDir    string // Directory instance log files must be in (empty allows none)
 	mu        sync.RWMutex
 	instances map[string]*CaddyInstance
 }
@@ -62,11 +70,8 @@ func (s *InstanceStore) load() error {
 	return nil
 }
 
-// save saves instances to the file
+// save saves instances to the file; callers must hold s.mu
 func (s *InstanceStore) save() error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	instances := make([]*CaddyInstance, 0, len(s.instances))
 	for _, inst := range s.instances {
 		instances = append(instances, inst)
@@ -113,11 +118,87 @@ func (s *InstanceStore) Get(id string) (*CaddyInstance, error) {
 	return inst, nil
 }
 
+// SetLogDir sets the directory instance log files must be in. Without one
+// no local log files can be tailed.
+func (s *InstanceStore) SetLogDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logDir = dir
+}
+
+// ResolveLogFile returns the file an instance's log file refers to once
+// symlinks are resolved, or ErrLogFileNotAllowed unless it is inside the log
+// directory. Relative paths are taken relative to the log directory.
+func (s *InstanceStore) ResolveLogFile(path string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return resolveLogFile(s.logDir, path)
+}
+
+func resolveLogFile(dir, path string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("%w: no log directory is configured", ErrLogFileNotAllowed)
+	}
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrLogFileNotAllowed, err)
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrLogFileNotAllowed, err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Caddy may not have created the file yet, but its directory
+		// has to exist
+		var parent string
+		if parent, err = filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+			resolved = filepath.Join(parent, filepath.Base(path))
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrLogFileNotAllowed, err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w %s", ErrLogFileNotAllowed, dir)
+	}
+	return resolved, nil
+}
+
+// checkLogFile returns the log file of req as stored: cleaned and absolute,
+// and only if it is inside the log directory; callers must hold s.mu
+func (s *InstanceStore) checkLogFile(req *InstanceRequest) (string, error) {
+	if req.LogFile == "" {
+		return "", nil
+	}
+	if _, err := resolveLogFile(s.logDir, req.LogFile); err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(req.LogFile) {
+		return filepath.Clean(req.LogFile), nil
+	}
+	return filepath.Abs(filepath.Join(s.logDir, req.LogFile))
+}
+
 // Create creates a new instance
 func (s *InstanceStore) Create(req *InstanceRequest) (*CaddyInstance, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	logFile, err := s.checkLogFile(req)
+	if err != nil {
+		return nil, err
+	}
+
 	// Generate ID
 	id := generateID()
 	now := time.Now()
@@ -129,6 +210,8 @@ func (s *InstanceStore) Create(req *InstanceRequest) (*CaddyInstance, error) {
 		APIKeyFile: req.APIKeyFile,
 		Status:     StatusUnknown,
 		Tags:       req.Tags,
+		LogFile:    logFile,
+		LogSource:  req.LogSource,
 		CreatedAt:  now,
 		UpdatedAt:  now,
 	}
@@ -152,11 +235,17 @@ func (s *InstanceStore) Update(id string, req *InstanceRequest) (*CaddyInstance,
 	if !ok {
 		return nil, fmt.Errorf("instance not found: %s", id)
 	}
+	logFile, err := s.checkLogFile(req)
+	if err != nil {
+		return nil, err
+	}
 
 	inst.Name = req.Name
 	inst.URL = req.URL
 	inst.APIKeyFile = req.APIKeyFile
 	inst.Tags = req.Tags
+	inst.LogFile = logFile
+	inst.LogSource = req.LogSource
 	inst.UpdatedAt = time.Now()
 
 	if err := s.save(); err != nil {
@@ -331,22 +420,8 @@ func (s *InstanceService) GetMetrics(id string) (*InstanceMetrics, error) {
 
 	pm, err := ParsePrometheusMetrics(metricsText)
 	if err != nil {
-		return nil, err
-	}
-
-	metrics := &InstanceMetrics{
-		InstanceID:  id,
-		Timestamp:   time.Now(),
-		NumRequests: int64(pm.RequestsTotal),
-		StatusCodes: make(map[int]int64),
-	}
-
-	// Convert status codes
-	for codeStr, count := range pm.RequestsByCode {
-		var code int
-		fmt.Sscanf(codeStr, "%d", &code)
-		metrics.StatusCodes[code] = int64(count)
+		return nil, fmt.Errorf("failed to parse metrics: %w", err)
 	}
 
-	return metrics, nil
+	return NewInstanceMetrics(id, pm, time.Now()), nil
 }
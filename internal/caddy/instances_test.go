@@ -0,0 +1,104 @@
+package caddy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveLogFile(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "logs")
+	outside := filepath.Join(root, "secret.json")
+	for _, d := range []string{dir, filepath.Join(dir, "sub")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{outside, filepath.Join(dir, "access.log")} {
+		if err := os.WriteFile(f, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link.log")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(dir, "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dir  string
+		path string
+		want string // Resolved path relative to dir, "" if refused
+	}{
+		{"file in dir", dir, filepath.Join(dir, "access.log"), "access.log"},
+		{"relative to dir", dir, "access.log", "access.log"},
+		{"not created yet", dir, filepath.Join(dir, "sub", "new.log"), "sub/new.log"},
+		{"dot segments inside dir", dir, filepath.Join(dir, "sub", "..", "access.log"), "access.log"},
+		{"outside dir", dir, outside, ""},
+		{"dot segments out of dir", dir, filepath.Join(dir, "..", "secret.json"), ""},
+		{"relative out of dir", dir, "../secret.json", ""},
+		{"symlink out of dir", dir, filepath.Join(dir, "link.log"), ""},
+		{"through symlinked directory", dir, filepath.Join(dir, "up", "secret.json"), ""},
+		{"the dir itself", dir, dir, ""},
+		{"missing parent", dir, filepath.Join(dir, "nope", "a.log"), ""},
+		{"sibling with dir as prefix", dir, dir + "-other/a.log", ""},
+		{"no log dir", "", filepath.Join(dir, "access.log"), ""},
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveLogFile(tt.dir, tt.path)
+			if tt.want == "" {
+				if !errors.Is(err, ErrLogFileNotAllowed) {
+					t.Errorf("got %q, %v; want ErrLogFileNotAllowed", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(realDir, tt.want); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestInstanceStoreLogFile(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewInstanceStore(filepath.Join(dir, "instances.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &InstanceRequest{Name: "web", URL: "http://localhost:2019", LogFile: "/etc/passwd"}
+	if _, err := store.Create(req); !errors.Is(err, ErrLogFileNotAllowed) {
+		t.Fatalf("create without a log directory: got %v, want ErrLogFileNotAllowed", err)
+	}
+
+	store.SetLogDir(dir)
+	req.LogFile = "access.log"
+	inst, err := store.Create(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "access.log"); inst.LogFile != want {
+		t.Errorf("stored log file %q, want %q", inst.LogFile, want)
+	}
+
+	req.LogFile = filepath.Join(dir, "..", "instances.json")
+	if _, err := store.Update(inst.ID, req); !errors.Is(err, ErrLogFileNotAllowed) {
+		t.Errorf("update: got %v, want ErrLogFileNotAllowed", err)
+	}
+	if got, _ := store.Get(inst.ID); got.LogFile != filepath.Join(dir, "access.log") {
+		t.Errorf("refused update changed the log file to %q", got.LogFile)
+	}
+}
@@ -0,0 +1,750 @@
+package caddy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLogBufferSize is the number of log entries kept per instance
+	DefaultLogBufferSize = 1000
+
+	logSyncInterval  = 15 * time.Second
+	logTailInterval  = 500 * time.Millisecond
+	logTailBacklog   = 256 * 1024 // Bytes read from the end of a file when tailing starts
+	logMaxLineLength = 1024 * 1024
+)
+
+// logLevels orders zap log levels by severity
+var logLevels = map[string]int{
+	"debug":  0,
+	"info":   1,
+	"warn":   2,
+	"error":  3,
+	"dpanic": 4,
+	"panic":  5,
+	"fatal":  6,
+}
+
+// LevelAtLeast reports whether level is at least as severe as minLevel.
+// An empty or unknown minLevel matches every entry.
+func LevelAtLeast(level, minLevel string) bool {
+	min, ok := logLevels[strings.ToLower(minLevel)]
+	if !ok {
+		return true
+	}
+	return logLevels[strings.ToLower(level)] >= min
+}
+
+// ParseLogLine parses a single line written by one of Caddy's log encoders.
+// JSON lines are decoded field by field; console-encoded lines are split on
+// tabs; anything else is kept verbatim as the message.
+func ParseLogLine(line []byte) LogEntry {
+	line = bytes.TrimSpace(line)
+
+	var raw map[string]json.RawMessage
+	if len(line) > 0 && line[0] == '{' && json.Unmarshal(line, &raw) == nil {
+		return parseJSONLogEntry(raw)
+	}
+
+	return parseConsoleLogEntry(string(line))
+}
+
+func parseJSONLogEntry(raw map[string]json.RawMessage) LogEntry {
+	var entry LogEntry
+
+	take := func(key string, dst interface{}) {
+		value, ok := raw[key]
+		if !ok {
+			return
+		}
+		if err := json.Unmarshal(value, dst); err == nil {
+			delete(raw, key)
+		}
+	}
+
+	if ts, ok := raw["ts"]; ok {
+		if t, ok := parseLogTime(ts); ok {
+			entry.Time = t
+			delete(raw, "ts")
+		}
+	}
+	take("level", &entry.Level)
+	take("msg", &entry.Message)
+	take("logger", &entry.Logger)
+	take("caller", &entry.Caller)
+	take("error", &entry.Error)
+	take("status", &entry.Status)
+	take("size", &entry.Size)
+	take("bytes_read", &entry.BytesRead)
+	take("duration", &entry.Duration)
+	take("user_id", &entry.UserID)
+	take("resp_headers", &entry.RespHeaders)
+
+	var req LogRequest
+	if value, ok := raw["request"]; ok && json.Unmarshal(value, &req) == nil {
+		entry.Request = &req
+		delete(raw, "request")
+	}
+
+	if len(raw) > 0 {
+		entry.Fields = make(map[string]interface{}, len(raw))
+		for key, value := range raw {
+			var v interface{}
+			if err := json.Unmarshal(value, &v); err == nil {
+				entry.Fields[key] = v
+			}
+		}
+	}
+
+	entry.Level = strings.ToLower(entry.Level)
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	return entry
+}
+
+// parseLogTime decodes Caddy's "ts" field, which is a float of Unix seconds
+// by default but may be a formatted string when time_format is configured
+func parseLogTime(ts json.RawMessage) (time.Time, bool) {
+	var seconds float64
+	if err := json.Unmarshal(ts, &seconds); err == nil {
+		sec := int64(seconds)
+		nsec := int64((seconds - float64(sec)) * 1e9)
+		return time.Unix(sec, nsec), true
+	}
+
+	var s string
+	if err := json.Unmarshal(ts, &s); err != nil {
+		return time.Time{}, false
+	}
+	return parseLogTimeString(s)
+}
+
+func parseLogTimeString(s string) (time.Time, bool) {
+	layouts := []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.000Z0700",
+		"2006/01/02 15:04:05.000",
+		"2006/01/02 15:04:05",
+		time.StampMilli,
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := int64(seconds)
+		return time.Unix(sec, int64((seconds-float64(sec))*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+// parseConsoleLogEntry handles zap's console encoder:
+// time<TAB>LEVEL<TAB>logger<TAB>message<TAB>{json fields}
+func parseConsoleLogEntry(line string) LogEntry {
+	entry := LogEntry{
+		Time:    time.Now(),
+		Level:   "info",
+		Message: line,
+	}
+
+	parts := strings.Split(line, "\t")
+	if len(parts) < 3 {
+		return entry
+	}
+	level := strings.ToLower(parts[1])
+	if _, ok := logLevels[level]; !ok {
+		return entry
+	}
+
+	if t, ok := parseLogTimeString(parts[0]); ok {
+		entry.Time = t
+	}
+	entry.Level = level
+
+	rest := parts[2:]
+	if len(rest) > 1 && !strings.Contains(rest[0], " ") {
+		entry.Logger = rest[0]
+		rest = rest[1:]
+	}
+	entry.Message = rest[0]
+
+	if len(rest) > 1 {
+		var raw map[string]json.RawMessage
+		if json.Unmarshal([]byte(rest[len(rest)-1]), &raw) == nil {
+			fields := parseJSONLogEntry(raw)
+			fields.Time, fields.Level, fields.Message, fields.Logger = entry.Time, entry.Level, entry.Message, entry.Logger
+			return fields
+		}
+	}
+
+	return entry
+}
+
+// LogBuffer is a bounded ring buffer of log entries with live subscribers
+type LogBuffer struct {
+	mu      sync.RWMutex
+	entries []LogEntry
+	next    int
+	full    bool
+	subs    map[chan LogEntry]struct{}
+}
+
+// NewLogBuffer creates a ring buffer holding at most size entries
+func NewLogBuffer(size int) *LogBuffer {
+	if size <= 0 {
+		size = DefaultLogBufferSize
+	}
+	return &LogBuffer{
+		entries: make([]LogEntry, size),
+		subs:    make(map[chan LogEntry]struct{}),
+	}
+}
+
+// Append adds an entry, evicting the oldest one when the buffer is full
+func (b *LogBuffer) Append(entry LogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- entry:
+		default:
+			// Slow follower, drop rather than block ingestion
+		}
+	}
+}
+
+// Tail returns up to n of the newest entries at or above minLevel, oldest first
+func (b *LogBuffer) Tail(n int, minLevel string) []LogEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.entries)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	result := make([]LogEntry, 0, n)
+	for i := 1; i <= count && len(result) < n; i++ {
+		idx := (b.next - i + len(b.entries)) % len(b.entries)
+		if LevelAtLeast(b.entries[idx].Level, minLevel) {
+			result = append(result, b.entries[idx])
+		}
+	}
+
+	// Collected newest first; flip to chronological order
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+
+	return result
+}
+
+// Subscribe returns a channel receiving every new entry and a function that
+// cancels the subscription
+func (b *LogBuffer) Subscribe() (<-chan LogEntry, func()) {
+	ch := make(chan LogEntry, 256)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// LogSink receives logs from Caddy instances and keeps them per instance.
+// Caddy ships logs to it with the "net" log writer (tcp or udp), and
+// instances with a LogFile set are tailed from the local filesystem.
+type LogSink struct {
+	store      *InstanceStore
+	bufferSize int
+
+	mu        sync.RWMutex
+	buffers   map[string]*LogBuffer
+	sources   map[string][]string // Remote IP -> instance IDs
+	tailers   map[string]*fileTailer
+	rejected  map[string]string // Instance ID -> log file refused for being outside the log directory
+	listeners []io.Closer
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewLogSink creates a log sink for the instances in store
+func NewLogSink(store *InstanceStore, bufferSize int) *LogSink {
+	return &LogSink{
+		store:      store,
+		bufferSize: bufferSize,
+		buffers:    make(map[string]*LogBuffer),
+		sources:    make(map[string][]string),
+		tailers:    make(map[string]*fileTailer),
+		rejected:   make(map[string]string),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start begins keeping log sources and file tailers in sync with the instance store
+func (s *LogSink) Start() {
+	s.sync()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(logSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.sync()
+			}
+		}
+	}()
+}
+
+// Listen opens a listener for Caddy's net log writer. The address uses
+// Caddy's network address syntax, e.g. "tcp/:9514" or "udp/127.0.0.1:9514";
+// without a network prefix tcp is assumed.
+func (s *LogSink) Listen(address string) error {
+	network, addr := "tcp", address
+	if i := strings.Index(address, "/"); i >= 0 {
+		network, addr = address[:i], address[i+1:]
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for logs: %w", err)
+		}
+		s.addListener(ln)
+		s.wg.Add(1)
+		go s.serveTCP(ln)
+	case "udp", "udp4", "udp6":
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for logs: %w", err)
+		}
+		s.addListener(conn)
+		s.wg.Add(1)
+		go s.serveUDP(conn)
+	default:
+		return fmt.Errorf("unsupported log network: %s", network)
+	}
+
+	return nil
+}
+
+// Close stops all listeners and tailers
+func (s *LogSink) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+
+	s.mu.Lock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for id, t := range s.tailers {
+		t.stop()
+		delete(s.tailers, id)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// Buffer returns the log buffer for an instance, creating it if needed
+func (s *LogSink) Buffer(instanceID string) *LogBuffer {
+	s.mu.RLock()
+	buf, ok := s.buffers[instanceID]
+	s.mu.RUnlock()
+	if ok {
+		return buf
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if buf, ok := s.buffers[instanceID]; ok {
+		return buf
+	}
+	buf = NewLogBuffer(s.bufferSize)
+	s.buffers[instanceID] = buf
+	return buf
+}
+
+func (s *LogSink) addListener(l io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+func (s *LogSink) serveTCP(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("Log sink: accept failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+
+			closed := make(chan struct{})
+			defer close(closed)
+			go func() {
+				select {
+				case <-s.done:
+					conn.Close()
+				case <-closed:
+				}
+			}()
+
+			remoteIP := addrIP(conn.RemoteAddr())
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(make([]byte, 64*1024), logMaxLineLength)
+			for scanner.Scan() {
+				s.route(remoteIP, scanner.Bytes())
+			}
+		}()
+	}
+}
+
+func (s *LogSink) serveUDP(conn net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("Log sink: read failed: %v", err)
+			continue
+		}
+
+		remoteIP := addrIP(addr)
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			s.route(remoteIP, line)
+		}
+	}
+}
+
+// route appends a line to the buffers of every instance shipping from remoteIP
+func (s *LogSink) route(remoteIP string, line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+
+	s.mu.RLock()
+	ids := s.sources[remoteIP]
+	s.mu.RUnlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	entry := ParseLogLine(line)
+	for _, id := range ids {
+		s.Buffer(id).Append(entry)
+	}
+}
+
+// sync refreshes source address mappings and file tailers from the instance store
+func (s *LogSink) sync() {
+	instances := s.store.List()
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+
+	sources := make(map[string][]string)
+	known := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		known[inst.ID] = true
+		for _, ip := range resolveLogSource(inst) {
+			sources[ip] = append(sources[ip], inst.ID)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sources = sources
+
+	for _, inst := range instances {
+		// The file is checked again on every sync, so a log file stored
+		// before the log directory was set, or a symlink changed since,
+		// can't be read outside the log directory
+		var path string
+		if inst.LogFile != "" {
+			var err error
+			if path, err = s.store.ResolveLogFile(inst.LogFile); err != nil {
+				if s.rejected[inst.ID] != inst.LogFile {
+					log.Printf("Warning: not tailing %s for instance %s: %v", inst.LogFile, inst.ID, err)
+					s.rejected[inst.ID] = inst.LogFile
+				}
+				path = ""
+			} else {
+				delete(s.rejected, inst.ID)
+			}
+		}
+
+		t, running := s.tailers[inst.ID]
+		if running && t.path == path {
+			continue
+		}
+		if running {
+			t.stop()
+			delete(s.tailers, inst.ID)
+		}
+		if path != "" {
+			s.tailers[inst.ID] = startFileTailer(path, s.bufferLocked(inst.ID))
+		}
+	}
+
+	for id, t := range s.tailers {
+		if !known[id] {
+			t.stop()
+			delete(s.tailers, id)
+		}
+	}
+	for id := range s.rejected {
+		if !known[id] {
+			delete(s.rejected, id)
+		}
+	}
+	for id := range s.buffers {
+		if !known[id] {
+			delete(s.buffers, id)
+		}
+	}
+}
+
+func (s *LogSink) bufferLocked(instanceID string) *LogBuffer {
+	buf, ok := s.buffers[instanceID]
+	if !ok {
+		buf = NewLogBuffer(s.bufferSize)
+		s.buffers[instanceID] = buf
+	}
+	return buf
+}
+
+// resolveLogSource returns the IP addresses an instance's logs arrive from
+func resolveLogSource(inst *CaddyInstance) []string {
+	host := inst.LogSource
+	if host == "" {
+		u, err := url.Parse(inst.URL)
+		if err != nil {
+			return nil
+		}
+		host = u.Hostname()
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{normalizeIP(ip)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil {
+			ips = append(ips, normalizeIP(ip))
+		}
+	}
+	return ips
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return normalizeIP(a.IP)
+	case *net.UDPAddr:
+		return normalizeIP(a.IP)
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return normalizeIP(ip)
+	}
+	return host
+}
+
+// normalizeIP maps IPv4-in-IPv6 addresses to their IPv4 form
+func normalizeIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
+// fileTailer follows a log file, surviving truncation and rotation
+type fileTailer struct {
+	path string
+	buf  *LogBuffer
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startFileTailer(path string, buf *LogBuffer) *fileTailer {
+	t := &fileTailer{
+		path: path,
+		buf:  buf,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *fileTailer) stop() {
+	close(t.quit)
+	<-t.done
+}
+
+func (t *fileTailer) run() {
+	defer close(t.done)
+
+	var (
+		f       *os.File
+		info    os.FileInfo
+		offset  int64
+		pending []byte
+		first   = true
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(logTailInterval)
+	defer ticker.Stop()
+
+	for {
+		current, err := os.Stat(t.path)
+		if err == nil {
+			reopen := f == nil || !os.SameFile(info, current) || current.Size() < offset
+			if reopen {
+				if f != nil {
+					f.Close()
+					f = nil
+				}
+				if nf, err := os.Open(t.path); err == nil {
+					f, info, offset, pending = nf, current, 0, nil
+					if first && current.Size() > logTailBacklog {
+						// Start near the end; the first line is probably partial
+						offset = current.Size() - logTailBacklog
+						t.skipPartial(f, &offset)
+					}
+				}
+			}
+			first = false
+
+			if f != nil && current.Size() > offset {
+				pending = t.readFrom(f, &offset, pending)
+			}
+		}
+
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *fileTailer) skipPartial(f *os.File, offset *int64) {
+	r := bufio.NewReader(io.NewSectionReader(f, *offset, logTailBacklog))
+	skipped, err := r.ReadBytes('\n')
+	if err == nil {
+		*offset += int64(len(skipped))
+	}
+}
+
+func (t *fileTailer) readFrom(f *os.File, offset *int64, pending []byte) []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.ReadAt(buf, *offset)
+		if n > 0 {
+			*offset += int64(n)
+			pending = append(pending, buf[:n]...)
+			for {
+				i := bytes.IndexByte(pending, '\n')
+				if i < 0 {
+					break
+				}
+				if line := bytes.TrimSpace(pending[:i]); len(line) > 0 {
+					t.buf.Append(ParseLogLine(line))
+				}
+				pending = pending[i+1:]
+			}
+			if len(pending) > logMaxLineLength {
+				pending = nil
+			}
+		}
+		if err != nil || n == 0 {
+			return append([]byte(nil), pending...)
+		}
+	}
+}
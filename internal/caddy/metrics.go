@@ -0,0 +1,188 @@
+package caddy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Caddy metric names
+const (
+	metricRequestsTotal    = "caddy_http_requests_total"
+	metricRequestErrors    = "caddy_http_request_errors_total"
+	metricRequestsInFlight = "caddy_http_requests_in_flight"
+	metricRequestDuration  = "caddy_http_request_duration_seconds"
+	metricRequestSize      = "caddy_http_request_size_bytes"
+	metricResponseSize     = "caddy_http_response_size_bytes"
+	metricProcessStart     = "process_start_time_seconds"
+)
+
+// perRequestMetrics are the metrics Caddy records in every handler a request
+// passes through, labelled by the handler
+var perRequestMetrics = map[string]bool{
+	metricRequestsTotal:    true,
+	metricRequestErrors:    true,
+	metricRequestsInFlight: true,
+	metricRequestDuration:  true,
+	metricRequestSize:      true,
+	metricResponseSize:     true,
+}
+
+// NewInstanceMetrics builds an instance snapshot from Caddy's parsed metrics.
+// Requests are counted once however many handlers they pass through; only
+// the per-handler figures count them for every handler.
+func NewInstanceMetrics(instanceID string, pm *PrometheusMetrics, now time.Time) *InstanceMetrics {
+	all := pm
+	pm = countOnce(pm)
+
+	metrics := &InstanceMetrics{
+		InstanceID:  instanceID,
+		Timestamp:   now,
+		StatusCodes: make(map[int]int64),
+	}
+
+	requests := pm.Sum(metricRequestsTotal, nil)
+	if requests == 0 {
+		requests = pm.Sum(metricRequestDuration+"_count", nil)
+	}
+	metrics.NumRequests = int64(requests)
+	metrics.TotalTraffic = int64(pm.Sum(metricResponseSize+"_sum", nil))
+	metrics.Errors = int64(pm.Sum(metricRequestErrors, nil))
+	metrics.InFlight = int64(pm.Sum(metricRequestsInFlight, nil))
+
+	if start := pm.Samples(metricProcessStart, nil); len(start) > 0 && start[0].Value > 0 {
+		metrics.Uptime = now.Unix() - int64(start[0].Value)
+	}
+
+	// Status codes only appear on the duration histogram in current Caddy
+	// versions; older ones also labelled the request counter
+	codes := pm.SumBy(metricRequestDuration+"_count", "code")
+	if len(codes) == 0 {
+		codes = pm.SumBy(metricRequestsTotal, "code")
+	}
+	for codeStr, count := range codes {
+		code, err := strconv.Atoi(codeStr)
+		if err != nil {
+			continue
+		}
+		metrics.StatusCodes[code] += int64(count)
+	}
+
+	durations := pm.Histograms(metricRequestDuration)
+	sizes := pm.Histograms(metricResponseSize)
+	metrics.Latency = mergeHistograms(durations)
+	metrics.ResponseSize = mergeHistograms(sizes)
+
+	metrics.Sites = groupSiteMetrics(pm, "host")
+	metrics.Servers = groupSiteMetrics(pm, "server")
+	metrics.Handlers = groupSiteMetrics(all, "handler")
+
+	return metrics
+}
+
+// perRequestBase returns the per-request metric a sample belongs to, and
+// whether the sample is the number of requests of its series
+func perRequestBase(name string) (base string, counts bool) {
+	if perRequestMetrics[name] {
+		return name, true
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if b, ok := strings.CutSuffix(name, suffix); ok && perRequestMetrics[b] {
+			return b, suffix == "_count"
+		}
+	}
+	return "", false
+}
+
+// countOnce returns pm with the per-request metrics of one handler per
+// series. A request through a subroute and a reverse_proxy is recorded by
+// both, so adding up every handler counts it twice. Of the series that only
+// differ in their handler label, the one with the most requests is kept:
+// the outermost handler, which every request of the others also passed.
+func countOnce(pm *PrometheusMetrics) *PrometheusMetrics {
+	group := func(base string, labels Labels) string {
+		return base + labels.Without("handler", "le").String()
+	}
+
+	type pick struct {
+		handler  string
+		requests float64
+	}
+	picks := make(map[string]pick)
+	for _, f := range pm.Families {
+		for _, s := range f.Samples {
+			handler, ok := s.Labels["handler"]
+			base, counts := perRequestBase(s.Name)
+			if !ok || !counts {
+				continue
+			}
+			// Ties go to the first handler by name, so the choice is stable
+			key := group(base, s.Labels)
+			if p, seen := picks[key]; !seen || s.Value > p.requests || s.Value == p.requests && handler < p.handler {
+				picks[key] = pick{handler: handler, requests: s.Value}
+			}
+		}
+	}
+
+	result := &PrometheusMetrics{Families: make(map[string]*MetricFamily, len(pm.Families))}
+	for name, f := range pm.Families {
+		kept := *f
+		kept.Samples = make([]Sample, 0, len(f.Samples))
+		for _, s := range f.Samples {
+			handler, ok := s.Labels["handler"]
+			if base, _ := perRequestBase(s.Name); ok && base != "" {
+				if p, picked := picks[group(base, s.Labels)]; picked && p.handler != handler {
+					continue
+				}
+			}
+			kept.Samples = append(kept.Samples, s)
+		}
+		result.Families[name] = &kept
+	}
+	return result
+}
+
+// groupSiteMetrics aggregates request, traffic and latency figures by label
+func groupSiteMetrics(pm *PrometheusMetrics, label string) map[string]SiteMetrics {
+	requests := pm.SumBy(metricRequestsTotal, label)
+	durationCount := pm.SumBy(metricRequestDuration+"_count", label)
+	durationSum := pm.SumBy(metricRequestDuration+"_sum", label)
+	if len(requests) == 0 {
+		requests = durationCount
+	}
+	sent := pm.SumBy(metricResponseSize+"_sum", label)
+	received := pm.SumBy(metricRequestSize+"_sum", label)
+	errors := pm.SumBy(metricRequestErrors, label)
+
+	if len(requests) == 0 && len(sent) == 0 {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, m := range []map[string]float64{requests, sent, received, errors} {
+		for name := range m {
+			names[name] = true
+		}
+	}
+
+	latency := groupHistograms(pm.Histograms(metricRequestDuration), label)
+	sizes := groupHistograms(pm.Histograms(metricResponseSize), label)
+
+	result := make(map[string]SiteMetrics, len(names))
+	for name := range names {
+		site := SiteMetrics{
+			Name:          name,
+			Requests:      int64(requests[name]),
+			BytesSent:     int64(sent[name]),
+			BytesReceived: int64(received[name]),
+			Errors:        int64(errors[name]),
+			Latency:       latency[name],
+			ResponseSize:  sizes[name],
+		}
+		if count := durationCount[name]; count > 0 {
+			site.LatencyAvg = durationSum[name] / count * 1000
+		}
+		result[name] = site
+	}
+	return result
+}
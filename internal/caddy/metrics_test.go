@@ -0,0 +1,325 @@
+package caddy
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// caddyMetricsSample is what Caddy's /metrics endpoint serves for two
+// servers: srv0 sends /api to a reverse_proxy and everything else to a
+// file_server, both inside a subroute, and srv1 answers with a
+// static_response. Each of srv0's 10 requests is recorded by the subroute
+// and by the handler that served it.
+const caddyMetricsSample = `
+# HELP caddy_http_request_duration_seconds Histogram of round-trip request durations.
+# TYPE caddy_http_request_duration_seconds histogram
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="0.005"} 1
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="0.01"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="0.025"} 4
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="0.05"} 5
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="0.1"} 6
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="0.25"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="0.5"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="1"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="2.5"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="5"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="10"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="subroute",method="GET",server="srv0",le="+Inf"} 7
+caddy_http_request_duration_seconds_sum{code="200",handler="subroute",method="GET",server="srv0"} 0.31
+caddy_http_request_duration_seconds_count{code="200",handler="subroute",method="GET",server="srv0"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="0.005"} 1
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="0.01"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="0.025"} 4
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="0.05"} 5
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="0.1"} 6
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="0.25"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="0.5"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="1"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="2.5"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="5"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="10"} 7
+caddy_http_request_duration_seconds_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="+Inf"} 7
+caddy_http_request_duration_seconds_sum{code="200",handler="reverse_proxy",method="GET",server="srv0"} 0.29
+caddy_http_request_duration_seconds_count{code="200",handler="reverse_proxy",method="GET",server="srv0"} 7
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="0.005"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="0.01"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="0.025"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="0.05"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="0.1"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="0.25"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="0.5"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="1"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="2.5"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="5"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="10"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="subroute",method="GET",server="srv0",le="+Inf"} 3
+caddy_http_request_duration_seconds_sum{code="404",handler="subroute",method="GET",server="srv0"} 0.006
+caddy_http_request_duration_seconds_count{code="404",handler="subroute",method="GET",server="srv0"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="0.005"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="0.01"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="0.025"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="0.05"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="0.1"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="0.25"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="0.5"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="1"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="2.5"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="5"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="10"} 3
+caddy_http_request_duration_seconds_bucket{code="404",handler="file_server",method="GET",server="srv0",le="+Inf"} 3
+caddy_http_request_duration_seconds_sum{code="404",handler="file_server",method="GET",server="srv0"} 0.005
+caddy_http_request_duration_seconds_count{code="404",handler="file_server",method="GET",server="srv0"} 3
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="0.005"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="0.01"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="0.025"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="0.05"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="0.1"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="0.25"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="0.5"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="1"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="2.5"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="5"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="10"} 2
+caddy_http_request_duration_seconds_bucket{code="200",handler="static_response",method="GET",server="srv1",le="+Inf"} 2
+caddy_http_request_duration_seconds_sum{code="200",handler="static_response",method="GET",server="srv1"} 0.001
+caddy_http_request_duration_seconds_count{code="200",handler="static_response",method="GET",server="srv1"} 2
+# HELP caddy_http_request_errors_total Number of requests resulting in middleware errors.
+# TYPE caddy_http_request_errors_total counter
+caddy_http_request_errors_total{handler="reverse_proxy",server="srv0"} 1
+caddy_http_request_errors_total{handler="subroute",server="srv0"} 1
+# HELP caddy_http_requests_in_flight Number of requests currently handled by this server.
+# TYPE caddy_http_requests_in_flight gauge
+caddy_http_requests_in_flight{handler="file_server",server="srv0"} 0
+caddy_http_requests_in_flight{handler="reverse_proxy",server="srv0"} 1
+caddy_http_requests_in_flight{handler="static_response",server="srv1"} 0
+caddy_http_requests_in_flight{handler="subroute",server="srv0"} 1
+# HELP caddy_http_requests_total Counter of HTTP(S) requests made.
+# TYPE caddy_http_requests_total counter
+caddy_http_requests_total{handler="file_server",server="srv0"} 3
+caddy_http_requests_total{handler="reverse_proxy",server="srv0"} 7
+caddy_http_requests_total{handler="static_response",server="srv1"} 2
+caddy_http_requests_total{handler="subroute",server="srv0"} 10
+# HELP caddy_http_response_size_bytes Size of the returned response.
+# TYPE caddy_http_response_size_bytes histogram
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="256"} 0
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="1024"} 0
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="4096"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="16384"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="65536"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="262144"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="1.04858e+06"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="4.1943e+06"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="subroute",method="GET",server="srv0",le="+Inf"} 7
+caddy_http_response_size_bytes_sum{code="200",handler="subroute",method="GET",server="srv0"} 14000
+caddy_http_response_size_bytes_count{code="200",handler="subroute",method="GET",server="srv0"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="256"} 0
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="1024"} 0
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="4096"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="16384"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="65536"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="262144"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="1.04858e+06"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="4.1943e+06"} 7
+caddy_http_response_size_bytes_bucket{code="200",handler="reverse_proxy",method="GET",server="srv0",le="+Inf"} 7
+caddy_http_response_size_bytes_sum{code="200",handler="reverse_proxy",method="GET",server="srv0"} 14000
+caddy_http_response_size_bytes_count{code="200",handler="reverse_proxy",method="GET",server="srv0"} 7
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="256"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="1024"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="4096"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="16384"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="65536"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="262144"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="1.04858e+06"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="4.1943e+06"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="subroute",method="GET",server="srv0",le="+Inf"} 3
+caddy_http_response_size_bytes_sum{code="404",handler="subroute",method="GET",server="srv0"} 57
+caddy_http_response_size_bytes_count{code="404",handler="subroute",method="GET",server="srv0"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="256"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="1024"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="4096"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="16384"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="65536"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="262144"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="1.04858e+06"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="4.1943e+06"} 3
+caddy_http_response_size_bytes_bucket{code="404",handler="file_server",method="GET",server="srv0",le="+Inf"} 3
+caddy_http_response_size_bytes_sum{code="404",handler="file_server",method="GET",server="srv0"} 57
+caddy_http_response_size_bytes_count{code="404",handler="file_server",method="GET",server="srv0"} 3
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="256"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="1024"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="4096"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="16384"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="65536"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="262144"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="1.04858e+06"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="4.1943e+06"} 2
+caddy_http_response_size_bytes_bucket{code="200",handler="static_response",method="GET",server="srv1",le="+Inf"} 2
+caddy_http_response_size_bytes_sum{code="200",handler="static_response",method="GET",server="srv1"} 24
+caddy_http_response_size_bytes_count{code="200",handler="static_response",method="GET",server="srv1"} 2
+# HELP process_start_time_seconds Start time of the process since unix epoch in seconds.
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1.7e+09
+`
+
+func TestHistogramsCaddySample(t *testing.T) {
+	pm, err := ParsePrometheusMetrics(caddyMetricsSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := pm.Histograms(metricRequestDuration)
+	if len(series) != 5 {
+		t.Fatalf("got %d duration series, want 5", len(series))
+	}
+
+	var proxied *Histogram
+	for i := range series {
+		if series[i].Labels["handler"] == "reverse_proxy" {
+			proxied = &series[i]
+		}
+	}
+	if proxied == nil {
+		t.Fatal("no reverse_proxy series")
+	}
+	want := Labels{"server": "srv0", "handler": "reverse_proxy", "code": "200", "method": "GET"}
+	if proxied.Labels.String() != want.String() {
+		t.Errorf("labels %s, want %s", proxied.Labels, want)
+	}
+	if proxied.Count != 7 || math.Abs(proxied.Sum-0.29) > 1e-9 {
+		t.Errorf("count=%v sum=%v, want 7 and 0.29", proxied.Count, proxied.Sum)
+	}
+
+	var bounds, counts []float64
+	for _, b := range proxied.Buckets {
+		bounds = append(bounds, b.UpperBound)
+		counts = append(counts, b.Count)
+	}
+	wantBounds := []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, math.Inf(1)}
+	wantCounts := []float64{1, 2, 4, 5, 6, 7, 7, 7, 7, 7, 7, 7}
+	if !slices.Equal(bounds, wantBounds) || !slices.Equal(counts, wantCounts) {
+		t.Errorf("buckets %v: %v, want %v: %v", bounds, counts, wantBounds, wantCounts)
+	}
+}
+
+func TestNewInstanceMetricsCaddySample(t *testing.T) {
+	pm, err := ParsePrometheusMetrics(caddyMetricsSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_600, 0)
+	m := NewInstanceMetrics("caddy1", pm, now)
+
+	if m.NumRequests != 12 {
+		t.Errorf("requests %d, want 12", m.NumRequests)
+	}
+	if m.TotalTraffic != 14081 {
+		t.Errorf("traffic %d, want 14081", m.TotalTraffic)
+	}
+	if m.Errors != 1 || m.InFlight != 1 {
+		t.Errorf("errors=%d in flight=%d, want 1 and 1", m.Errors, m.InFlight)
+	}
+	if m.Uptime != 600 {
+		t.Errorf("uptime %d, want 600", m.Uptime)
+	}
+	if m.StatusCodes[200] != 9 || m.StatusCodes[404] != 3 || len(m.StatusCodes) != 2 {
+		t.Errorf("status codes %v, want 200: 9 and 404: 3", m.StatusCodes)
+	}
+
+	// One series per request: reverse_proxy and file_server, which tie
+	// with the subroute, and static_response
+	lat := m.Latency
+	if lat == nil {
+		t.Fatal("no latency histogram")
+	}
+	wantCounts := []float64{6, 7, 9, 10, 11, 12, 12, 12, 12, 12, 12}
+	if lat.Count != 12 || math.Abs(lat.Sum-0.296) > 1e-9 || !slices.Equal(lat.Counts, wantCounts) {
+		t.Errorf("latency count=%v sum=%v counts=%v, want 12, 0.296 and %v", lat.Count, lat.Sum, lat.Counts, wantCounts)
+	}
+	if m.ResponseSize == nil || m.ResponseSize.Count != 12 || m.ResponseSize.Sum != 14081 {
+		t.Errorf("response size %+v, want 12 responses of 14081 bytes", m.ResponseSize)
+	}
+
+	servers := []struct {
+		name     string
+		requests int64
+		sent     int64
+		avg      float64 // Milliseconds
+	}{
+		{"srv0", 10, 14057, 29.5},
+		{"srv1", 2, 24, 0.5},
+	}
+	for _, want := range servers {
+		got, ok := m.Servers[want.name]
+		if !ok {
+			t.Errorf("no figures for server %s", want.name)
+			continue
+		}
+		if got.Requests != want.requests || got.BytesSent != want.sent || math.Abs(got.LatencyAvg-want.avg) > 1e-9 {
+			t.Errorf("server %s: requests=%d sent=%d avg=%v, want %d, %d and %v",
+				want.name, got.Requests, got.BytesSent, got.LatencyAvg, want.requests, want.sent, want.avg)
+		}
+	}
+
+	// Per handler every handler counts its own requests
+	handlers := map[string]int64{"subroute": 10, "reverse_proxy": 7, "file_server": 3, "static_response": 2}
+	if len(m.Handlers) != len(handlers) {
+		t.Errorf("got %d handlers, want %d", len(m.Handlers), len(handlers))
+	}
+	for name, requests := range handlers {
+		if got := m.Handlers[name].Requests; got != requests {
+			t.Errorf("handler %s: %d requests, want %d", name, got, requests)
+		}
+	}
+}
+
+func TestCountOnce(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		requests float64
+	}{
+		{
+			name: "nested handlers",
+			input: `caddy_http_requests_total{handler="subroute",server="srv0"} 10
+caddy_http_requests_total{handler="reverse_proxy",server="srv0"} 7`,
+			requests: 10,
+		},
+		{
+			name: "one series per server",
+			input: `caddy_http_requests_total{handler="subroute",server="srv0"} 10
+caddy_http_requests_total{handler="file_server",server="srv1"} 4`,
+			requests: 14,
+		},
+		{
+			name:     "without handler label",
+			input:    `caddy_http_requests_total{server="srv0"} 5`,
+			requests: 5,
+		},
+		{
+			name: "other metrics untouched",
+			input: `caddy_http_requests_total{handler="a",server="srv0"} 3
+caddy_http_requests_total{handler="b",server="srv0"} 3
+caddy_reverse_proxy_upstreams_healthy{handler="a",upstream="x"} 1
+caddy_reverse_proxy_upstreams_healthy{handler="b",upstream="x"} 1`,
+			requests: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, err := ParsePrometheusMetrics(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			once := countOnce(pm)
+			if got := once.Sum(metricRequestsTotal, nil); got != tt.requests {
+				t.Errorf("requests %v, want %v", got, tt.requests)
+			}
+			if got, want := once.Sum("caddy_reverse_proxy_upstreams_healthy", nil), pm.Sum("caddy_reverse_proxy_upstreams_healthy", nil); got != want {
+				t.Errorf("unrelated metric changed from %v to %v", want, got)
+			}
+		})
+	}
+}
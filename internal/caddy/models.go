@@ -23,7 +23,9 @@ type CaddyInstance struct {
 	URL        string         `json:"url"`          // Admin API URL (e.g., http://localhost:2019)
 	APIKeyFile string         `json:"api_key_file"` // Path to file containing API key
 	Status     InstanceStatus `json:"status"`
-	Tags       []string       `json:"tags,omitempty"` // Grouping tags
+	Tags       []string       `json:"tags,omitempty"`       // Grouping tags
+	LogFile    string         `json:"log_file,omitempty"`   // Local JSON log file to tail
+	LogSource  string         `json:"log_source,omitempty"` // Host that ships logs to the sink (defaults to URL host)
 	LastPing   time.Time      `json:"last_ping,omitempty"`
 	CreatedAt  time.Time      `json:"created_at"`
 	UpdatedAt  time.Time      `json:"updated_at"`
@@ -50,11 +52,17 @@ func (c *CaddyInstance) IsOnline() bool {
 type InstanceMetrics struct {
 	InstanceID   string                 `json:"instance_id"`
 	Timestamp    time.Time              `json:"timestamp"`
-	Uptime       int64                  `json:"uptime"`       // Uptime in seconds
-	NumRequests  int64                  `json:"num_requests"` // Total requests
-	TotalTraffic int64                  `json:"total_bytes"`  // Total bytes served
-	Sites        map[string]SiteMetrics `json:"sites,omitempty"`
-	StatusCodes  map[int]int64          `json:"status_codes"` // HTTP status code counts
+	Uptime       int64                  `json:"uptime"`                  // Uptime in seconds
+	NumRequests  int64                  `json:"num_requests"`            // Total requests
+	TotalTraffic int64                  `json:"total_bytes"`             // Total bytes served
+	Errors       int64                  `json:"errors"`                  // Total handler errors
+	InFlight     int64                  `json:"in_flight"`               // Requests in flight at collection time
+	Sites        map[string]SiteMetrics `json:"sites,omitempty"`         // Keyed by host
+	Servers      map[string]SiteMetrics `json:"servers,omitempty"`       // Keyed by server name
+	Handlers     map[string]SiteMetrics `json:"handlers,omitempty"`      // Keyed by handler module
+	StatusCodes  map[int]int64          `json:"status_codes"`            // HTTP status code counts
+	Latency      *HistogramSnapshot     `json:"latency,omitempty"`       // Request duration histogram (seconds)
+	ResponseSize *HistogramSnapshot     `json:"response_size,omitempty"` // Response size histogram (bytes)
 }
 
 // SiteMetrics represents per-site metrics
@@ -63,16 +71,11 @@ type SiteMetrics struct {
 	Requests      int64   `json:"requests"`
 	BytesSent     int64   `json:"bytes_sent"`
 	BytesReceived int64   `json:"bytes_received"`
+	Errors        int64   `json:"errors,omitempty"`
 	LatencyAvg    float64 `json:"latency_avg_ms"`
-}
 
-// PrometheusMetrics represents parsed Prometheus metrics from Caddy
-type PrometheusMetrics struct {
-	RequestsTotal    float64            `json:"requests_total"`
-	ResponseSizes    map[string]float64 `json:"response_sizes"`
-	RequestDurations map[string]float64 `json:"request_durations"`
-	RequestsByCode   map[string]float64 `json:"requests_by_code"`
-	RequestsByHost   map[string]float64 `json:"requests_by_host"`
+	Latency      *HistogramSnapshot `json:"latency,omitempty"`
+	ResponseSize *HistogramSnapshot `json:"response_size,omitempty"`
 }
 
 // ServerInfo represents basic Caddy server information
@@ -88,6 +91,8 @@ type Site struct {
 	Name   string      `json:"name"`
 	Config interface{} `json:"config"`
 	Listen []string    `json:"listen"`
+	Hosts  []string    `json:"hosts"`  // Hosts matched by the enabled routes
+	Routes []Route     `json:"routes"` // Nil if the routes couldn't be parsed
 }
 
 // Config represents Caddy configuration
@@ -97,6 +102,21 @@ type Config struct {
 	Storage interface{}    `json:"storage,omitempty"`
 }
 
+// AdaptResult is the JSON config Caddy's /adapt endpoint produced from a
+// Caddyfile, with the adapter's warnings
+type AdaptResult struct {
+	Config   json.RawMessage `json:"config"`
+	Warnings []AdaptWarning  `json:"warnings"`
+}
+
+// AdaptWarning is a problem the Caddyfile adapter found but could work around
+type AdaptWarning struct {
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Directive string `json:"directive,omitempty"`
+	Message   string `json:"message"`
+}
+
 // AdminConfig represents the admin API configuration
 type AdminConfig struct {
 	Listen string `json:"listen"`
@@ -104,10 +124,42 @@ type AdminConfig struct {
 
 // LogEntry represents a log entry from Caddy
 type LogEntry struct {
-	Time    time.Time `json:"time"`
-	Level   string    `json:"level"`
-	Message string    `json:"msg"`
-	Logger  string    `json:"logger,omitempty"`
+	Time        time.Time              `json:"time"`
+	Level       string                 `json:"level"`
+	Message     string                 `json:"msg"`
+	Logger      string                 `json:"logger,omitempty"`
+	Caller      string                 `json:"caller,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	Request     *LogRequest            `json:"request,omitempty"`
+	Status      int                    `json:"status,omitempty"`
+	Size        int64                  `json:"size,omitempty"`
+	BytesRead   int64                  `json:"bytes_read,omitempty"`
+	Duration    float64                `json:"duration,omitempty"` // Seconds
+	UserID      string                 `json:"user_id,omitempty"`
+	RespHeaders map[string][]string    `json:"resp_headers,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"` // Any other structured fields
+}
+
+// LogRequest represents the request object of a Caddy access log entry
+type LogRequest struct {
+	RemoteIP   string              `json:"remote_ip,omitempty"`
+	RemotePort string              `json:"remote_port,omitempty"`
+	ClientIP   string              `json:"client_ip,omitempty"`
+	Proto      string              `json:"proto,omitempty"`
+	Method     string              `json:"method,omitempty"`
+	Host       string              `json:"host,omitempty"`
+	URI        string              `json:"uri,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	TLS        *LogTLS             `json:"tls,omitempty"`
+}
+
+// LogTLS represents the TLS connection state of a logged request
+type LogTLS struct {
+	Resumed     bool   `json:"resumed"`
+	Version     int    `json:"version"`
+	CipherSuite int    `json:"cipher_suite"`
+	Proto       string `json:"proto,omitempty"`
+	ServerName  string `json:"server_name,omitempty"`
 }
 
 // InstanceRequest represents a request to add/update a Caddy instance
@@ -116,13 +168,16 @@ type InstanceRequest struct {
 	URL        string   `json:"url" binding:"required"`
 	APIKeyFile string   `json:"api_key_file"`
 	Tags       []string `json:"tags,omitempty"`
+	LogFile    string   `json:"log_file,omitempty"`
+	LogSource  string   `json:"log_source,omitempty"`
 }
 
 // InstanceResponse represents the API response for an instance
 type InstanceResponse struct {
-	Instance *CaddyInstance   `json:"instance"`
-	Metrics  *InstanceMetrics `json:"metrics,omitempty"`
-	Error    string           `json:"error,omitempty"`
+	Instance  *CaddyInstance   `json:"instance"`
+	Metrics   *InstanceMetrics `json:"metrics,omitempty"`
+	Collector *CollectorStatus `json:"collector,omitempty"`
+	Error     string           `json:"error,omitempty"`
 }
 
 // InstancesListResponse represents the API response for listing instances
@@ -137,5 +192,6 @@ type AnalyticsResponse struct {
 	History    []*InstanceMetrics `json:"history,omitempty"`
 	TotalReqs  int64              `json:"total_requests"`
 	TotalBytes int64              `json:"total_bytes"`
+	Traffic    *AnalyticsResult   `json:"traffic,omitempty"`
 	Error      string             `json:"error,omitempty"`
 }
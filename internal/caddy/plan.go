@@ -0,0 +1,265 @@
+package caddy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigPlan describes what loading a proposed config would change
+type ConfigPlan struct {
+	Changes []JSONChange      `json:"changes"`
+	Summary ConfigPlanSummary `json:"summary"`
+}
+
+// ConfigPlanSummary condenses a plan into its operational effect
+type ConfigPlanSummary struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Changed int `json:"changed"`
+
+	ServersAdded   []string `json:"servers_added"`
+	ServersRemoved []string `json:"servers_removed"`
+	ServersChanged []string `json:"servers_changed"`
+
+	HostsAdded       []string `json:"hosts_added"` // Hosts matched by routes
+	HostsRemoved     []string `json:"hosts_removed"`
+	UpstreamsAdded   []string `json:"upstreams_added"` // reverse_proxy dial addresses
+	UpstreamsRemoved []string `json:"upstreams_removed"`
+	TLSPolicies      []string `json:"tls_policies"` // Paths of TLS policies and settings that change
+}
+
+// PlanConfig compares an instance's live config with a proposed one
+// without applying anything
+func (s *ConfigService) PlanConfig(instanceID string, proposed []byte) (*ConfigPlan, error) {
+	inst, err := s.instanceService.Get(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClientFromInstance(inst, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	// The raw config keeps sections Config doesn't model, which would
+	// otherwise show up as additions
+	live, err := client.GetRawConfig()
+	if err != nil {
+		return nil, err
+	}
+	return PlanConfigChange(live, proposed)
+}
+
+// PlanConfigChange diffs two configs and summarizes the difference
+func PlanConfigChange(current, proposed []byte) (*ConfigPlan, error) {
+	var currentDoc, proposedDoc any
+	if err := unmarshalJSONDoc(current, &currentDoc); err != nil {
+		return nil, fmt.Errorf("invalid current config: %w", err)
+	}
+	if err := unmarshalJSONDoc(proposed, &proposedDoc); err != nil {
+		return nil, fmt.Errorf("invalid proposed config: %w", err)
+	}
+
+	plan := &ConfigPlan{Changes: []JSONChange{}}
+	diffValues("", currentDoc, proposedDoc, &plan.Changes)
+
+	sum := &plan.Summary
+	sum.HostsAdded, sum.HostsRemoved = setDifference(collectHosts(currentDoc), collectHosts(proposedDoc))
+	sum.UpstreamsAdded, sum.UpstreamsRemoved = setDifference(collectUpstreams(currentDoc), collectUpstreams(proposedDoc))
+
+	currentServers, proposedServers := serverNames(currentDoc), serverNames(proposedDoc)
+	sum.ServersAdded, sum.ServersRemoved = setDifference(currentServers, proposedServers)
+
+	changed := map[string]bool{}
+	tls := map[string]bool{}
+	for _, c := range plan.Changes {
+		switch c.Op {
+		case DiffAdd:
+			sum.Added++
+		case DiffRemove:
+			sum.Removed++
+		default:
+			sum.Changed++
+		}
+
+		segments := splitJSONPointer(c.Path)
+		if len(segments) > 4 && segments[0] == "apps" && segments[1] == "http" && segments[2] == "servers" {
+			changed[segments[3]] = true
+		}
+		if policy := tlsPolicyPath(segments); policy != "" {
+			tls[policy] = true
+		}
+	}
+	sum.ServersChanged = sortedKeys(changed)
+	sum.TLSPolicies = sortedKeys(tls)
+
+	return plan, nil
+}
+
+// String describes the plan in one line, e.g. for audit details
+func (p *ConfigPlan) String() string {
+	s := p.Summary
+	if len(p.Changes) == 0 {
+		return "no changes"
+	}
+
+	parts := []string{fmt.Sprintf("%d added, %d removed, %d changed", s.Added, s.Removed, s.Changed)}
+	list := func(label string, items []string) {
+		if len(items) > 0 {
+			parts = append(parts, label+" "+strings.Join(items, ","))
+		}
+	}
+	list("+servers", s.ServersAdded)
+	list("-servers", s.ServersRemoved)
+	list("~servers", s.ServersChanged)
+	list("+hosts", s.HostsAdded)
+	list("-hosts", s.HostsRemoved)
+	list("+upstreams", s.UpstreamsAdded)
+	list("-upstreams", s.UpstreamsRemoved)
+	if len(s.TLSPolicies) > 0 {
+		parts = append(parts, fmt.Sprintf("%d TLS policies", len(s.TLSPolicies)))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// collectHosts returns the hosts matched anywhere in the http app,
+// including routes nested in subroutes
+func collectHosts(doc any) map[string]bool {
+	hosts := map[string]bool{}
+	walkJSON(httpApp(doc), func(key string, value any) {
+		if key != "match" {
+			return
+		}
+		matchers, _ := value.([]any)
+		for _, m := range matchers {
+			matcher, _ := m.(map[string]any)
+			list, _ := matcher["host"].([]any)
+			for _, h := range list {
+				if host, ok := h.(string); ok {
+					hosts[host] = true
+				}
+			}
+		}
+	})
+	return hosts
+}
+
+// collectUpstreams returns the dial addresses of every reverse_proxy
+// upstream in the http app
+func collectUpstreams(doc any) map[string]bool {
+	upstreams := map[string]bool{}
+	walkJSON(httpApp(doc), func(key string, value any) {
+		if key != "upstreams" {
+			return
+		}
+		list, _ := value.([]any)
+		for _, u := range list {
+			upstream, _ := u.(map[string]any)
+			if dial, ok := upstream["dial"].(string); ok {
+				upstreams[dial] = true
+			}
+		}
+	})
+	return upstreams
+}
+
+// serverNames returns the names of the http app's servers
+func serverNames(doc any) map[string]bool {
+	names := map[string]bool{}
+	app, _ := httpApp(doc).(map[string]any)
+	servers, _ := app["servers"].(map[string]any)
+	for name := range servers {
+		names[name] = true
+	}
+	return names
+}
+
+func httpApp(doc any) any {
+	root, _ := doc.(map[string]any)
+	apps, _ := root["apps"].(map[string]any)
+	return apps["http"]
+}
+
+// walkJSON calls fn for every key/value pair of every object in v
+func walkJSON(v any, fn func(key string, value any)) {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			fn(k, child)
+			walkJSON(child, fn)
+		}
+	case []any:
+		for _, child := range t {
+			walkJSON(child, fn)
+		}
+	}
+}
+
+// tlsPolicyPath returns the path of the TLS policy or setting a change
+// falls under, or "" if it doesn't touch TLS. Policies are reported by
+// index, e.g. /apps/tls/automation/policies/0 or
+// /apps/http/servers/srv0/tls_connection_policies/1.
+func tlsPolicyPath(segments []string) string {
+	for i, seg := range segments {
+		if seg == "tls_connection_policies" {
+			return joinJSONPointer(segments[:min(i+2, len(segments))])
+		}
+	}
+	if len(segments) < 2 || segments[0] != "apps" || segments[1] != "tls" {
+		return ""
+	}
+	n := 3 // /apps/tls/{section}
+	if len(segments) > 3 && segments[2] == "automation" && segments[3] == "policies" {
+		n = 5 // /apps/tls/automation/policies/{index}
+	}
+	return joinJSONPointer(segments[:min(n, len(segments))])
+}
+
+// splitJSONPointer splits a JSON Pointer into unescaped segments
+func splitJSONPointer(path string) []string {
+	if path == "" {
+		return nil
+	}
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, seg := range segments {
+		segments[i] = strings.ReplaceAll(strings.ReplaceAll(seg, "~1", "/"), "~0", "~")
+	}
+	return segments
+}
+
+func joinJSONPointer(segments []string) string {
+	var b strings.Builder
+	for _, seg := range segments {
+		b.WriteString("/" + escapeJSONPointer(seg))
+	}
+	return b.String()
+}
+
+// setDifference returns the keys only in b and the keys only in a, sorted
+func setDifference(a, b map[string]bool) (added, removed []string) {
+	added, removed = []string{}, []string{}
+	for k := range b {
+		if !a[k] {
+			added = append(added, k)
+		}
+	}
+	for k := range a {
+		if !b[k] {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,220 @@
+package caddy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// planBaseConfig has one server with a proxied host and a subroute that
+// proxies another, plus TLS connection and automation policies
+const planBaseConfig = `{
+	"admin": {"listen": "localhost:2019"},
+	"apps": {
+		"http": {"servers": {"srv0": {
+			"listen": [":443"],
+			"tls_connection_policies": [{}],
+			"routes": [
+				{"match": [{"host": ["example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.1:80"}]}]},
+				{"handle": [{"handler": "subroute", "routes": [
+					{"match": [{"host": ["api.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.2:80"}]}]}
+				]}]}
+			]
+		}}},
+		"tls": {"automation": {"policies": [{"subjects": ["example.com"]}]}}
+	}
+}`
+
+// jsonAt returns the object at path in doc, where path segments are
+// keys or, for arrays, indices
+func jsonAt(t *testing.T, doc any, path ...any) map[string]any {
+	t.Helper()
+	for _, seg := range path {
+		switch seg := seg.(type) {
+		case string:
+			doc = doc.(map[string]any)[seg]
+		case int:
+			doc = doc.([]any)[seg]
+		}
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		t.Fatalf("%v is not an object", path)
+	}
+	return obj
+}
+
+func TestPlanConfigChange(t *testing.T) {
+	srv0 := []any{"apps", "http", "servers", "srv0"}
+	nested := append(slices.Clone(srv0), "routes", 1, "handle", 0, "routes", 0)
+
+	tests := []struct {
+		name string
+		edit func(t *testing.T, doc map[string]any)
+		want ConfigPlanSummary
+		plan string // String() of the plan
+	}{
+		{
+			name: "unchanged",
+			edit: func(t *testing.T, doc map[string]any) {},
+			plan: "no changes",
+		},
+		{
+			name: "host added",
+			edit: func(t *testing.T, doc map[string]any) {
+				match := jsonAt(t, doc, append(slices.Clone(srv0), "routes", 0, "match", 0)...)
+				match["host"] = append(match["host"].([]any), "www.example.com")
+			},
+			want: ConfigPlanSummary{Added: 1, ServersChanged: []string{"srv0"}, HostsAdded: []string{"www.example.com"}},
+			plan: "1 added, 0 removed, 0 changed; ~servers srv0; +hosts www.example.com",
+		},
+		{
+			name: "nested upstream replaced",
+			edit: func(t *testing.T, doc map[string]any) {
+				jsonAt(t, doc, append(slices.Clone(nested), "handle", 0, "upstreams", 0)...)["dial"] = "10.0.0.3:80"
+			},
+			want: ConfigPlanSummary{Changed: 1, ServersChanged: []string{"srv0"},
+				UpstreamsAdded: []string{"10.0.0.3:80"}, UpstreamsRemoved: []string{"10.0.0.2:80"}},
+			plan: "0 added, 0 removed, 1 changed; ~servers srv0; +upstreams 10.0.0.3:80; -upstreams 10.0.0.2:80",
+		},
+		{
+			name: "nested route removed",
+			edit: func(t *testing.T, doc map[string]any) {
+				jsonAt(t, doc, append(slices.Clone(srv0), "routes", 1, "handle", 0)...)["routes"] = []any{}
+			},
+			want: ConfigPlanSummary{Removed: 1, ServersChanged: []string{"srv0"},
+				HostsRemoved: []string{"api.example.com"}, UpstreamsRemoved: []string{"10.0.0.2:80"}},
+			plan: "0 added, 1 removed, 0 changed; ~servers srv0; -hosts api.example.com; -upstreams 10.0.0.2:80",
+		},
+		{
+			name: "server added and removed",
+			edit: func(t *testing.T, doc map[string]any) {
+				servers := jsonAt(t, doc, "apps", "http", "servers")
+				servers["srv1"] = map[string]any{"listen": []any{":8080"}}
+				delete(servers, "srv0")
+			},
+			want: ConfigPlanSummary{Added: 1, Removed: 1, ServersAdded: []string{"srv1"}, ServersRemoved: []string{"srv0"},
+				HostsRemoved: []string{"api.example.com", "example.com"}, UpstreamsRemoved: []string{"10.0.0.1:80", "10.0.0.2:80"}},
+			plan: "1 added, 1 removed, 0 changed; +servers srv1; -servers srv0; -hosts api.example.com,example.com; -upstreams 10.0.0.1:80,10.0.0.2:80",
+		},
+		{
+			name: "TLS policies",
+			edit: func(t *testing.T, doc map[string]any) {
+				jsonAt(t, doc, "apps", "tls", "automation", "policies", 0)["subjects"] = []any{"example.com", "www.example.com"}
+				jsonAt(t, doc, append(slices.Clone(srv0), "tls_connection_policies", 0)...)["protocol_min"] = "tls1.3"
+			},
+			want: ConfigPlanSummary{Added: 2, ServersChanged: []string{"srv0"},
+				TLSPolicies: []string{"/apps/http/servers/srv0/tls_connection_policies/0", "/apps/tls/automation/policies/0"}},
+			plan: "2 added, 0 removed, 0 changed; ~servers srv0; 2 TLS policies",
+		},
+		{
+			name: "outside the http app",
+			edit: func(t *testing.T, doc map[string]any) {
+				jsonAt(t, doc, "admin")["listen"] = "localhost:2020"
+			},
+			want: ConfigPlanSummary{Changed: 1},
+			plan: "0 added, 0 removed, 1 changed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]any
+			if err := json.Unmarshal([]byte(planBaseConfig), &doc); err != nil {
+				t.Fatal(err)
+			}
+			tt.edit(t, doc)
+			proposed, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := PlanConfigChange([]byte(planBaseConfig), proposed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, want := plan.Summary, tt.want
+			if got.Added != want.Added || got.Removed != want.Removed || got.Changed != want.Changed {
+				t.Errorf("%d added, %d removed, %d changed, want %d, %d and %d",
+					got.Added, got.Removed, got.Changed, want.Added, want.Removed, want.Changed)
+			}
+			lists := []struct {
+				name      string
+				got, want []string
+			}{
+				{"servers added", got.ServersAdded, want.ServersAdded},
+				{"servers removed", got.ServersRemoved, want.ServersRemoved},
+				{"servers changed", got.ServersChanged, want.ServersChanged},
+				{"hosts added", got.HostsAdded, want.HostsAdded},
+				{"hosts removed", got.HostsRemoved, want.HostsRemoved},
+				{"upstreams added", got.UpstreamsAdded, want.UpstreamsAdded},
+				{"upstreams removed", got.UpstreamsRemoved, want.UpstreamsRemoved},
+				{"TLS policies", got.TLSPolicies, want.TLSPolicies},
+			}
+			for _, l := range lists {
+				// Empty lists are encoded as [], never null
+				if l.got == nil || !slices.Equal(l.got, l.want) {
+					t.Errorf("%s: %#v, want %v", l.name, l.got, l.want)
+				}
+			}
+			if s := plan.String(); s != tt.plan {
+				t.Errorf("plan %q, want %q", s, tt.plan)
+			}
+		})
+	}
+}
+
+func TestPlanConfigChangeInvalid(t *testing.T) {
+	if _, err := PlanConfigChange([]byte(planBaseConfig), []byte(`{"apps":`)); err == nil {
+		t.Error("planned an invalid proposed config")
+	}
+	if _, err := PlanConfigChange([]byte(`[1,]`), []byte(planBaseConfig)); err == nil {
+		t.Error("planned against an invalid current config")
+	}
+}
+
+// newTestConfigService returns a config service with one instance whose
+// admin API is served by handler
+func newTestConfigService(t *testing.T, handler http.Handler) (*ConfigService, *CaddyInstance) {
+	t.Helper()
+	admin := httptest.NewServer(handler)
+	t.Cleanup(admin.Close)
+
+	store, err := NewInstanceStore(filepath.Join(t.TempDir(), "instances.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := NewInstanceService(store)
+	inst, err := instances.Create(&InstanceRequest{Name: "test", URL: admin.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConfigService(instances, nil), inst
+}
+
+func TestPlanConfig(t *testing.T) {
+	s, inst := newTestConfigService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/config/" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(planBaseConfig))
+	}))
+
+	plan, err := s.PlanConfig(inst.ID, []byte(`{"admin": {"listen": "localhost:2019"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0 added, 1 removed, 0 changed; -servers srv0; -hosts api.example.com,example.com; -upstreams 10.0.0.1:80,10.0.0.2:80"
+	if got := plan.String(); got != want {
+		t.Errorf("plan %q, want %q", got, want)
+	}
+
+	if _, err := s.PlanConfig("missing", []byte(`{}`)); err == nil {
+		t.Error("planned a change for an unknown instance")
+	}
+}
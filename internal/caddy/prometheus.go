@@ -0,0 +1,538 @@
+package caddy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricType is the declared type of a metric family
+type MetricType string
+
+const (
+	MetricCounter        MetricType = "counter"
+	MetricGauge          MetricType = "gauge"
+	MetricHistogram      MetricType = "histogram"
+	MetricGaugeHistogram MetricType = "gaugehistogram"
+	MetricSummary        MetricType = "summary"
+	MetricInfo           MetricType = "info"
+	MetricStateSet       MetricType = "stateset"
+	MetricUntyped        MetricType = "untyped"
+)
+
+// Labels is a set of metric labels
+type Labels map[string]string
+
+// Without returns a copy of the labels without the given names
+func (l Labels) Without(names ...string) Labels {
+	out := make(Labels, len(l))
+	for k, v := range l {
+		out[k] = v
+	}
+	for _, n := range names {
+		delete(out, n)
+	}
+	return out
+}
+
+// Matches reports whether every label in match has the same value in l
+func (l Labels) Matches(match Labels) bool {
+	for k, v := range match {
+		if l[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String renders the labels in exposition format with sorted names
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for k := range l {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(l[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Exemplar is an OpenMetrics exemplar attached to a sample
+type Exemplar struct {
+	Labels    Labels     `json:"labels"`
+	Value     float64    `json:"value"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// Sample is a single exposed series value
+type Sample struct {
+	Name      string     `json:"name"`
+	Labels    Labels     `json:"labels"`
+	Value     float64    `json:"value"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Exemplar  *Exemplar  `json:"exemplar,omitempty"`
+}
+
+// MetricFamily groups the samples of one metric with its metadata
+type MetricFamily struct {
+	Name    string     `json:"name"`
+	Type    MetricType `json:"type"`
+	Help    string     `json:"help,omitempty"`
+	Unit    string     `json:"unit,omitempty"`
+	Samples []Sample   `json:"samples"`
+}
+
+// Bucket is a cumulative histogram bucket
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      float64 `json:"count"`
+}
+
+// Histogram is one labelled series of a histogram family
+type Histogram struct {
+	Labels  Labels   `json:"labels"`
+	Buckets []Bucket `json:"buckets"` // Sorted by upper bound
+	Sum     float64  `json:"sum"`
+	Count   float64  `json:"count"`
+}
+
+// PrometheusMetrics represents parsed Prometheus metrics from Caddy
+type PrometheusMetrics struct {
+	Families map[string]*MetricFamily `json:"families"`
+}
+
+// Family returns the metric family with the given name, or nil
+func (pm *PrometheusMetrics) Family(name string) *MetricFamily {
+	return pm.Families[name]
+}
+
+// Samples returns the samples called name whose labels match
+func (pm *PrometheusMetrics) Samples(name string, match Labels) []Sample {
+	var result []Sample
+	for _, f := range pm.Families {
+		for _, s := range f.Samples {
+			if s.Name == name && s.Labels.Matches(match) {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+// Sum adds up the samples called name whose labels match
+func (pm *PrometheusMetrics) Sum(name string, match Labels) float64 {
+	var total float64
+	for _, s := range pm.Samples(name, match) {
+		total += s.Value
+	}
+	return total
+}
+
+// SumBy adds up the samples called name grouped by the value of label.
+// Samples without the label are skipped.
+func (pm *PrometheusMetrics) SumBy(name, label string) map[string]float64 {
+	result := make(map[string]float64)
+	for _, s := range pm.Samples(name, nil) {
+		if v, ok := s.Labels[label]; ok {
+			result[v] += s.Value
+		}
+	}
+	return result
+}
+
+// Histograms returns the series of a histogram family, one per label set
+func (pm *PrometheusMetrics) Histograms(name string) []Histogram {
+	f := pm.Families[name]
+	if f == nil || (f.Type != MetricHistogram && f.Type != MetricGaugeHistogram) {
+		return nil
+	}
+
+	series := make(map[string]*Histogram)
+	var order []string
+	get := func(labels Labels) *Histogram {
+		key := labels.String()
+		h, ok := series[key]
+		if !ok {
+			h = &Histogram{Labels: labels}
+			series[key] = h
+			order = append(order, key)
+		}
+		return h
+	}
+
+	for _, s := range f.Samples {
+		switch s.Name {
+		case name + "_bucket":
+			le, err := parseFloat(s.Labels["le"])
+			if err != nil {
+				continue
+			}
+			h := get(s.Labels.Without("le"))
+			h.Buckets = append(h.Buckets, Bucket{UpperBound: le, Count: s.Value})
+		case name + "_sum", name + "_gsum":
+			get(s.Labels).Sum = s.Value
+		case name + "_count", name + "_gcount":
+			get(s.Labels).Count = s.Value
+		}
+	}
+
+	result := make([]Histogram, 0, len(order))
+	for _, key := range order {
+		h := series[key]
+		sort.Slice(h.Buckets, func(i, j int) bool { return h.Buckets[i].UpperBound < h.Buckets[j].UpperBound })
+		if h.Count == 0 && len(h.Buckets) > 0 {
+			h.Count = h.Buckets[len(h.Buckets)-1].Count
+		}
+		result = append(result, *h)
+	}
+	return result
+}
+
+// familySuffixes maps a family type to the sample name suffixes it owns
+var familySuffixes = map[MetricType][]string{
+	MetricCounter:        {"_total", "_created"},
+	MetricHistogram:      {"_bucket", "_sum", "_count", "_created"},
+	MetricGaugeHistogram: {"_bucket", "_gsum", "_gcount"},
+	MetricSummary:        {"_sum", "_count", "_created"},
+	MetricInfo:           {"_info"},
+}
+
+// ParsePrometheusMetrics parses the Prometheus text exposition format
+// (0.0.4) or OpenMetrics 1.0 into metric families. OpenMetrics is detected
+// by its "# EOF" terminator, which also switches timestamps from
+// milliseconds to seconds.
+func ParsePrometheusMetrics(metricsText string) (*PrometheusMetrics, error) {
+	p := &promParser{
+		pm:          &PrometheusMetrics{Families: make(map[string]*MetricFamily)},
+		openMetrics: isOpenMetrics(metricsText),
+	}
+
+	for i, line := range strings.Split(metricsText, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if err := p.parseLine(line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+
+	return p.pm, nil
+}
+
+func isOpenMetrics(text string) bool {
+	text = strings.TrimRight(text, "\r\n ")
+	return strings.HasSuffix(text, "# EOF")
+}
+
+type promParser struct {
+	pm          *PrometheusMetrics
+	openMetrics bool
+}
+
+func (p *promParser) family(name string) *MetricFamily {
+	f, ok := p.pm.Families[name]
+	if !ok {
+		f = &MetricFamily{Name: name, Type: MetricUntyped}
+		p.pm.Families[name] = f
+	}
+	return f
+}
+
+// familyFor finds the declared family a sample name belongs to
+func (p *promParser) familyFor(sampleName string) *MetricFamily {
+	if f, ok := p.pm.Families[sampleName]; ok {
+		return f
+	}
+	for typ, suffixes := range familySuffixes {
+		for _, suffix := range suffixes {
+			if !strings.HasSuffix(sampleName, suffix) {
+				continue
+			}
+			base := strings.TrimSuffix(sampleName, suffix)
+			if f, ok := p.pm.Families[base]; ok && f.Type == typ {
+				return f
+			}
+		}
+	}
+	return p.family(sampleName)
+}
+
+func (p *promParser) parseLine(line string) error {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(trimmed, "#") {
+		return p.parseComment(trimmed)
+	}
+
+	sample, err := p.parseSample(trimmed)
+	if err != nil {
+		return err
+	}
+
+	f := p.familyFor(sample.Name)
+	f.Samples = append(f.Samples, *sample)
+	return nil
+}
+
+func (p *promParser) parseComment(line string) error {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), " ", 3)
+	if len(fields) < 2 {
+		return nil // Plain comment or "# EOF"
+	}
+
+	keyword, name := fields[0], fields[1]
+	var rest string
+	if len(fields) == 3 {
+		rest = fields[2]
+	}
+
+	switch keyword {
+	case "HELP":
+		p.family(name).Help = unescapeHelp(rest)
+	case "TYPE":
+		typ := MetricType(strings.ToLower(strings.TrimSpace(rest)))
+		switch typ {
+		case MetricCounter, MetricGauge, MetricHistogram, MetricGaugeHistogram,
+			MetricSummary, MetricInfo, MetricStateSet, MetricUntyped:
+		case "unknown":
+			typ = MetricUntyped
+		default:
+			return fmt.Errorf("unknown metric type %q", rest)
+		}
+		p.family(name).Type = typ
+	case "UNIT":
+		p.family(name).Unit = strings.TrimSpace(rest)
+	}
+	return nil
+}
+
+func (p *promParser) parseSample(line string) (*Sample, error) {
+	s := &Sample{Labels: Labels{}}
+
+	// Metric name
+	i := 0
+	for i < len(line) && isNameChar(line[i], i == 0) {
+		i++
+	}
+	if i == 0 {
+		return nil, fmt.Errorf("invalid metric name in %q", line)
+	}
+	s.Name = line[:i]
+	rest := line[i:]
+
+	// Label set
+	if strings.HasPrefix(rest, "{") {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return nil, err
+		}
+		s.Labels = labels
+		rest = rest[n:]
+	}
+
+	// Exemplar, OpenMetrics only
+	var exemplarText string
+	if idx := strings.Index(rest, " # "); idx >= 0 {
+		exemplarText = strings.TrimSpace(rest[idx+3:])
+		rest = rest[:idx]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid sample %q", line)
+	}
+
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q: %w", fields[0], err)
+	}
+	s.Value = value
+
+	if len(fields) == 2 {
+		ts, err := p.parseTimestamp(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		s.Timestamp = &ts
+	}
+
+	if exemplarText != "" {
+		ex, err := p.parseExemplar(exemplarText)
+		if err != nil {
+			return nil, err
+		}
+		s.Exemplar = ex
+	}
+
+	return s, nil
+}
+
+func (p *promParser) parseExemplar(text string) (*Exemplar, error) {
+	if !strings.HasPrefix(text, "{") {
+		return nil, fmt.Errorf("invalid exemplar %q", text)
+	}
+	labels, n, err := parseLabels(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exemplar: %w", err)
+	}
+
+	fields := strings.Fields(text[n:])
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid exemplar %q", text)
+	}
+
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid exemplar value %q: %w", fields[0], err)
+	}
+
+	ex := &Exemplar{Labels: labels, Value: value}
+	if len(fields) == 2 {
+		ts, err := parseSecondsTimestamp(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		ex.Timestamp = &ts
+	}
+	return ex, nil
+}
+
+// parseTimestamp reads milliseconds in the Prometheus format and
+// (possibly fractional) seconds in OpenMetrics
+func (p *promParser) parseTimestamp(s string) (time.Time, error) {
+	if p.openMetrics {
+		return parseSecondsTimestamp(s)
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func parseSecondsTimestamp(s string) (time.Time, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// parseLabels parses a {name="value",...} block and returns the number of
+// bytes consumed
+func parseLabels(s string) (Labels, int, error) {
+	labels := Labels{}
+	i := 1 // Skip '{'
+
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated label set")
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		start := i
+		for i < len(s) && isNameChar(s[i], i == start) {
+			i++
+		}
+		if i == start {
+			return nil, 0, fmt.Errorf("invalid label name at %q", s[start:])
+		}
+		name := s[start:i]
+
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i+1 >= len(s) || s[i] != '=' || s[i+1] != '"' {
+			return nil, 0, fmt.Errorf("expected =\" after label %q", name)
+		}
+		i += 2
+
+		var value strings.Builder
+		closed := false
+		for i < len(s) {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) {
+				switch s[i+1] {
+				case 'n':
+					value.WriteByte('\n')
+				case '\\':
+					value.WriteByte('\\')
+				case '"':
+					value.WriteByte('"')
+				default:
+					value.WriteByte('\\')
+					value.WriteByte(s[i+1])
+				}
+				i += 2
+				continue
+			}
+			if c == '"' {
+				closed = true
+				i++
+				break
+			}
+			value.WriteByte(c)
+			i++
+		}
+		if !closed {
+			return nil, 0, fmt.Errorf("unterminated value for label %q", name)
+		}
+		labels[name] = value.String()
+	}
+}
+
+func isNameChar(c byte, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
+
+func parseFloat(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf", "+inf", "inf":
+		return math.Inf(1), nil
+	case "-Inf", "-inf":
+		return math.Inf(-1), nil
+	case "NaN", "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func unescapeHelp(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	r := strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`)
+	return r.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	return r.Replace(s)
+}
@@ -0,0 +1,91 @@
+package caddy
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrometheusMetricsMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string // Expected part of the error
+	}{
+		{"missing metric name", `{code="200"} 1`, "line 1: invalid metric name"},
+		{"name starts with a digit", `2xx_total 1`, "line 1: invalid metric name"},
+		{"unterminated label set", `m{code="200",`, "line 1: unterminated label set"},
+		{"unterminated label value", `m{code="200} 1`, "line 1: unterminated value for label \"code\""},
+		{"backslash ends label value", `m{code="\`, "line 1: unterminated value for label \"code\""},
+		{"label without value", `m{code} 1`, "line 1: expected =\" after label \"code\""},
+		{"unquoted label value", `m{code=200} 1`, "line 1: expected =\" after label \"code\""},
+		{"invalid label name", `m{1code="200"} 1`, "line 1: invalid label name"},
+		{"missing value", `m{code="200"}`, "line 1: invalid sample"},
+		{"too many fields", `m 1 2 3`, "line 1: invalid sample"},
+		{"invalid value", `m one`, "line 1: invalid value \"one\""},
+		{"fractional millisecond timestamp", `m 1 1.5`, "line 1: invalid timestamp \"1.5\""},
+		{"unknown type", "# TYPE m bogus\nm 1", "line 1: unknown metric type \"bogus\""},
+		{"exemplar without labels", "m_total 1 # 0.5\n# EOF", "line 1: invalid exemplar \"0.5\""},
+		{"exemplar without value", "m_total 1 # {trace_id=\"a\"}\n# EOF", "line 1: invalid exemplar"},
+		{"invalid exemplar value", "m_total 1 # {trace_id=\"a\"} x\n# EOF", "line 1: invalid exemplar value \"x\""},
+		{"invalid exemplar timestamp", "m_total 1 # {trace_id=\"a\"} 1 t\n# EOF", "line 1: invalid timestamp \"t\""},
+		{"line number", "# HELP m Help\n# TYPE m gauge\nm 1\nm{", "line 4: unterminated label set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, err := ParsePrometheusMetrics(tt.input)
+			if err == nil {
+				t.Fatalf("parsed %q without error: %+v", tt.input, pm.Families)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParsePrometheusMetricsEdgeCases(t *testing.T) {
+	input := "# HELP m_total Help with \\\\ and \\n escapes\r\n" +
+		"# TYPE m_total counter\r\n" +
+		"m_total{path=\"/a\\\"b\\\\c\\nd\",code=\"200\",} +Inf 1700000000000\r\n" +
+		"\r\n" +
+		"# a plain comment\n" +
+		"m_total{ code=\"500\" } NaN\n" +
+		"u -1.5e3\n"
+	pm, err := ParsePrometheusMetrics(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := pm.Family("m_total")
+	if f == nil || f.Type != MetricCounter || f.Help != "Help with \\ and \n escapes" || len(f.Samples) != 2 {
+		t.Fatalf("m_total = %+v", f)
+	}
+	s := f.Samples[0]
+	if s.Labels["path"] != "/a\"b\\c\nd" || s.Labels["code"] != "200" || !math.IsInf(s.Value, 1) {
+		t.Errorf("first sample = %+v", s)
+	}
+	if s.Timestamp == nil || !s.Timestamp.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("first sample timestamp = %v", s.Timestamp)
+	}
+	if s := f.Samples[1]; s.Labels["code"] != "500" || !math.IsNaN(s.Value) {
+		t.Errorf("second sample = %+v", s)
+	}
+	if u := pm.Family("u"); u == nil || u.Type != MetricUntyped || len(u.Samples) != 1 || u.Samples[0].Value != -1500 {
+		t.Errorf("u = %+v", u)
+	}
+}
+
+func TestParsePrometheusMetricsTruncated(t *testing.T) {
+	// A scrape cut off anywhere must give an error or fewer samples, never
+	// a panic
+	input := "# HELP m_total Requests\n" +
+		"# TYPE m_total counter\n" +
+		"m_total{code=\"200\",path=\"/x\\\"y\"} 12 1700000000.5 # {trace_id=\"abc\"} 1 1700000000\n" +
+		"# EOF\n"
+	for i := range len(input) {
+		ParsePrometheusMetrics(input[:i])
+	}
+}
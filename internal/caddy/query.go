@@ -0,0 +1,421 @@
+package caddy
+
+import (
+	"fmt"
+	"godash/internal/models"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dimensions an analytics query can be grouped by
+const (
+	GroupByNone        = ""
+	GroupByHost        = "host"
+	GroupByServer      = "server"
+	GroupByHandler     = "handler"
+	GroupByStatus      = "status"       // Exact status code
+	GroupByStatusClass = "status_class" // 2xx, 3xx, ...
+	GroupByInstance    = "instance"
+)
+
+// AnalyticsQuery selects a counter over a time range, optionally split into
+// one series per group
+type AnalyticsQuery struct {
+	Metric  string // Counter as accepted by ParseCounter (default "requests")
+	GroupBy string // One of the GroupBy constants
+	Start   time.Time
+	End     time.Time
+	Step    time.Duration // Bucket width
+	Per     time.Duration // Unit of rates (default one second)
+	Limit   int           // Keep the largest groups and fold the rest into "other" (0 keeps all)
+}
+
+// AnalyticsSeries is the bucketed rate of one group
+type AnalyticsSeries struct {
+	Name   string      `json:"name"`
+	Total  float64     `json:"total"`
+	Resets int         `json:"resets"`
+	Points []RatePoint `json:"points"`
+}
+
+// AnalyticsResult is the answer to an AnalyticsQuery, both as raw series
+// and as chart data of per-bucket rates
+type AnalyticsResult struct {
+	Metric      string            `json:"metric"`
+	GroupBy     string            `json:"group_by,omitempty"`
+	Source      string            `json:"source"` // Resolution read: raw, 1m, 1h or 1d
+	Instances   []string          `json:"instances"`
+	Start       time.Time         `json:"start"`
+	End         time.Time         `json:"end"`
+	StepSeconds float64           `json:"step_seconds"`
+	PerSeconds  float64           `json:"per_seconds"`
+	Total       float64           `json:"total"`
+	Series      []AnalyticsSeries `json:"series"` // Largest total first
+	Chart       models.ChartData  `json:"chart"`
+}
+
+// GroupSummary is the traffic of one host, server or handler over a range
+type GroupSummary struct {
+	Name          string  `json:"name"`
+	Requests      int64   `json:"requests"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	Errors        int64   `json:"errors"`
+	ErrorRate     float64 `json:"error_rate"` // Percentage of requests
+}
+
+// StatusCount is the number of responses with one status code
+type StatusCount struct {
+	Code  int   `json:"code"`
+	Count int64 `json:"count"`
+}
+
+// ErrorSummary breaks down the error responses served over a range
+type ErrorSummary struct {
+	Start         time.Time      `json:"start"`
+	End           time.Time      `json:"end"`
+	TotalRequests int64          `json:"total_requests"`
+	ClientErrors  int64          `json:"client_errors"` // 4xx responses
+	ServerErrors  int64          `json:"server_errors"` // 5xx responses
+	ErrorRate     float64        `json:"error_rate"`    // Percentage of requests answered with 4xx or 5xx
+	ByStatus      []StatusCount  `json:"by_status"`     // 4xx and 5xx codes, most frequent first
+	ByHost        []GroupSummary `json:"by_host"`       // Hosts with errors, most errors first
+}
+
+// Query computes a counter's rate over a range for the given instances,
+// summing each group across instances so the result is fleet-wide when
+// more than one instance is given. A bucket is only a gap when no
+// instance has data for it.
+func (s *AnalyticsStore) Query(instanceIDs []string, q AnalyticsQuery) (*AnalyticsResult, error) {
+	if q.Metric == "" {
+		q.Metric = "requests"
+	}
+	if q.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if !q.End.After(q.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if _, err := groupCounter(q.Metric, q.GroupBy, ""); err != nil {
+		return nil, err
+	}
+
+	opts := RateOptions{Start: q.Start, End: q.End, Step: q.Step, Per: q.Per}
+	result := &AnalyticsResult{
+		Metric:    q.Metric,
+		GroupBy:   q.GroupBy,
+		Source:    tierName(s.tierFor(q.Start, q.Step)),
+		Instances: instanceIDs,
+		Start:     q.Start,
+		End:       q.End,
+	}
+
+	groups := make(map[string]*AnalyticsSeries)
+	for _, id := range instanceIDs {
+		history, _, err := s.queryHistory(id, q.Start, q.End, q.Step, max(q.Step, 5*time.Minute), func(name string) bool {
+			return !isHistogramSeries(name)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range groupKeys(history, q.GroupBy, id) {
+			counter, err := groupCounter(q.Metric, q.GroupBy, key)
+			if err != nil {
+				return nil, err
+			}
+			rates := ComputeRates(history, counter, opts)
+			result.StepSeconds = rates.StepSeconds
+			result.PerSeconds = rates.PerSeconds
+
+			name := key
+			if q.GroupBy == GroupByNone {
+				name = q.Metric
+			}
+			groups[name] = addRates(groups[name], name, rates)
+		}
+	}
+
+	if len(groups) == 0 {
+		// Still return the empty buckets so charts show the range
+		rates := ComputeRates(nil, func(*InstanceMetrics) float64 { return 0 }, opts)
+		result.StepSeconds = rates.StepSeconds
+		result.PerSeconds = rates.PerSeconds
+		if q.GroupBy == GroupByNone {
+			groups[q.Metric] = addRates(nil, q.Metric, rates)
+		}
+	}
+
+	result.Series = make([]AnalyticsSeries, 0, len(groups))
+	for _, series := range groups {
+		result.Series = append(result.Series, *series)
+	}
+	sort.Slice(result.Series, func(i, j int) bool {
+		a, b := result.Series[i], result.Series[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		return a.Name < b.Name
+	})
+	if q.Limit > 0 && len(result.Series) > q.Limit {
+		var other *AnalyticsSeries
+		for _, series := range result.Series[q.Limit:] {
+			rates := &RateSeries{Total: series.Total, Resets: series.Resets, Points: series.Points}
+			other = addRates(other, "other", rates)
+		}
+		result.Series = append(result.Series[:q.Limit], *other)
+	}
+
+	for _, series := range result.Series {
+		result.Total += series.Total
+	}
+	result.Chart = analyticsChart(result.Series)
+	return result, nil
+}
+
+// addRates adds one instance's rates to a group's series
+func addRates(series *AnalyticsSeries, name string, rates *RateSeries) *AnalyticsSeries {
+	if series == nil {
+		points := make([]RatePoint, len(rates.Points))
+		copy(points, rates.Points)
+		return &AnalyticsSeries{Name: name, Total: rates.Total, Resets: rates.Resets, Points: points}
+	}
+
+	series.Total += rates.Total
+	series.Resets += rates.Resets
+	for i := range series.Points {
+		if i >= len(rates.Points) {
+			break
+		}
+		p := rates.Points[i]
+		series.Points[i].Increase += p.Increase
+		series.Points[i].Rate += p.Rate
+		series.Points[i].Coverage = math.Max(series.Points[i].Coverage, p.Coverage)
+	}
+	return series
+}
+
+// analyticsChart turns series into chart data of per-bucket rates
+func analyticsChart(series []AnalyticsSeries) models.ChartData {
+	chart := models.ChartData{Labels: []string{}, Datasets: []models.Dataset{}}
+	if len(series) == 0 {
+		return chart
+	}
+	for _, p := range series[0].Points {
+		chart.Labels = append(chart.Labels, p.Time.Format(time.RFC3339))
+	}
+	for _, s := range series {
+		data := make([]float64, len(s.Points))
+		for i, p := range s.Points {
+			data[i] = p.Rate
+		}
+		chart.Datasets = append(chart.Datasets, models.Dataset{Label: s.Name, Data: data})
+	}
+	return chart
+}
+
+// groupKeys returns the groups present anywhere in the history
+func groupKeys(history []*InstanceMetrics, groupBy, instanceID string) []string {
+	switch groupBy {
+	case GroupByNone:
+		return []string{""}
+	case GroupByInstance:
+		return []string{instanceID}
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range history {
+		switch groupBy {
+		case GroupByHost, GroupByServer, GroupByHandler:
+			for name := range siteGroup(m, groupBy) {
+				seen[name] = true
+			}
+		case GroupByStatus:
+			for code := range m.StatusCodes {
+				seen[strconv.Itoa(code)] = true
+			}
+		case GroupByStatusClass:
+			for code := range m.StatusCodes {
+				seen[fmt.Sprintf("%dxx", code/100)] = true
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// groupCounter resolves the counter of one group. An empty key only
+// validates the combination of metric and grouping.
+func groupCounter(metric, groupBy, key string) (CounterFunc, error) {
+	name, selector, _, err := parseMetricSelector(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	switch groupBy {
+	case GroupByNone, GroupByInstance:
+		return ParseCounter(metric)
+	case GroupByHost, GroupByServer, GroupByHandler:
+		if selector != "" {
+			return nil, fmt.Errorf("metric selectors can't be combined with grouping by %s", groupBy)
+		}
+		if key == "" {
+			_, err := ParseCounter(name)
+			return nil, err
+		}
+		return ParseCounter(name + ":" + groupBy + "=" + key)
+	case GroupByStatus, GroupByStatusClass:
+		if name != "requests" || selector != "" {
+			return nil, fmt.Errorf("grouping by %s only applies to requests", groupBy)
+		}
+		if key == "" {
+			return nil, nil
+		}
+		return ParseCounter("requests:status=" + key)
+	}
+	return nil, fmt.Errorf("unknown grouping %q", groupBy)
+}
+
+// siteGroup returns the host, server or handler metrics of a sample
+func siteGroup(m *InstanceMetrics, groupBy string) map[string]SiteMetrics {
+	switch groupBy {
+	case GroupByServer:
+		return m.Servers
+	case GroupByHandler:
+		return m.Handlers
+	}
+	return m.Sites
+}
+
+// GetHistory returns an instance's stored metrics over a range at the
+// resolution picked for step (see AnalyticsQuery)
+func (s *AnalyticsStore) GetHistory(instanceID string, start, end time.Time, step time.Duration) ([]*InstanceMetrics, string, error) {
+	return s.queryHistory(instanceID, start, end, step, 0, nil)
+}
+
+// GetGroupSummaries returns the traffic of every host, server or handler
+// over a range, summed across instances, busiest first
+func (s *AnalyticsStore) GetGroupSummaries(instanceIDs []string, groupBy string, start, end time.Time) ([]GroupSummary, error) {
+	switch groupBy {
+	case GroupByHost, GroupByServer, GroupByHandler:
+	default:
+		return nil, fmt.Errorf("can't summarise by %q", groupBy)
+	}
+
+	step := end.Sub(start) / 100
+	summaries := make(map[string]*GroupSummary)
+	for _, id := range instanceIDs {
+		history, _, err := s.queryHistory(id, start, end, step, 0, func(name string) bool {
+			return !isHistogramSeries(name)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range groupKeys(history, groupBy, id) {
+			pick := func(field func(SiteMetrics) int64) int64 {
+				return int64(TotalIncrease(history, func(m *InstanceMetrics) float64 {
+					return float64(field(siteGroup(m, groupBy)[name]))
+				}))
+			}
+			summary := summaries[name]
+			if summary == nil {
+				summary = &GroupSummary{Name: name}
+				summaries[name] = summary
+			}
+			summary.Requests += pick(func(s SiteMetrics) int64 { return s.Requests })
+			summary.BytesSent += pick(func(s SiteMetrics) int64 { return s.BytesSent })
+			summary.BytesReceived += pick(func(s SiteMetrics) int64 { return s.BytesReceived })
+			summary.Errors += pick(func(s SiteMetrics) int64 { return s.Errors })
+		}
+	}
+
+	result := make([]GroupSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		if summary.Requests > 0 {
+			summary.ErrorRate = float64(summary.Errors) / float64(summary.Requests) * 100
+		}
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// GetErrorSummary returns the 4xx and 5xx responses served over a range,
+// by status code and by host, summed across instances
+func (s *AnalyticsStore) GetErrorSummary(instanceIDs []string, start, end time.Time) (*ErrorSummary, error) {
+	summary := &ErrorSummary{Start: start, End: end, ByStatus: []StatusCount{}, ByHost: []GroupSummary{}}
+
+	step := end.Sub(start) / 100
+	byStatus := make(map[int]int64)
+	for _, id := range instanceIDs {
+		history, _, err := s.queryHistory(id, start, end, step, 0, func(name string) bool {
+			return name == "uptime" || name == "num_requests" || strings.HasPrefix(name, "status/")
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		summary.TotalRequests += int64(TotalIncrease(history, func(m *InstanceMetrics) float64 {
+			return float64(m.NumRequests)
+		}))
+		for _, key := range groupKeys(history, GroupByStatus, id) {
+			code, _ := strconv.Atoi(key)
+			if code < 400 {
+				continue
+			}
+			byStatus[code] += int64(TotalIncrease(history, func(m *InstanceMetrics) float64 {
+				return float64(m.StatusCodes[code])
+			}))
+		}
+	}
+
+	for code, count := range byStatus {
+		if count == 0 {
+			continue
+		}
+		if code < 500 {
+			summary.ClientErrors += count
+		} else {
+			summary.ServerErrors += count
+		}
+		summary.ByStatus = append(summary.ByStatus, StatusCount{Code: code, Count: count})
+	}
+	sort.Slice(summary.ByStatus, func(i, j int) bool {
+		a, b := summary.ByStatus[i], summary.ByStatus[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Code < b.Code
+	})
+	if summary.TotalRequests > 0 {
+		summary.ErrorRate = float64(summary.ClientErrors+summary.ServerErrors) / float64(summary.TotalRequests) * 100
+	}
+
+	hosts, err := s.GetGroupSummaries(instanceIDs, GroupByHost, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		if host.Errors > 0 {
+			summary.ByHost = append(summary.ByHost, host)
+		}
+	}
+	sort.SliceStable(summary.ByHost, func(i, j int) bool {
+		return summary.ByHost[i].Errors > summary.ByHost[j].Errors
+	})
+	return summary, nil
+}
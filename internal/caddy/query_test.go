@@ -0,0 +1,252 @@
+package caddy
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestQueryStore stores ten minutes of samples every 30 seconds for two
+// instances. Per sample, "a" serves 30 requests to example.com and 10 to
+// api.test, with 5 of them 404s and 5 500s; "b" serves 20 requests to
+// example.com, all 200s.
+func newTestQueryStore(t *testing.T) (*AnalyticsStore, time.Time) {
+	t.Helper()
+	store, err := NewAnalyticsStore(filepath.Join(t.TempDir(), "metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	base := time.Now().UTC().Truncate(time.Minute).Add(-time.Hour)
+	for i := int64(0); i <= 20; i++ {
+		ts := base.Add(time.Duration(i) * 30 * time.Second)
+		a := &InstanceMetrics{
+			Timestamp:   ts,
+			Uptime:      3600 + 30*i,
+			NumRequests: 40 * i,
+			StatusCodes: map[int]int64{200: 30 * i, 404: 5 * i, 500: 5 * i},
+			Sites: map[string]SiteMetrics{
+				"example.com": {Requests: 30 * i, BytesSent: 1000 * i, Errors: 2 * i},
+				"api.test":    {Requests: 10 * i, Errors: 3 * i},
+			},
+		}
+		b := &InstanceMetrics{
+			Timestamp:   ts,
+			Uptime:      600 + 30*i,
+			NumRequests: 20 * i,
+			StatusCodes: map[int]int64{200: 20 * i},
+			Sites:       map[string]SiteMetrics{"example.com": {Requests: 20 * i, BytesSent: 500 * i}},
+		}
+		if err := store.SaveMetrics("a", a); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveMetrics("b", b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store, base
+}
+
+func TestAnalyticsQuery(t *testing.T) {
+	store, base := newTestQueryStore(t)
+
+	type series struct {
+		name  string
+		total float64
+	}
+	tests := []struct {
+		name      string
+		instances []string
+		query     AnalyticsQuery
+		want      []series // Largest total first
+	}{
+		{
+			name:      "fleet-wide",
+			instances: []string{"a", "b"},
+			want:      []series{{"requests", 1200}},
+		},
+		{
+			name:      "by instance",
+			instances: []string{"b", "a"},
+			query:     AnalyticsQuery{GroupBy: GroupByInstance},
+			want:      []series{{"a", 800}, {"b", 400}},
+		},
+		{
+			name:      "by host",
+			instances: []string{"a", "b"},
+			query:     AnalyticsQuery{GroupBy: GroupByHost},
+			want:      []series{{"example.com", 1000}, {"api.test", 200}},
+		},
+		{
+			name:      "bytes by host",
+			instances: []string{"a", "b"},
+			query:     AnalyticsQuery{Metric: "bytes", GroupBy: GroupByHost},
+			want:      []series{{"example.com", 30000}, {"api.test", 0}},
+		},
+		{
+			name:      "by status class",
+			instances: []string{"a"},
+			query:     AnalyticsQuery{GroupBy: GroupByStatusClass},
+			want:      []series{{"2xx", 600}, {"4xx", 100}, {"5xx", 100}},
+		},
+		{
+			name:      "by status with the rest folded",
+			instances: []string{"a", "b"},
+			query:     AnalyticsQuery{GroupBy: GroupByStatus, Limit: 1},
+			want:      []series{{"200", 1000}, {"other", 200}},
+		},
+		{
+			name:      "selector",
+			instances: []string{"a", "b"},
+			query:     AnalyticsQuery{Metric: "requests:host=api.test"},
+			want:      []series{{"requests:host=api.test", 200}},
+		},
+		{
+			name:  "no instances",
+			query: AnalyticsQuery{},
+			want:  []series{{"requests", 0}},
+		},
+		{
+			name:      "unknown instance",
+			instances: []string{"missing"},
+			query:     AnalyticsQuery{GroupBy: GroupByHost},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			q.Start, q.End, q.Step = base, base.Add(10*time.Minute), 30*time.Second
+			result, err := store.Query(tt.instances, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Source != "raw" || result.StepSeconds != 30 || result.PerSeconds != 1 {
+				t.Errorf("source %s, step %vs per %vs, want raw, 30s and 1s", result.Source, result.StepSeconds, result.PerSeconds)
+			}
+
+			if len(result.Series) != len(tt.want) {
+				t.Fatalf("got %d series, want %d", len(result.Series), len(tt.want))
+			}
+			var total float64
+			for i, want := range tt.want {
+				got := result.Series[i]
+				if got.Name != want.name || math.Abs(got.Total-want.total) > 1e-6 {
+					t.Errorf("series %d is %s with %v, want %s with %v", i, got.Name, got.Total, want.name, want.total)
+				}
+				if len(got.Points) != 20 {
+					t.Errorf("series %s has %d points, want 20", got.Name, len(got.Points))
+				}
+				total += want.total
+			}
+			if math.Abs(result.Total-total) > 1e-6 {
+				t.Errorf("total %v, want %v", result.Total, total)
+			}
+
+			if len(result.Chart.Datasets) != len(tt.want) {
+				t.Errorf("chart has %d datasets, want %d", len(result.Chart.Datasets), len(tt.want))
+			}
+			if len(tt.want) > 0 && len(result.Chart.Labels) != 20 {
+				t.Errorf("chart has %d labels, want 20", len(result.Chart.Labels))
+			}
+		})
+	}
+}
+
+func TestAnalyticsQueryRates(t *testing.T) {
+	store, base := newTestQueryStore(t)
+
+	result, err := store.Query([]string{"a", "b"}, AnalyticsQuery{
+		Start: base,
+		End:   base.Add(10 * time.Minute),
+		Step:  time.Minute,
+		Per:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != "1m" {
+		t.Errorf("source %s, want 1m", result.Source)
+	}
+	// Minute rollups keep the last sample of each minute, so the first
+	// half minute of the range has no interval to measure
+	points := result.Series[0].Points
+	for i, p := range points[1:] {
+		if math.Abs(p.Increase-120) > 1e-6 || math.Abs(p.Rate-120) > 1e-6 {
+			t.Errorf("minute %d: increase %v at %v per minute, want 120", i+1, p.Increase, p.Rate)
+		}
+	}
+	if got := result.Chart.Datasets[0].Data[1]; got != points[1].Rate {
+		t.Errorf("chart rate %v, want %v", got, points[1].Rate)
+	}
+}
+
+func TestAnalyticsQueryErrors(t *testing.T) {
+	store, base := newTestQueryStore(t)
+
+	tests := []struct {
+		name  string
+		query AnalyticsQuery
+	}{
+		{"no step", AnalyticsQuery{Start: base, End: base.Add(time.Minute)}},
+		{"empty range", AnalyticsQuery{Start: base, End: base, Step: time.Second}},
+		{"unknown metric", AnalyticsQuery{Metric: "latency", Start: base, End: base.Add(time.Minute), Step: time.Second}},
+		{"selector with grouping", AnalyticsQuery{Metric: "requests:host=a", GroupBy: GroupByHost, Start: base, End: base.Add(time.Minute), Step: time.Second}},
+		{"status grouping of bytes", AnalyticsQuery{Metric: "bytes", GroupBy: GroupByStatus, Start: base, End: base.Add(time.Minute), Step: time.Second}},
+		{"unknown grouping", AnalyticsQuery{GroupBy: "path", Start: base, End: base.Add(time.Minute), Step: time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := store.Query([]string{"a"}, tt.query); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGroupSummaries(t *testing.T) {
+	store, base := newTestQueryStore(t)
+	end := base.Add(10 * time.Minute)
+
+	hosts, err := store.GetGroupSummaries([]string{"a", "b"}, GroupByHost, base, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GroupSummary{
+		{Name: "example.com", Requests: 1000, BytesSent: 30000, Errors: 40, ErrorRate: 4},
+		{Name: "api.test", Requests: 200, Errors: 60, ErrorRate: 30},
+	}
+	if len(hosts) != len(want) {
+		t.Fatalf("got %d hosts, want %d", len(hosts), len(want))
+	}
+	for i := range want {
+		if hosts[i] != want[i] {
+			t.Errorf("host %d: %+v, want %+v", i, hosts[i], want[i])
+		}
+	}
+
+	if _, err := store.GetGroupSummaries([]string{"a"}, GroupByStatus, base, end); err == nil {
+		t.Error("summarising by status succeeded")
+	}
+
+	summary, err := store.GetErrorSummary([]string{"a", "b"}, base, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.TotalRequests != 1200 || summary.ClientErrors != 100 || summary.ServerErrors != 100 {
+		t.Errorf("%d requests with %d client and %d server errors, want 1200, 100 and 100",
+			summary.TotalRequests, summary.ClientErrors, summary.ServerErrors)
+	}
+	if math.Abs(summary.ErrorRate-200.0/12) > 1e-9 {
+		t.Errorf("error rate %v, want %v", summary.ErrorRate, 200.0/12)
+	}
+	if len(summary.ByStatus) != 2 || summary.ByStatus[0] != (StatusCount{Code: 404, Count: 100}) || summary.ByStatus[1] != (StatusCount{Code: 500, Count: 100}) {
+		t.Errorf("by status %+v, want 404 and 500 with 100 each", summary.ByStatus)
+	}
+	if len(summary.ByHost) != 2 || summary.ByHost[0].Name != "api.test" || summary.ByHost[1].Name != "example.com" {
+		t.Errorf("by host %+v, want api.test before example.com", summary.ByHost)
+	}
+}
@@ -0,0 +1,278 @@
+package caddy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CounterFunc extracts a cumulative counter value from a stored sample
+type CounterFunc func(*InstanceMetrics) float64
+
+// ParseCounter resolves a counter name used by the rate API. Supported
+// names are "requests", "bytes", "bytes_received" and "errors", optionally
+// narrowed by a selector: "requests:host=example.com", "requests:server=srv0",
+// "requests:handler=reverse_proxy", "requests:code=404" or
+// "requests:status=5xx". Selectors on bytes and errors work the same way
+// for host, server and handler.
+func ParseCounter(metric string) (CounterFunc, error) {
+	name, key, value, err := parseMetricSelector(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	siteField := map[string]func(SiteMetrics) int64{
+		"requests":       func(s SiteMetrics) int64 { return s.Requests },
+		"bytes":          func(s SiteMetrics) int64 { return s.BytesSent },
+		"bytes_received": func(s SiteMetrics) int64 { return s.BytesReceived },
+		"errors":         func(s SiteMetrics) int64 { return s.Errors },
+	}
+	field, ok := siteField[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", name)
+	}
+
+	switch key {
+	case "":
+		switch name {
+		case "requests":
+			return func(m *InstanceMetrics) float64 { return float64(m.NumRequests) }, nil
+		case "bytes":
+			return func(m *InstanceMetrics) float64 { return float64(m.TotalTraffic) }, nil
+		case "errors":
+			return func(m *InstanceMetrics) float64 { return float64(m.Errors) }, nil
+		case "bytes_received":
+			return func(m *InstanceMetrics) float64 {
+				var total int64
+				for _, s := range m.Servers {
+					total += s.BytesReceived
+				}
+				return float64(total)
+			}, nil
+		}
+	case "host", "server", "handler":
+		return func(m *InstanceMetrics) float64 {
+			group := m.Sites
+			switch key {
+			case "server":
+				group = m.Servers
+			case "handler":
+				group = m.Handlers
+			}
+			return float64(field(group[value]))
+		}, nil
+	case "code", "status":
+		if name != "requests" {
+			return nil, fmt.Errorf("%s selector only applies to requests", key)
+		}
+		match, err := statusMatcher(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *InstanceMetrics) float64 {
+			var total int64
+			for code, count := range m.StatusCodes {
+				if match(code) {
+					total += count
+				}
+			}
+			return float64(total)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown selector %q", key)
+}
+
+// parseMetricSelector splits "name:key=value" into its parts
+func parseMetricSelector(metric string) (name, key, value string, err error) {
+	name, selector, _ := strings.Cut(metric, ":")
+	key, value, hasSelector := strings.Cut(selector, "=")
+	if selector != "" && !hasSelector {
+		return "", "", "", fmt.Errorf("invalid selector %q", selector)
+	}
+	return name, key, value, nil
+}
+
+// statusMatcher matches an exact code ("404") or a class ("5xx")
+func statusMatcher(value string) (func(int) bool, error) {
+	if len(value) == 3 && strings.HasSuffix(strings.ToLower(value), "xx") {
+		class := int(value[0] - '0')
+		if class < 1 || class > 5 {
+			return nil, fmt.Errorf("invalid status class %q", value)
+		}
+		return func(code int) bool { return code/100 == class }, nil
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status code %q", value)
+	}
+	return func(c int) bool { return c == code }, nil
+}
+
+// RateOptions controls how counter history is turned into rates
+type RateOptions struct {
+	Start  time.Time
+	End    time.Time
+	Step   time.Duration // Bucket width
+	Per    time.Duration // Unit of Rate, e.g. time.Minute for per-minute rates (default one second)
+	MaxGap time.Duration // Longer gaps between samples are treated as missing data (default 3x the typical spacing)
+}
+
+// RatePoint is the counter increase within one bucket
+type RatePoint struct {
+	Time     time.Time `json:"time"`     // Bucket start
+	Increase float64   `json:"increase"` // Counter increase within the bucket
+	Rate     float64   `json:"rate"`     // Increase per RateSeries.Per
+	Coverage float64   `json:"coverage"` // Fraction of the bucket backed by samples
+}
+
+// RateSeries is a bucketed rate computed from counter history
+type RateSeries struct {
+	Metric      string      `json:"metric"`
+	Source      string      `json:"source"` // Resolution read: raw, 1m, 1h or 1d
+	Start       time.Time   `json:"start"`
+	End         time.Time   `json:"end"`
+	StepSeconds float64     `json:"step_seconds"`
+	PerSeconds  float64     `json:"per_seconds"`
+	Total       float64     `json:"total"`  // Sum of bucket increases (gaps excluded)
+	Resets      int         `json:"resets"` // Counter resets detected in the range
+	Points      []RatePoint `json:"points"`
+}
+
+// CounterIncrease returns how much a counter grew between two samples and
+// whether the counter was reset in between. After a reset the counter
+// restarted from zero, so the current value is the increase.
+func CounterIncrease(prev, cur *InstanceMetrics, counter CounterFunc) (float64, bool) {
+	before, after := counter(prev), counter(cur)
+	if processRestarted(prev, cur) || after < before {
+		return after, true
+	}
+	return after - before, false
+}
+
+// processRestarted compares the process start time implied by each
+// sample's uptime, which catches restarts that happened long enough ago
+// for the counter to have grown past its previous value
+func processRestarted(prev, cur *InstanceMetrics) bool {
+	if prev.Uptime <= 0 || cur.Uptime <= 0 {
+		return false
+	}
+	prevStart := prev.Timestamp.Unix() - prev.Uptime
+	curStart := cur.Timestamp.Unix() - cur.Uptime
+	return curStart > prevStart+1
+}
+
+// TotalIncrease sums counter increases across consecutive samples
+func TotalIncrease(history []*InstanceMetrics, counter CounterFunc) float64 {
+	var total float64
+	for i := 1; i < len(history); i++ {
+		inc, _ := CounterIncrease(history[i-1], history[i], counter)
+		total += inc
+	}
+	return total
+}
+
+// ComputeRates buckets counter increases from history (sorted by time).
+// Each increase is spread over its buckets in proportion to how much of the
+// sampling interval falls into them; intervals longer than MaxGap are
+// treated as missing data and leave their buckets uncovered.
+func ComputeRates(history []*InstanceMetrics, counter CounterFunc, opts RateOptions) *RateSeries {
+	if opts.Step <= 0 {
+		opts.Step = time.Minute
+	}
+	if opts.Per <= 0 {
+		opts.Per = time.Second
+	}
+	if opts.MaxGap <= 0 {
+		opts.MaxGap = 3 * typicalSpacing(history)
+	}
+
+	start := opts.Start.Truncate(opts.Step)
+	n := int(math.Ceil(float64(opts.End.Sub(start)) / float64(opts.Step)))
+	if n < 0 {
+		n = 0
+	}
+
+	series := &RateSeries{
+		Start:       start,
+		End:         opts.End,
+		StepSeconds: opts.Step.Seconds(),
+		PerSeconds:  opts.Per.Seconds(),
+		Points:      make([]RatePoint, n),
+	}
+	for i := range series.Points {
+		series.Points[i].Time = start.Add(time.Duration(i) * opts.Step)
+	}
+
+	for i := 1; i < len(history); i++ {
+		prev, cur := history[i-1], history[i]
+		t0, t1 := prev.Timestamp, cur.Timestamp
+		span := t1.Sub(t0)
+		if span <= 0 || t1.Before(start) || !t0.Before(opts.End) {
+			continue
+		}
+
+		inc, reset := CounterIncrease(prev, cur, counter)
+		if reset {
+			series.Resets++
+		}
+		if opts.MaxGap > 0 && span > opts.MaxGap {
+			continue
+		}
+
+		first := max(0, int(t0.Sub(start)/opts.Step))
+		for b := first; b < n; b++ {
+			bStart := series.Points[b].Time
+			bEnd := bStart.Add(opts.Step)
+			if !bStart.Before(t1) {
+				break
+			}
+			overlap := minTime(bEnd, t1).Sub(maxTime(bStart, t0))
+			if overlap <= 0 {
+				continue
+			}
+			frac := float64(overlap) / float64(span)
+			series.Points[b].Increase += inc * frac
+			series.Points[b].Coverage += float64(overlap) / float64(opts.Step)
+			series.Total += inc * frac
+		}
+	}
+
+	for i := range series.Points {
+		p := &series.Points[i]
+		p.Rate = p.Increase / opts.Step.Seconds() * opts.Per.Seconds()
+		p.Coverage = math.Min(p.Coverage, 1)
+	}
+
+	return series
+}
+
+// typicalSpacing returns the median interval between samples
+func typicalSpacing(history []*InstanceMetrics) time.Duration {
+	if len(history) < 2 {
+		return 0
+	}
+	gaps := make([]time.Duration, 0, len(history)-1)
+	for i := 1; i < len(history); i++ {
+		gaps = append(gaps, history[i].Timestamp.Sub(history[i-1].Timestamp))
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	return gaps[len(gaps)/2]
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
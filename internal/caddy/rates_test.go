@@ -0,0 +1,197 @@
+package caddy
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// rateSample is a stored sample with the given request count, taken at
+// base+offset by a process that started at base+started
+func rateSample(base time.Time, offset, started time.Duration, requests int64) *InstanceMetrics {
+	ts := base.Add(offset)
+	return &InstanceMetrics{
+		Timestamp:   ts,
+		NumRequests: requests,
+		Uptime:      int64(ts.Sub(base.Add(started)).Seconds()),
+		StatusCodes: map[int]int64{200: requests},
+	}
+}
+
+func TestCounterIncrease(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	requests := func(m *InstanceMetrics) float64 { return float64(m.NumRequests) }
+
+	tests := []struct {
+		name  string
+		prev  *InstanceMetrics
+		cur   *InstanceMetrics
+		inc   float64
+		reset bool
+	}{
+		{"growing", rateSample(base, time.Hour, 0, 100), rateSample(base, time.Hour+time.Minute, 0, 160), 60, false},
+		{"unchanged", rateSample(base, time.Hour, 0, 100), rateSample(base, time.Hour+time.Minute, 0, 100), 0, false},
+		{"counter went down", rateSample(base, time.Hour, 0, 100), rateSample(base, time.Hour+time.Minute, time.Hour+30*time.Second, 7), 7, true},
+		{"restart with a larger counter", rateSample(base, time.Hour, 0, 100), rateSample(base, 3*time.Hour, 2*time.Hour, 500), 500, true},
+		{"no uptime", &InstanceMetrics{Timestamp: base, NumRequests: 10}, &InstanceMetrics{Timestamp: base.Add(time.Minute), NumRequests: 25}, 15, false},
+		{"uptime rounding", rateSample(base, time.Hour, 0, 100), &InstanceMetrics{Timestamp: base.Add(time.Hour + time.Minute), Uptime: 3661, NumRequests: 110}, 10, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inc, reset := CounterIncrease(tt.prev, tt.cur, requests)
+			if inc != tt.inc || reset != tt.reset {
+				t.Errorf("increase %v reset %v, want %v and %v", inc, reset, tt.inc, tt.reset)
+			}
+		})
+	}
+}
+
+func TestComputeRates(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	requests := func(m *InstanceMetrics) float64 { return float64(m.NumRequests) }
+	// Samples every 30 seconds, 60 requests per minute
+	steady := func(from, to time.Duration, started time.Duration, offset int64) []*InstanceMetrics {
+		var history []*InstanceMetrics
+		for d := from; d <= to; d += 30 * time.Second {
+			history = append(history, rateSample(base, d, started, offset+int64((d-from)/time.Second)))
+		}
+		return history
+	}
+
+	tests := []struct {
+		name      string
+		history   []*InstanceMetrics
+		opts      RateOptions
+		increases []float64
+		coverage  []float64
+		total     float64
+		resets    int
+	}{
+		{
+			name:      "steady",
+			history:   steady(0, 3*time.Minute, 0, 0),
+			opts:      RateOptions{Start: base, End: base.Add(3 * time.Minute), Step: time.Minute},
+			increases: []float64{60, 60, 60},
+			coverage:  []float64{1, 1, 1},
+			total:     180,
+		},
+		{
+			name:      "interval spread over buckets",
+			history:   []*InstanceMetrics{rateSample(base, 30*time.Second, 0, 0), rateSample(base, 90*time.Second, 0, 120)},
+			opts:      RateOptions{Start: base, End: base.Add(2 * time.Minute), Step: time.Minute},
+			increases: []float64{60, 60},
+			coverage:  []float64{0.5, 0.5},
+			total:     120,
+		},
+		{
+			name: "reset counts from zero",
+			history: append(steady(0, time.Minute, 0, 0),
+				steady(90*time.Second, 2*time.Minute, 80*time.Second, 10)...),
+			opts:      RateOptions{Start: base, End: base.Add(2 * time.Minute), Step: time.Minute},
+			increases: []float64{60, 10 + 30},
+			coverage:  []float64{1, 1},
+			total:     100,
+			resets:    1,
+		},
+		{
+			name: "gap left uncovered",
+			history: append(steady(0, time.Minute, 0, 0),
+				steady(5*time.Minute, 6*time.Minute, 0, 300)...),
+			opts:      RateOptions{Start: base, End: base.Add(6 * time.Minute), Step: time.Minute},
+			increases: []float64{60, 0, 0, 0, 0, 60},
+			coverage:  []float64{1, 0, 0, 0, 0, 1},
+			total:     120,
+		},
+		{
+			name:      "unaligned start",
+			history:   steady(0, 2*time.Minute, 0, 0),
+			opts:      RateOptions{Start: base.Add(20 * time.Second), End: base.Add(2 * time.Minute), Step: time.Minute},
+			increases: []float64{60, 60},
+			coverage:  []float64{1, 1},
+			total:     120,
+		},
+		{
+			name:      "outside the range",
+			history:   steady(10*time.Minute, 12*time.Minute, 0, 0),
+			opts:      RateOptions{Start: base, End: base.Add(2 * time.Minute), Step: time.Minute},
+			increases: []float64{0, 0},
+			coverage:  []float64{0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series := ComputeRates(tt.history, requests, tt.opts)
+			if len(series.Points) != len(tt.increases) {
+				t.Fatalf("got %d points, want %d", len(series.Points), len(tt.increases))
+			}
+			for i, p := range series.Points {
+				if math.Abs(p.Increase-tt.increases[i]) > 1e-9 || math.Abs(p.Coverage-tt.coverage[i]) > 1e-9 {
+					t.Errorf("point %d: increase %v coverage %v, want %v and %v", i, p.Increase, p.Coverage, tt.increases[i], tt.coverage[i])
+				}
+				if want := p.Increase / 60; math.Abs(p.Rate-want) > 1e-9 {
+					t.Errorf("point %d: rate %v, want %v per second", i, p.Rate, want)
+				}
+			}
+			if math.Abs(series.Total-tt.total) > 1e-9 || series.Resets != tt.resets {
+				t.Errorf("total %v resets %d, want %v and %d", series.Total, series.Resets, tt.total, tt.resets)
+			}
+		})
+	}
+}
+
+func TestParseCounter(t *testing.T) {
+	m := &InstanceMetrics{
+		NumRequests:  100,
+		TotalTraffic: 5000,
+		Errors:       3,
+		StatusCodes:  map[int]int64{200: 80, 204: 5, 404: 10, 502: 5},
+		Sites:        map[string]SiteMetrics{"example.com": {Requests: 70, BytesSent: 4000}},
+		Servers:      map[string]SiteMetrics{"srv0": {Requests: 100, BytesReceived: 900}, "srv1": {BytesReceived: 100}},
+		Handlers:     map[string]SiteMetrics{"reverse_proxy": {Requests: 60, Errors: 2}},
+	}
+
+	tests := []struct {
+		metric string
+		want   float64
+		err    bool
+	}{
+		{metric: "requests", want: 100},
+		{metric: "bytes", want: 5000},
+		{metric: "errors", want: 3},
+		{metric: "bytes_received", want: 1000},
+		{metric: "requests:host=example.com", want: 70},
+		{metric: "requests:host=missing.com", want: 0},
+		{metric: "bytes:host=example.com", want: 4000},
+		{metric: "requests:server=srv0", want: 100},
+		{metric: "errors:handler=reverse_proxy", want: 2},
+		{metric: "requests:code=404", want: 10},
+		{metric: "requests:status=2xx", want: 85},
+		{metric: "requests:status=5XX", want: 5},
+		{metric: "latency", err: true},
+		{metric: "requests:host", err: true},
+		{metric: "requests:path=/", err: true},
+		{metric: "bytes:code=200", err: true},
+		{metric: "requests:status=6xx", err: true},
+		{metric: "requests:code=ok", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.metric, func(t *testing.T) {
+			counter, err := ParseCounter(tt.metric)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := counter(m); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
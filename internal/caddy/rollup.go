@@ -0,0 +1,370 @@
+package caddy
+
+import (
+	"fmt"
+	"godash/internal/tsdb"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RollupTier is one downsampled resolution of stored metrics
+type RollupTier struct {
+	Name            string
+	Width           time.Duration // Bucket width
+	SegmentDuration time.Duration // Time window of each segment file
+}
+
+// rollupTiers are ordered finest first; each tier is built from the one below
+var rollupTiers = []RollupTier{
+	{Name: "1m", Width: time.Minute, SegmentDuration: 24 * time.Hour},
+	{Name: "1h", Width: time.Hour, SegmentDuration: 30 * 24 * time.Hour},
+	{Name: "1d", Width: 24 * time.Hour, SegmentDuration: 365 * 24 * time.Hour},
+}
+
+// RetentionPolicy sets how long each resolution is kept (0 keeps everything)
+type RetentionPolicy struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hour   time.Duration
+	Day    time.Duration
+}
+
+// DefaultRetentionPolicy keeps raw samples for a week and rollups for
+// progressively longer
+var DefaultRetentionPolicy = RetentionPolicy{
+	Raw:    7 * 24 * time.Hour,
+	Minute: 30 * 24 * time.Hour,
+	Hour:   180 * 24 * time.Hour,
+	Day:    3 * 365 * 24 * time.Hour,
+}
+
+// tier returns the retention of a rollup tier by index
+func (p RetentionPolicy) tier(i int) time.Duration {
+	return []time.Duration{p.Minute, p.Hour, p.Day}[i]
+}
+
+// Aggregate summarises the values of one series within a bucket
+type Aggregate struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   float64 `json:"sum"`
+	Count float64 `json:"count"`
+	Last  float64 `json:"last"`
+}
+
+// Mean returns the average value within the bucket
+func (a Aggregate) Mean() float64 {
+	if a.Count == 0 {
+		return math.NaN()
+	}
+	return a.Sum / a.Count
+}
+
+func (a *Aggregate) merge(b Aggregate) {
+	if a.Count == 0 {
+		*a = b
+		return
+	}
+	a.Min = math.Min(a.Min, b.Min)
+	a.Max = math.Max(a.Max, b.Max)
+	a.Sum += b.Sum
+	a.Count += b.Count
+	a.Last = b.Last
+}
+
+// Rollup is one bucket of a rollup tier
+type Rollup struct {
+	Start    time.Time            `json:"start"`
+	LastTime time.Time            `json:"last_time"` // Time of the newest raw sample in the bucket
+	Series   map[string]Aggregate `json:"series"`
+}
+
+// merge adds a newer partial rollup of the same bucket
+func (r *Rollup) merge(other *Rollup) {
+	for name, agg := range other.Series {
+		cur := r.Series[name]
+		cur.merge(agg)
+		r.Series[name] = cur
+	}
+	if other.LastTime.After(r.LastTime) {
+		r.LastTime = other.LastTime
+	}
+}
+
+func (r *Rollup) clone() *Rollup {
+	c := &Rollup{Start: r.Start, LastTime: r.LastTime, Series: make(map[string]Aggregate, len(r.Series))}
+	for name, agg := range r.Series {
+		c.Series[name] = agg
+	}
+	return c
+}
+
+// Metrics returns the bucket as instance metrics using each series' last
+// value, timestamped at the newest raw sample so rates and resets are
+// computed the same way as for raw samples
+func (r *Rollup) Metrics(instanceID string) *InstanceMetrics {
+	values := make(map[string]float64, len(r.Series))
+	for name, agg := range r.Series {
+		values[name] = agg.Last
+	}
+	return fromSample(instanceID, tsdb.Sample{Time: r.LastTime, Values: values})
+}
+
+// rollupFromSample turns one raw sample into a single-observation rollup
+func rollupFromSample(s tsdb.Sample) *Rollup {
+	r := &Rollup{Start: s.Time, LastTime: s.Time, Series: make(map[string]Aggregate, len(s.Values))}
+	for name, v := range s.Values {
+		r.Series[name] = Aggregate{Min: v, Max: v, Sum: v, Count: 1, Last: v}
+	}
+	return r
+}
+
+// Rollups are stored as tsdb samples at the bucket start. Scalar series
+// keep all five aggregates as "<series>#min" etc.; cumulative histogram
+// buckets only need "#last". "@time" holds the newest raw sample time.
+const rollupTimeSeries = "@time"
+
+var rollupFields = []string{"min", "max", "sum", "count", "last"}
+
+func (r *Rollup) sample() tsdb.Sample {
+	values := make(map[string]float64, len(r.Series)*len(rollupFields)+1)
+	values[rollupTimeSeries] = float64(r.LastTime.UnixMilli())
+	for name, agg := range r.Series {
+		if isHistogramSeries(name) {
+			values[name+"#last"] = agg.Last
+			continue
+		}
+		values[name+"#min"] = agg.Min
+		values[name+"#max"] = agg.Max
+		values[name+"#sum"] = agg.Sum
+		values[name+"#count"] = agg.Count
+		values[name+"#last"] = agg.Last
+	}
+	return tsdb.Sample{Time: r.Start, Values: values}
+}
+
+func rollupFromTierSample(s tsdb.Sample) *Rollup {
+	r := &Rollup{Start: s.Time, LastTime: s.Time, Series: make(map[string]Aggregate)}
+	for key, v := range s.Values {
+		if key == rollupTimeSeries {
+			r.LastTime = time.UnixMilli(int64(v))
+			continue
+		}
+		name, field, ok := strings.Cut(key, "#")
+		if !ok {
+			continue
+		}
+		agg := r.Series[name]
+		switch field {
+		case "min":
+			agg.Min = v
+		case "max":
+			agg.Max = v
+		case "sum":
+			agg.Sum = v
+		case "count":
+			agg.Count = v
+		case "last":
+			agg.Last = v
+		}
+		r.Series[name] = agg
+	}
+	for name, agg := range r.Series {
+		// Histogram buckets only store their last value
+		if agg.Count == 0 {
+			r.Series[name] = Aggregate{Min: agg.Last, Max: agg.Last, Sum: agg.Last, Count: 1, Last: agg.Last}
+		}
+	}
+	return r
+}
+
+// tierFilter adapts a series filter to tier series names
+func tierFilter(filter func(string) bool) func(string) bool {
+	if filter == nil {
+		return nil
+	}
+	return func(key string) bool {
+		if key == rollupTimeSeries {
+			return true
+		}
+		name, _, _ := strings.Cut(key, "#")
+		return filter(name)
+	}
+}
+
+// tierDB is the storage and in-progress bucket of one rollup tier
+type tierDB struct {
+	tier    RollupTier
+	db      *tsdb.DB
+	pending *Rollup // Bucket still being filled
+}
+
+// instanceDB holds an instance's raw samples and rollup tiers
+type instanceDB struct {
+	id    string
+	raw   *tsdb.DB
+	tiers []*tierDB
+
+	mu sync.Mutex // Serialises appends and guards in-progress buckets
+}
+
+// openInstanceDB opens raw storage and every tier, then rebuilds each
+// tier's in-progress bucket (and any buckets missed while stopped) from the
+// tier below it
+func openInstanceDB(dir, instanceID string) (*instanceDB, error) {
+	raw, err := tsdb.Open(filepath.Join(dir, "raw"), tsdb.Options{SegmentDuration: rawSegmentDuration})
+	if err != nil {
+		return nil, err
+	}
+	inst := &instanceDB{id: instanceID, raw: raw}
+
+	for _, tier := range rollupTiers {
+		db, err := tsdb.Open(filepath.Join(dir, tier.Name), tsdb.Options{SegmentDuration: tier.SegmentDuration})
+		if err != nil {
+			inst.close()
+			return nil, err
+		}
+		inst.tiers = append(inst.tiers, &tierDB{tier: tier, db: db})
+	}
+
+	for i, t := range inst.tiers {
+		var from time.Time
+		if last, ok := t.db.Last(); ok {
+			from = last.Time.Add(t.tier.Width)
+		}
+		replay := func(r *Rollup) {
+			inst.add(i, r, false)
+		}
+		if i == 0 {
+			err = raw.Query(from, time.Now().Add(time.Hour), func(s tsdb.Sample) bool {
+				replay(rollupFromSample(s))
+				return true
+			})
+		} else {
+			err = inst.tiers[i-1].db.Query(from, time.Now().Add(time.Hour), func(s tsdb.Sample) bool {
+				replay(rollupFromTierSample(s))
+				return true
+			})
+		}
+		if err != nil {
+			inst.close()
+			return nil, fmt.Errorf("failed to rebuild %s rollups: %w", t.tier.Name, err)
+		}
+	}
+
+	return inst, nil
+}
+
+func (inst *instanceDB) close() error {
+	var firstErr error
+	dbs := []*tsdb.DB{inst.raw}
+	for _, t := range inst.tiers {
+		dbs = append(dbs, t.db)
+	}
+	for _, db := range dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// add folds a partial rollup into tier i. When it starts a new bucket the
+// previous one is written out and, if cascade is set, fed to the next tier.
+// Callers must serialise calls per instance.
+func (inst *instanceDB) add(i int, r *Rollup, cascade bool) {
+	t := inst.tiers[i]
+	start := r.Start.Truncate(t.tier.Width)
+
+	if t.pending != nil && !t.pending.Start.Equal(start) {
+		done := t.pending
+		t.pending = nil
+		// Buckets already on disk (e.g. replayed after a restart) are skipped
+		if err := t.db.Append(done.sample()); err == nil && cascade && i+1 < len(inst.tiers) {
+			inst.add(i+1, done, true)
+		}
+	}
+
+	if t.pending == nil {
+		t.pending = &Rollup{Start: start, Series: make(map[string]Aggregate)}
+	}
+	t.pending.merge(r)
+}
+
+// append stores a raw sample and folds it into the rollup tiers
+func (inst *instanceDB) append(s tsdb.Sample) error {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	if err := inst.raw.Append(s); err != nil {
+		return err
+	}
+	inst.add(0, rollupFromSample(s), true)
+	return nil
+}
+
+// pendingRollups returns tier i's in-progress buckets, including data still
+// held in the in-progress buckets of finer tiers
+func (inst *instanceDB) pendingRollups(i int) []*Rollup {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	width := inst.tiers[i].tier.Width
+	byStart := make(map[time.Time]*Rollup)
+	var order []time.Time
+
+	for j := i; j >= 0; j-- {
+		p := inst.tiers[j].pending
+		if p == nil {
+			continue
+		}
+		start := p.Start.Truncate(width)
+		r, ok := byStart[start]
+		if !ok {
+			r = &Rollup{Start: start, Series: make(map[string]Aggregate)}
+			byStart[start] = r
+			order = append(order, start)
+		}
+		r.merge(p.clone())
+	}
+
+	sort.Slice(order, func(a, b int) bool { return order[a].Before(order[b]) })
+	result := make([]*Rollup, 0, len(order))
+	for _, start := range order {
+		result = append(result, byStart[start])
+	}
+	return result
+}
+
+// queryTier returns tier i's buckets starting within [start, end] in time
+// order, including in-progress ones
+func (inst *instanceDB) queryTier(i int, start, end time.Time, filter func(string) bool) ([]*Rollup, error) {
+	var rollups []*Rollup
+	err := inst.tiers[i].db.QuerySeries(start, end, tierFilter(filter), func(s tsdb.Sample) bool {
+		rollups = append(rollups, rollupFromTierSample(s))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// In-progress buckets always follow the stored ones
+	for _, r := range inst.pendingRollups(i) {
+		if r.Start.Before(start) || r.Start.After(end) {
+			continue
+		}
+		if filter != nil {
+			for name := range r.Series {
+				if !filter(name) {
+					delete(r.Series, name)
+				}
+			}
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, nil
+}
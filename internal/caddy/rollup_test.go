@@ -0,0 +1,160 @@
+package caddy
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAggregateMerge(t *testing.T) {
+	var a Aggregate
+	if !math.IsNaN(a.Mean()) {
+		t.Error("empty aggregate has a mean")
+	}
+	a.merge(Aggregate{Min: 3, Max: 5, Sum: 8, Count: 2, Last: 5})
+	a.merge(Aggregate{Min: 1, Max: 4, Sum: 5, Count: 2, Last: 1})
+	if want := (Aggregate{Min: 1, Max: 5, Sum: 13, Count: 4, Last: 1}); a != want {
+		t.Errorf("got %+v, want %+v", a, want)
+	}
+	if a.Mean() != 3.25 {
+		t.Errorf("mean %v, want 3.25", a.Mean())
+	}
+}
+
+func TestTierFor(t *testing.T) {
+	now := time.Now()
+	keepRaw := DefaultRetentionPolicy
+	keepRaw.Raw = 0
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		start  time.Time
+		step   time.Duration
+		want   string
+	}{
+		{"fine step", DefaultRetentionPolicy, now.Add(-time.Hour), 10 * time.Second, "raw"},
+		{"minute step", DefaultRetentionPolicy, now.Add(-time.Hour), time.Minute, "1m"},
+		{"between tiers", DefaultRetentionPolicy, now.Add(-time.Hour), 5 * time.Minute, "1m"},
+		{"hour step", DefaultRetentionPolicy, now.Add(-time.Hour), time.Hour, "1h"},
+		{"day step", DefaultRetentionPolicy, now.Add(-time.Hour), 7 * 24 * time.Hour, "1d"},
+		{"raw samples expired", DefaultRetentionPolicy, now.Add(-10 * 24 * time.Hour), 10 * time.Second, "1m"},
+		{"minute rollups expired", DefaultRetentionPolicy, now.Add(-60 * 24 * time.Hour), time.Minute, "1h"},
+		{"hour rollups expired", DefaultRetentionPolicy, now.Add(-400 * 24 * time.Hour), time.Minute, "1d"},
+		{"raw samples kept forever", keepRaw, now.Add(-400 * 24 * time.Hour), 10 * time.Second, "raw"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &AnalyticsStore{retention: tt.policy}
+			if got := tierName(s.tierFor(tt.start, tt.step)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollupTiers(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewAnalyticsStore(filepath.Join(dir, "metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two and a half hours of samples every 10 seconds, with a counter
+	// growing by 5 and a gauge cycling through 0..6
+	base := time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour)
+	const samples = 900
+	for i := 0; i < samples; i++ {
+		m := &InstanceMetrics{
+			Timestamp:   base.Add(time.Duration(i) * 10 * time.Second),
+			NumRequests: int64(i * 5),
+			InFlight:    int64(i % 7),
+		}
+		if err := store.SaveMetrics("inst", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	end := base.Add(3 * time.Hour)
+
+	check := func(t *testing.T, store *AnalyticsStore) {
+		minutes, err := store.GetRollups("inst", 0, base, end, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(minutes) != samples/6 {
+			t.Fatalf("got %d minute buckets, want %d", len(minutes), samples/6)
+		}
+		first := minutes[0]
+		if want := (Aggregate{Min: 0, Max: 25, Sum: 75, Count: 6, Last: 25}); first.Series["num_requests"] != want {
+			t.Errorf("first minute requests %+v, want %+v", first.Series["num_requests"], want)
+		}
+		if want := (Aggregate{Min: 0, Max: 5, Sum: 15, Count: 6, Last: 5}); first.Series["in_flight"] != want {
+			t.Errorf("first minute in flight %+v, want %+v", first.Series["in_flight"], want)
+		}
+		if !first.Start.Equal(base) || !first.LastTime.Equal(base.Add(50*time.Second)) {
+			t.Errorf("first minute starts %v with last sample %v", first.Start, first.LastTime)
+		}
+
+		hours, err := store.GetRollups("inst", 1, base, end, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantHours := []struct {
+			count, last float64
+		}{
+			{360, 359 * 5},
+			{360, 719 * 5},
+			{180, 899 * 5}, // Still in progress
+		}
+		if len(hours) != len(wantHours) {
+			t.Fatalf("got %d hour buckets, want %d", len(hours), len(wantHours))
+		}
+		for i, want := range wantHours {
+			got := hours[i].Series["num_requests"]
+			if got.Count != want.count || got.Last != want.last || !hours[i].Start.Equal(base.Add(time.Duration(i)*time.Hour)) {
+				t.Errorf("hour %d at %v: %+v, want count %v and last %v", i, hours[i].Start, got, want.count, want.last)
+			}
+		}
+		if got := hours[0].Series["in_flight"]; got.Min != 0 || got.Max != 6 {
+			t.Errorf("first hour in flight ranges from %v to %v, want 0 to 6", got.Min, got.Max)
+		}
+
+		// The day tier holds every sample, whether or not the samples
+		// cross midnight
+		days, err := store.GetRollups("inst", 2, base.Add(-24*time.Hour), end, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count float64
+		for _, d := range days {
+			count += d.Series["num_requests"].Count
+		}
+		if count != samples || days[len(days)-1].Series["num_requests"].Last != (samples-1)*5 {
+			t.Errorf("days hold %v samples ending at %v, want %d ending at %d", count, days[len(days)-1].Series["num_requests"].Last, samples, (samples-1)*5)
+		}
+
+		// Rates over an hour step are read from the hour tier
+		rates, err := store.GetRates("inst", "requests", RateOptions{Start: base.Add(time.Hour), End: base.Add(2 * time.Hour), Step: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rates.Source != "1h" || math.Abs(rates.Total-360*5) > 1e-6 {
+			t.Errorf("rates from %s total %v, want 1h and %d", rates.Source, rates.Total, 360*5)
+		}
+	}
+
+	t.Run("live", func(t *testing.T) { check(t, store) })
+
+	// In-progress buckets are rebuilt from the finer tiers after a restart
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewAnalyticsStore(filepath.Join(dir, "metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	t.Run("reopened", func(t *testing.T) { check(t, reopened) })
+}
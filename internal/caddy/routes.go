@@ -0,0 +1,419 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRouteNotFound is returned for a route index a server doesn't have
+var ErrRouteNotFound = errors.New("route not found")
+
+// disabledRouteGroup marks a disabled route. Caddy has no way to switch a
+// route off, so a disabled route is wrapped in a route of this group that
+// never matches, with the original as its only subroute.
+const disabledRouteGroup = "godash_disabled"
+
+// Route is one route of an HTTP server, with its matchers and handler chain
+type Route struct {
+	ID       string         `json:"id,omitempty"` // The route's @id
+	Group    string         `json:"group,omitempty"`
+	Match    []RouteMatch   `json:"match,omitempty"` // The route matches if any set matches
+	Handle   []RouteHandler `json:"handle"`
+	Terminal bool           `json:"terminal,omitempty"`
+	Disabled bool           `json:"disabled,omitempty"`
+}
+
+// RouteMatch is one matcher set of a route; it matches if all its matchers do
+type RouteMatch struct {
+	Host     []string                   `json:"host,omitempty"`
+	Path     []string                   `json:"path,omitempty"`
+	Method   []string                   `json:"method,omitempty"`
+	Header   map[string][]string        `json:"header,omitempty"`
+	RemoteIP []string                   `json:"remote_ip,omitempty"` // IPs or CIDR ranges
+	Other    map[string]json.RawMessage `json:"other,omitempty"`     // Matchers without a field here, kept as they are
+}
+
+// RouteHandler is one handler of a route's chain, as Caddy configures it:
+// the module name in "handler" and the module's own fields
+type RouteHandler map[string]any
+
+// Name returns the handler's module name
+func (h RouteHandler) Name() string {
+	name, _ := h["handler"].(string)
+	return name
+}
+
+// caddyRoute is a route as it appears in Caddy's JSON config
+type caddyRoute struct {
+	ID       string                       `json:"@id,omitempty"`
+	Group    string                       `json:"group,omitempty"`
+	Match    []map[string]json.RawMessage `json:"match,omitempty"`
+	Handle   []RouteHandler               `json:"handle,omitempty"`
+	Terminal bool                         `json:"terminal,omitempty"`
+}
+
+// Validate checks a route before it is sent to an instance
+func (r *Route) Validate() error {
+	for i, set := range r.Match {
+		for _, m := range set.Method {
+			if m == "" || strings.ToUpper(m) != m {
+				return fmt.Errorf("match %d: method %q must be upper case", i, m)
+			}
+		}
+		for name := range set.Header {
+			if name == "" {
+				return fmt.Errorf("match %d: header matcher needs a header name", i)
+			}
+		}
+		for _, ip := range set.RemoteIP {
+			if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+				return fmt.Errorf("match %d: %q is not an IP address or CIDR range", i, ip)
+			}
+		}
+	}
+	for i, h := range r.Handle {
+		if h.Name() == "" {
+			return fmt.Errorf("handler %d has no \"handler\" module name", i)
+		}
+	}
+	return nil
+}
+
+// Hosts returns the hosts a route matches on
+func (r *Route) Hosts() []string {
+	var hosts []string
+	for _, set := range r.Match {
+		hosts = append(hosts, set.Host...)
+	}
+	return hosts
+}
+
+// parseRoute converts a route from Caddy's JSON config, unwrapping it if it
+// is disabled
+func parseRoute(raw []byte) (Route, error) {
+	var cr caddyRoute
+	if err := json.Unmarshal(raw, &cr); err != nil {
+		return Route{}, fmt.Errorf("failed to parse route: %w", err)
+	}
+
+	if cr.Group == disabledRouteGroup && len(cr.Handle) == 1 && cr.Handle[0].Name() == "subroute" {
+		if inner, ok := cr.Handle[0]["routes"].([]any); ok && len(inner) == 1 {
+			innerJSON, err := json.Marshal(inner[0])
+			if err != nil {
+				return Route{}, err
+			}
+			route, err := parseRoute(innerJSON)
+			route.Disabled = true
+			return route, err
+		}
+	}
+
+	route := Route{ID: cr.ID, Group: cr.Group, Handle: cr.Handle, Terminal: cr.Terminal}
+	if route.Handle == nil {
+		route.Handle = []RouteHandler{}
+	}
+	for _, set := range cr.Match {
+		m, err := parseRouteMatch(set)
+		if err != nil {
+			return Route{}, err
+		}
+		route.Match = append(route.Match, m)
+	}
+	return route, nil
+}
+
+func parseRouteMatch(set map[string]json.RawMessage) (RouteMatch, error) {
+	var m RouteMatch
+	for name, raw := range set {
+		var err error
+		switch name {
+		case "host":
+			err = json.Unmarshal(raw, &m.Host)
+		case "path":
+			err = json.Unmarshal(raw, &m.Path)
+		case "method":
+			err = json.Unmarshal(raw, &m.Method)
+		case "header":
+			err = json.Unmarshal(raw, &m.Header)
+		case "remote_ip":
+			// Only plain ranges have a field; other options keep it in Other
+			var remote map[string]json.RawMessage
+			if err = json.Unmarshal(raw, &remote); err == nil && len(remote) == 1 && remote["ranges"] != nil {
+				err = json.Unmarshal(remote["ranges"], &m.RemoteIP)
+				break
+			}
+			fallthrough
+		default:
+			if m.Other == nil {
+				m.Other = make(map[string]json.RawMessage)
+			}
+			m.Other[name] = raw
+			err = nil
+		}
+		if err != nil {
+			return RouteMatch{}, fmt.Errorf("failed to parse %s matcher: %w", name, err)
+		}
+	}
+	return m, nil
+}
+
+// caddyJSON converts a route to Caddy's JSON config, wrapping it if it is
+// disabled
+func (r *Route) caddyJSON() ([]byte, error) {
+	cr := caddyRoute{ID: r.ID, Group: r.Group, Handle: r.Handle, Terminal: r.Terminal}
+	for _, set := range r.Match {
+		m := make(map[string]json.RawMessage)
+		for name, raw := range set.Other {
+			m[name] = raw
+		}
+		fields := map[string]any{}
+		if len(set.Host) > 0 {
+			fields["host"] = set.Host
+		}
+		if len(set.Path) > 0 {
+			fields["path"] = set.Path
+		}
+		if len(set.Method) > 0 {
+			fields["method"] = set.Method
+		}
+		if len(set.Header) > 0 {
+			fields["header"] = set.Header
+		}
+		if len(set.RemoteIP) > 0 {
+			fields["remote_ip"] = map[string][]string{"ranges": set.RemoteIP}
+		}
+		for name, v := range fields {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = raw
+		}
+		cr.Match = append(cr.Match, m)
+	}
+
+	if !r.Disabled {
+		return json.Marshal(cr)
+	}
+	return json.Marshal(map[string]any{
+		"group": disabledRouteGroup,
+		"match": []map[string]any{{"not": []map[string]any{{}}}},
+		"handle": []map[string]any{{
+			"handler": "subroute",
+			"routes":  []caddyRoute{cr},
+		}},
+	})
+}
+
+// parseRoutes converts a server's routes from Caddy's JSON config
+func parseRoutes(raw []byte) ([]Route, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %w", err)
+	}
+
+	routes := make([]Route, 0, len(items))
+	for _, item := range items {
+		route, err := parseRoute(item)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// routesPath returns the config path of a server's routes
+func routesPath(server string) (string, error) {
+	if server == "" || strings.Contains(server, "/") {
+		return "", fmt.Errorf("invalid server name %q", server)
+	}
+	return "apps/http/servers/" + server + "/routes", nil
+}
+
+// ListRoutes returns the routes of a server and the ETag of the route list.
+// Passing the ETag to the route changes below makes them fail with
+// ErrConfigConflict if the routes have changed since.
+func (s *ConfigService) ListRoutes(instanceID, server string) ([]Route, string, error) {
+	path, err := routesPath(server)
+	if err != nil {
+		return nil, "", err
+	}
+
+	inst, err := s.instanceService.Get(instanceID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := NewClientFromInstance(inst, 10*time.Second)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create client: %w", err)
+	}
+
+	raw, etag, err := client.GetPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+	routes, err := parseRoutes(raw)
+	return routes, etag, err
+}
+
+// AddRoute adds a route to a server, before index or, with a negative index,
+// after the existing routes
+func (s *ConfigService) AddRoute(instanceID, server string, route Route, index int, etag string, change ConfigChange) error {
+	path, err := routesPath(server)
+	if err != nil {
+		return err
+	}
+	value, err := route.caddyJSON()
+	if err != nil {
+		return err
+	}
+
+	return s.applyChange(instanceID, ChangeEditRoutes, change, 10*time.Second, func(client *Client) error {
+		if index >= 0 {
+			return client.InsertAt(path, index, value, etag)
+		}
+		return client.AppendPath(path, value, etag)
+	})
+}
+
+// UpdateRoute replaces the route at index
+func (s *ConfigService) UpdateRoute(instanceID, server string, index int, route Route, etag string, change ConfigChange) error {
+	path, err := routesPath(server)
+	if err != nil {
+		return err
+	}
+	value, err := route.caddyJSON()
+	if err != nil {
+		return err
+	}
+
+	return s.applyChange(instanceID, ChangeEditRoutes, change, 10*time.Second, func(client *Client) error {
+		if err := checkRouteIndex(client, path, index); err != nil {
+			return err
+		}
+		return client.PatchPath(path+"/"+strconv.Itoa(index), value, etag)
+	})
+}
+
+// MoveRoute moves the route at index from so that it ends up at index to
+func (s *ConfigService) MoveRoute(instanceID, server string, from, to int, etag string, change ConfigChange) error {
+	path, err := routesPath(server)
+	if err != nil {
+		return err
+	}
+
+	return s.applyChange(instanceID, ChangeEditRoutes, change, 10*time.Second, func(client *Client) error {
+		raw, _, err := client.GetPath(path)
+		if err != nil {
+			return err
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return fmt.Errorf("failed to parse routes: %w", err)
+		}
+		if from < 0 || from >= len(items) || to < 0 || to >= len(items) {
+			return ErrRouteNotFound
+		}
+
+		item := items[from]
+		items = append(items[:from], items[from+1:]...)
+		items = append(items[:to], append([]json.RawMessage{item}, items[to:]...)...)
+		value, err := json.Marshal(items)
+		if err != nil {
+			return err
+		}
+		return client.PatchPath(path, value, etag)
+	})
+}
+
+// SetRouteEnabled enables or disables the route at index. A disabled route
+// stays in the config but never matches.
+func (s *ConfigService) SetRouteEnabled(instanceID, server string, index int, enabled bool, etag string, change ConfigChange) error {
+	path, err := routesPath(server)
+	if err != nil {
+		return err
+	}
+
+	return s.applyChange(instanceID, ChangeEditRoutes, change, 10*time.Second, func(client *Client) error {
+		if err := checkRouteIndex(client, path, index); err != nil {
+			return err
+		}
+		routePath := path + "/" + strconv.Itoa(index)
+		raw, _, err := client.GetPath(routePath)
+		if err != nil {
+			return err
+		}
+		route, err := parseRoute(raw)
+		if err != nil {
+			return err
+		}
+		if route.Disabled == !enabled {
+			return nil
+		}
+
+		route.Disabled = !enabled
+		value, err := route.caddyJSON()
+		if err != nil {
+			return err
+		}
+		return client.PatchPath(routePath, value, etag)
+	})
+}
+
+// DeleteRoute removes the route at index
+func (s *ConfigService) DeleteRoute(instanceID, server string, index int, etag string, change ConfigChange) error {
+	path, err := routesPath(server)
+	if err != nil {
+		return err
+	}
+
+	return s.applyChange(instanceID, ChangeEditRoutes, change, 10*time.Second, func(client *Client) error {
+		if err := checkRouteIndex(client, path, index); err != nil {
+			return err
+		}
+		return client.DeletePath(path+"/"+strconv.Itoa(index), etag)
+	})
+}
+
+// checkRouteIndex returns ErrRouteNotFound if a server has no route at index
+func checkRouteIndex(client *Client, path string, index int) error {
+	raw, _, err := client.GetPath(path)
+	if err != nil {
+		return err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return fmt.Errorf("failed to parse routes: %w", err)
+	}
+	if index < 0 || index >= len(items) {
+		return ErrRouteNotFound
+	}
+	return nil
+}
+
+// siteHosts returns the distinct hosts the enabled routes of a server match
+func siteHosts(routes []Route) []string {
+	seen := map[string]bool{}
+	hosts := []string{}
+	for _, r := range routes {
+		if r.Disabled {
+			continue
+		}
+		for _, h := range r.Hosts() {
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,308 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// sameJSON reports whether two JSON documents hold the same value
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestParseRoute(t *testing.T) {
+	proxy := RouteHandler{"handler": "reverse_proxy", "upstreams": []any{map[string]any{"dial": "10.0.0.1:80"}}}
+
+	tests := []struct {
+		name  string
+		caddy string // Route as in Caddy's config, which caddyJSON must reproduce
+		want  Route
+	}{
+		{
+			name:  "handlers only",
+			caddy: `{"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:80"}]}]}`,
+			want:  Route{Handle: []RouteHandler{proxy}},
+		},
+		{
+			name:  "no handlers",
+			caddy: `{"@id":"empty","match":[{"path":["/x"]}],"terminal":true}`,
+			want:  Route{ID: "empty", Match: []RouteMatch{{Path: []string{"/x"}}}, Handle: []RouteHandler{}, Terminal: true},
+		},
+		{
+			name: "typed matchers",
+			caddy: `{"group":"g","match":[
+				{"host":["example.com"],"path":["/api/*"],"method":["GET","POST"]},
+				{"header":{"X-Env":["staging"]},"remote_ip":{"ranges":["10.0.0.0/8","::1"]}}
+			],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:80"}]}]}`,
+			want: Route{Group: "g", Match: []RouteMatch{
+				{Host: []string{"example.com"}, Path: []string{"/api/*"}, Method: []string{"GET", "POST"}},
+				{Header: map[string][]string{"X-Env": {"staging"}}, RemoteIP: []string{"10.0.0.0/8", "::1"}},
+			}, Handle: []RouteHandler{proxy}},
+		},
+		{
+			name:  "other matchers",
+			caddy: `{"match":[{"host":["example.com"],"not":[{"path":["/admin"]}],"remote_ip":{"ranges":["10.0.0.0/8"],"forwarded":true}}]}`,
+			want: Route{Match: []RouteMatch{{Host: []string{"example.com"}, Other: map[string]json.RawMessage{
+				"not":       json.RawMessage(`[{"path":["/admin"]}]`),
+				"remote_ip": json.RawMessage(`{"ranges":["10.0.0.0/8"],"forwarded":true}`),
+			}}}, Handle: []RouteHandler{}},
+		},
+		{
+			name: "disabled",
+			caddy: `{"group":"godash_disabled","match":[{"not":[{}]}],"handle":[{"handler":"subroute","routes":[
+				{"@id":"api","match":[{"host":["example.com"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:80"}]}]}
+			]}]}`,
+			want: Route{ID: "api", Match: []RouteMatch{{Host: []string{"example.com"}}}, Handle: []RouteHandler{proxy}, Disabled: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route, err := parseRoute([]byte(tt.caddy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(route)
+			want, _ := json.Marshal(tt.want)
+			if !sameJSON(t, got, want) {
+				t.Errorf("parsed %s, want %s", got, want)
+			}
+
+			data, err := route.caddyJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(t, data, []byte(tt.caddy)) {
+				t.Errorf("converted back to %s, want %s", data, tt.caddy)
+			}
+		})
+	}
+
+	for _, bad := range []string{`[]`, `{"match":[{"host":"example.com"}]}`, `{"match":[{"header":["X-Env"]}]}`} {
+		if _, err := parseRoute([]byte(bad)); err == nil {
+			t.Errorf("parsed %s", bad)
+		}
+	}
+}
+
+func TestRouteValidate(t *testing.T) {
+	handle := []RouteHandler{{"handler": "static_response"}}
+	tests := []struct {
+		name  string
+		route Route
+		err   bool
+	}{
+		{name: "valid", route: Route{Match: []RouteMatch{{Method: []string{"GET"}, Header: map[string][]string{"X-Env": nil}, RemoteIP: []string{"10.0.0.0/8", "192.168.1.1", "::1"}}}, Handle: handle}},
+		{name: "no handlers", route: Route{}},
+		{name: "lower case method", route: Route{Match: []RouteMatch{{Method: []string{"get"}}}, Handle: handle}, err: true},
+		{name: "empty method", route: Route{Match: []RouteMatch{{Method: []string{""}}}, Handle: handle}, err: true},
+		{name: "unnamed header", route: Route{Match: []RouteMatch{{Header: map[string][]string{"": {"x"}}}}, Handle: handle}, err: true},
+		{name: "invalid remote IP", route: Route{Match: []RouteMatch{{RemoteIP: []string{"10.0.0.0/33"}}}, Handle: handle}, err: true},
+		{name: "hostname as remote IP", route: Route{Match: []RouteMatch{{RemoteIP: []string{"example.com"}}}, Handle: handle}, err: true},
+		{name: "handler without module", route: Route{Handle: []RouteHandler{{"body": "x"}}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.route.Validate(); (err != nil) != tt.err {
+				t.Errorf("got %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSiteHosts(t *testing.T) {
+	routes := []Route{
+		{Match: []RouteMatch{{Host: []string{"b.example.com"}}, {Host: []string{"a.example.com"}}}},
+		{Match: []RouteMatch{{Host: []string{"a.example.com"}, Path: []string{"/api"}}}},
+		{Match: []RouteMatch{{Host: []string{"off.example.com"}}}, Disabled: true},
+		{Match: []RouteMatch{{Path: []string{"/"}}}},
+	}
+	if got, want := siteHosts(routes), []string{"a.example.com", "b.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := siteHosts(nil); got == nil || len(got) != 0 {
+		t.Errorf("no routes: got %#v, want an empty list", got)
+	}
+}
+
+// routesConfig has a server with three routes, for example.com, api and
+// static
+const routesConfig = `{"apps": {"http": {"servers": {"srv0": {"listen": [":443"], "routes": [
+	{"@id": "main", "match": [{"host": ["example.com"]}], "handle": [{"handler": "static_response", "body": "main"}]},
+	{"@id": "api", "match": [{"host": ["api.example.com"]}], "handle": [{"handler": "reverse_proxy", "upstreams": [{"dial": "10.0.0.1:80"}]}]},
+	{"@id": "static", "handle": [{"handler": "file_server"}]}
+]}}}}}`
+
+func TestConfigServiceRoutes(t *testing.T) {
+	const server = "srv0"
+	change := ConfigChange{Author: "admin"}
+	added := Route{ID: "new", Match: []RouteMatch{{Host: []string{"new.example.com"}}}, Handle: []RouteHandler{{"handler": "static_response"}}}
+
+	tests := []struct {
+		name   string
+		change func(s *ConfigService, id, etag string) error
+		ids    []string // Route IDs afterwards, disabled ones with a "-" prefix
+		err    error
+	}{
+		{
+			name:   "append",
+			change: func(s *ConfigService, id, etag string) error { return s.AddRoute(id, server, added, -1, etag, change) },
+			ids:    []string{"main", "api", "static", "new"},
+		},
+		{
+			name:   "insert",
+			change: func(s *ConfigService, id, etag string) error { return s.AddRoute(id, server, added, 1, etag, change) },
+			ids:    []string{"main", "new", "api", "static"},
+		},
+		{
+			name: "update",
+			change: func(s *ConfigService, id, etag string) error {
+				return s.UpdateRoute(id, server, 2, added, etag, change)
+			},
+			ids: []string{"main", "api", "new"},
+		},
+		{
+			name: "update past the end",
+			change: func(s *ConfigService, id, etag string) error {
+				return s.UpdateRoute(id, server, 3, added, etag, change)
+			},
+			ids: []string{"main", "api", "static"},
+			err: ErrRouteNotFound,
+		},
+		{
+			name:   "move down",
+			change: func(s *ConfigService, id, etag string) error { return s.MoveRoute(id, server, 0, 2, etag, change) },
+			ids:    []string{"api", "static", "main"},
+		},
+		{
+			name:   "move up",
+			change: func(s *ConfigService, id, etag string) error { return s.MoveRoute(id, server, 2, 0, etag, change) },
+			ids:    []string{"static", "main", "api"},
+		},
+		{
+			name:   "move out of range",
+			change: func(s *ConfigService, id, etag string) error { return s.MoveRoute(id, server, 0, 3, etag, change) },
+			ids:    []string{"main", "api", "static"},
+			err:    ErrRouteNotFound,
+		},
+		{
+			name: "disable",
+			change: func(s *ConfigService, id, etag string) error {
+				return s.SetRouteEnabled(id, server, 1, false, etag, change)
+			},
+			ids: []string{"main", "-api", "static"},
+		},
+		{
+			name: "enable an enabled route",
+			change: func(s *ConfigService, id, etag string) error {
+				return s.SetRouteEnabled(id, server, 1, true, etag, change)
+			},
+			ids: []string{"main", "api", "static"},
+		},
+		{
+			name:   "delete",
+			change: func(s *ConfigService, id, etag string) error { return s.DeleteRoute(id, server, 0, etag, change) },
+			ids:    []string{"api", "static"},
+		},
+		{
+			name:   "delete a negative index",
+			change: func(s *ConfigService, id, etag string) error { return s.DeleteRoute(id, server, -1, etag, change) },
+			ids:    []string{"main", "api", "static"},
+			err:    ErrRouteNotFound,
+		},
+		{
+			name: "stale etag",
+			change: func(s *ConfigService, id, etag string) error {
+				if err := s.DeleteRoute(id, server, 2, "", change); err != nil {
+					return err
+				}
+				return s.DeleteRoute(id, server, 0, etag, change)
+			},
+			ids: []string{"main", "api"},
+			err: ErrConfigConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin, _ := newFakeAdmin(t, routesConfig)
+			s, inst := newTestConfigService(t, admin)
+
+			_, etag, err := s.ListRoutes(inst.ID, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.change(s, inst.ID, etag); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+
+			routes, _, err := s.ListRoutes(inst.ID, server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, r := range routes {
+				if r.Disabled {
+					ids = append(ids, "-"+r.ID)
+				} else {
+					ids = append(ids, r.ID)
+				}
+			}
+			if !slices.Equal(ids, tt.ids) {
+				t.Errorf("routes %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
+
+func TestConfigServiceRouteToggle(t *testing.T) {
+	admin, _ := newFakeAdmin(t, routesConfig)
+	s, inst := newTestConfigService(t, admin)
+	change := ConfigChange{Author: "admin"}
+	const path = "apps/http/servers/srv0/routes/1"
+	original := admin.get(t, path)
+
+	if err := s.SetRouteEnabled(inst.ID, "srv0", 1, false, "", change); err != nil {
+		t.Fatal(err)
+	}
+	var disabled map[string]any
+	if err := json.Unmarshal([]byte(admin.get(t, path)), &disabled); err != nil {
+		t.Fatal(err)
+	}
+	if disabled["group"] != disabledRouteGroup {
+		t.Errorf("disabled route is %v", disabled)
+	}
+
+	// A disabled route's hosts no longer count for the site
+	sites, err := s.GetSites(inst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sites) != 1 || !slices.Equal(sites[0].Hosts, []string{"example.com"}) || len(sites[0].Routes) != 3 {
+		t.Errorf("sites %+v, want srv0 with example.com only", sites)
+	}
+
+	if err := s.SetRouteEnabled(inst.ID, "srv0", 1, true, "", change); err != nil {
+		t.Fatal(err)
+	}
+	if got := admin.get(t, path); !sameJSON(t, []byte(got), []byte(original)) {
+		t.Errorf("enabled route is %s, want %s", got, original)
+	}
+
+	for _, server := range []string{"", "srv0/routes"} {
+		if _, _, err := s.ListRoutes(inst.ID, server); err == nil {
+			t.Errorf("listed the routes of server %q", server)
+		}
+	}
+}
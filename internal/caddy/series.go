@@ -0,0 +1,215 @@
+package caddy
+
+import (
+	"godash/internal/tsdb"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InstanceMetrics are stored as flat tsdb series named by path:
+//
+//	num_requests, total_bytes, errors, in_flight, uptime
+//	status/<code>
+//	latency/count, latency/sum, latency/le/<bound>   (also response_size/...)
+//	<group>/<name>/<field>                            (group: sites, servers, handlers)
+//	<group>/<name>/latency/le/<bound>, ...
+//
+// Group member names are path-escaped so they can't contain a separator.
+
+// seriesGroups maps series group names to the InstanceMetrics maps
+var seriesGroups = []string{"sites", "servers", "handlers"}
+
+// toSample flattens metrics into a tsdb sample
+func toSample(m *InstanceMetrics) tsdb.Sample {
+	values := map[string]float64{
+		"uptime":       float64(m.Uptime),
+		"num_requests": float64(m.NumRequests),
+		"total_bytes":  float64(m.TotalTraffic),
+		"errors":       float64(m.Errors),
+		"in_flight":    float64(m.InFlight),
+	}
+	for code, count := range m.StatusCodes {
+		values["status/"+strconv.Itoa(code)] = float64(count)
+	}
+	flattenHistogram(values, "latency/", m.Latency)
+	flattenHistogram(values, "response_size/", m.ResponseSize)
+
+	for i, group := range []map[string]SiteMetrics{m.Sites, m.Servers, m.Handlers} {
+		for name, site := range group {
+			prefix := seriesGroups[i] + "/" + url.PathEscape(name) + "/"
+			values[prefix+"requests"] = float64(site.Requests)
+			values[prefix+"bytes_sent"] = float64(site.BytesSent)
+			values[prefix+"bytes_received"] = float64(site.BytesReceived)
+			values[prefix+"errors"] = float64(site.Errors)
+			values[prefix+"latency_avg_ms"] = site.LatencyAvg
+			flattenHistogram(values, prefix+"latency/", site.Latency)
+			flattenHistogram(values, prefix+"response_size/", site.ResponseSize)
+		}
+	}
+
+	return tsdb.Sample{Time: m.Timestamp, Values: values}
+}
+
+func flattenHistogram(values map[string]float64, prefix string, h *HistogramSnapshot) {
+	if h == nil {
+		return
+	}
+	values[prefix+"count"] = h.Count
+	values[prefix+"sum"] = h.Sum
+	for i, bound := range h.Bounds {
+		values[prefix+"le/"+strconv.FormatFloat(bound, 'g', -1, 64)] = h.Counts[i]
+	}
+}
+
+// fromSample rebuilds metrics from a tsdb sample. Series that aren't
+// present (e.g. filtered out of a query) are left at their zero value.
+func fromSample(instanceID string, s tsdb.Sample) *InstanceMetrics {
+	m := &InstanceMetrics{
+		InstanceID:  instanceID,
+		Timestamp:   s.Time,
+		StatusCodes: make(map[int]int64),
+	}
+
+	hists := make(map[string]*histogramBuilder)
+	hist := func(key string) *histogramBuilder {
+		b, ok := hists[key]
+		if !ok {
+			b = &histogramBuilder{buckets: make(map[float64]float64)}
+			hists[key] = b
+		}
+		return b
+	}
+	sites := make(map[string]map[string]*SiteMetrics)
+
+	for key, v := range s.Values {
+		parts := strings.Split(key, "/")
+		switch parts[0] {
+		case "uptime":
+			m.Uptime = int64(v)
+		case "num_requests":
+			m.NumRequests = int64(v)
+		case "total_bytes":
+			m.TotalTraffic = int64(v)
+		case "errors":
+			m.Errors = int64(v)
+		case "in_flight":
+			m.InFlight = int64(v)
+		case "status":
+			if len(parts) != 2 {
+				continue
+			}
+			if code, err := strconv.Atoi(parts[1]); err == nil {
+				m.StatusCodes[code] = int64(v)
+			}
+		case "latency", "response_size":
+			hist(parts[0]).set(parts[1:], v)
+		case "sites", "servers", "handlers":
+			if len(parts) < 3 {
+				continue
+			}
+			name, err := url.PathUnescape(parts[1])
+			if err != nil {
+				continue
+			}
+			if sites[parts[0]] == nil {
+				sites[parts[0]] = make(map[string]*SiteMetrics)
+			}
+			site := sites[parts[0]][name]
+			if site == nil {
+				site = &SiteMetrics{Name: name}
+				sites[parts[0]][name] = site
+			}
+			switch parts[2] {
+			case "requests":
+				site.Requests = int64(v)
+			case "bytes_sent":
+				site.BytesSent = int64(v)
+			case "bytes_received":
+				site.BytesReceived = int64(v)
+			case "errors":
+				site.Errors = int64(v)
+			case "latency_avg_ms":
+				site.LatencyAvg = v
+			case "latency", "response_size":
+				hist(strings.Join(parts[:3], "/")).set(parts[3:], v)
+			}
+		}
+	}
+
+	m.Latency = hists["latency"].build()
+	m.ResponseSize = hists["response_size"].build()
+
+	for _, group := range seriesGroups {
+		members := sites[group]
+		if len(members) == 0 {
+			continue
+		}
+		result := make(map[string]SiteMetrics, len(members))
+		for name, site := range members {
+			prefix := group + "/" + url.PathEscape(name) + "/"
+			site.Latency = hists[prefix+"latency"].build()
+			site.ResponseSize = hists[prefix+"response_size"].build()
+			result[name] = *site
+		}
+		switch group {
+		case "sites":
+			m.Sites = result
+		case "servers":
+			m.Servers = result
+		case "handlers":
+			m.Handlers = result
+		}
+	}
+
+	return m
+}
+
+// histogramBuilder collects flattened histogram series
+type histogramBuilder struct {
+	buckets map[float64]float64
+	sum     float64
+	count   float64
+}
+
+func (b *histogramBuilder) set(parts []string, v float64) {
+	switch {
+	case len(parts) == 1 && parts[0] == "count":
+		b.count = v
+	case len(parts) == 1 && parts[0] == "sum":
+		b.sum = v
+	case len(parts) == 2 && parts[0] == "le":
+		if bound, err := strconv.ParseFloat(parts[1], 64); err == nil {
+			b.buckets[bound] = v
+		}
+	}
+}
+
+func (b *histogramBuilder) build() *HistogramSnapshot {
+	if b == nil {
+		return nil
+	}
+	h := &HistogramSnapshot{Sum: b.sum, Count: b.count}
+	for bound := range b.buckets {
+		h.Bounds = append(h.Bounds, bound)
+	}
+	sort.Float64s(h.Bounds)
+	h.Counts = make([]float64, len(h.Bounds))
+	for i, bound := range h.Bounds {
+		h.Counts[i] = b.buckets[bound]
+	}
+	return h
+}
+
+// isHistogramSeries reports whether a series belongs to a stored histogram
+func isHistogramSeries(name string) bool {
+	parts := strings.Split(name, "/")
+	switch parts[0] {
+	case "latency", "response_size":
+		return true
+	case "sites", "servers", "handlers":
+		return len(parts) > 3
+	}
+	return false
+}
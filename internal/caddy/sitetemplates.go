@@ -0,0 +1,645 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrTemplateNotFound is returned for a site template that doesn't exist
+var ErrTemplateNotFound = errors.New("site template not found")
+
+// ErrInvalidSite is returned for site parameters a template can't use, or a
+// site that would clash with the instance's config
+var ErrInvalidSite = errors.New("invalid site")
+
+func invalidSite(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidSite, fmt.Sprintf(format, args...))
+}
+
+// TLS modes of a site created from a template
+const (
+	SiteTLSAuto     = "auto"     // Caddy's automatic HTTPS with public certificates
+	SiteTLSInternal = "internal" // Certificates from Caddy's internal CA
+	SiteTLSOff      = "off"      // Plain HTTP on port 80
+)
+
+// SiteParams are the parameters of a site template. Which of the
+// template-specific ones a template uses is listed in its Params.
+type SiteParams struct {
+	Name  string   `json:"name,omitempty"` // Server to create if none listens on the site's port; derived from the first host if empty
+	Hosts []string `json:"hosts"`
+
+	Upstreams    []string `json:"upstreams,omitempty"` // host:port dial addresses
+	Root         string   `json:"root,omitempty"`
+	RedirectTo   string   `json:"redirect_to,omitempty"`
+	RedirectCode int      `json:"redirect_code,omitempty"` // Defaults to 308
+
+	TLS             string `json:"tls,omitempty"` // auto (default), internal or off
+	Compression     bool   `json:"compression,omitempty"`
+	SecurityHeaders bool   `json:"security_headers,omitempty"`
+}
+
+// TemplateParam describes one parameter of a site template for forms
+type TemplateParam struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"` // string, list, int, bool or choice
+	Required bool     `json:"required,omitempty"`
+	Default  any      `json:"default,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// siteParamInfo describes every SiteParams field, by its JSON name
+var siteParamInfo = map[string]TemplateParam{
+	"name":             {Name: "name", Label: "Server name", Type: "string"},
+	"hosts":            {Name: "hosts", Label: "Hostnames", Type: "list", Required: true},
+	"upstreams":        {Name: "upstreams", Label: "Upstreams (host:port)", Type: "list", Required: true},
+	"root":             {Name: "root", Label: "Root directory", Type: "string", Required: true},
+	"redirect_to":      {Name: "redirect_to", Label: "Redirect to", Type: "string", Required: true},
+	"redirect_code":    {Name: "redirect_code", Label: "Redirect status", Type: "choice", Default: "308", Options: []string{"301", "302", "307", "308"}},
+	"tls":              {Name: "tls", Label: "TLS", Type: "choice", Default: SiteTLSAuto, Options: []string{SiteTLSAuto, SiteTLSInternal, SiteTLSOff}},
+	"compression":      {Name: "compression", Label: "Compression (zstd, gzip)", Type: "bool"},
+	"security_headers": {Name: "security_headers", Label: "Security headers", Type: "bool"},
+}
+
+// commonSiteParams are the parameters every template takes
+var commonSiteParams = []string{"hosts", "tls", "compression", "security_headers", "name"}
+
+// SiteTemplate generates the routes of a site from typed parameters
+type SiteTemplate struct {
+	Name        string          `json:"name"`
+	Title       string          `json:"title"`
+	Description string          `json:"description,omitempty"`
+	Params      []string        `json:"params"` // Template-specific parameters, by JSON name
+	Routes      json.RawMessage `json:"routes,omitempty"`
+	Builtin     bool            `json:"builtin"`
+
+	build func(p SiteParams) ([]any, error)
+}
+
+// SiteTemplateInfo describes a template and all its parameters for forms
+type SiteTemplateInfo struct {
+	Name        string          `json:"name"`
+	Title       string          `json:"title"`
+	Description string          `json:"description,omitempty"`
+	Builtin     bool            `json:"builtin"`
+	Params      []TemplateParam `json:"params"` // Template-specific ones first, then the common ones
+}
+
+// Info describes the template and its parameters
+func (t *SiteTemplate) Info() SiteTemplateInfo {
+	info := SiteTemplateInfo{Name: t.Name, Title: t.Title, Description: t.Description, Builtin: t.Builtin}
+	for _, name := range append(append([]string{}, t.Params...), commonSiteParams...) {
+		info.Params = append(info.Params, siteParamInfo[name])
+	}
+	return info
+}
+
+// builtinSiteTemplates are the templates Godash ships with
+var builtinSiteTemplates = []*SiteTemplate{
+	{
+		Name:        "reverse_proxy",
+		Builtin:     true,
+		Title:       "Reverse proxy",
+		Description: "Proxy all requests to one or more upstreams, balancing between them",
+		Params:      []string{"upstreams"},
+		build: func(p SiteParams) ([]any, error) {
+			upstreams := make([]any, 0, len(p.Upstreams))
+			for _, u := range p.Upstreams {
+				upstreams = append(upstreams, map[string]any{"dial": u})
+			}
+			return []any{map[string]any{
+				"handle": []any{map[string]any{"handler": "reverse_proxy", "upstreams": upstreams}},
+			}}, nil
+		},
+	},
+	{
+		Name:        "static_files",
+		Builtin:     true,
+		Title:       "Static files",
+		Description: "Serve files from a directory",
+		Params:      []string{"root"},
+		build: func(p SiteParams) ([]any, error) {
+			return []any{map[string]any{
+				"handle": []any{map[string]any{"handler": "file_server", "root": p.Root}},
+			}}, nil
+		},
+	},
+	{
+		Name:        "redirect",
+		Builtin:     true,
+		Title:       "Redirect",
+		Description: "Redirect every request to another URL, keeping the path and query unless the target has placeholders",
+		Params:      []string{"redirect_to", "redirect_code"},
+		build: func(p SiteParams) ([]any, error) {
+			location := p.RedirectTo
+			if !strings.Contains(location, "{") {
+				location = strings.TrimRight(location, "/") + "{http.request.uri}"
+			}
+			return []any{map[string]any{
+				"handle": []any{map[string]any{
+					"handler":     "static_response",
+					"status_code": p.RedirectCode,
+					"headers":     map[string]any{"Location": []any{location}},
+				}},
+			}}, nil
+		},
+	},
+	{
+		Name:        "spa",
+		Builtin:     true,
+		Title:       "Single-page app",
+		Description: "Serve files from a directory, answering paths without a file with index.html",
+		Params:      []string{"root"},
+		build: func(p SiteParams) ([]any, error) {
+			return []any{
+				map[string]any{
+					"match": []any{map[string]any{"file": map[string]any{
+						"root":      p.Root,
+						"try_files": []any{"{http.request.uri.path}", "/index.html"},
+					}}},
+					"handle": []any{map[string]any{"handler": "rewrite", "uri": "{http.matchers.file.relative}"}},
+				},
+				map[string]any{
+					"handle": []any{map[string]any{"handler": "file_server", "root": p.Root}},
+				},
+			}, nil
+		},
+	},
+}
+
+// templateName matches valid template and server names
+var templateName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// templatePlaceholder matches a {{param}} placeholder in a template file
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([a-z_]+)\s*\}\}`)
+
+// SiteTemplates provides the built-in site templates and those registered as
+// JSON files in a directory. Files are read on every call, so templates can
+// be added without a restart.
+type SiteTemplates struct {
+	dir string
+}
+
+// NewSiteTemplates creates the template registry. Template files are read
+// from dir, which may be empty for only the built-in templates.
+func NewSiteTemplates(dir string) *SiteTemplates {
+	return &SiteTemplates{dir: dir}
+}
+
+// List returns all templates, built-in ones first, then files by name. Files
+// that can't be loaded are logged and skipped.
+func (st *SiteTemplates) List() []*SiteTemplate {
+	templates := append([]*SiteTemplate{}, builtinSiteTemplates...)
+	if st == nil || st.dir == "" {
+		return templates
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(st.dir, "*.json"))
+	sort.Strings(paths)
+	for _, path := range paths {
+		t, err := loadSiteTemplate(path)
+		if err != nil {
+			log.Printf("Warning: skipping site template %s: %v", path, err)
+			continue
+		}
+		templates = append(templates, t)
+	}
+	return templates
+}
+
+// Get returns a template by name
+func (st *SiteTemplates) Get(name string) (*SiteTemplate, error) {
+	for _, t := range st.List() {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, ErrTemplateNotFound
+}
+
+// loadSiteTemplate reads a template file. Its routes are a JSON array of
+// routes for the site's subroute; a string that is exactly a {{param}}
+// placeholder is replaced with the parameter's JSON value, and placeholders
+// inside longer strings with its text.
+func loadSiteTemplate(path string) (*SiteTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t SiteTemplate
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if !templateName.MatchString(t.Name) {
+		return nil, fmt.Errorf("invalid template name %q", t.Name)
+	}
+	for _, b := range builtinSiteTemplates {
+		if b.Name == t.Name {
+			return nil, fmt.Errorf("template %q is built in", t.Name)
+		}
+	}
+	if t.Title == "" {
+		t.Title = t.Name
+	}
+	for _, name := range t.Params {
+		if _, ok := siteParamInfo[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+
+	var routes []any
+	if err := unmarshalJSONDoc(t.Routes, &routes); err != nil || len(routes) == 0 {
+		return nil, fmt.Errorf("routes must be a non-empty JSON array")
+	}
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(string(t.Routes), -1) {
+		if _, ok := siteParamInfo[m[1]]; !ok {
+			return nil, fmt.Errorf("unknown placeholder %s", m[0])
+		}
+	}
+
+	t.Builtin = false
+	t.build = func(p SiteParams) ([]any, error) {
+		values, err := siteParamValues(p)
+		if err != nil {
+			return nil, err
+		}
+		var fresh []any
+		if err := unmarshalJSONDoc(t.Routes, &fresh); err != nil {
+			return nil, err
+		}
+		return substitutePlaceholders(fresh, values).([]any), nil
+	}
+	return &t, nil
+}
+
+// siteParamValues returns the parameters by JSON name, the way placeholders
+// see them; upstreams become reverse_proxy upstream objects
+func siteParamValues(p SiteParams) (map[string]any, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	if err := unmarshalJSONDoc(data, &values); err != nil {
+		return nil, err
+	}
+
+	upstreams := make([]any, 0, len(p.Upstreams))
+	for _, u := range p.Upstreams {
+		upstreams = append(upstreams, map[string]any{"dial": u})
+	}
+	values["upstreams"] = upstreams
+	return values, nil
+}
+
+func substitutePlaceholders(v any, values map[string]any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			t[k] = substitutePlaceholders(child, values)
+		}
+	case []any:
+		for i, child := range t {
+			t[i] = substitutePlaceholders(child, values)
+		}
+	case string:
+		if m := templatePlaceholder.FindStringSubmatch(t); m != nil && m[0] == t {
+			return values[m[1]]
+		}
+		return templatePlaceholder.ReplaceAllStringFunc(t, func(s string) string {
+			name := templatePlaceholder.FindStringSubmatch(s)[1]
+			switch value := values[name].(type) {
+			case nil:
+				return ""
+			case string:
+				return value
+			case []any:
+				parts := make([]string, len(value))
+				for i, v := range value {
+					// Upstreams are joined by their dial addresses
+					if upstream, ok := v.(map[string]any); ok {
+						v = upstream["dial"]
+					}
+					parts[i] = fmt.Sprint(v)
+				}
+				return strings.Join(parts, ",")
+			default:
+				return fmt.Sprint(value)
+			}
+		})
+	}
+	return v
+}
+
+// Validate checks the parameters a template needs and fills in defaults
+func (t *SiteTemplate) Validate(p *SiteParams) error {
+	if len(p.Hosts) == 0 {
+		return invalidSite("at least one hostname is required")
+	}
+	for _, h := range p.Hosts {
+		if h == "" || strings.ContainsAny(h, " /:") {
+			return invalidSite("invalid hostname %q", h)
+		}
+	}
+	if p.Name != "" && !templateName.MatchString(p.Name) {
+		return invalidSite("invalid server name %q", p.Name)
+	}
+
+	switch p.TLS {
+	case "":
+		p.TLS = SiteTLSAuto
+	case SiteTLSAuto, SiteTLSInternal, SiteTLSOff:
+	default:
+		return invalidSite("invalid TLS mode %q", p.TLS)
+	}
+	if p.RedirectCode == 0 {
+		p.RedirectCode = 308
+	}
+
+	for _, name := range t.Params {
+		switch name {
+		case "upstreams":
+			if len(p.Upstreams) == 0 {
+				return invalidSite("at least one upstream is required")
+			}
+			for i, u := range p.Upstreams {
+				u = strings.TrimPrefix(u, "http://")
+				if _, _, err := net.SplitHostPort(u); err != nil {
+					return invalidSite("upstream %q must be host:port", p.Upstreams[i])
+				}
+				p.Upstreams[i] = u
+			}
+		case "root":
+			if p.Root == "" {
+				return invalidSite("a root directory is required")
+			}
+		case "redirect_to":
+			if !strings.HasPrefix(p.RedirectTo, "http://") && !strings.HasPrefix(p.RedirectTo, "https://") {
+				return invalidSite("the redirect target must be an http:// or https:// URL")
+			}
+		case "redirect_code":
+			switch p.RedirectCode {
+			case 301, 302, 307, 308:
+			default:
+				return invalidSite("invalid redirect status %d", p.RedirectCode)
+			}
+		}
+	}
+	return nil
+}
+
+// Route generates the site's route: it matches the hosts and runs the
+// security headers, compression and the template's own routes in order
+func (t *SiteTemplate) Route(p SiteParams) (map[string]any, error) {
+	routes, err := t.build(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var sub []any
+	if p.SecurityHeaders {
+		headers := map[string]any{
+			"X-Content-Type-Options": []any{"nosniff"},
+			"X-Frame-Options":        []any{"DENY"},
+			"Referrer-Policy":        []any{"strict-origin-when-cross-origin"},
+		}
+		if p.TLS != SiteTLSOff {
+			headers["Strict-Transport-Security"] = []any{"max-age=31536000"}
+		}
+		sub = append(sub, map[string]any{
+			"handle": []any{map[string]any{"handler": "headers", "response": map[string]any{"set": headers}}},
+		})
+	}
+	if p.Compression {
+		sub = append(sub, map[string]any{
+			"handle": []any{map[string]any{
+				"handler":   "encode",
+				"encodings": map[string]any{"zstd": map[string]any{}, "gzip": map[string]any{}},
+				"prefer":    []any{"zstd", "gzip"},
+			}},
+		})
+	}
+	sub = append(sub, routes...)
+
+	hosts := make([]any, 0, len(p.Hosts))
+	for _, h := range p.Hosts {
+		hosts = append(hosts, h)
+	}
+	return map[string]any{
+		"match":    []any{map[string]any{"host": hosts}},
+		"handle":   []any{map[string]any{"handler": "subroute", "routes": sub}},
+		"terminal": true,
+	}, nil
+}
+
+// SitePreview is what creating a site from a template would change
+type SitePreview struct {
+	Server    string          `json:"server"`     // Server the route goes into
+	NewServer bool            `json:"new_server"` // Whether that server is created
+	Route     json.RawMessage `json:"route"`
+	TLSPolicy json.RawMessage `json:"tls_policy,omitempty"`
+	Plan      *ConfigPlan     `json:"plan"`
+}
+
+// buildSite adds a site to a config. The route goes into the first server
+// listening on the site's port, before its routes without a host matcher,
+// or into a new server if there is none.
+func buildSite(config []byte, t *SiteTemplate, p SiteParams) ([]byte, *SitePreview, error) {
+	var doc map[string]any
+	if err := unmarshalJSONDoc(config, &doc); err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if doc == nil {
+		doc = map[string]any{}
+	}
+
+	route, err := t.Route(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	servers := childObject(childObject(childObject(doc, "apps"), "http"), "servers")
+	port := ":443"
+	if p.TLS == SiteTLSOff {
+		port = ":80"
+	}
+
+	preview := &SitePreview{}
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		srv, _ := servers[name].(map[string]any)
+		listen, _ := srv["listen"].([]any)
+		for _, l := range listen {
+			if addr, _ := l.(string); strings.HasSuffix(addr, port) {
+				preview.Server = name
+				break
+			}
+		}
+		if preview.Server != "" {
+			break
+		}
+	}
+
+	if preview.Server == "" {
+		preview.Server, preview.NewServer = p.Name, true
+		if preview.Server == "" {
+			preview.Server = "site_" + strings.NewReplacer(".", "_", "*", "wildcard").Replace(p.Hosts[0])
+		}
+		if _, exists := servers[preview.Server]; exists {
+			return nil, nil, invalidSite("server %s already exists and doesn't listen on %s", preview.Server, port)
+		}
+		srv := map[string]any{"listen": []any{port}, "routes": []any{route}}
+		if p.TLS == SiteTLSOff {
+			srv["automatic_https"] = map[string]any{"disable": true}
+		}
+		servers[preview.Server] = srv
+	} else {
+		srv := servers[preview.Server].(map[string]any)
+		routes, _ := srv["routes"].([]any)
+		existing := map[string]bool{}
+		insert := len(routes)
+		for i, r := range routes {
+			raw, _ := json.Marshal(r)
+			parsed, err := parseRoute(raw)
+			if err != nil {
+				continue
+			}
+			hosts := parsed.Hosts()
+			if len(hosts) == 0 && insert == len(routes) {
+				insert = i
+			}
+			for _, h := range hosts {
+				existing[h] = true
+			}
+		}
+		for _, h := range p.Hosts {
+			if existing[h] {
+				return nil, nil, invalidSite("server %s already has routes for %s", preview.Server, h)
+			}
+		}
+		routes = append(routes[:insert], append([]any{route}, routes[insert:]...)...)
+		srv["routes"] = routes
+	}
+
+	if p.TLS == SiteTLSInternal {
+		subjects := make([]any, 0, len(p.Hosts))
+		for _, h := range p.Hosts {
+			subjects = append(subjects, h)
+		}
+		policy := map[string]any{"subjects": subjects, "issuers": []any{map[string]any{"module": "internal"}}}
+		// Policies without subjects catch everything else, so new policies
+		// go first
+		automation := childObject(childObject(childObject(doc, "apps"), "tls"), "automation")
+		policies, _ := automation["policies"].([]any)
+		automation["policies"] = append([]any{policy}, policies...)
+		if preview.TLSPolicy, err = json.Marshal(policy); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if preview.Route, err = json.Marshal(route); err != nil {
+		return nil, nil, err
+	}
+	proposed, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if preview.Plan, err = PlanConfigChange(config, proposed); err != nil {
+		return nil, nil, err
+	}
+	return proposed, preview, nil
+}
+
+// childObject returns the object under key, creating it if needed
+func childObject(parent map[string]any, key string) map[string]any {
+	child, ok := parent[key].(map[string]any)
+	if !ok {
+		child = map[string]any{}
+		parent[key] = child
+	}
+	return child
+}
+
+// SetSiteTemplates sets the registry of site templates
+func (s *ConfigService) SetSiteTemplates(templates *SiteTemplates) {
+	s.templates = templates
+}
+
+// SiteTemplates returns the available site templates
+func (s *ConfigService) SiteTemplates() []*SiteTemplate {
+	return s.templates.List()
+}
+
+// PreviewSite shows what creating a site from a template would change on an
+// instance, without changing anything
+func (s *ConfigService) PreviewSite(instanceID, templateName string, params SiteParams) (*SitePreview, error) {
+	t, err := s.templates.Get(templateName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Validate(&params); err != nil {
+		return nil, err
+	}
+
+	inst, err := s.instanceService.Get(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClientFromInstance(inst, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	config, err := client.GetRawConfig()
+	if err != nil {
+		return nil, err
+	}
+	_, preview, err := buildSite(config, t, params)
+	return preview, err
+}
+
+// CreateSiteFromTemplate creates a site from a template on an instance. The
+// site is built against the config at the time of the change, so the result
+// may differ from an earlier preview if the config changed in between.
+func (s *ConfigService) CreateSiteFromTemplate(instanceID, templateName string, params SiteParams, change ConfigChange) (*SitePreview, error) {
+	t, err := s.templates.Get(templateName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Validate(&params); err != nil {
+		return nil, err
+	}
+	if change.Message == "" {
+		change.Message = fmt.Sprintf("Create %s site for %s", t.Title, strings.Join(params.Hosts, ", "))
+	}
+
+	var preview *SitePreview
+	err = s.applyChange(instanceID, ChangeCreateSite, change, 30*time.Second, func(client *Client) error {
+		config, err := client.GetRawConfig()
+		if err != nil {
+			return err
+		}
+		proposed, p, err := buildSite(config, t, params)
+		if err != nil {
+			return err
+		}
+		preview = p
+		return client.ReloadConfig(proposed)
+	})
+	return preview, err
+}
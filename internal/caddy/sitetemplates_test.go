@@ -0,0 +1,450 @@
+package caddy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// builtinTemplate returns a built-in site template by name
+func builtinTemplate(t *testing.T, name string) *SiteTemplate {
+	t.Helper()
+	tmpl, err := NewSiteTemplates("").Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpl
+}
+
+func TestSiteTemplateValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		params   SiteParams
+		want     SiteParams // Params after defaults are filled in
+		err      bool
+	}{
+		{
+			name:     "defaults",
+			template: "reverse_proxy",
+			params:   SiteParams{Hosts: []string{"example.com"}, Upstreams: []string{"10.0.0.1:80"}},
+			want:     SiteParams{Hosts: []string{"example.com"}, Upstreams: []string{"10.0.0.1:80"}, TLS: SiteTLSAuto, RedirectCode: 308},
+		},
+		{
+			name:     "upstream scheme stripped",
+			template: "reverse_proxy",
+			params:   SiteParams{Hosts: []string{"example.com"}, Upstreams: []string{"http://10.0.0.1:80", "app:8080"}, TLS: SiteTLSOff},
+			want:     SiteParams{Hosts: []string{"example.com"}, Upstreams: []string{"10.0.0.1:80", "app:8080"}, TLS: SiteTLSOff, RedirectCode: 308},
+		},
+		{
+			name:     "redirect",
+			template: "redirect",
+			params:   SiteParams{Hosts: []string{"old.example.com"}, RedirectTo: "https://example.com", RedirectCode: 302},
+			want:     SiteParams{Hosts: []string{"old.example.com"}, RedirectTo: "https://example.com", RedirectCode: 302, TLS: SiteTLSAuto},
+		},
+		{
+			name:     "params of other templates are ignored",
+			template: "static_files",
+			params:   SiteParams{Hosts: []string{"example.com"}, Root: "/srv", Upstreams: []string{"bad"}, RedirectCode: 200},
+			want:     SiteParams{Hosts: []string{"example.com"}, Root: "/srv", Upstreams: []string{"bad"}, RedirectCode: 200, TLS: SiteTLSAuto},
+		},
+		{name: "no hosts", template: "static_files", params: SiteParams{Root: "/srv"}, err: true},
+		{name: "empty host", template: "static_files", params: SiteParams{Hosts: []string{""}, Root: "/srv"}, err: true},
+		{name: "host with a port", template: "static_files", params: SiteParams{Hosts: []string{"example.com:8080"}, Root: "/srv"}, err: true},
+		{name: "host with a path", template: "static_files", params: SiteParams{Hosts: []string{"example.com/app"}, Root: "/srv"}, err: true},
+		{name: "invalid server name", template: "static_files", params: SiteParams{Name: "Web Server", Hosts: []string{"example.com"}, Root: "/srv"}, err: true},
+		{name: "invalid TLS mode", template: "static_files", params: SiteParams{Hosts: []string{"example.com"}, Root: "/srv", TLS: "manual"}, err: true},
+		{name: "no upstreams", template: "reverse_proxy", params: SiteParams{Hosts: []string{"example.com"}}, err: true},
+		{name: "upstream without a port", template: "reverse_proxy", params: SiteParams{Hosts: []string{"example.com"}, Upstreams: []string{"10.0.0.1"}}, err: true},
+		{name: "no root", template: "spa", params: SiteParams{Hosts: []string{"example.com"}}, err: true},
+		{name: "relative redirect", template: "redirect", params: SiteParams{Hosts: []string{"example.com"}, RedirectTo: "/new"}, err: true},
+		{name: "redirect status not a redirect", template: "redirect", params: SiteParams{Hosts: []string{"example.com"}, RedirectTo: "https://example.com", RedirectCode: 304}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.params
+			err := builtinTemplate(t, tt.template).Validate(&p)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidSite) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidSite)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(p)
+			want, _ := json.Marshal(tt.want)
+			if string(got) != string(want) {
+				t.Errorf("params %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSiteTemplateRoute(t *testing.T) {
+	const headers = `{"handle":[{"handler":"headers","response":{"set":{
+		"X-Content-Type-Options":["nosniff"],"X-Frame-Options":["DENY"],
+		"Referrer-Policy":["strict-origin-when-cross-origin"],"Strict-Transport-Security":["max-age=31536000"]}}}]}`
+	const encode = `{"handle":[{"handler":"encode","encodings":{"zstd":{},"gzip":{}},"prefer":["zstd","gzip"]}]}`
+
+	tests := []struct {
+		name     string
+		template string
+		params   SiteParams
+		routes   string // Routes of the site's subroute
+	}{
+		{
+			name:     "reverse proxy",
+			template: "reverse_proxy",
+			params:   SiteParams{Upstreams: []string{"10.0.0.1:80", "10.0.0.2:80"}},
+			routes:   `[{"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:80"},{"dial":"10.0.0.2:80"}]}]}]`,
+		},
+		{
+			name:     "static files with headers and compression",
+			template: "static_files",
+			params:   SiteParams{Root: "/srv/www", SecurityHeaders: true, Compression: true},
+			routes:   `[` + headers + `,` + encode + `,{"handle":[{"handler":"file_server","root":"/srv/www"}]}]`,
+		},
+		{
+			name:     "no HSTS without TLS",
+			template: "static_files",
+			params:   SiteParams{Root: "/srv/www", SecurityHeaders: true, TLS: SiteTLSOff},
+			routes: `[{"handle":[{"handler":"headers","response":{"set":{
+				"X-Content-Type-Options":["nosniff"],"X-Frame-Options":["DENY"],
+				"Referrer-Policy":["strict-origin-when-cross-origin"]}}}]},
+				{"handle":[{"handler":"file_server","root":"/srv/www"}]}]`,
+		},
+		{
+			name:     "redirect keeps the URI",
+			template: "redirect",
+			params:   SiteParams{RedirectTo: "https://example.com/", RedirectCode: 301},
+			routes:   `[{"handle":[{"handler":"static_response","status_code":301,"headers":{"Location":["https://example.com{http.request.uri}"]}}]}]`,
+		},
+		{
+			name:     "redirect with placeholders",
+			template: "redirect",
+			params:   SiteParams{RedirectTo: "https://example.com{http.request.uri.path}", RedirectCode: 308},
+			routes:   `[{"handle":[{"handler":"static_response","status_code":308,"headers":{"Location":["https://example.com{http.request.uri.path}"]}}]}]`,
+		},
+		{
+			name:     "single-page app",
+			template: "spa",
+			params:   SiteParams{Root: "/srv/app", Compression: true},
+			routes: `[` + encode + `,
+				{"match":[{"file":{"root":"/srv/app","try_files":["{http.request.uri.path}","/index.html"]}}],
+				 "handle":[{"handler":"rewrite","uri":"{http.matchers.file.relative}"}]},
+				{"handle":[{"handler":"file_server","root":"/srv/app"}]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Hosts = []string{"example.com", "www.example.com"}
+			route, err := builtinTemplate(t, tt.template).Route(tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(route)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := `{"match":[{"host":["example.com","www.example.com"]}],"handle":[{"handler":"subroute","routes":` + tt.routes + `}],"terminal":true}`
+			if !sameJSON(t, got, []byte(want)) {
+				t.Errorf("route %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSiteTemplateFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"api.json": `{"name":"api","description":"API behind a proxy","params":["upstreams"],"routes":[
+			{"match":[{"path":["/api/*"]}],"handle":[{"handler":"reverse_proxy","upstreams":"{{upstreams}}"}]},
+			{"handle":[{"handler":"static_response","body":"{{ hosts }} via {{upstreams}}"}]}
+		]}`,
+		"docs.json":        `{"name":"docs","title":"Documentation","params":["root"],"routes":[{"handle":[{"handler":"file_server","root":"{{root}}"}]}]}`,
+		"bad-name.json":    `{"name":"Bad Name","routes":[{}]}`,
+		"builtin.json":     `{"name":"spa","routes":[{}]}`,
+		"param.json":       `{"name":"param","params":["port"],"routes":[{}]}`,
+		"no-routes.json":   `{"name":"no_routes","routes":[]}`,
+		"placeholder.json": `{"name":"placeholder","routes":[{"handle":[{"handler":"file_server","root":"{{port}}"}]}]}`,
+		"invalid.json":     `{"name":`,
+		"notes.txt":        `not a template`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	templates := NewSiteTemplates(dir)
+
+	var names []string
+	for _, tmpl := range templates.List() {
+		names = append(names, tmpl.Name)
+	}
+	if want := []string{"reverse_proxy", "static_files", "redirect", "spa", "api", "docs"}; !slices.Equal(names, want) {
+		t.Errorf("templates %v, want %v", names, want)
+	}
+	if _, err := templates.Get("placeholder"); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("got %v for a skipped template, want %v", err, ErrTemplateNotFound)
+	}
+
+	api, err := templates.Get("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := api.Info()
+	var params []string
+	for _, p := range info.Params {
+		params = append(params, p.Name)
+	}
+	if info.Title != "api" || info.Builtin || !slices.Equal(params, append([]string{"upstreams"}, commonSiteParams...)) {
+		t.Errorf("info %+v", info)
+	}
+
+	p := SiteParams{Hosts: []string{"example.com", "www.example.com"}, Upstreams: []string{"http://10.0.0.1:80"}}
+	if err := api.Validate(&p); err != nil {
+		t.Fatal(err)
+	}
+	route, err := api.Route(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(jsonAt(t, route, "handle", 0)["routes"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[
+		{"match":[{"path":["/api/*"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:80"}]}]},
+		{"handle":[{"handler":"static_response","body":"example.com,www.example.com via 10.0.0.1:80"}]}
+	]`
+	if !sameJSON(t, got, []byte(want)) {
+		t.Errorf("routes %s, want %s", got, want)
+	}
+
+	// Every route is built from the file again
+	if _, err := api.Route(SiteParams{Hosts: []string{"example.org"}, Upstreams: []string{"10.0.0.9:80"}}); err != nil {
+		t.Fatal(err)
+	}
+	again, err := api.Route(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotAgain, _ := json.Marshal(jsonAt(t, again, "handle", 0)["routes"]); string(gotAgain) != string(got) {
+		t.Errorf("second build %s, want %s", gotAgain, got)
+	}
+
+	docs, err := templates.Get("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err = docs.Route(SiteParams{Hosts: []string{"docs.example.com"}, Root: "/srv/docs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := jsonAt(t, route, "handle", 0, "routes", 0, "handle", 0)["root"]; docs.Title != "Documentation" || root != "/srv/docs" {
+		t.Errorf("title %q root %v", docs.Title, root)
+	}
+}
+
+const siteBaseConfig = `{
+	"apps": {
+		"http": {"servers": {
+			"srv0": {"listen": [":443"], "routes": [
+				{"match": [{"host": ["a.example.com"]}], "handle": [{"handler": "static_response"}]},
+				{"handle": [{"handler": "static_response", "body": "fallback"}]}
+			]},
+			"srv1": {"listen": [":8080"], "routes": []}
+		}},
+		"tls": {"automation": {"policies": [{"issuers": [{"module": "acme"}]}]}}
+	}
+}`
+
+func TestBuildSite(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		params    SiteParams
+		server    string
+		newServer bool
+		hosts     []string // Hosts of the server's routes, "" for routes without
+		listen    string   // Listen address of a new server
+		policies  int      // TLS automation policies afterwards
+		err       bool
+	}{
+		{
+			name:     "before routes without hosts",
+			config:   siteBaseConfig,
+			params:   SiteParams{Hosts: []string{"new.example.com"}, TLS: SiteTLSAuto},
+			server:   "srv0",
+			hosts:    []string{"a.example.com", "new.example.com", ""},
+			policies: 1,
+		},
+		{
+			name:   "host already routed",
+			config: siteBaseConfig,
+			params: SiteParams{Hosts: []string{"new.example.com", "a.example.com"}, TLS: SiteTLSAuto},
+			err:    true,
+		},
+		{
+			name:      "new server without TLS",
+			config:    siteBaseConfig,
+			params:    SiteParams{Hosts: []string{"new.example.com"}, TLS: SiteTLSOff},
+			server:    "site_new_example_com",
+			newServer: true,
+			hosts:     []string{"new.example.com"},
+			listen:    ":80",
+			policies:  1,
+		},
+		{
+			name:      "named server for a wildcard",
+			config:    siteBaseConfig,
+			params:    SiteParams{Name: "web", Hosts: []string{"*.example.com"}, TLS: SiteTLSOff},
+			server:    "web",
+			newServer: true,
+			hosts:     []string{"*.example.com"},
+			listen:    ":80",
+			policies:  1,
+		},
+		{
+			name:   "server name taken",
+			config: siteBaseConfig,
+			params: SiteParams{Name: "srv1", Hosts: []string{"new.example.com"}, TLS: SiteTLSOff},
+			err:    true,
+		},
+		{
+			name:     "internal certificates",
+			config:   siteBaseConfig,
+			params:   SiteParams{Hosts: []string{"new.example.com"}, TLS: SiteTLSInternal},
+			server:   "srv0",
+			hosts:    []string{"a.example.com", "new.example.com", ""},
+			policies: 2,
+		},
+		{
+			name:      "empty config",
+			config:    "",
+			params:    SiteParams{Hosts: []string{"*.example.com"}, TLS: SiteTLSInternal},
+			server:    "site_wildcard_example_com",
+			newServer: true,
+			hosts:     []string{"*.example.com"},
+			listen:    ":443",
+			policies:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Root = "/srv"
+			proposed, preview, err := buildSite([]byte(tt.config), builtinTemplate(t, "static_files"), tt.params)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidSite) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidSite)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.Server != tt.server || preview.NewServer != tt.newServer {
+				t.Errorf("server %s (new %v), want %s (new %v)", preview.Server, preview.NewServer, tt.server, tt.newServer)
+			}
+
+			var doc map[string]any
+			if err := json.Unmarshal(proposed, &doc); err != nil {
+				t.Fatal(err)
+			}
+			srv := jsonAt(t, doc, "apps", "http", "servers", tt.server)
+			raw, _ := json.Marshal(srv["routes"])
+			routes, err := parseRoutes(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hosts []string
+			for _, r := range routes {
+				hosts = append(hosts, strings.Join(r.Hosts(), ","))
+			}
+			if !slices.Equal(hosts, tt.hosts) {
+				t.Errorf("route hosts %q, want %q", hosts, tt.hosts)
+			}
+			if tt.newServer {
+				listen, _ := json.Marshal(srv["listen"])
+				if want := `["` + tt.listen + `"]`; string(listen) != want {
+					t.Errorf("listen %s, want %s", listen, want)
+				}
+				if _, disabled := srv["automatic_https"]; disabled != (tt.params.TLS == SiteTLSOff) {
+					t.Errorf("automatic_https %v with TLS %s", srv["automatic_https"], tt.params.TLS)
+				}
+			}
+
+			policies, _ := jsonAt(t, doc, "apps", "tls", "automation")["policies"].([]any)
+			if len(policies) != tt.policies {
+				t.Errorf("%d TLS policies, want %d", len(policies), tt.policies)
+			}
+			if tt.params.TLS == SiteTLSInternal {
+				want := `{"subjects":["` + tt.params.Hosts[0] + `"],"issuers":[{"module":"internal"}]}`
+				first, _ := json.Marshal(policies[0])
+				if !sameJSON(t, first, []byte(want)) || !sameJSON(t, preview.TLSPolicy, []byte(want)) {
+					t.Errorf("first policy %s and preview %s, want %s", first, preview.TLSPolicy, want)
+				}
+			} else if preview.TLSPolicy != nil {
+				t.Errorf("TLS policy %s without internal certificates", preview.TLSPolicy)
+			}
+
+			if !slices.Equal(preview.Plan.Summary.HostsAdded, tt.params.Hosts) {
+				t.Errorf("plan adds hosts %v, want %v", preview.Plan.Summary.HostsAdded, tt.params.Hosts)
+			}
+		})
+	}
+}
+
+func TestConfigServiceSiteTemplates(t *testing.T) {
+	admin, _ := newFakeAdmin(t, siteBaseConfig)
+	s, inst := newTestConfigService(t, admin)
+	s.SetSiteTemplates(NewSiteTemplates(""))
+	params := SiteParams{Hosts: []string{"app.example.com"}, Upstreams: []string{"10.0.0.1:80"}}
+
+	if len(s.SiteTemplates()) != len(builtinSiteTemplates) {
+		t.Errorf("templates %v, want the built-in ones", s.SiteTemplates())
+	}
+	if _, err := s.PreviewSite(inst.ID, "missing", params); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("got %v for an unknown template, want %v", err, ErrTemplateNotFound)
+	}
+	if _, err := s.CreateSiteFromTemplate(inst.ID, "reverse_proxy", SiteParams{Hosts: params.Hosts}, ConfigChange{}); !errors.Is(err, ErrInvalidSite) {
+		t.Errorf("got %v without upstreams, want %v", err, ErrInvalidSite)
+	}
+
+	before := admin.get(t, "")
+	preview, err := s.PreviewSite(inst.ID, "reverse_proxy", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.get(t, "") != before || len(admin.requests) != 0 {
+		t.Errorf("preview changed the config: %v", admin.requests)
+	}
+	if preview.Server != "srv0" || !slices.Equal(preview.Plan.Summary.UpstreamsAdded, params.Upstreams) {
+		t.Errorf("preview %+v", preview)
+	}
+
+	created, err := s.CreateSiteFromTemplate(inst.ID, "reverse_proxy", params, ConfigChange{Author: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(admin.requests, []string{"POST /load"}) {
+		t.Errorf("requests %v, want a single load", admin.requests)
+	}
+	if got := admin.get(t, "apps/http/servers/srv0/routes/1"); !sameJSON(t, []byte(got), created.Route) {
+		t.Errorf("second route %s, want %s", got, created.Route)
+	}
+
+	// The host is routed now, so a second site for it clashes
+	if _, err := s.CreateSiteFromTemplate(inst.ID, "reverse_proxy", params, ConfigChange{}); !errors.Is(err, ErrInvalidSite) {
+		t.Errorf("got %v for a routed host, want %v", err, ErrInvalidSite)
+	}
+}
@@ -0,0 +1,56 @@
+// Package caddyfile reads Caddyfiles without a Caddy instance. It
+// tokenizes and parses them into blocks, snippets and imports, reformats
+// them the way caddy fmt does and lints them, so Caddyfiles can be edited
+// even when the instance that would adapt them isn't reachable. It knows
+// the Caddyfile syntax and Caddy's standard directives, not what each
+// directive accepts; the instance's /adapt endpoint remains the final check.
+package caddyfile
+
+import "fmt"
+
+// Token is one token of a Caddyfile
+type Token struct {
+	Text   string `json:"text"` // Without quotes; escaped quotes are unescaped
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Quoted bool   `json:"quoted,omitempty"` // Written in quotes, backticks or as a heredoc
+
+	group int // Logical line the token belongs to
+}
+
+// isOpen reports whether the token opens a block
+func (t Token) isOpen() bool {
+	return !t.Quoted && t.Text == "{"
+}
+
+// isClose reports whether the token closes a block
+func (t Token) isClose() bool {
+	return !t.Quoted && t.Text == "}"
+}
+
+// SyntaxError is a Caddyfile that can't be tokenized or parsed
+type SyntaxError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// Tokenize splits a Caddyfile into tokens, dropping comments
+func Tokenize(input []byte) ([]Token, error) {
+	items, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]Token, 0, len(items))
+	for _, it := range items {
+		if !it.comment {
+			tokens = append(tokens, it.Token)
+		}
+	}
+	return tokens, nil
+}
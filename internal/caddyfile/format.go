@@ -0,0 +1,73 @@
+package caddyfile
+
+import "strings"
+
+// Format reformats a Caddyfile the way caddy fmt does: one tab of
+// indentation per block level, single spaces between tokens, '{' at the end
+// of its line and '}' on its own, at most one blank line in a row, none
+// just inside a block and one between top-level blocks. Comments, quoted
+// tokens and heredocs are kept as written, except that a bare <<EOF ending
+// its line is quoted so it doesn't become a heredoc. The result ends with a
+// single newline.
+func Format(input []byte) ([]byte, error) {
+	items, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return []byte{}, nil
+	}
+
+	var b strings.Builder
+	nesting := 0
+	afterOpen := false
+	afterBlock := false // Just closed a top-level block
+	for i := 0; i < len(items); {
+		// Collect the logical line
+		end := i + 1
+		for end < len(items) && items[end].group == items[i].group {
+			end++
+		}
+		line := items[i:end]
+
+		if line[0].isClose() && nesting > 0 {
+			nesting--
+		}
+		if i > 0 {
+			b.WriteString("\n")
+			if (line[0].newlines > 1 || afterBlock) && !afterOpen && !line[0].isClose() {
+				b.WriteString("\n")
+			}
+		}
+
+		b.WriteString(strings.Repeat("\t", nesting))
+		for j, it := range line {
+			if j > 0 {
+				if it.continued {
+					b.WriteString(" \\\n" + strings.Repeat("\t", nesting+1))
+				} else {
+					b.WriteString(" ")
+				}
+			}
+			// A bare <<EOF that was followed by spaces, or by the end of the
+			// input, would open a heredoc once it ends its line; quoting it
+			// keeps it a plain token
+			if j == len(line)-1 && isHeredocOpener(it) {
+				b.WriteString(`"` + it.raw + `"`)
+			} else {
+				b.WriteString(it.raw)
+			}
+		}
+
+		last := line[len(line)-1]
+		afterBlock = nesting == 0 && last.isClose()
+		afterOpen = last.isOpen()
+		if afterOpen {
+			nesting++
+		}
+		i = end
+	}
+
+	b.WriteString("\n")
+	return []byte(b.String()), nil
+}
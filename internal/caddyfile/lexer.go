@@ -0,0 +1,267 @@
+package caddyfile
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// heredocMarker matches the marker of a heredoc opening such as <<EOF
+var heredocMarker = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// item is a lexed token or comment along with the layout around it, which
+// the formatter needs and the parser ignores
+type item struct {
+	Token
+	raw       string // Text as written, including quotes
+	comment   bool
+	continued bool // Preceded by an escaped newline
+	newlines  int  // Newlines between the previous item and this one
+}
+
+// lexer splits Caddyfile input into items. Lines are counted from 1 and
+// columns in characters from 1.
+type lexer struct {
+	input []rune
+	pos   int
+	line  int
+	col   int
+	group int // Logical line; escaped newlines and newlines inside tokens don't start a new one
+}
+
+func lex(input []byte) ([]item, error) {
+	l := &lexer{input: []rune(string(input)), line: 1, col: 1}
+	var items []item
+	for {
+		it, ok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return items, nil
+		}
+		items = append(items, it)
+	}
+}
+
+func (l *lexer) peek(offset int) rune {
+	if l.pos+offset >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+offset]
+}
+
+func (l *lexer) advance() rune {
+	ch := l.input[l.pos]
+	l.pos++
+	if ch == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	return ch
+}
+
+// next returns the next item, skipping whitespace
+func (l *lexer) next() (item, bool, error) {
+	var it item
+	for l.pos < len(l.input) {
+		ch := l.peek(0)
+		switch {
+		case ch == '\n':
+			l.advance()
+			l.group++
+			it.newlines++
+		case ch == '\\' && (l.peek(1) == '\n' || (l.peek(1) == '\r' && l.peek(2) == '\n')) && !l.onlySpaceAfter(1):
+			// An escaped newline continues the logical line. At the end of
+			// the input there is nothing to continue, so the backslash is
+			// read as a token and kept.
+			for l.peek(0) != '\n' {
+				l.advance()
+			}
+			l.advance()
+			it.continued = true
+		case unicode.IsSpace(ch):
+			l.advance()
+		default:
+			return l.readItem(it)
+		}
+	}
+	return it, false, nil
+}
+
+func (l *lexer) readItem(it item) (item, bool, error) {
+	it.Line, it.Column, it.group = l.line, l.col, l.group
+	start := l.pos
+
+	switch ch := l.peek(0); {
+	case ch == '#':
+		for l.pos < len(l.input) && l.peek(0) != '\n' {
+			l.advance()
+		}
+		it.comment = true
+		it.raw = strings.TrimRightFunc(string(l.input[start:l.pos]), unicode.IsSpace)
+		it.Text = it.raw
+		return it, true, nil
+
+	case ch == '"':
+		l.advance()
+		var text []rune
+		for {
+			if l.pos >= len(l.input) {
+				return it, false, &SyntaxError{Line: it.Line, Column: it.Column, Message: "unterminated quoted string"}
+			}
+			ch := l.advance()
+			if ch == '\\' && l.pos < len(l.input) {
+				next := l.advance()
+				if next != '"' {
+					text = append(text, '\\')
+				}
+				text = append(text, next)
+				continue
+			}
+			if ch == '"' {
+				break
+			}
+			text = append(text, ch)
+		}
+		it.Text, it.Quoted = string(text), true
+
+	case ch == '`':
+		l.advance()
+		for {
+			if l.pos >= len(l.input) {
+				return it, false, &SyntaxError{Line: it.Line, Column: it.Column, Message: "unterminated backtick string"}
+			}
+			if l.advance() == '`' {
+				break
+			}
+		}
+		it.Text, it.Quoted = string(l.input[start+1:l.pos-1]), true
+
+	case ch == '<' && l.peek(1) == '<':
+		if text, ok, err := l.readHeredoc(it); err != nil {
+			return it, false, err
+		} else if ok {
+			it.Text, it.Quoted = text, true
+			break
+		}
+		it.Text = l.readBare()
+
+	default:
+		it.Text = l.readBare()
+	}
+
+	it.raw = string(l.input[start:l.pos])
+	return it, true, nil
+}
+
+// onlySpaceAfter reports whether the input after the next offset runes is
+// all whitespace
+func (l *lexer) onlySpaceAfter(offset int) bool {
+	for i := l.pos + offset; i < len(l.input); i++ {
+		if !unicode.IsSpace(l.input[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isHeredocOpener reports whether a bare token reads as a heredoc opening
+// such as <<EOF when it ends its line
+func isHeredocOpener(it item) bool {
+	return !it.Quoted && !it.comment && strings.HasPrefix(it.raw, "<<") && heredocMarker.MatchString(it.raw[2:])
+}
+
+// readBare reads an unquoted token up to the next whitespace. A backslash
+// keeps the following character in the token, so "\ " doesn't end it.
+func (l *lexer) readBare() string {
+	start := l.pos
+	for l.pos < len(l.input) {
+		ch := l.peek(0)
+		if unicode.IsSpace(ch) {
+			break
+		}
+		if ch == '\\' && l.pos+1 < len(l.input) && l.peek(1) != '\n' && l.peek(1) != '\r' {
+			l.advance()
+		}
+		l.advance()
+	}
+	return string(l.input[start:l.pos])
+}
+
+// readHeredoc reads a heredoc such as
+//
+//	<<EOF
+//	    text
+//	    EOF
+//
+// The closing marker's indentation is removed from every line. It returns
+// false without consuming anything if the input isn't a heredoc opening.
+func (l *lexer) readHeredoc(it item) (string, bool, error) {
+	end := l.pos + 2
+	for end < len(l.input) && !unicode.IsSpace(l.input[end]) {
+		end++
+	}
+	marker := string(l.input[l.pos+2 : end])
+	if !heredocMarker.MatchString(marker) || end >= len(l.input) {
+		return "", false, nil
+	}
+	// The marker ends its line, with "\n" or "\r\n"
+	if l.input[end] != '\n' && (l.input[end] != '\r' || (end+1 < len(l.input) && l.input[end+1] != '\n')) {
+		return "", false, nil
+	}
+
+	for l.pos < end {
+		l.advance()
+	}
+	for l.pos < len(l.input) && l.peek(0) != '\n' {
+		l.advance()
+	}
+	if l.pos >= len(l.input) {
+		return "", false, &SyntaxError{Line: it.Line, Column: it.Column, Message: "heredoc " + marker + " is never closed"}
+	}
+	l.advance()
+
+	markerRunes := []rune(marker)
+	var lines []string
+	for {
+		if l.pos >= len(l.input) {
+			return "", false, &SyntaxError{Line: it.Line, Column: it.Column, Message: "heredoc " + marker + " is never closed"}
+		}
+
+		// The closing marker may be followed by more arguments on its line
+		start := l.pos
+		i := start
+		for i < len(l.input) && (l.input[i] == ' ' || l.input[i] == '\t') {
+			i++
+		}
+		after := i + len(markerRunes)
+		if after <= len(l.input) && string(l.input[i:after]) == marker && (after == len(l.input) || unicode.IsSpace(l.input[after])) {
+			indent := string(l.input[start:i])
+			for i, content := range lines {
+				if content == "" {
+					continue
+				}
+				if !strings.HasPrefix(content, indent) {
+					return "", false, &SyntaxError{Line: it.Line + 1 + i, Column: 1, Message: "heredoc line is indented less than its closing marker"}
+				}
+				lines[i] = content[len(indent):]
+			}
+			for l.pos < after {
+				l.advance()
+			}
+			return strings.Join(lines, "\n"), true, nil
+		}
+
+		for l.pos < len(l.input) && l.peek(0) != '\n' {
+			l.advance()
+		}
+		line := strings.TrimSuffix(string(l.input[start:l.pos]), "\r")
+		lines = append(lines, line)
+		if l.pos < len(l.input) {
+			l.advance()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package caddyfile
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string // Token texts
+		err   bool
+	}{
+		{name: "empty", input: "", want: nil},
+		{name: "bare tokens", input: "example.com {\n\trespond ok\n}\n", want: []string{"example.com", "{", "respond", "ok", "}"}},
+		{name: "comment", input: "# comment\nfoo bar # trailing\n", want: []string{"foo", "bar"}},
+		{name: "quoted", input: `respond "hello \"world\""`, want: []string{"respond", `hello "world"`}},
+		{name: "quoted keeps other escapes", input: `path "a\nb"`, want: []string{"path", `a\nb`}},
+		{name: "escaped space", input: `a\ b c`, want: []string{`a\ b`, "c"}},
+		{name: "backtick", input: "respond `a \"b\"`", want: []string{"respond", `a "b"`}},
+		{name: "escaped newline", input: "a \\\n  b\n", want: []string{"a", "b"}},
+		{name: "escaped CRLF", input: "a \\\r\n  b\r\n", want: []string{"a", "b"}},
+		{name: "trailing backslash", input: "a \\", want: []string{"a", `\`}},
+		{name: "trailing escaped newline", input: "a \\\n", want: []string{"a", `\`}},
+		{name: "heredoc", input: "respond <<EOF\n\thello\n\tworld\n\tEOF 200\n", want: []string{"respond", "hello\nworld", "200"}},
+		{name: "heredoc CRLF", input: "respond <<EOF\r\n  hi\r\n  EOF\r\n", want: []string{"respond", "hi"}},
+		{name: "heredoc at EOF", input: "respond <<EOF\nhi\nEOF", want: []string{"respond", "hi"}},
+		{name: "not a heredoc", input: "a <<EOF b\n", want: []string{"a", "<<EOF", "b"}},
+		{name: "opener at EOF", input: "a <<EOF", want: []string{"a", "<<EOF"}},
+		{name: "unclosed heredoc", input: "respond <<EOF\nhi\n", err: true},
+		{name: "opener then newline at EOF", input: "<<EOF\n", err: true},
+		{name: "opener then CR at EOF", input: "<<EOF\r", err: true},
+		{name: "argument opener then CR at EOF", input: "a <<EOF\r", err: true},
+		{name: "numeric opener then CR at EOF", input: "<<00\r", err: true},
+		{name: "opener then lone CR", input: "a <<EOF\rb\n", want: []string{"a", "<<EOF", "b"}},
+		{name: "heredoc indented less than marker", input: "<<EOF\nhi\n  EOF\n", err: true},
+		{name: "unterminated quote", input: `respond "hi`, err: true},
+		{name: "unterminated backtick", input: "respond `hi", err: true},
+		{name: "quote ending in backslash", input: `respond "hi\`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := Tokenize([]byte(tt.input))
+			if tt.err {
+				var syntaxErr *SyntaxError
+				if !errors.As(err, &syntaxErr) {
+					t.Fatalf("Tokenize(%q) error = %v, want a SyntaxError", tt.input, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Tokenize(%q) error = %v", tt.input, err)
+			}
+			var got []string
+			for _, tok := range tokens {
+				got = append(got, tok.Text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Tokenize(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenizePositions(t *testing.T) {
+	tokens, err := Tokenize([]byte("a {\n\tb \"c d\"\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Token{
+		{Text: "a", Line: 1, Column: 1},
+		{Text: "{", Line: 1, Column: 3},
+		{Text: "b", Line: 2, Column: 2},
+		{Text: "c d", Line: 2, Column: 4, Quoted: true},
+		{Text: "}", Line: 3, Column: 1},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("got %d tokens, want %d", len(tokens), len(want))
+	}
+	for i, tok := range tokens {
+		tok.group = 0
+		if tok != want[i] {
+			t.Errorf("token %d = %+v, want %+v", i, tok, want[i])
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "empty", input: "", want: ""},
+		{name: "indentation", input: "a {\nb c\n    d {\ne\n}\n}", want: "a {\n\tb c\n\td {\n\t\te\n\t}\n}\n"},
+		{name: "blank lines", input: "a {\n\n\tb\n\n\n\tc\n\n}\nd {\n}\n", want: "a {\n\tb\n\n\tc\n}\n\nd {\n}\n"},
+		{name: "escaped newline", input: "a b \\\n      c\n", want: "a b \\\n\tc\n"},
+		{name: "heredoc kept", input: "respond <<EOF\n  hi\n  EOF\n", want: "respond <<EOF\n  hi\n  EOF\n"},
+		{name: "trailing backslash kept", input: "a \\", want: "a \\\n"},
+		{name: "trailing escaped newline kept", input: "a \\\n", want: "a \\\n"},
+		{name: "opener at EOF quoted", input: "a <<0", want: "a \"<<0\"\n"},
+		{name: "opener before spaces quoted", input: "a <<EOF  \nb\n", want: "a \"<<EOF\"\nb\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Format([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("Format(%q) error = %v", tt.input, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Format(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+
+			// Formatting keeps the tokens and is idempotent
+			before, err := Tokenize([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := Tokenize(got)
+			if err != nil {
+				t.Fatalf("formatted output doesn't tokenize: %v", err)
+			}
+			if len(before) != len(after) {
+				t.Fatalf("formatting changed the tokens: %d before, %d after", len(before), len(after))
+			}
+			for i := range before {
+				if before[i].Text != after[i].Text {
+					t.Errorf("token %d changed from %q to %q", i, before[i].Text, after[i].Text)
+				}
+			}
+			again, err := Format(got)
+			if err != nil || string(again) != string(got) {
+				t.Errorf("Format isn't idempotent: %q, then %q (error %v)", got, again, err)
+			}
+		})
+	}
+}
+
+func TestNoPanicOnMalformedInput(t *testing.T) {
+	inputs := []string{
+		"<<", "<<\r", "<<EOF\r", "a <<EOF\r", "<<00\r", "\\", "\\\r", "\\\r\n", "\"\\", "`", "<<EOF\n  x\r",
+		"{", "}", "a {\n", "}\n}", "import", "(snip", "<<-\n",
+	}
+	for _, input := range inputs {
+		Tokenize([]byte(input))
+		Format([]byte(input))
+		Lint([]byte(input))
+	}
+}
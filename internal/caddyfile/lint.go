@@ -0,0 +1,297 @@
+package caddyfile
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Diagnostic severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is a problem found in a Caddyfile
+type Diagnostic struct {
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// EnvPlaceholder is a {$NAME} or {$NAME:default} environment placeholder.
+// Caddy substitutes these from the instance's environment before parsing.
+type EnvPlaceholder struct {
+	Name       string `json:"name"`
+	Default    string `json:"default,omitempty"`
+	HasDefault bool   `json:"has_default"`
+	Line       int    `json:"line"`
+	Column     int    `json:"column"`
+}
+
+// standardDirectives are the HTTP handler directives built into Caddy
+var standardDirectives = map[string]bool{
+	"abort": true, "acme_server": true, "basic_auth": true, "basicauth": true,
+	"bind": true, "encode": true, "error": true, "file_server": true,
+	"forward_auth": true, "fs": true, "handle": true, "handle_errors": true,
+	"handle_path": true, "header": true, "import": true, "intercept": true,
+	"invoke": true, "log": true, "log_append": true, "log_name": true,
+	"log_skip": true, "map": true, "method": true, "metrics": true,
+	"php_fastcgi": true, "push": true, "redir": true, "request_body": true,
+	"request_header": true, "respond": true, "reverse_proxy": true,
+	"rewrite": true, "root": true, "route": true, "skip_log": true,
+	"templates": true, "tls": true, "tracing": true, "try_files": true,
+	"uri": true, "vars": true,
+}
+
+// routeDirectives hold further directives in their blocks
+var routeDirectives = map[string]bool{
+	"handle": true, "handle_errors": true, "handle_path": true, "route": true,
+}
+
+// EnvPlaceholders returns the environment placeholders in a Caddyfile
+func EnvPlaceholders(input []byte) ([]EnvPlaceholder, []Diagnostic) {
+	var placeholders []EnvPlaceholder
+	var diags []Diagnostic
+	for lineNo, line := range strings.Split(string(input), "\n") {
+		rest := line
+		offset := 0
+		for {
+			i := strings.Index(rest, "{$")
+			if i < 0 {
+				break
+			}
+			col := utf8.RuneCountInString(line[:offset+i]) + 1
+			end := strings.IndexByte(rest[i:], '}')
+			if end < 0 {
+				diags = append(diags, Diagnostic{Line: lineNo + 1, Column: col, Severity: SeverityError, Message: "environment placeholder is never closed"})
+				break
+			}
+
+			body := rest[i+2 : i+end]
+			ph := EnvPlaceholder{Name: body, Line: lineNo + 1, Column: col}
+			if name, def, ok := strings.Cut(body, ":"); ok {
+				ph.Name, ph.Default, ph.HasDefault = name, def, true
+			}
+			if ph.Name == "" {
+				diags = append(diags, Diagnostic{Line: lineNo + 1, Column: col, Severity: SeverityError, Message: "environment placeholder has no variable name"})
+			} else {
+				placeholders = append(placeholders, ph)
+			}
+			offset += i + end + 1
+			rest = rest[i+end+1:]
+		}
+	}
+	return placeholders, diags
+}
+
+// Lint checks a Caddyfile. Syntax errors stop the check at the first one;
+// after that it reports imports of unknown or recursive snippets, duplicate
+// site addresses, undefined named matchers, unknown directives, environment
+// placeholders without a default and unformatted input.
+func Lint(input []byte) []Diagnostic {
+	placeholders, diags := EnvPlaceholders(input)
+	for _, ph := range placeholders {
+		if !ph.HasDefault {
+			diags = append(diags, Diagnostic{
+				Line: ph.Line, Column: ph.Column, Severity: SeverityWarning,
+				Message: fmt.Sprintf("environment variable %s has no default and is empty if the instance doesn't set it", ph.Name),
+			})
+		}
+	}
+
+	f, err := Parse(input)
+	if err != nil {
+		if se, ok := err.(*SyntaxError); ok {
+			diags = append(diags, Diagnostic{Line: se.Line, Column: se.Column, Severity: SeverityError, Message: se.Message})
+		}
+		return sortDiagnostics(diags)
+	}
+
+	l := &linter{snippets: map[string]int{}}
+	diags = append(diags, l.lintFile(f)...)
+
+	if formatted, err := Format(input); err == nil && !bytes.Equal(formatted, input) {
+		diags = append(diags, Diagnostic{Line: 1, Column: 1, Severity: SeverityWarning, Message: "input is not formatted; formatting fixes the indentation and spacing"})
+	}
+	return sortDiagnostics(diags)
+}
+
+type linter struct {
+	snippets map[string]int // Snippet name -> index of its block
+	diags    []Diagnostic
+}
+
+func (l *linter) report(t Token, severity, format string, args ...any) {
+	l.diags = append(l.diags, Diagnostic{Line: t.Line, Column: t.Column, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) lintFile(f *File) []Diagnostic {
+	for i, b := range f.Blocks {
+		if name := b.SnippetName(); name != "" {
+			if _, dup := l.snippets[name]; dup {
+				l.report(b.Keys[0], SeverityError, "snippet %q is defined more than once", name)
+				continue
+			}
+			l.snippets[name] = i
+		}
+	}
+
+	// Imports of each snippet, to find recursion
+	imports := map[string][]Token{}
+	sites := map[string]Token{}
+	for i, b := range f.Blocks {
+		for _, imp := range blockImports(b) {
+			l.checkImport(imp, i)
+			if name := b.SnippetName(); name != "" {
+				imports[name] = append(imports[name], imp)
+			}
+		}
+
+		if b.Kind != BlockSite {
+			continue
+		}
+		for _, key := range b.Keys {
+			if prev, dup := sites[key.Text]; dup {
+				l.report(key, SeverityError, "site address %s is already defined on line %d", key.Text, prev.Line)
+			} else {
+				sites[key.Text] = key
+			}
+		}
+		l.lintSite(b)
+	}
+	l.checkRecursion(imports)
+	return l.diags
+}
+
+// blockImports returns the target tokens of all imports in a block
+func blockImports(b *Block) []Token {
+	if b.Kind == BlockImport {
+		return []Token{b.Keys[1]}
+	}
+	var targets []Token
+	var walk func([]*Directive)
+	walk = func(directives []*Directive) {
+		for _, d := range directives {
+			if d.Name.Text == "import" && !d.Name.Quoted && len(d.Args) > 0 {
+				targets = append(targets, d.Args[0])
+			}
+			walk(d.Block)
+		}
+	}
+	walk(b.Directives)
+	return targets
+}
+
+// checkImport checks that an import in the block at index refers to a
+// snippet defined before it. Names that look like file paths are imported
+// from the instance's file system and can't be checked here.
+func (l *linter) checkImport(target Token, index int) {
+	if looksLikeFile(target.Text) {
+		if _, ok := l.snippets[target.Text]; !ok {
+			l.report(target, SeverityWarning, "import of file %q is resolved on the instance and wasn't checked", target.Text)
+		}
+		return
+	}
+
+	defined, ok := l.snippets[target.Text]
+	switch {
+	case !ok:
+		l.report(target, SeverityError, "no snippet named %q", target.Text)
+	case defined >= index:
+		l.report(target, SeverityError, "snippet %q is used before it is defined", target.Text)
+	}
+}
+
+func looksLikeFile(name string) bool {
+	return strings.ContainsAny(name, "/.*\\")
+}
+
+// checkRecursion reports snippets that import themselves, directly or not
+func (l *linter) checkRecursion(imports map[string][]Token) {
+	state := map[string]int{} // 1 while visiting, 2 when done
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case 1:
+			return true
+		case 2:
+			return false
+		}
+		state[name] = 1
+		for _, imp := range imports[name] {
+			if visit(imp.Text) {
+				l.report(imp, SeverityError, "snippet %q imports itself", imp.Text)
+				state[name] = 2
+				return false
+			}
+		}
+		state[name] = 2
+		return false
+	}
+
+	names := make([]string, 0, len(imports))
+	for name := range imports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		visit(name)
+	}
+}
+
+// lintSite checks a site's directives and named matchers. Matchers are only
+// checked when the site imports nothing, since an import may define them.
+func (l *linter) lintSite(b *Block) {
+	defined := map[string]bool{}
+	imports := false
+	var used []Token
+
+	var walk func(directives []*Directive, routes bool)
+	walk = func(directives []*Directive, routes bool) {
+		for _, d := range directives {
+			name := d.Name.Text
+			switch {
+			case strings.HasPrefix(name, "@"):
+				defined[name] = true
+				continue
+			case name == "import":
+				imports = true
+			case routes && !standardDirectives[name]:
+				l.report(d.Name, SeverityWarning, "unknown directive %q; it needs a plugin on the instance", name)
+			}
+			if len(d.Args) > 0 && strings.HasPrefix(d.Args[0].Text, "@") && !d.Args[0].Quoted {
+				used = append(used, d.Args[0])
+			}
+			if routes && routeDirectives[name] {
+				walk(d.Block, true)
+			}
+		}
+	}
+	walk(b.Directives, true)
+
+	if imports {
+		return
+	}
+	for _, t := range used {
+		if !defined[t.Text] {
+			l.report(t, SeverityError, "named matcher %s is not defined in this site", t.Text)
+		}
+	}
+}
+
+func sortDiagnostics(diags []Diagnostic) []Diagnostic {
+	if diags == nil {
+		return []Diagnostic{}
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Column < diags[j].Column
+	})
+	return diags
+}
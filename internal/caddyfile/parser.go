@@ -0,0 +1,224 @@
+package caddyfile
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Kinds of top-level block
+const (
+	BlockGlobal  = "global"  // The global options block
+	BlockSite    = "site"    // A site block
+	BlockSnippet = "snippet" // A snippet, e.g. (common) { ... }
+	BlockImport  = "import"  // A top-level import line
+)
+
+// File is a parsed Caddyfile. Imports are kept as written, not expanded.
+type File struct {
+	Blocks []*Block `json:"blocks"` // In file order
+}
+
+// Block is a top-level block. A site's keys are its addresses; a snippet's
+// only key is its name in parentheses; a top-level import's keys are the
+// import line.
+type Block struct {
+	Kind       string       `json:"kind"`
+	Keys       []Token      `json:"keys"`
+	Directives []*Directive `json:"directives,omitempty"`
+}
+
+// Directive is one line of a block, with its nested block if it has one
+type Directive struct {
+	Name  Token        `json:"name"`
+	Args  []Token      `json:"args,omitempty"`
+	Block []*Directive `json:"block,omitempty"`
+	Open  *Token       `json:"-"` // The opening brace of Block
+}
+
+// SnippetName returns the name of a snippet block, or "" for other blocks
+func (b *Block) SnippetName() string {
+	if b.Kind != BlockSnippet {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(b.Keys[0].Text, "("), ")")
+}
+
+// snippetKey matches the key of a snippet definition
+var snippetKey = regexp.MustCompile(`^\(.+\)$`)
+
+// Parse tokenizes and parses a Caddyfile. Like Caddy, it allows leaving out
+// the braces of the only site block in a file.
+func Parse(input []byte) (*File, error) {
+	tokens, err := Tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	f := &File{Blocks: []*Block{}}
+	for p.pos < len(p.tokens) {
+		b, err := p.parseBlock(len(f.Blocks) == 0)
+		if err != nil {
+			return nil, err
+		}
+		f.Blocks = append(f.Blocks, b)
+	}
+	return f, nil
+}
+
+type parser struct {
+	tokens []Token
+	pos    int
+}
+
+// line returns the tokens of the logical line starting at the current token
+func (p *parser) line() []Token {
+	end := p.pos + 1
+	for end < len(p.tokens) && p.tokens[end].group == p.tokens[p.pos].group {
+		end++
+	}
+	return p.tokens[p.pos:end]
+}
+
+func errorAt(t Token, message string) *SyntaxError {
+	return &SyntaxError{Line: t.Line, Column: t.Column, Message: message}
+}
+
+func (p *parser) parseBlock(first bool) (*Block, error) {
+	line := p.line()
+	start := line[0]
+
+	switch {
+	case start.isOpen():
+		if !first {
+			return nil, errorAt(start, "the global options block must be the first block, and a site block needs an address")
+		}
+		if len(line) > 1 {
+			return nil, errorAt(line[1], "unexpected token after '{' on the same line")
+		}
+		p.pos++
+		directives, err := p.parseDirectives(&start)
+		if err != nil {
+			return nil, err
+		}
+		return &Block{Kind: BlockGlobal, Keys: []Token{}, Directives: directives}, nil
+
+	case start.isClose():
+		return nil, errorAt(start, "unexpected '}' without a matching '{'")
+
+	case start.Text == "import" && !start.Quoted:
+		p.pos += len(line)
+		if len(line) < 2 {
+			return nil, errorAt(start, "import needs a snippet name or file pattern")
+		}
+		return &Block{Kind: BlockImport, Keys: line}, nil
+	}
+
+	// Keys may continue on the next line after a trailing comma
+	var keys []Token
+	var open *Token
+	for {
+		line = p.line()
+		p.pos += len(line)
+		if last := line[len(line)-1]; last.isOpen() {
+			open = &last
+			line = line[:len(line)-1]
+		}
+		for _, t := range line {
+			if t.isOpen() || t.isClose() {
+				return nil, errorAt(t, "unexpected '"+t.Text+"' in site addresses")
+			}
+			for _, key := range strings.Split(t.Text, ",") {
+				if key != "" {
+					keys = append(keys, Token{Text: key, Line: t.Line, Column: t.Column, Quoted: t.Quoted, group: t.group})
+				}
+			}
+		}
+		if open != nil || p.pos >= len(p.tokens) || !strings.HasSuffix(line[len(line)-1].Text, ",") {
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errorAt(start, "block has no address")
+	}
+
+	kind := BlockSite
+	if len(keys) == 1 && snippetKey.MatchString(keys[0].Text) {
+		kind = BlockSnippet
+		if open == nil {
+			return nil, errorAt(start, "snippet "+keys[0].Text+" needs a block")
+		}
+	}
+
+	if open == nil {
+		// Only the single site of a file may leave out its braces; it then
+		// runs to the end of the file
+		if !first {
+			return nil, errorAt(start, "site block needs '{' at the end of its address line")
+		}
+		directives, err := p.parseDirectives(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &Block{Kind: kind, Keys: keys, Directives: directives}, nil
+	}
+
+	directives, err := p.parseDirectives(open)
+	if err != nil {
+		return nil, err
+	}
+	return &Block{Kind: kind, Keys: keys, Directives: directives}, nil
+}
+
+// parseDirectives parses the lines of a block up to its closing brace, or
+// to the end of the input if open is nil
+func (p *parser) parseDirectives(open *Token) ([]*Directive, error) {
+	directives := []*Directive{}
+	for {
+		if p.pos >= len(p.tokens) {
+			if open != nil {
+				return nil, errorAt(*open, "'{' is never closed")
+			}
+			return directives, nil
+		}
+
+		line := p.line()
+		if line[0].isClose() {
+			if open == nil {
+				return nil, errorAt(line[0], "unexpected '}' without a matching '{'")
+			}
+			if len(line) > 1 {
+				return nil, errorAt(line[1], "unexpected token after '}' on the same line")
+			}
+			p.pos++
+			return directives, nil
+		}
+		if line[0].isOpen() {
+			return nil, errorAt(line[0], "'{' must be at the end of a directive's line")
+		}
+
+		p.pos += len(line)
+		d := &Directive{Name: line[0], Args: line[1:]}
+		if last := line[len(line)-1]; len(line) > 1 && last.isOpen() {
+			d.Args = line[1 : len(line)-1]
+			d.Open = &last
+		}
+		for _, t := range d.Args {
+			if t.isOpen() {
+				return nil, errorAt(t, "unexpected token after '{' on the same line")
+			}
+			if t.isClose() {
+				return nil, errorAt(t, "'}' must be on its own line")
+			}
+		}
+
+		if d.Open != nil {
+			block, err := p.parseDirectives(d.Open)
+			if err != nil {
+				return nil, err
+			}
+			d.Block = block
+		}
+		directives = append(directives, d)
+	}
+}
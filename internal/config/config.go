@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds all configuration for the application
@@ -11,6 +13,8 @@ type Config struct {
 	Server   ServerConfig
 	Database DatabaseConfig
 	Session  SessionConfig
+	Auth     AuthConfig
+	Caddy    CaddyConfig
 }
 
 // ServerConfig holds server-specific configuration
@@ -35,6 +39,50 @@ type SessionConfig struct {
 	MaxAge    int
 }
 
+// AuthConfig holds user and password configuration
+type AuthConfig struct {
+	PasswordMinLength     int  // Minimum length of new passwords
+	PasswordRequireUpper  bool // New passwords need an uppercase letter
+	PasswordRequireLower  bool // New passwords need a lowercase letter
+	PasswordRequireDigit  bool // New passwords need a digit
+	PasswordRequireSymbol bool // New passwords need a symbol
+
+	AdminUsername string // Username of the admin created when there are no users
+	AdminEmail    string // Email of that admin
+	AdminPassword string // Initial password of that admin (empty generates one)
+
+	RequireTwoFactor   bool // Every user must enroll in two-factor authentication
+	RememberDeviceDays int  // How long a device skips the second factor after "remember this device" (0 disables)
+}
+
+// CaddyConfig holds Caddy integration configuration
+type CaddyConfig struct {
+	LogListen        string        // Address for Caddy's net log writer, e.g. "tcp/:9514" (empty disables)
+	LogBufferSize    int           // Log entries kept in memory per instance
+	LogDir           string        // Directory local instance log files must be in (empty disables them)
+	MetricsInterval  time.Duration // How often every instance is scraped (0 disables the collector)
+	MetricsTimeout   time.Duration // Per-instance scrape timeout
+	MetricsWorkers   int           // Concurrent scrapes
+	MetricsRetention time.Duration // How long raw samples are kept
+
+	RollupRetentionMinute time.Duration // How long 1m rollups are kept
+	RollupRetentionHour   time.Duration // How long 1h rollups are kept
+	RollupRetentionDay    time.Duration // How long 1d rollups are kept
+
+	ConfigHistoryMax int // Config versions kept per instance
+
+	AuditEnabled    bool          // Record instance operations in the audit log
+	AuditMaxEntries int           // Entries per audit log file before it is archived
+	AuditMaxSize    int64         // Bytes per audit log file before it is archived
+	AuditMaxAge     time.Duration // Age of an audit log file before it is archived
+	AuditKeyFile    string        // File holding the HMAC key that signs audit entries (empty disables signing)
+
+	AuditSyslog         string // Syslog collector for audit entries, e.g. "tls/siem:6514" (empty disables forwarding)
+	AuditSyslogCAFile   string // CA bundle for verifying a tls collector
+	AuditSyslogFacility int    // Syslog facility of forwarded entries
+	AuditSyslogQueueMax int64  // Bytes of undelivered entries kept on disk
+}
+
 // Load loads configuration from environment variables with defaults
 func Load() *Config {
 	return &Config{
@@ -54,6 +102,47 @@ func Load() *Config {
 			SecretKey: getEnv("SESSION_SECRET", "change-this-secret-key-in-production"),
 			MaxAge:    getEnvAsInt("SESSION_MAX_AGE", 86400), // 24 hours
 		},
+		Auth: AuthConfig{
+			PasswordMinLength:     getEnvAsInt("AUTH_PASSWORD_MIN_LENGTH", 12),
+			PasswordRequireUpper:  getEnvAsBool("AUTH_PASSWORD_REQUIRE_UPPER", false),
+			PasswordRequireLower:  getEnvAsBool("AUTH_PASSWORD_REQUIRE_LOWER", false),
+			PasswordRequireDigit:  getEnvAsBool("AUTH_PASSWORD_REQUIRE_DIGIT", false),
+			PasswordRequireSymbol: getEnvAsBool("AUTH_PASSWORD_REQUIRE_SYMBOL", false),
+
+			AdminUsername: getEnv("AUTH_ADMIN_USERNAME", "admin"),
+			AdminEmail:    getEnv("AUTH_ADMIN_EMAIL", "admin@localhost"),
+			AdminPassword: getEnv("AUTH_ADMIN_PASSWORD", ""),
+
+			RequireTwoFactor:   getEnvAsBool("AUTH_2FA_REQUIRED", false),
+			RememberDeviceDays: getEnvAsInt("AUTH_REMEMBER_DEVICE_DAYS", 30),
+		},
+		Caddy: CaddyConfig{
+			LogListen:     getEnv("CADDY_LOG_LISTEN", ""),
+			LogBufferSize: getEnvAsInt("CADDY_LOG_BUFFER", 1000),
+			LogDir:        getEnv("CADDY_LOG_DIR", "/var/log/caddy"),
+
+			MetricsInterval:  getEnvAsDuration("CADDY_METRICS_INTERVAL", 60*time.Second),
+			MetricsTimeout:   getEnvAsDuration("CADDY_METRICS_TIMEOUT", 10*time.Second),
+			MetricsWorkers:   getEnvAsInt("CADDY_METRICS_WORKERS", 4),
+			MetricsRetention: getEnvAsDuration("CADDY_METRICS_RETENTION", 7*24*time.Hour),
+
+			RollupRetentionMinute: getEnvAsDuration("CADDY_ROLLUP_RETENTION_1M", 30*24*time.Hour),
+			RollupRetentionHour:   getEnvAsDuration("CADDY_ROLLUP_RETENTION_1H", 180*24*time.Hour),
+			RollupRetentionDay:    getEnvAsDuration("CADDY_ROLLUP_RETENTION_1D", 3*365*24*time.Hour),
+
+			ConfigHistoryMax: getEnvAsInt("CADDY_CONFIG_HISTORY_MAX", 200),
+
+			AuditEnabled:    getEnvAsBool("CADDY_AUDIT_ENABLED", true),
+			AuditMaxEntries: getEnvAsInt("CADDY_AUDIT_MAX_ENTRIES", 10000),
+			AuditMaxSize:    int64(getEnvAsInt("CADDY_AUDIT_MAX_SIZE_MB", 10)) << 20,
+			AuditMaxAge:     getEnvAsDuration("CADDY_AUDIT_MAX_AGE", 30*24*time.Hour),
+			AuditKeyFile:    getEnv("CADDY_AUDIT_KEY_FILE", ""),
+
+			AuditSyslog:         getEnv("CADDY_AUDIT_SYSLOG", ""),
+			AuditSyslogCAFile:   getEnv("CADDY_AUDIT_SYSLOG_CA_FILE", ""),
+			AuditSyslogFacility: getEnvAsInt("CADDY_AUDIT_SYSLOG_FACILITY", 13),
+			AuditSyslogQueueMax: int64(getEnvAsInt("CADDY_AUDIT_SYSLOG_QUEUE_MB", 100)) << 20,
+		},
 	}
 }
 
@@ -74,4 +163,34 @@ func getEnvAsInt(key string, defaultVal int) int {
 		}
 	}
 	return defaultVal
-}
\ No newline at end of file
+}
+
+func getEnvAsBool(key string, defaultVal bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		} else {
+			log.Printf("Warning: Invalid boolean value for %s: %s, using default: %t", key, value, defaultVal)
+		}
+	}
+	return defaultVal
+}
+
+// getEnvAsDuration parses a Go duration, additionally accepting a "d" suffix for days
+func getEnvAsDuration(key string, defaultVal time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultVal
+	}
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.ParseFloat(days, 64); err == nil {
+			return time.Duration(n * float64(24*time.Hour))
+		}
+	} else if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+
+	log.Printf("Warning: Invalid duration value for %s: %s, using default: %s", key, value, defaultVal)
+	return defaultVal
+}
@@ -1,17 +1,27 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"godash/internal/caddy"
+	"godash/internal/caddyfile"
 	"godash/internal/middleware"
+	"godash/internal/models"
 	"godash/internal/services"
 	"html/template"
 	"io"
+	"log"
 	"net/http"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
 )
 
 // Handlers struct holds all handler dependencies
@@ -23,6 +33,10 @@ type Handlers struct {
 	caddyInstanceSvc  *caddy.InstanceService
 	caddyConfigSvc    *caddy.ConfigService
 	caddyAnalyticsSvc *caddy.AnalyticsStore
+	caddyCollector    *caddy.Collector
+	auditStore        *caddy.AuditStore
+	rbac              *services.RBACService
+	tokens            *services.TokenService
 }
 
 // New creates a new handlers instance
@@ -55,6 +69,80 @@ func NewWithCaddy(userService *services.UserService, dashboardService *services.
 	return handlers, nil
 }
 
+// SetLogSink connects the Caddy log sink to the log endpoints
+func (h *Handlers) SetLogSink(sink *caddy.LogSink) {
+	if h.caddyConfigSvc != nil {
+		h.caddyConfigSvc.SetLogSink(sink)
+	}
+}
+
+// SetCollector connects the background metrics collector to the status endpoints
+func (h *Handlers) SetCollector(collector *caddy.Collector) {
+	h.caddyCollector = collector
+}
+
+// SetConfigHistory enables config snapshots, diffs and rollback
+func (h *Handlers) SetConfigHistory(history *caddy.ConfigHistory) {
+	if h.caddyConfigSvc != nil {
+		h.caddyConfigSvc.SetHistory(history)
+	}
+}
+
+// SetSiteTemplates sets the templates sites can be created from
+func (h *Handlers) SetSiteTemplates(templates *caddy.SiteTemplates) {
+	if h.caddyConfigSvc != nil {
+		h.caddyConfigSvc.SetSiteTemplates(templates)
+	}
+}
+
+// SetAuditStore enables audit logging of instance operations
+func (h *Handlers) SetAuditStore(store *caddy.AuditStore) {
+	h.auditStore = store
+}
+
+// SetRBAC enables the role and role binding endpoints and filters instance
+// lists by what the current user may read
+func (h *Handlers) SetRBAC(rbac *services.RBACService) {
+	h.rbac = rbac
+}
+
+// SetTokenService enables the API token endpoints
+func (h *Handlers) SetTokenService(tokens *services.TokenService) {
+	h.tokens = tokens
+}
+
+// audit records an operation on behalf of the current user. The caller sets
+// the action, target and details; opErr is the outcome. A failure to write
+// the audit log is logged but doesn't fail the request.
+func (h *Handlers) audit(r *http.Request, entry caddy.AuditEntry, opErr error) {
+	if h.auditStore == nil {
+		return
+	}
+
+	if user := middleware.GetCurrentUser(r); user != nil {
+		entry.UserID = user.ID
+		entry.Username = user.Username
+	}
+	if token := middleware.GetCurrentToken(r); token != nil {
+		entry.TokenID = token.ID
+		entry.TokenName = token.Name
+	}
+	entry.IPAddress = middleware.ClientIP(r)
+	entry.Success = opErr == nil
+	if opErr != nil {
+		entry.ErrorMsg = opErr.Error()
+	}
+	if entry.InstanceName == "" && entry.InstanceID != "" && h.caddyInstanceSvc != nil {
+		if inst, err := h.caddyInstanceSvc.Get(entry.InstanceID); err == nil {
+			entry.InstanceName = inst.Name
+		}
+	}
+
+	if err := h.auditStore.Log(&entry); err != nil {
+		log.Printf("Failed to write audit entry for %s: %v", entry.Action, err)
+	}
+}
+
 // HomeHandler redirects to the dashboard
 func (h *Handlers) HomeHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/dashboard", http.StatusFound)
@@ -83,7 +171,12 @@ func (h *Handlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
-	if err := h.authMiddleware.Login(w, r, username, password); err != nil {
+	err := h.authMiddleware.Login(w, r, username, password)
+	if errors.Is(err, middleware.ErrSecondFactorRequired) {
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+	if err != nil {
 		// Login failed, show error
 		data := struct {
 			Error string
@@ -101,12 +194,104 @@ func (h *Handlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/dashboard", http.StatusFound)
 }
 
+// TwoFactorLoginHandler asks for the second factor of a login started on
+// the login page: a code from the user's authenticator app or a recovery
+// code
+func (h *Handlers) TwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	user := h.authMiddleware.PendingUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	data := struct {
+		Username     string
+		RememberDays int
+		Error        string
+	}{
+		Username:     user.Username,
+		RememberDays: int(h.authMiddleware.RememberDeviceDuration().Hours() / 24),
+	}
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+
+		_, recovery, err := h.authMiddleware.CompleteLogin(w, r, r.FormValue("code"), r.FormValue("remember") != "")
+		action := caddy.ActionLogin2FA
+		if recovery {
+			action = caddy.ActionUseRecoveryCode
+		}
+		entry := caddy.AuditEntry{Action: action, UserID: user.ID, Username: user.Username, Details: userDetails(user)}
+		h.audit(r, entry, err)
+		if err == nil {
+			http.Redirect(w, r, "/dashboard", http.StatusFound)
+			return
+		}
+		if errors.Is(err, middleware.ErrNoPendingLogin) {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		data.Error = err.Error()
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "login-2fa.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // LogoutHandler handles user logout
 func (h *Handlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	h.authMiddleware.Logout(w, r)
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
+// ChangePasswordHandler shows the password change form and changes the
+// current user's password. Users who must change their password are
+// redirected here until they do.
+func (h *Handlers) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+	data := struct {
+		User         interface{}
+		Forced       bool
+		Requirements []string
+		Error        string
+	}{
+		User:         user,
+		Forced:       user.MustChangePassword,
+		Requirements: h.userService.PasswordPolicy().Requirements(),
+	}
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+
+		password := r.FormValue("new_password")
+		var err error
+		if password != r.FormValue("confirm_password") {
+			err = errors.New("the new passwords don't match")
+		} else {
+			err = h.userService.ChangePassword(user.ID, r.FormValue("current_password"), password)
+			h.audit(r, caddy.AuditEntry{Action: caddy.ActionChangePassword, Details: userDetails(user)}, err)
+			if errors.Is(err, services.ErrInvalidCredentials) {
+				err = errors.New("the current password is wrong")
+			}
+		}
+		if err == nil {
+			http.Redirect(w, r, "/dashboard", http.StatusFound)
+			return
+		}
+		data.Error = err.Error()
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "change-password.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // DashboardHandler handles the main dashboard page
 func (h *Handlers) DashboardHandler(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetCurrentUser(r)
@@ -149,7 +334,11 @@ func (h *Handlers) APISystemStatsHandler(w http.ResponseWriter, r *http.Request)
 
 // APIUsersHandler returns users list as JSON
 func (h *Handlers) APIUsersHandler(w http.ResponseWriter, r *http.Request) {
-	users := h.userService.List()
+	users, err := h.userService.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(users); err != nil {
@@ -157,228 +346,1866 @@ func (h *Handlers) APIUsersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// StaticFileHandler serves static files with proper MIME types
-func (h *Handlers) StaticFileHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract the file path from URL
-	filePath := r.URL.Path[len("/static/"):]
-	fullPath := filepath.Join("web/static", filePath)
+// userRequest is the body of user create and update requests
+type userRequest struct {
+	Username           string  `json:"username"`
+	Email              *string `json:"email"` // Unchanged if omitted
+	Role               string  `json:"role"`
+	Password           string  `json:"password"`
+	MustChangePassword bool    `json:"must_change_password"`
+	Invite             bool    `json:"invite"`
+	Require2FA         *bool   `json:"require_2fa"` // Unchanged if omitted
+}
 
-	// Set appropriate content type based on file extension
-	ext := filepath.Ext(filePath)
-	switch ext {
-	case ".css":
-		w.Header().Set("Content-Type", "text/css")
-	case ".js":
-		w.Header().Set("Content-Type", "application/javascript")
-	case ".png":
-		w.Header().Set("Content-Type", "image/png")
-	case ".jpg", ".jpeg":
-		w.Header().Set("Content-Type", "image/jpeg")
-	case ".gif":
-		w.Header().Set("Content-Type", "image/gif")
-	case ".svg":
-		w.Header().Set("Content-Type", "image/svg+xml")
+// APIAdminUsersHandler returns all users, including deactivated ones
+func (h *Handlers) APIAdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := h.userService.ListAll()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	http.ServeFile(w, r, fullPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":           users,
+		"password_policy": h.userService.PasswordPolicy().Requirements(),
+	})
 }
 
-// Caddy API Handlers
-
-// APIListInstancesHandler returns list of Caddy instances
-func (h *Handlers) APIListInstancesHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+// APIAdminCreateUserHandler creates a user. With "invite" the user gets no
+// password; the response carries an invitation link to pass on instead.
+// The current user must hold every permission of the new user's role.
+func (h *Handlers) APIAdminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	instances := h.caddyInstanceSvc.List()
-
-	w.Header().Set("Content-Type", "application/json")
-	response := caddy.InstancesListResponse{
-		Instances: instances,
-		Total:     len(instances),
+	var email string
+	if req.Email != nil {
+		email = *req.Email
 	}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	user := models.NewUser(req.Username, email, req.Role)
+	if req.Require2FA != nil {
+		user.TOTPRequired = *req.Require2FA
 	}
-}
-
-// APIGetInstanceHandler returns a single Caddy instance
-func (h *Handlers) APIGetInstanceHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+	if h.rbac != nil && h.rbac.RoleExists(req.Role) {
+		if err := h.checkGrant(r, nil, models.RoleBinding{Role: req.Role}); err != nil {
+			h.audit(r, caddy.AuditEntry{Action: caddy.ActionCreateUser, Details: fmt.Sprintf("%s with role %s", userDetails(user), req.Role)}, err)
+			rbacError(w, err)
+			return
+		}
+	}
+	resp := map[string]interface{}{"user": user}
+	var err error
+	if req.Invite {
+		var token string
+		token, err = h.userService.Invite(user)
+		if err == nil {
+			resp["invite_url"] = inviteURL(r, token)
+		}
+		h.audit(r, caddy.AuditEntry{Action: caddy.ActionInviteUser, Details: userDetails(user)}, err)
+	} else {
+		user.MustChangePassword = req.MustChangePassword
+		err = h.userService.Create(user, req.Password)
+		h.audit(r, caddy.AuditEntry{Action: caddy.ActionCreateUser, Details: userDetails(user)}, err)
+	}
+	if err != nil {
+		userError(w, err)
 		return
 	}
 
-	vars := mux.Vars(r)
-	id := vars["id"]
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
 
-	inst, err := h.caddyInstanceSvc.Get(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+// APIAdminGetUserHandler returns a user
+func (h *Handlers) APIAdminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromPath(w, r)
+	if !ok {
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	response := caddy.InstanceResponse{Instance: inst}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	json.NewEncoder(w).Encode(user)
 }
 
-// APICreateInstanceHandler creates a new Caddy instance
-func (h *Handlers) APICreateInstanceHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+// APIAdminUpdateUserHandler changes a user's username, email, role and
+// whether they must use two-factor authentication. Omitted fields are kept.
+// The current user must hold every permission of both the old and the new
+// role.
+func (h *Handlers) APIAdminUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromPath(w, r)
+	if !ok {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	defer r.Body.Close()
 
-	var req caddy.InstanceRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if current := middleware.GetCurrentUser(r); current != nil && current.ID == user.ID && req.Role != "" && req.Role != user.Role {
+		http.Error(w, "You can't change your own role", http.StatusConflict)
 		return
 	}
+	if !h.allowManage(w, r, caddy.ActionUpdateUser, user) {
+		return
+	}
+	if req.Role != "" && req.Role != user.Role && h.rbac != nil && h.rbac.RoleExists(req.Role) {
+		if err := h.checkGrant(r, nil, models.RoleBinding{Role: req.Role}); err != nil {
+			h.audit(r, caddy.AuditEntry{Action: caddy.ActionUpdateUser, Details: fmt.Sprintf("%s: role %s -> %s", userDetails(user), user.Role, req.Role)}, err)
+			rbacError(w, err)
+			return
+		}
+	}
 
-	inst, err := h.caddyInstanceSvc.Create(&req)
+	details := userDetails(user)
+	if req.Username != "" && req.Username != user.Username {
+		details += fmt.Sprintf(": username %s -> %s", user.Username, req.Username)
+	}
+	if req.Email != nil && *req.Email != user.Email {
+		details += fmt.Sprintf(": email %q -> %q", user.Email, *req.Email)
+	}
+	if req.Role != "" && req.Role != user.Role {
+		details += fmt.Sprintf(": role %s -> %s", user.Role, req.Role)
+	}
+	if req.Require2FA != nil && *req.Require2FA != user.TOTPRequired {
+		details += fmt.Sprintf(": two-factor required %t", *req.Require2FA)
+		user.TOTPRequired = *req.Require2FA
+	}
+	if req.Username != "" {
+		user.Username = req.Username
+	}
+	if req.Role != "" {
+		user.Role = req.Role
+	}
+	if req.Email != nil {
+		user.Email = *req.Email
+	}
+
+	err := h.userService.Update(user)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionUpdateUser, Details: details}, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		userError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	response := caddy.InstanceResponse{Instance: inst}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	json.NewEncoder(w).Encode(user)
 }
 
-// APIUpdateInstanceHandler updates a Caddy instance
-func (h *Handlers) APIUpdateInstanceHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
-		return
-	}
+// APIAdminDeactivateUserHandler deactivates a user, ending their sessions
+func (h *Handlers) APIAdminDeactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.setUserActive(w, r, false)
+}
 
-	vars := mux.Vars(r)
-	id := vars["id"]
+// APIAdminActivateUserHandler reactivates a deactivated user
+func (h *Handlers) APIAdminActivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.setUserActive(w, r, true)
+}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+func (h *Handlers) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	user, ok := h.userFromPath(w, r)
+	if !ok {
 		return
 	}
-	defer r.Body.Close()
-
-	var req caddy.InstanceRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if current := middleware.GetCurrentUser(r); !active && current != nil && current.ID == user.ID {
+		http.Error(w, "You can't deactivate your own account", http.StatusConflict)
 		return
 	}
 
-	inst, err := h.caddyInstanceSvc.Update(id, &req)
+	action := caddy.ActionDeactivateUser
+	if active {
+		action = caddy.ActionActivateUser
+	}
+	if !h.allowManage(w, r, action, user) {
+		return
+	}
+	updated, err := h.userService.SetActive(user.ID, active)
+	h.audit(r, caddy.AuditEntry{Action: action, Details: userDetails(user)}, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		userError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	response := caddy.InstanceResponse{Instance: inst}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	json.NewEncoder(w).Encode(updated)
 }
 
-// APIDeleteInstanceHandler deletes a Caddy instance
-func (h *Handlers) APIDeleteInstanceHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+// APIAdminResetPasswordHandler resets a user's password. Without a password
+// in the body one is generated and returned. Either way the user has to
+// change it at the next login.
+func (h *Handlers) APIAdminResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromPath(w, r)
+	if !ok || !h.allowManage(w, r, caddy.ActionResetPassword, user) {
 		return
 	}
 
-	vars := mux.Vars(r)
-	id := vars["id"]
+	var req struct {
+		Password string `json:"password"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
 
-	if err := h.caddyInstanceSvc.Delete(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	resp := map[string]interface{}{"status": "ok"}
+	var err error
+	if req.Password != "" {
+		err = h.userService.SetPassword(user.ID, req.Password, true)
+	} else {
+		var password string
+		if password, err = h.userService.ResetPassword(user.ID); err == nil {
+			resp["password"] = password
+		}
+	}
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionResetPassword, Details: userDetails(user)}, err)
+	if err != nil {
+		userError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
-// APITestInstanceHandler tests connection to a Caddy instance
-func (h *Handlers) APITestInstanceHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+// APIAdminReinviteUserHandler issues a new invitation link to a user who
+// hasn't accepted theirs
+func (h *Handlers) APIAdminReinviteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromPath(w, r)
+	if !ok || !h.allowManage(w, r, caddy.ActionInviteUser, user) {
 		return
 	}
 
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	if err := h.caddyInstanceSvc.TestConnection(id); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	token, err := h.userService.Reinvite(user.ID)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionInviteUser, Details: userDetails(user)}, err)
+	if err != nil {
+		userError(w, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "connected"})
+	json.NewEncoder(w).Encode(map[string]string{"invite_url": inviteURL(r, token)})
 }
 
-// APIRefreshInstanceHandler refreshes the status of a Caddy instance
-func (h *Handlers) APIRefreshInstanceHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+// APIAdminReset2FAHandler turns off a user's two-factor authentication,
+// e.g. after they lost their device. If it is required they enroll again
+// at the next login.
+func (h *Handlers) APIAdminReset2FAHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.userFromPath(w, r)
+	if !ok || !h.allowManage(w, r, caddy.ActionReset2FA, user) {
 		return
 	}
 
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	if err := h.caddyInstanceSvc.RefreshStatus(id); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := h.userService.ResetTOTP(user.ID)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionReset2FA, Details: userDetails(user)}, err)
+	if err != nil {
+		twoFactorError(w, err)
 		return
 	}
 
-	inst, _ := h.caddyInstanceSvc.Get(id)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": string(inst.Status)})
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// APIInstanceMetricsHandler returns metrics for a Caddy instance
-func (h *Handlers) APIInstanceMetricsHandler(w http.ResponseWriter, r *http.Request) {
-	if h.caddyInstanceSvc == nil || h.caddyConfigSvc == nil {
-		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+// APIAdminRolesHandler returns every role and the permissions roles can
+// be built from
+func (h *Handlers) APIAdminRolesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rbac == nil {
+		http.Error(w, "Roles not initialized", http.StatusServiceUnavailable)
 		return
 	}
 
-	vars := mux.Vars(r)
-	id := vars["id"]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roles":       h.rbac.Roles(),
+		"permissions": models.AllPermissions,
+	})
+}
 
-	metrics, err := h.caddyConfigSvc.CollectMetrics(id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// APIAdminSaveRoleHandler creates a custom role (POST) or replaces the one
+// named in the path (PUT). Only permissions the current user holds
+// everywhere can be put in a role.
+func (h *Handlers) APIAdminSaveRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rbac == nil {
+		http.Error(w, "Roles not initialized", http.StatusServiceUnavailable)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	response := caddy.AnalyticsResponse{Metrics: metrics}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+	var role models.Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	perms := []models.Permission{}
+	for _, p := range role.Permissions {
+		if p.Valid() {
+			perms = append(perms, p)
+		}
+	}
+	if err := h.checkGrant(r, perms, models.RoleBinding{}); err != nil {
+		h.audit(r, caddy.AuditEntry{Action: caddy.ActionSaveRole, Details: fmt.Sprintf("role %s: %v", role.Name, role.Permissions)}, err)
+		rbacError(w, err)
+		return
+	}
+	name, update := mux.Vars(r)["name"]
+	if update {
+		if _, err := h.rbac.GetRole(name); err != nil {
+			rbacError(w, err)
+			return
+		}
+		role.Name = name
+	} else if h.rbac.RoleExists(role.Name) {
+		http.Error(w, fmt.Sprintf("role %q already exists", role.Name), http.StatusConflict)
+		return
+	}
+
+	saved, err := h.rbac.SaveRole(role)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionSaveRole, Details: fmt.Sprintf("role %s: %v", role.Name, role.Permissions)}, err)
+	if err != nil {
+		rbacError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !update {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(saved)
+}
+
+// APIAdminDeleteRoleHandler deletes a custom role nobody holds
+func (h *Handlers) APIAdminDeleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rbac == nil {
+		http.Error(w, "Roles not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	err := h.rbac.DeleteRole(name)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionDeleteRole, Details: "role " + name}, err)
+	if err != nil {
+		rbacError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// APIAdminUserBindingsHandler returns the role bindings of a user
+func (h *Handlers) APIAdminUserBindingsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rbac == nil {
+		http.Error(w, "Roles not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	user, ok := h.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	bindings := h.rbac.Bindings(user.ID)
+	if bindings == nil {
+		bindings = []models.RoleBinding{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bindings)
+}
+
+// APIAdminAddBindingHandler grants a user a role, limited to the instances
+// and tags in the request if there are any. The current user must hold
+// what the role grants on that scope, and can't grant themselves roles.
+func (h *Handlers) APIAdminAddBindingHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rbac == nil {
+		http.Error(w, "Roles not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	user, ok := h.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.RoleBinding
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.UserID = user.ID
+	if current := middleware.GetCurrentUser(r); current != nil && current.ID == user.ID {
+		http.Error(w, "You can't grant yourself a role", http.StatusForbidden)
+		return
+	}
+
+	var binding *models.RoleBinding
+	err := h.checkGrant(r, nil, req)
+	if err == nil {
+		binding, err = h.rbac.AddBinding(req)
+	}
+	details := fmt.Sprintf("role %s for %s", req.Role, userDetails(user))
+	if req.Scoped() {
+		details += fmt.Sprintf(" on instances %v and tags %v", req.Instances, req.Tags)
+	}
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionAddBinding, Details: details}, err)
+	if err != nil {
+		rbacError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(binding)
+}
+
+// APIAdminDeleteBindingHandler revokes a role binding
+func (h *Handlers) APIAdminDeleteBindingHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rbac == nil {
+		http.Error(w, "Roles not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := mux.Vars(r)["bid"]
+	details := "binding " + id
+	for _, b := range h.rbac.Bindings(0) {
+		if b.ID == id {
+			details = fmt.Sprintf("role %s for user id %d", b.Role, b.UserID)
+		}
+	}
+	err := h.rbac.DeleteBinding(id)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionDeleteBinding, Details: details}, err)
+	if err != nil {
+		rbacError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// allowManage checks that the current user holds every permission user
+// holds through their role and role bindings, so changing the user's role
+// or taking over their account can't gain more than the current user has.
+// Otherwise the attempt is audited as action, a 403 is written and false
+// returned.
+func (h *Handlers) allowManage(w http.ResponseWriter, r *http.Request, action caddy.AuditAction, user *models.User) bool {
+	if h.rbac == nil {
+		return true
+	}
+
+	scopes := append([]models.RoleBinding{{Role: user.Role}}, h.rbac.Bindings(user.ID)...)
+	for _, scope := range scopes {
+		err := h.checkGrant(r, nil, scope)
+		if err == nil || errors.Is(err, services.ErrRoleNotFound) {
+			continue
+		}
+		h.audit(r, caddy.AuditEntry{Action: action, Details: userDetails(user)}, err)
+		http.Error(w, fmt.Sprintf("You can't manage %s: %v", user.Username, err), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkGrant returns an error unless the current user may grant perms, or
+// the role of scope if perms is nil, wherever scope applies. They must hold
+// each permission there themselves, and a request made with an API token
+// also needs each among the token's scopes.
+func (h *Handlers) checkGrant(r *http.Request, perms []models.Permission, scope models.RoleBinding) error {
+	if perms == nil {
+		role, err := h.rbac.GetRole(scope.Role)
+		if err != nil {
+			return err
+		}
+		perms = role.Permissions
+	}
+	if err := h.rbac.CanGrantPermissions(middleware.GetCurrentUser(r), perms, scope); err != nil {
+		return err
+	}
+	if token := middleware.GetCurrentToken(r); token != nil {
+		for _, p := range perms {
+			if !token.Has(p) && !(p.Global() && scope.Scoped()) {
+				return fmt.Errorf("%w: %s is not among the token's scopes", services.ErrGrantDenied, p)
+			}
+		}
+	}
+	return nil
+}
+
+// APIAccountHandler returns the current user
+func (h *Handlers) APIAccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":            middleware.GetCurrentUser(r),
+		"password_policy": h.userService.PasswordPolicy().Requirements(),
+	})
+}
+
+// APIAccountPermissionsHandler returns what the current user may do: the
+// permissions held on the dashboard as a whole, and per instance those held
+// on it, limited to the scopes of the API token the request was made with.
+// Pages use it to hide actions the user can't take.
+func (h *Handlers) APIAccountPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+
+	var global []models.Permission
+	instances := make(map[string][]models.Permission)
+	if h.rbac != nil {
+		global = h.rbac.Permissions(user, "", nil)
+		if h.caddyInstanceSvc != nil {
+			for _, inst := range h.caddyInstanceSvc.List() {
+				if perms := h.rbac.Permissions(user, inst.ID, inst.Tags); len(perms) > 0 {
+					instances[inst.ID] = perms
+				}
+			}
+		}
+	} else if user.IsAdmin() {
+		global = models.AllPermissions
+	}
+	if token := middleware.GetCurrentToken(r); token != nil {
+		global = slices.DeleteFunc(slices.Clone(global), func(p models.Permission) bool { return !token.Has(p) })
+		for id, perms := range instances {
+			if perms = slices.DeleteFunc(perms, func(p models.Permission) bool { return !token.Has(p) }); len(perms) > 0 {
+				instances[id] = perms
+			} else {
+				delete(instances, id)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"role":      user.Role,
+		"global":    global,
+		"instances": instances,
+	})
+}
+
+// APIUpdateAccountHandler changes the current user's email
+func (h *Handlers) APIUpdateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	current := middleware.GetCurrentUser(r)
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userService.UpdateEmail(current.ID, req.Email)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionUpdateUser, Details: userDetails(current) + ": email"}, err)
+	if err != nil {
+		userError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// APIChangePasswordHandler changes the current user's password
+func (h *Handlers) APIChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	current := middleware.GetCurrentUser(r)
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.userService.ChangePassword(current.ID, req.CurrentPassword, req.NewPassword)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionChangePassword, Details: userDetails(current)}, err)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		http.Error(w, "The current password is wrong", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		userError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// tokenRequest is the body of API token create requests
+type tokenRequest struct {
+	Name          string              `json:"name"`
+	Scopes        []models.Permission `json:"scopes"`
+	AllowedIPs    []string            `json:"allowed_ips"`
+	ExpiresInDays int                 `json:"expires_in_days"` // 0 for a token that never expires
+}
+
+// APIAccountTokensHandler returns the current user's API tokens and the
+// scopes tokens can have
+func (h *Handlers) APIAccountTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if h.tokens == nil {
+		http.Error(w, "API tokens not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	user := middleware.GetCurrentUser(r)
+
+	scopes := []models.Permission{}
+	for _, p := range models.AllPermissions {
+		if h.rbac == nil || h.rbac.CanAnywhere(user, p) {
+			scopes = append(scopes, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tokens": h.tokens.List(user.ID),
+		"scopes": scopes,
+	})
+}
+
+// APICreateAccountTokenHandler issues an API token to the current user. The
+// token is only part of this response.
+func (h *Handlers) APICreateAccountTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if h.tokens == nil {
+		http.Error(w, "API tokens not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	user := middleware.GetCurrentUser(r)
+
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, p := range req.Scopes {
+		if p.Valid() && h.rbac != nil && !h.rbac.CanAnywhere(user, p) {
+			http.Error(w, fmt.Sprintf("You don't have the %s permission", p), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "expires_in_days must not be negative", http.StatusBadRequest)
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	raw, token, err := h.tokens.Create(user.ID, req.Name, req.Scopes, req.AllowedIPs, expiresAt)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionCreateToken, Details: fmt.Sprintf("token %q with scopes %v", req.Name, req.Scopes)}, err)
+	if err != nil {
+		tokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     raw,
+		"api_token": token,
+	})
+}
+
+// APIRevokeAccountTokenHandler revokes one of the current user's API tokens
+func (h *Handlers) APIRevokeAccountTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if h.tokens == nil {
+		http.Error(w, "API tokens not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	token, err := h.tokens.Get(mux.Vars(r)["tid"])
+	if err == nil && token.UserID != middleware.GetCurrentUser(r).ID {
+		err = services.ErrTokenNotFound
+	}
+	if err != nil {
+		tokenError(w, err)
+		return
+	}
+	h.revokeToken(w, r, token)
+}
+
+// APIAdminTokensHandler returns the API tokens of every user
+func (h *Handlers) APIAdminTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if h.tokens == nil {
+		http.Error(w, "API tokens not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.tokens.List(0))
+}
+
+// APIAdminRevokeTokenHandler revokes any user's API token
+func (h *Handlers) APIAdminRevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if h.tokens == nil {
+		http.Error(w, "API tokens not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	token, err := h.tokens.Get(mux.Vars(r)["tid"])
+	if err != nil {
+		tokenError(w, err)
+		return
+	}
+	h.revokeToken(w, r, token)
+}
+
+// revokeToken revokes a token and writes the response
+func (h *Handlers) revokeToken(w http.ResponseWriter, r *http.Request, token *models.APIToken) {
+	err := h.tokens.Revoke(token.ID)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionRevokeToken, Details: fmt.Sprintf("token %q (%s) of user id %d", token.Name, token.Prefix, token.UserID)}, err)
+	if err != nil {
+		tokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+}
+
+// TwoFactorHandler shows the page to set up and manage two-factor
+// authentication. Users who must enroll are redirected here until they do.
+func (h *Handlers) TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+	data := struct {
+		User     interface{}
+		Required bool
+	}{
+		User:     user,
+		Required: h.userService.TOTPRequired(user),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "two-factor.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// codeRequest is the body of requests confirmed with a code from the
+// user's authenticator app
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+// APIAccount2FAHandler returns the current user's two-factor status
+func (h *Handlers) APIAccount2FAHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":              user.TOTPEnabled,
+		"required":             h.userService.TOTPRequired(user),
+		"recovery_codes_left":  len(user.RecoveryCodes),
+		"remember_device_days": int(h.authMiddleware.RememberDeviceDuration().Hours() / 24),
+	})
+}
+
+// APIAccount2FASetupHandler starts two-factor enrollment. It returns a new
+// secret with its provisioning URI and a QR code of it for authenticator
+// apps to scan.
+func (h *Handlers) APIAccount2FASetupHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+
+	secret, uri, err := h.userService.BeginTOTPSetup(user.ID)
+	if err != nil {
+		twoFactorError(w, err)
+		return
+	}
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to render QR code: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    uri,
+		"qr":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// APIAccount2FAEnableHandler turns on two-factor authentication once a code
+// shows the user's app has the secret. The recovery codes are only part of
+// this response.
+func (h *Handlers) APIAccount2FAEnableHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.userService.EnableTOTP(user.ID, req.Code)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionEnable2FA, Details: userDetails(user)}, err)
+	if err != nil {
+		twoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// APIAccount2FADisableHandler turns off the current user's two-factor
+// authentication after checking their password
+func (h *Handlers) APIAccount2FADisableHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := h.userService.DisableTOTP(user.ID, req.Password)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionDisable2FA, Details: userDetails(user)}, err)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		http.Error(w, "The password is wrong", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		twoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// APIAccountRecoveryCodesHandler replaces the current user's recovery codes
+// after checking a code from their app. The new codes are only part of this
+// response.
+func (h *Handlers) APIAccountRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.userService.RegenerateRecoveryCodes(user.ID, req.Code)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionRegenerateRecovery, Details: userDetails(user)}, err)
+	if err != nil {
+		twoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// APIAccountForgetDevicesHandler makes every device the current user asked
+// to remember ask for a code again
+func (h *Handlers) APIAccountForgetDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetCurrentUser(r)
+
+	err := h.userService.ForgetDevices(user.ID)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionForgetDevices, Details: userDetails(user)}, err)
+	if err != nil {
+		twoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// AcceptInviteHandler shows the invitation form and sets the invited user's
+// password
+func (h *Handlers) AcceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	user, err := h.userService.GetInvite(token)
+	data := struct {
+		Username     string
+		Requirements []string
+		Error        string
+	}{
+		Requirements: h.userService.PasswordPolicy().Requirements(),
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		data.Error = err.Error()
+		if err := h.templates.ExecuteTemplate(w, "accept-invite.html", data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	data.Username = user.Username
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+
+		password := r.FormValue("new_password")
+		if password != r.FormValue("confirm_password") {
+			err = errors.New("the passwords don't match")
+		} else {
+			_, err = h.userService.AcceptInvite(token, password)
+			entry := caddy.AuditEntry{Action: caddy.ActionAcceptInvite, UserID: user.ID, Username: user.Username, Details: userDetails(user)}
+			h.audit(r, entry, err)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		data.Error = err.Error()
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "accept-invite.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// userFromPath returns the user named by the {uid} path variable, or writes
+// the error response
+func (h *Handlers) userFromPath(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["uid"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := h.userService.GetByID(id)
+	if err != nil {
+		userError(w, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// inviteURL returns the link an invited user accepts the invitation at
+func inviteURL(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/invite/%s", scheme, r.Host, token)
+}
+
+// userDetails names a user for the audit log
+func userDetails(user *models.User) string {
+	if user == nil {
+		return ""
+	}
+	return fmt.Sprintf("user %s (id %d)", user.Username, user.ID)
+}
+
+// userError writes the response for a failed user operation
+func userError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrUsernameTaken), errors.Is(err, services.ErrEmailTaken), errors.Is(err, services.ErrLastAdmin):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, services.ErrInvalidUser), errors.Is(err, services.ErrWeakPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// rbacError writes the response for a failed role or binding operation
+func rbacError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrRoleNotFound), errors.Is(err, services.ErrBindingNotFound), errors.Is(err, services.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrBuiltinRole), errors.Is(err, services.ErrRoleInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, services.ErrInvalidRole):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, services.ErrGrantDenied):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// tokenError writes the response for a failed API token operation
+func tokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrTokenNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrInvalidToken):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// twoFactorError writes the response for a failed two-factor operation
+func twoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrInvalidCode):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, services.ErrTooManyAttempts):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, services.ErrTOTPNotEnabled), errors.Is(err, services.ErrTOTPAlreadyEnabled),
+		errors.Is(err, services.ErrTOTPNotStarted), errors.Is(err, services.ErrTOTPRequired):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// StaticFileHandler serves static files with proper MIME types
+func (h *Handlers) StaticFileHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the file path from URL
+	filePath := r.URL.Path[len("/static/"):]
+	fullPath := filepath.Join("web/static", filePath)
+
+	// Set appropriate content type based on file extension
+	ext := filepath.Ext(filePath)
+	switch ext {
+	case ".css":
+		w.Header().Set("Content-Type", "text/css")
+	case ".js":
+		w.Header().Set("Content-Type", "application/javascript")
+	case ".png":
+		w.Header().Set("Content-Type", "image/png")
+	case ".jpg", ".jpeg":
+		w.Header().Set("Content-Type", "image/jpeg")
+	case ".gif":
+		w.Header().Set("Content-Type", "image/gif")
+	case ".svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+	}
+
+	http.ServeFile(w, r, fullPath)
+}
+
+// Caddy API Handlers
+
+// APIListInstancesHandler returns list of Caddy instances
+func (h *Handlers) APIListInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	instances := h.readableInstances(r, h.caddyInstanceSvc.List())
+
+	w.Header().Set("Content-Type", "application/json")
+	response := caddy.InstancesListResponse{
+		Instances: instances,
+		Total:     len(instances),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIGetInstanceHandler returns a single Caddy instance
+func (h *Handlers) APIGetInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	inst, err := h.caddyInstanceSvc.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := caddy.InstanceResponse{Instance: inst}
+	if h.caddyCollector != nil {
+		if status, ok := h.caddyCollector.InstanceStatus(id); ok {
+			response.Collector = &status
+		}
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APICollectorStatusHandler returns the scrape status of every instance
+func (h *Handlers) APICollectorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyCollector == nil {
+		http.Error(w, "Metrics collector not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	status := []caddy.CollectorStatus{}
+	for _, st := range h.caddyCollector.Status() {
+		if h.authMiddleware.Can(r, models.PermInstanceRead, st.InstanceID) {
+			status = append(status, st)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APICreateInstanceHandler creates a new Caddy instance
+func (h *Handlers) APICreateInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req caddy.InstanceRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	inst, err := h.caddyInstanceSvc.Create(&req)
+	entry := caddy.AuditEntry{Action: caddy.ActionCreateInstance, InstanceName: req.Name, Details: req.URL}
+	if inst != nil {
+		entry.InstanceID = inst.ID
+	}
+	h.audit(r, entry, err)
+	if errors.Is(err, caddy.ErrLogFileNotAllowed) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	response := caddy.InstanceResponse{Instance: inst}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIUpdateInstanceHandler updates a Caddy instance
+func (h *Handlers) APIUpdateInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req caddy.InstanceRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	inst, err := h.caddyInstanceSvc.Update(id, &req)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionUpdateInstance, InstanceID: id, Details: req.URL}, err)
+	if errors.Is(err, caddy.ErrLogFileNotAllowed) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := caddy.InstanceResponse{Instance: inst}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIDeleteInstanceHandler deletes a Caddy instance
+func (h *Handlers) APIDeleteInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// Look the name up first; it's gone once the instance is deleted
+	entry := caddy.AuditEntry{Action: caddy.ActionDeleteInstance, InstanceID: id}
+	if inst, err := h.caddyInstanceSvc.Get(id); err == nil {
+		entry.InstanceName = inst.Name
+	}
+
+	err := h.caddyInstanceSvc.Delete(id)
+	h.audit(r, entry, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APITestInstanceHandler tests connection to a Caddy instance
+func (h *Handlers) APITestInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	err := h.caddyInstanceSvc.TestConnection(id)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionTestConnection, InstanceID: id}, err)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "connected"})
+}
+
+// APIRefreshInstanceHandler refreshes the status of a Caddy instance
+func (h *Handlers) APIRefreshInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	err := h.caddyInstanceSvc.RefreshStatus(id)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionRefreshStatus, InstanceID: id}, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	inst, _ := h.caddyInstanceSvc.Get(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": string(inst.Status)})
+}
+
+// APIInstanceMetricsHandler returns metrics for a Caddy instance
+func (h *Handlers) APIInstanceMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil || h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	metrics, err := h.caddyConfigSvc.CollectMetrics(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := caddy.AnalyticsResponse{Metrics: metrics}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIInstanceRatesHandler returns a counter as per-interval increases and
+// rates, e.g. ?metric=requests&range=24h&step=1m&per=minute
+func (h *Handlers) APIInstanceRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyAnalyticsSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	query := r.URL.Query()
+
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = "requests"
+	}
+
+	rangeDur, err := parseDurationParam(query.Get("range"), time.Hour)
+	if err != nil || rangeDur <= 0 {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+	step, err := parseDurationParam(query.Get("step"), defaultRateStep(rangeDur))
+	if err != nil || step < time.Second {
+		http.Error(w, "Invalid step", http.StatusBadRequest)
+		return
+	}
+	if rangeDur/step > 10000 {
+		http.Error(w, "Step too small for range", http.StatusBadRequest)
+		return
+	}
+
+	per, err := parsePerParam(query.Get("per"))
+	if err != nil {
+		http.Error(w, "Invalid per", http.StatusBadRequest)
+		return
+	}
+
+	end := time.Now()
+	series, err := h.caddyAnalyticsSvc.GetRates(id, metric, caddy.RateOptions{
+		Start: end.Add(-rangeDur),
+		End:   end,
+		Step:  step,
+		Per:   per,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(series); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIInstanceLatencyHandler returns latency percentiles and a heatmap for a
+// time window, e.g. ?metric=duration:host=example.com&range=6h&step=5m
+func (h *Handlers) APIInstanceLatencyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyAnalyticsSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	query := r.URL.Query()
+
+	rangeDur, err := parseDurationParam(query.Get("range"), time.Hour)
+	if err != nil || rangeDur <= 0 {
+		http.Error(w, "Invalid range", http.StatusBadRequest)
+		return
+	}
+	step, err := parseDurationParam(query.Get("step"), defaultRateStep(rangeDur))
+	if err != nil || step < time.Second {
+		http.Error(w, "Invalid step", http.StatusBadRequest)
+		return
+	}
+	if rangeDur/step > 1000 {
+		http.Error(w, "Step too small for range", http.StatusBadRequest)
+		return
+	}
+
+	end := time.Now()
+	report, err := h.caddyAnalyticsSvc.GetLatency(id, query.Get("metric"), caddy.LatencyOptions{
+		Start: end.Add(-rangeDur),
+		End:   end,
+		Step:  step,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIAnalyticsHandler returns fleet-wide totals and traffic across the
+// instances selected by ?instances=id1,id2 and/or ?tag=prod (all instances
+// by default). Traffic takes the same parameters as the instance traffic
+// endpoint, so ?group_by=instance splits it per instance.
+func (h *Handlers) APIAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil || h.caddyAnalyticsSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	instances, err := h.selectInstances(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	q, err := parseAnalyticsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := h.caddyAnalyticsSvc.GetAggregatedMetrics(instances, q.Start, q.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if response.Traffic, err = h.caddyAnalyticsSvc.Query(instanceIDs(instances), q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIInstanceAnalyticsHandler returns an instance's totals and stored
+// metrics history for a time window, e.g. ?range=24h&step=15m
+func (h *Handlers) APIInstanceAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil || h.caddyAnalyticsSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, err := h.caddyInstanceSvc.Get(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	q, err := parseAnalyticsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := h.caddyAnalyticsSvc.GetAggregatedMetrics([]*caddy.CaddyInstance{inst}, q.Start, q.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(response.History) > 0 {
+		response.Metrics = response.History[0]
+	}
+	if response.History, _, err = h.caddyAnalyticsSvc.GetHistory(inst.ID, q.Start, q.End, q.Step); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIInstanceTrafficHandler returns a counter over time, optionally split
+// by host, server, handler, status or status_class, e.g.
+// ?metric=requests&group_by=status_class&range=24h&step=15m&per=minute&limit=5
+func (h *Handlers) APIInstanceTrafficHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil || h.caddyAnalyticsSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, err := h.caddyInstanceSvc.Get(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	q, err := parseAnalyticsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.caddyAnalyticsSvc.Query([]string{inst.ID}, q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIInstanceSiteAnalyticsHandler returns per-host traffic totals for a time
+// window; ?group_by=server or handler summarises those instead
+func (h *Handlers) APIInstanceSiteAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil || h.caddyAnalyticsSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, err := h.caddyInstanceSvc.Get(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	q, err := parseAnalyticsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.GroupBy == caddy.GroupByNone {
+		q.GroupBy = caddy.GroupByHost
+	}
+
+	sites, err := h.caddyAnalyticsSvc.GetGroupSummaries([]string{inst.ID}, q.GroupBy, q.Start, q.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"group_by": q.GroupBy,
+		"sites":    sites,
+	})
+}
+
+// APIInstanceErrorAnalyticsHandler returns the error responses served in a
+// time window by status code and host
+func (h *Handlers) APIInstanceErrorAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyInstanceSvc == nil || h.caddyAnalyticsSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, err := h.caddyInstanceSvc.Get(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	q, err := parseAnalyticsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summary, err := h.caddyAnalyticsSvc.GetErrorSummary([]string{inst.ID}, q.Start, q.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIAdminAuditHandler returns audit entries newest first. Filters:
+// user_id, username, instance_id, action, success, and since/until as
+// RFC 3339 times (or range=24h for the most recent window). Pages hold
+// limit entries (default 50, at most 500); pass next_cursor back as cursor
+// for the next page.
+func (h *Handlers) APIAdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if h.auditStore == nil {
+		http.Error(w, "Audit logging not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Cursor = r.URL.Query().Get("cursor")
+	q.Limit = min(q.Limit, 500)
+
+	page, err := h.auditStore.Query(q)
+	if errors.Is(err, caddy.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// APIAdminAuditExportHandler downloads the audit entries matching the same
+// filters as APIAdminAuditHandler, oldest first, as format=jsonl (default),
+// csv or cef. A limit caps the number of entries; by default all are exported.
+func (h *Handlers) APIAdminAuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if h.auditStore == nil {
+		http.Error(w, "Audit logging not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	var contentType string
+	switch format {
+	case "", caddy.ExportJSONL:
+		format, contentType = caddy.ExportJSONL, "application/x-ndjson"
+	case caddy.ExportCSV:
+		contentType = "text/csv"
+	case caddy.ExportCEF:
+		contentType = "text/plain; charset=utf-8"
+	default:
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	filename := fmt.Sprintf("audit-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := h.auditStore.Export(w, q, format); err != nil {
+		// Headers are already sent; the truncated download is all we can signal
+		log.Printf("Audit export failed: %v", err)
+	}
+}
+
+// APIAdminAuditVerifyHandler checks the audit log's hash chain and reports
+// the first broken link
+func (h *Handlers) APIAdminAuditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.auditStore == nil {
+		http.Error(w, "Audit logging not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	result, err := h.auditStore.Verify()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// selectInstances resolves the ?instances= and ?tag= filters of fleet
+// queries. Both take comma-separated lists; an instance matches if it is
+// listed or has any of the tags.
+func (h *Handlers) selectInstances(r *http.Request) ([]*caddy.CaddyInstance, error) {
+	query := r.URL.Query()
+	ids := splitList(query.Get("instances"))
+	tags := splitList(query.Get("tag"))
+	if len(ids) == 0 && len(tags) == 0 {
+		return h.readableInstances(r, h.caddyInstanceSvc.List()), nil
+	}
+
+	var result []*caddy.CaddyInstance
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		inst, err := h.caddyInstanceSvc.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if !h.authMiddleware.Can(r, models.PermInstanceRead, inst.ID) {
+			return nil, fmt.Errorf("instance not found: %s", id)
+		}
+		if !seen[inst.ID] {
+			seen[inst.ID] = true
+			result = append(result, inst)
+		}
+	}
+	for _, inst := range h.readableInstances(r, h.caddyInstanceSvc.List()) {
+		if seen[inst.ID] {
+			continue
+		}
+		for _, tag := range inst.Tags {
+			if slices.Contains(tags, tag) {
+				seen[inst.ID] = true
+				result = append(result, inst)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// readableInstances returns the instances the current user may read
+func (h *Handlers) readableInstances(r *http.Request, instances []*caddy.CaddyInstance) []*caddy.CaddyInstance {
+	readable := make([]*caddy.CaddyInstance, 0, len(instances))
+	for _, inst := range instances {
+		if h.authMiddleware.Can(r, models.PermInstanceRead, inst.ID) {
+			readable = append(readable, inst)
+		}
+	}
+	return readable
+}
+
+func instanceIDs(instances []*caddy.CaddyInstance) []string {
+	ids := make([]string, len(instances))
+	for i, inst := range instances {
+		ids[i] = inst.ID
+	}
+	return ids
+}
+
+// splitList splits a comma-separated parameter, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseAuditQuery reads the audit filters: user_id, username, instance_id,
+// action, success, range, since, until and limit
+func parseAuditQuery(r *http.Request) (caddy.AuditQuery, error) {
+	query := r.URL.Query()
+	q := caddy.AuditQuery{
+		Username:   query.Get("username"),
+		InstanceID: query.Get("instance_id"),
+		Action:     caddy.AuditAction(query.Get("action")),
+	}
+
+	var err error
+	if v := query.Get("user_id"); v != "" {
+		if q.UserID, err = strconv.Atoi(v); err != nil {
+			return q, fmt.Errorf("invalid user_id")
+		}
+	}
+	if v := query.Get("success"); v != "" {
+		success, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid success")
+		}
+		q.Success = &success
+	}
+	if v := query.Get("range"); v != "" {
+		rangeDur, err := parseDurationParam(v, 0)
+		if err != nil || rangeDur <= 0 {
+			return q, fmt.Errorf("invalid range")
+		}
+		q.Since = time.Now().Add(-rangeDur)
+	}
+	if v := query.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid since")
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("invalid until")
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit")
+		}
+	}
+	return q, nil
+}
+
+// parseAnalyticsQuery reads the shared analytics parameters: range, step,
+// metric, group_by, per and limit
+func parseAnalyticsQuery(r *http.Request) (caddy.AnalyticsQuery, error) {
+	query := r.URL.Query()
+
+	rangeDur, err := parseDurationParam(query.Get("range"), 6*time.Hour)
+	if err != nil || rangeDur <= 0 {
+		return caddy.AnalyticsQuery{}, fmt.Errorf("invalid range")
+	}
+	step, err := parseDurationParam(query.Get("step"), defaultRateStep(rangeDur))
+	if err != nil || step < time.Second {
+		return caddy.AnalyticsQuery{}, fmt.Errorf("invalid step")
+	}
+	if rangeDur/step > 10000 {
+		return caddy.AnalyticsQuery{}, fmt.Errorf("step too small for range")
+	}
+	per, err := parsePerParam(query.Get("per"))
+	if err != nil {
+		return caddy.AnalyticsQuery{}, fmt.Errorf("invalid per")
+	}
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return caddy.AnalyticsQuery{}, fmt.Errorf("invalid limit")
+		}
+	}
+
+	end := time.Now()
+	return caddy.AnalyticsQuery{
+		Metric:  query.Get("metric"),
+		GroupBy: query.Get("group_by"),
+		Start:   end.Add(-rangeDur),
+		End:     end,
+		Step:    step,
+		Per:     per,
+		Limit:   limit,
+	}, nil
+}
+
+// parsePerParam parses the unit of rates: second (default), minute, hour or a duration
+func parsePerParam(value string) (time.Duration, error) {
+	switch value {
+	case "", "second":
+		return time.Second, nil
+	case "minute":
+		return time.Minute, nil
+	case "hour":
+		return time.Hour, nil
+	}
+	per, err := parseDurationParam(value, time.Second)
+	if err != nil {
+		return 0, err
+	}
+	if per <= 0 {
+		return 0, fmt.Errorf("per must be positive")
+	}
+	return per, nil
+}
+
+// defaultRateStep picks a bucket width that keeps charts at a few hundred points
+func defaultRateStep(rangeDur time.Duration) time.Duration {
+	for _, step := range []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour} {
+		if rangeDur/step <= 300 {
+			return step
+		}
+	}
+	return 6 * time.Hour
+}
+
+// parseDurationParam parses a Go duration, additionally accepting a "d" suffix for days
+func parseDurationParam(value string, defaultVal time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultVal, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
 // APIInstanceConfigHandler returns the config for a Caddy instance
 func (h *Handlers) APIInstanceConfigHandler(w http.ResponseWriter, r *http.Request) {
 	if h.caddyConfigSvc == nil {
@@ -390,6 +2217,7 @@ func (h *Handlers) APIInstanceConfigHandler(w http.ResponseWriter, r *http.Reque
 	id := vars["id"]
 
 	config, err := h.caddyConfigSvc.ExportConfig(id)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionViewConfig, InstanceID: id, Details: "json"}, err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -399,7 +2227,9 @@ func (h *Handlers) APIInstanceConfigHandler(w http.ResponseWriter, r *http.Reque
 	w.Write([]byte(config))
 }
 
-// APIInstanceLogsHandler returns logs for a Caddy instance
+// APIInstanceLogsHandler returns logs for a Caddy instance.
+// Query parameters: lines (tail size), level (minimum level) and
+// follow=true to keep streaming new entries as server-sent events.
 func (h *Handlers) APIInstanceLogsHandler(w http.ResponseWriter, r *http.Request) {
 	if h.caddyConfigSvc == nil {
 		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
@@ -417,19 +2247,91 @@ func (h *Handlers) APIInstanceLogsHandler(w http.ResponseWriter, r *http.Request
 			tailLines = n
 		}
 	}
+	level := r.URL.Query().Get("level")
 
-	logs, err := h.caddyConfigSvc.GetLogs(id, tailLines)
+	logs, err := h.caddyConfigSvc.GetLogs(id, tailLines, level)
+	details := fmt.Sprintf("lines=%d level=%s follow=%s", tailLines, level, r.URL.Query().Get("follow"))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionViewLogs, InstanceID: id, Details: details}, err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if r.URL.Query().Get("follow") == "true" {
+		h.streamLogs(w, r, id, level, logs)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(logs); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// streamLogs writes the tail followed by live entries as server-sent events
+func (h *Handlers) streamLogs(w http.ResponseWriter, r *http.Request, id, level string, tail []caddy.LogEntry) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	entries, cancel, err := h.caddyConfigSvc.FollowLogs(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	writeEvent := func(entry caddy.LogEntry) bool {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return false
+		}
+		return true
+	}
+
+	for _, entry := range tail {
+		if !writeEvent(entry) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			if !caddy.LevelAtLeast(entry.Level, level) {
+				continue
+			}
+			if !writeEvent(entry) {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 // APIInstanceReloadHandler reloads configuration on a Caddy instance
 func (h *Handlers) APIInstanceReloadHandler(w http.ResponseWriter, r *http.Request) {
 	if h.caddyConfigSvc == nil {
@@ -448,20 +2350,306 @@ func (h *Handlers) APIInstanceReloadHandler(w http.ResponseWriter, r *http.Reque
 	defer r.Body.Close()
 
 	// If no body provided, just reload current config
+	change := configChange(r, r.URL.Query().Get("message"))
+	entry := caddy.AuditEntry{Action: caddy.ActionReloadConfig, InstanceID: id, Details: "current config"}
 	if len(body) == 0 {
-		if err := h.caddyConfigSvc.ReloadConfig(id, nil); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		err = h.caddyConfigSvc.ReloadConfig(id, nil, change)
+	} else {
+		entry.Details = fmt.Sprintf("new config (%d bytes)", len(body))
+		if plan, err := h.caddyConfigSvc.PlanConfig(id, body); err == nil {
+			entry.Details += ": " + plan.String()
+		}
+		err = h.caddyConfigSvc.ReloadConfig(id, body, change)
+	}
+	h.audit(r, entry, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+}
+
+// APIInstanceConfigPlanHandler previews a reload: it diffs the JSON config in
+// the request body against the instance's live config without applying it
+func (h *Handlers) APIInstanceConfigPlanHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if !json.Valid(body) {
+		http.Error(w, "Invalid JSON config", http.StatusBadRequest)
+		return
+	}
+
+	plan, err := h.caddyConfigSvc.PlanConfig(vars["id"], body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// APIInstanceConfigVersionsHandler lists the saved config versions of an
+// instance, newest first
+func (h *Handlers) APIInstanceConfigVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	versions, err := h.caddyConfigSvc.ConfigVersions(id)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionViewConfig, InstanceID: id, Details: "versions"}, err)
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// APIInstanceConfigVersionHandler returns one saved config version, including
+// the config
+func (h *Handlers) APIInstanceConfigVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil || version <= 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	v, err := h.caddyConfigSvc.ConfigVersion(vars["id"], version)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionViewConfig, InstanceID: vars["id"], Details: fmt.Sprintf("version %d", version)}, err)
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// APIInstanceConfigDiffHandler returns the structural diff between two saved
+// config versions given as from and to; to defaults to the newest version
+func (h *Handlers) APIInstanceConfigDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil || from <= 0 {
+		http.Error(w, "Invalid from", http.StatusBadRequest)
+		return
+	}
+	to := 0
+	if v := query.Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil || to <= 0 {
+			http.Error(w, "Invalid to", http.StatusBadRequest)
 			return
 		}
-	} else {
-		if err := h.caddyConfigSvc.ReloadConfig(id, body); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	diff, err := h.caddyConfigSvc.DiffConfigVersions(vars["id"], from, to)
+	details := fmt.Sprintf("diff of versions %d and %d", from, to)
+	if to == 0 {
+		details = fmt.Sprintf("diff of version %d and the newest", from)
+	}
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionViewConfig, InstanceID: vars["id"], Details: details}, err)
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// APIInstanceConfigRollbackHandler loads a saved config version back onto an
+// instance. An optional JSON body {"message": "..."} describes the rollback.
+func (h *Handlers) APIInstanceConfigRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil || version <= 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Message string `json:"message"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = h.caddyConfigSvc.RollbackConfig(id, version, configChange(r, req.Message))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionRollbackConfig, InstanceID: id, Details: fmt.Sprintf("version %d", version)}, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "rolled back"})
+}
+
+// historyError reports a config history failure, distinguishing a disabled
+// history from a missing instance or version
+func historyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, caddy.ErrHistoryDisabled) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusNotFound)
+}
+
+// configChange attributes a config change to the current user
+func configChange(r *http.Request, message string) caddy.ConfigChange {
+	change := caddy.ConfigChange{Message: message}
+	if user := middleware.GetCurrentUser(r); user != nil {
+		change.Author = user.Username
+	}
+	return change
+}
+
+// APIInstanceConfigPathHandler returns the JSON value at a config path of an
+// instance, with its ETag. Paths are relative to the config root, e.g.
+// apps/http/servers/srv0, or start with an @id.
+func (h *Handlers) APIInstanceConfigPathHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	value, etag, err := h.caddyConfigSvc.GetConfigPath(vars["id"], vars["path"])
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionViewConfig, InstanceID: vars["id"], Details: "path " + vars["path"]}, err)
+	if err != nil {
+		configPathError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Write(value)
+}
+
+// APIInstanceEditConfigPathHandler changes the value at a config path of an
+// instance: PUT sets it, PATCH replaces an existing value, POST appends to an
+// array (or inserts before the query parameter index) and DELETE removes it.
+// PUT on an array path such as .../srv0/listen replaces the whole array, and
+// on an element such as .../listen/0 replaces that element; only POST adds
+// elements.
+// An If-Match header with the ETag of an earlier read makes the change fail
+// with 412 Precondition Failed if the path has changed since. The query
+// parameter message describes the change.
+func (h *Handlers) APIInstanceEditConfigPathHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, path := vars["id"], vars["path"]
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if r.Method != http.MethodDelete && !json.Valid(body) {
+		http.Error(w, "Invalid JSON value", http.StatusBadRequest)
+		return
+	}
+
+	index := -1
+	if v := r.URL.Query().Get("index"); v != "" && r.Method == http.MethodPost {
+		if index, err = strconv.Atoi(v); err != nil || index < 0 {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
 			return
 		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+
+	etag := r.Header.Get("If-Match")
+	change := configChange(r, r.URL.Query().Get("message"))
+	switch {
+	case r.Method == http.MethodPut:
+		err = h.caddyConfigSvc.SetConfigPath(id, path, body, etag, change)
+	case r.Method == http.MethodPatch:
+		err = h.caddyConfigSvc.PatchConfigPath(id, path, body, etag, change)
+	case r.Method == http.MethodPost && index >= 0:
+		err = h.caddyConfigSvc.InsertConfigPath(id, path, index, body, etag, change)
+	case r.Method == http.MethodPost:
+		err = h.caddyConfigSvc.AppendConfigPath(id, path, body, etag, change)
+	case r.Method == http.MethodDelete:
+		err = h.caddyConfigSvc.DeleteConfigPath(id, path, etag, change)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	details := fmt.Sprintf("%s %s", r.Method, path)
+	if r.Method != http.MethodDelete {
+		details += fmt.Sprintf(" (%d bytes)", len(body))
+	}
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionEditConfigPath, InstanceID: id, Details: details}, err)
+	if err != nil {
+		configPathError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
+
+// configPathError reports a failed config path request: a stale ETag as 412
+// Precondition Failed, a path or value the instance rejected with the
+// instance's status, and anything else as an internal error
+func configPathError(w http.ResponseWriter, err error) {
+	if errors.Is(err, caddy.ErrConfigConflict) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	var pathErr *caddy.PathError
+	if errors.As(err, &pathErr) && pathErr.StatusCode >= 400 && pathErr.StatusCode < 500 {
+		http.Error(w, err.Error(), pathErr.StatusCode)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
 // APIInstanceStartHandler starts a Caddy instance
@@ -471,6 +2659,9 @@ func (h *Handlers) APIInstanceStartHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	vars := mux.Vars(r)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionStartServer, InstanceID: vars["id"], Details: "pending"}, nil)
+
 	// Note: Starting Caddy requires the binary to be available
 	// This is a placeholder - actual implementation depends on deployment
 	w.Header().Set("Content-Type", "application/json")
@@ -490,7 +2681,9 @@ func (h *Handlers) APIInstanceStopHandler(w http.ResponseWriter, r *http.Request
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := h.caddyConfigSvc.StopServer(id); err != nil {
+	err := h.caddyConfigSvc.StopServer(id)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionStopServer, InstanceID: id}, err)
+	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
@@ -512,14 +2705,20 @@ func (h *Handlers) APIInstanceRestartHandler(w http.ResponseWriter, r *http.Requ
 	id := vars["id"]
 
 	// Stop first
+	entry := caddy.AuditEntry{Action: caddy.ActionRestartServer, InstanceID: id, Details: "stop"}
 	if err := h.caddyConfigSvc.StopServer(id); err != nil {
 		// Try reload as fallback
-		if reloadErr := h.caddyConfigSvc.ReloadConfig(id, nil); reloadErr != nil {
+		entry.Details = "reload after stop failed: " + err.Error()
+		reloadErr := h.caddyConfigSvc.ReloadConfig(id, nil, configChange(r, "Reload during restart"))
+		h.audit(r, entry, reloadErr)
+		if reloadErr != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(map[string]string{"error": reloadErr.Error()})
 			return
 		}
+	} else {
+		h.audit(r, entry, nil)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -569,13 +2768,37 @@ func (h *Handlers) APIInstanceCreateSiteHandler(w http.ResponseWriter, r *http.R
 	var req struct {
 		SiteName string                 `json:"site_name"`
 		Config   map[string]interface{} `json:"config"`
+		Template string                 `json:"template"`
+		Params   caddy.SiteParams       `json:"params"`
+		Message  string                 `json:"message"`
 	}
 	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if err := h.caddyConfigSvc.CreateSite(id, req.SiteName, req.Config); err != nil {
+	// A template builds the site from typed parameters instead of raw JSON
+	if req.Template != "" {
+		preview, err := h.caddyConfigSvc.CreateSiteFromTemplate(id, req.Template, req.Params, configChange(r, req.Message))
+		details := fmt.Sprintf("%s template for %s", req.Template, strings.Join(req.Params.Hosts, ", "))
+		if preview != nil {
+			details += " in " + preview.Server
+		}
+		h.audit(r, caddy.AuditEntry{Action: caddy.ActionCreateSite, InstanceID: id, Details: details}, err)
+		if err != nil {
+			siteTemplateError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(preview)
+		return
+	}
+
+	err = h.caddyConfigSvc.CreateSite(id, req.SiteName, req.Config, configChange(r, req.Message))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionCreateSite, InstanceID: id, Details: req.SiteName}, err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -585,6 +2808,66 @@ func (h *Handlers) APIInstanceCreateSiteHandler(w http.ResponseWriter, r *http.R
 	json.NewEncoder(w).Encode(map[string]string{"status": "created"})
 }
 
+// APISiteTemplatesHandler lists the templates sites can be created from,
+// with the parameters each takes
+func (h *Handlers) APISiteTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	templates := h.caddyConfigSvc.SiteTemplates()
+	infos := make([]caddy.SiteTemplateInfo, 0, len(templates))
+	for _, t := range templates {
+		infos = append(infos, t.Info())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// APIInstancePreviewSiteHandler shows the route, TLS policy and config plan
+// that creating a site from a template would produce, without applying it.
+// The body is {"template": "...", "params": {...}}.
+func (h *Handlers) APIInstancePreviewSiteHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	var req struct {
+		Template string           `json:"template"`
+		Params   caddy.SiteParams `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	preview, err := h.caddyConfigSvc.PreviewSite(vars["id"], req.Template, req.Params)
+	if err != nil {
+		siteTemplateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
+// siteTemplateError reports an unknown template as not found and parameters
+// the template can't use as a bad request
+func siteTemplateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, caddy.ErrTemplateNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, caddy.ErrInvalidSite):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // APIInstanceDeleteSiteHandler deletes a site
 func (h *Handlers) APIInstanceDeleteSiteHandler(w http.ResponseWriter, r *http.Request) {
 	if h.caddyConfigSvc == nil {
@@ -596,7 +2879,9 @@ func (h *Handlers) APIInstanceDeleteSiteHandler(w http.ResponseWriter, r *http.R
 	id := vars["id"]
 	siteName := vars["site"]
 
-	if err := h.caddyConfigSvc.DeleteSite(id, siteName); err != nil {
+	err := h.caddyConfigSvc.DeleteSite(id, siteName, configChange(r, r.URL.Query().Get("message")))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionDeleteSite, InstanceID: id, Details: siteName}, err)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -604,6 +2889,242 @@ func (h *Handlers) APIInstanceDeleteSiteHandler(w http.ResponseWriter, r *http.R
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// APIInstanceRoutesHandler returns the routes of a site, with the ETag of the
+// route list. Sending the ETag back as If-Match with a route change makes it
+// fail with 412 Precondition Failed if the routes have changed since.
+func (h *Handlers) APIInstanceRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	routes, etag, err := h.caddyConfigSvc.ListRoutes(vars["id"], vars["site"])
+	if err != nil {
+		routeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	json.NewEncoder(w).Encode(routes)
+}
+
+// APIInstanceAddRouteHandler adds the route in the request body to a site,
+// after its other routes or before the query parameter index
+func (h *Handlers) APIInstanceAddRouteHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, site := vars["id"], vars["site"]
+
+	route, ok := decodeRoute(w, r)
+	if !ok {
+		return
+	}
+	index := -1
+	if v := r.URL.Query().Get("index"); v != "" {
+		var err error
+		if index, err = strconv.Atoi(v); err != nil || index < 0 {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.caddyConfigSvc.AddRoute(id, site, route, index, r.Header.Get("If-Match"), configChange(r, r.URL.Query().Get("message")))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionAddRoute, InstanceID: id, Details: routeDetails(site, index, &route)}, err)
+	if err != nil {
+		routeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "created"})
+}
+
+// APIInstanceUpdateRouteHandler replaces a route of a site with the route in
+// the request body
+func (h *Handlers) APIInstanceUpdateRouteHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, site := vars["id"], vars["site"]
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid route index", http.StatusBadRequest)
+		return
+	}
+
+	route, ok := decodeRoute(w, r)
+	if !ok {
+		return
+	}
+
+	err = h.caddyConfigSvc.UpdateRoute(id, site, index, route, r.Header.Get("If-Match"), configChange(r, r.URL.Query().Get("message")))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionUpdateRoute, InstanceID: id, Details: routeDetails(site, index, &route)}, err)
+	if err != nil {
+		routeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
+
+// APIInstanceMoveRouteHandler moves a route of a site to the position given
+// as {"to": n} in the request body
+func (h *Handlers) APIInstanceMoveRouteHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, site := vars["id"], vars["site"]
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid route index", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		To      *int   `json:"to"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.To == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err = h.caddyConfigSvc.MoveRoute(id, site, index, *req.To, r.Header.Get("If-Match"), configChange(r, req.Message))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionMoveRoute, InstanceID: id, Details: fmt.Sprintf("%s route %d to %d", site, index, *req.To)}, err)
+	if err != nil {
+		routeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "moved"})
+}
+
+// APIInstanceEnableRouteHandler enables a disabled route of a site
+func (h *Handlers) APIInstanceEnableRouteHandler(w http.ResponseWriter, r *http.Request) {
+	h.setRouteEnabled(w, r, true)
+}
+
+// APIInstanceDisableRouteHandler disables a route of a site. The route stays
+// in the config but no longer matches any request.
+func (h *Handlers) APIInstanceDisableRouteHandler(w http.ResponseWriter, r *http.Request) {
+	h.setRouteEnabled(w, r, false)
+}
+
+func (h *Handlers) setRouteEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, site := vars["id"], vars["site"]
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid route index", http.StatusBadRequest)
+		return
+	}
+
+	action, status := caddy.ActionEnableRoute, "enabled"
+	if !enabled {
+		action, status = caddy.ActionDisableRoute, "disabled"
+	}
+	err = h.caddyConfigSvc.SetRouteEnabled(id, site, index, enabled, r.Header.Get("If-Match"), configChange(r, r.URL.Query().Get("message")))
+	h.audit(r, caddy.AuditEntry{Action: action, InstanceID: id, Details: fmt.Sprintf("%s route %d", site, index)}, err)
+	if err != nil {
+		routeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// APIInstanceDeleteRouteHandler deletes a route of a site
+func (h *Handlers) APIInstanceDeleteRouteHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, site := vars["id"], vars["site"]
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid route index", http.StatusBadRequest)
+		return
+	}
+
+	err = h.caddyConfigSvc.DeleteRoute(id, site, index, r.Header.Get("If-Match"), configChange(r, r.URL.Query().Get("message")))
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionDeleteRoute, InstanceID: id, Details: fmt.Sprintf("%s route %d", site, index)}, err)
+	if err != nil {
+		routeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeRoute reads and validates the route in the request body, writing a
+// bad request if it is invalid
+func decodeRoute(w http.ResponseWriter, r *http.Request) (caddy.Route, bool) {
+	var route caddy.Route
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		http.Error(w, "Invalid route", http.StatusBadRequest)
+		return route, false
+	}
+	if err := route.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return route, false
+	}
+	return route, true
+}
+
+// routeDetails describes a route change for the audit log
+func routeDetails(site string, index int, route *caddy.Route) string {
+	details := site + " route"
+	if index >= 0 {
+		details += fmt.Sprintf(" %d", index)
+	}
+	if hosts := route.Hosts(); len(hosts) > 0 {
+		details += " for " + strings.Join(hosts, ", ")
+	}
+	handlers := make([]string, 0, len(route.Handle))
+	for _, handler := range route.Handle {
+		handlers = append(handlers, handler.Name())
+	}
+	if len(handlers) > 0 {
+		details += " (" + strings.Join(handlers, ", ") + ")"
+	}
+	return details
+}
+
+// routeError reports a failed route request: a missing route as not found,
+// otherwise like any other config path failure
+func routeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, caddy.ErrRouteNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	configPathError(w, err)
+}
+
 // APIInstanceHealthHandler returns health status for a Caddy instance
 func (h *Handlers) APIInstanceHealthHandler(w http.ResponseWriter, r *http.Request) {
 	if h.caddyConfigSvc == nil {
@@ -648,6 +3169,7 @@ func (h *Handlers) APIInstanceCaddyfileHandler(w http.ResponseWriter, r *http.Re
 	id := vars["id"]
 
 	caddyfile, err := h.caddyConfigSvc.GetCaddyfile(id)
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionViewConfig, InstanceID: id, Details: "caddyfile"}, err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -656,3 +3178,114 @@ func (h *Handlers) APIInstanceCaddyfileHandler(w http.ResponseWriter, r *http.Re
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write([]byte(caddyfile))
 }
+
+// APIInstanceAdaptCaddyfileHandler converts the Caddyfile in the request body
+// to JSON config with the instance's adapter, without applying it
+func (h *Handlers) APIInstanceAdaptCaddyfileHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	result, err := h.caddyConfigSvc.AdaptCaddyfile(vars["id"], body)
+	if err != nil {
+		adaptError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// APIInstanceUpdateCaddyfileHandler adapts the Caddyfile in the request body
+// and loads the result onto the instance. The query parameter message
+// describes the change.
+func (h *Handlers) APIInstanceUpdateCaddyfileHandler(w http.ResponseWriter, r *http.Request) {
+	if h.caddyConfigSvc == nil {
+		http.Error(w, "Caddy service not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	result, err := h.caddyConfigSvc.UpdateCaddyfile(id, body, configChange(r, r.URL.Query().Get("message")))
+	details := fmt.Sprintf("caddyfile (%d bytes)", len(body))
+	if result != nil {
+		details += fmt.Sprintf(", %d warnings", len(result.Warnings))
+	}
+	h.audit(r, caddy.AuditEntry{Action: caddy.ActionUpdateCaddyfile, InstanceID: id, Details: details}, err)
+	if err != nil {
+		adaptError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "reloaded",
+		"warnings": result.Warnings,
+	})
+}
+
+// APIFormatCaddyfileHandler reformats the Caddyfile in the request body. It
+// works without contacting the instance, so offline instances can be edited.
+func (h *Handlers) APIFormatCaddyfileHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	formatted, err := caddyfile.Format(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"caddyfile": string(formatted),
+		"changed":   string(formatted) != string(body),
+	})
+}
+
+// APILintCaddyfileHandler returns diagnostics with line and column positions
+// for the Caddyfile in the request body, without contacting the instance
+func (h *Handlers) APILintCaddyfileHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caddyfile.Lint(body))
+}
+
+// adaptError writes a Caddyfile the adapter rejected as a bad request, and
+// any other failure as an internal error
+func adaptError(w http.ResponseWriter, err error) {
+	var adaptErr *caddy.AdaptError
+	if errors.As(err, &adaptErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
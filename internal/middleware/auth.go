@@ -2,17 +2,52 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"godash/internal/models"
 	"godash/internal/services"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
 
+// ChangePasswordPath is the page users who must change their password are
+// sent to; until they do, every other protected page redirects there
+const ChangePasswordPath = "/account/password"
+
+// TwoFactorPath is the page users who must enroll in two-factor
+// authentication are sent to; until they do, every other protected page
+// redirects there
+const TwoFactorPath = "/account/2fa"
+
+// pendingLoginTTL is how long the second step of a login may take after the
+// password was checked
+const pendingLoginTTL = 5 * time.Minute
+
+// Login errors
+var (
+	// ErrSecondFactorRequired is returned by Login when the password was
+	// right and CompleteLogin must check a code before the user is logged in
+	ErrSecondFactorRequired = errors.New("second factor required")
+	// ErrNoPendingLogin is returned by CompleteLogin without a recent Login
+	ErrNoPendingLogin = errors.New("the login has expired, sign in again")
+)
+
 // AuthMiddleware handles authentication
 type AuthMiddleware struct {
-	store       *sessions.CookieStore
-	userService *services.UserService
+	store        *sessions.CookieStore
+	userService  *services.UserService
+	rbac         *services.RBACService
+	tokens       *services.TokenService
+	instanceTags func(id string) ([]string, bool)
+
+	// rememberDevice is how long a device skips the second factor after
+	// "remember this device" (0 disables it)
+	rememberDevice time.Duration
 }
 
 // NewAuthMiddleware creates a new authentication middleware
@@ -23,9 +58,21 @@ func NewAuthMiddleware(secretKey string, userService *services.UserService) *Aut
 	}
 }
 
-// RequireAuth is middleware that requires authentication
+// RequireAuth is middleware that requires authentication, by session or,
+// for API requests, by an "Authorization: Bearer" API token
 func (m *AuthMiddleware) RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Nested middleware doesn't authenticate again
+		if GetCurrentUser(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if raw, ok := bearerToken(r); ok {
+			m.authenticateToken(w, r, raw, next)
+			return
+		}
+
 		session, _ := m.store.Get(r, "session")
 		
 		userID, ok := session.Values["user_id"].(int)
@@ -54,12 +101,77 @@ func (m *AuthMiddleware) RequireAuth(next http.Handler) http.Handler {
 			return
 		}
 		
+		if user.MustChangePassword && r.URL.Path != ChangePasswordPath {
+			if isAPIRequest(r) {
+				http.Error(w, "Password change required", http.StatusForbidden)
+				return
+			}
+			http.Redirect(w, r, ChangePasswordPath, http.StatusFound)
+			return
+		}
+
+		if m.userService.NeedsTOTPEnrollment(user) && !isTwoFactorSetup(r) {
+			if isAPIRequest(r) {
+				http.Error(w, "Two-factor enrollment required", http.StatusForbidden)
+				return
+			}
+			http.Redirect(w, r, TwoFactorPath, http.StatusFound)
+			return
+		}
+
 		// Add user to context
 		ctx := context.WithValue(r.Context(), "user", user)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// authenticateToken serves an API request made with an API token on behalf
+// of the token's user
+func (m *AuthMiddleware) authenticateToken(w http.ResponseWriter, r *http.Request, raw string, next http.Handler) {
+	if m.tokens == nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, "API tokens are only accepted by the API", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := m.tokens.Authenticate(raw, ClientIP(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := m.userService.GetByID(token.UserID)
+	if err != nil || !user.Active {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.MustChangePassword {
+		http.Error(w, "Password change required", http.StatusForbidden)
+		return
+	}
+	if m.userService.NeedsTOTPEnrollment(user) {
+		http.Error(w, "Two-factor enrollment required", http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), "user", user)
+	ctx = context.WithValue(ctx, "api_token", token)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireSession is middleware that refuses requests made with an API
+// token, for account changes that need the user themselves, like creating
+// tokens or changing the password
+func (m *AuthMiddleware) RequireSession(next http.Handler) http.Handler {
+	return m.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetCurrentToken(r) != nil {
+			http.Error(w, "Not allowed with an API token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
 // RequireAdmin is middleware that requires admin privileges
 func (m *AuthMiddleware) RequireAdmin(next http.Handler) http.Handler {
 	return m.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -78,24 +190,204 @@ func (m *AuthMiddleware) RequireAdmin(next http.Handler) http.Handler {
 	}))
 }
 
-// Login authenticates a user and creates a session
+// SetRBAC enables permission checks against roles and role bindings.
+// Without it only admins pass RequirePermission.
+func (m *AuthMiddleware) SetRBAC(rbac *services.RBACService) {
+	m.rbac = rbac
+}
+
+// SetTokenService enables authentication with API tokens
+func (m *AuthMiddleware) SetTokenService(tokens *services.TokenService) {
+	m.tokens = tokens
+}
+
+// SetRememberDevice sets how long a device skips the second factor after
+// the user ticks "remember this device"; 0 disables remembering devices
+func (m *AuthMiddleware) SetRememberDevice(d time.Duration) {
+	m.rememberDevice = d
+}
+
+// RememberDeviceDuration returns how long a device skips the second factor
+// after "remember this device", or 0 if devices aren't remembered
+func (m *AuthMiddleware) RememberDeviceDuration() time.Duration {
+	return m.rememberDevice
+}
+
+// SetInstanceTags sets how the tags of an instance are looked up, so role
+// bindings scoped to tags apply to it
+func (m *AuthMiddleware) SetInstanceTags(lookup func(id string) ([]string, bool)) {
+	m.instanceTags = lookup
+}
+
+// RequirePermission is middleware that requires the current user to hold
+// perm. On routes with an {id} variable it must be held on that instance;
+// elsewhere holding it on any instance is enough and handlers filter what
+// they return.
+func (m *AuthMiddleware) RequirePermission(perm models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return m.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetCurrentUser(r)
+
+			var allowed bool
+			if id, ok := mux.Vars(r)["id"]; ok {
+				allowed = m.Can(r, perm, id)
+			} else if !tokenAllows(r, perm) {
+				allowed = false
+			} else if m.rbac != nil {
+				allowed = m.rbac.CanAnywhere(user, perm)
+			} else {
+				allowed = user.IsAdmin()
+			}
+
+			if !allowed {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// RequireGlobalPermission is middleware that requires the current user to
+// hold perm on the dashboard as a whole, not just on some instances
+func (m *AuthMiddleware) RequireGlobalPermission(perm models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return m.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.Can(r, perm, "") {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// Can reports whether the current user holds perm on the instance with the
+// given ID, or on the dashboard as a whole for an empty ID. Unknown
+// instances need the permission on the dashboard as a whole. Requests made
+// with an API token also need perm among the token's scopes.
+func (m *AuthMiddleware) Can(r *http.Request, perm models.Permission, instanceID string) bool {
+	user := GetCurrentUser(r)
+	if user == nil || !tokenAllows(r, perm) {
+		return false
+	}
+	if m.rbac == nil {
+		return user.IsAdmin()
+	}
+
+	var tags []string
+	if instanceID != "" && m.instanceTags != nil {
+		var ok bool
+		if tags, ok = m.instanceTags(instanceID); !ok {
+			instanceID = ""
+		}
+	}
+	return m.rbac.Can(user, perm, instanceID, tags)
+}
+
+// Login checks a user's password and creates a session. For users with
+// two-factor authentication it returns ErrSecondFactorRequired instead,
+// unless the device is remembered, and the session only holds the pending
+// login until CompleteLogin checks a code.
 func (m *AuthMiddleware) Login(w http.ResponseWriter, r *http.Request, username, password string) error {
 	user, err := m.userService.Authenticate(username, password)
 	if err != nil {
 		return err
 	}
-	
+
 	session, _ := m.store.Get(r, "session")
+	if user.TOTPEnabled && !m.deviceRemembered(r, user) {
+		session.Values["user_id"] = nil
+		session.Values["pending_user_id"] = user.ID
+		session.Values["pending_at"] = time.Now().Unix()
+		session.Save(r, w)
+		return ErrSecondFactorRequired
+	}
+
 	session.Values["user_id"] = user.ID
 	session.Save(r, w)
-	
 	return nil
 }
 
+// PendingUser returns the user whose login waits for a second factor, or nil
+func (m *AuthMiddleware) PendingUser(r *http.Request) *models.User {
+	session, _ := m.store.Get(r, "session")
+	userID, ok := session.Values["pending_user_id"].(int)
+	at, _ := session.Values["pending_at"].(int64)
+	if !ok || time.Since(time.Unix(at, 0)) > pendingLoginTTL {
+		return nil
+	}
+	user, err := m.userService.GetByID(userID)
+	if err != nil || !user.Active {
+		return nil
+	}
+	return user
+}
+
+// CompleteLogin finishes a login started by Login with a code from the
+// user's authenticator app or a recovery code, which recovery reports. With
+// remember the device skips the second factor for a while. The pending user
+// is returned even when the code is wrong, so the attempt can be audited.
+func (m *AuthMiddleware) CompleteLogin(w http.ResponseWriter, r *http.Request, code string, remember bool) (user *models.User, recovery bool, err error) {
+	user = m.PendingUser(r)
+	if user == nil {
+		return nil, false, ErrNoPendingLogin
+	}
+
+	recovery, err = m.userService.VerifySecondFactor(user.ID, code)
+	if err != nil {
+		return user, false, err
+	}
+
+	session, _ := m.store.Get(r, "session")
+	delete(session.Values, "pending_user_id")
+	delete(session.Values, "pending_at")
+	session.Values["user_id"] = user.ID
+	session.Save(r, w)
+
+	if remember && m.rememberDevice > 0 {
+		// Read the user again; the code check changed it
+		if current, err := m.userService.GetByID(user.ID); err == nil {
+			m.rememberThisDevice(w, r, current)
+		}
+	}
+	return user, recovery, nil
+}
+
+// rememberThisDevice sets a signed cookie that lets the user skip the
+// second factor on this device until it expires or the user's devices are
+// forgotten, which bumps their device epoch
+func (m *AuthMiddleware) rememberThisDevice(w http.ResponseWriter, r *http.Request, user *models.User) {
+	device, _ := m.store.Get(r, "device")
+	expires := time.Now().Add(m.rememberDevice)
+	device.Values[fmt.Sprintf("u%d", user.ID)] = fmt.Sprintf("%d:%d", user.DeviceEpoch, expires.Unix())
+	device.Options.MaxAge = int(m.rememberDevice.Seconds())
+	device.Options.HttpOnly = true
+	device.Save(r, w)
+}
+
+// deviceRemembered reports whether the request comes from a device the user
+// asked to remember
+func (m *AuthMiddleware) deviceRemembered(r *http.Request, user *models.User) bool {
+	if m.rememberDevice <= 0 {
+		return false
+	}
+	device, _ := m.store.Get(r, "device")
+	value, _ := device.Values[fmt.Sprintf("u%d", user.ID)].(string)
+	var epoch int
+	var expires int64
+	if _, err := fmt.Sscanf(value, "%d:%d", &epoch, &expires); err != nil {
+		return false
+	}
+	return epoch == user.DeviceEpoch && time.Now().Unix() < expires
+}
+
 // Logout destroys the user session
 func (m *AuthMiddleware) Logout(w http.ResponseWriter, r *http.Request) {
 	session, _ := m.store.Get(r, "session")
 	session.Values["user_id"] = nil
+	delete(session.Values, "pending_user_id")
+	delete(session.Values, "pending_at")
 	session.Save(r, w)
 }
 
@@ -108,6 +400,48 @@ func GetCurrentUser(r *http.Request) *models.User {
 	return user
 }
 
+// GetCurrentToken returns the API token the current request was made with,
+// or nil for requests made with a session
+func GetCurrentToken(r *http.Request) *models.APIToken {
+	token, ok := r.Context().Value("api_token").(*models.APIToken)
+	if !ok {
+		return nil
+	}
+	return token
+}
+
+// tokenAllows reports whether the request's API token, if any, has perm
+// among its scopes
+func tokenAllows(r *http.Request, perm models.Permission) bool {
+	token := GetCurrentToken(r)
+	return token == nil || token.Has(perm)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// ClientIP returns the address of the connecting client
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isTwoFactorSetup reports whether the request is for the page or API that
+// sets up two-factor authentication
+func isTwoFactorSetup(r *http.Request) bool {
+	return r.URL.Path == TwoFactorPath || strings.HasPrefix(r.URL.Path, "/api/account/2fa")
+}
+
 // isAPIRequest checks if the request is an API request
 func isAPIRequest(r *http.Request) bool {
 	return r.Header.Get("Content-Type") == "application/json" ||
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"godash/internal/models"
+	"godash/internal/services"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateToken(t *testing.T) {
+	dir := t.TempDir()
+	store, err := services.NewFileUserStore(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := services.NewUserService(store, services.PasswordPolicy{})
+	tokens, err := services.NewTokenService(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newUser := func(name string, active, mustChange bool) *models.User {
+		u := models.NewUser(name, name+"@example.com", models.RoleUser)
+		u.Active = active
+		u.MustChangePassword = mustChange
+		if err := users.Create(u, "Test-Pass-1234"); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	newToken := func(user *models.User, allowedIPs []string, expiresAt *time.Time) string {
+		raw, _, err := tokens.Create(user.ID, "test", []models.Permission{models.PermInstanceRead}, allowedIPs, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	alice := newUser("alice", true, false)
+	open := newToken(alice, nil, nil)
+	restricted := newToken(alice, []string{"203.0.113.7", "10.1.0.0/16"}, nil)
+	soon := time.Now().Add(50 * time.Millisecond)
+	expired := newToken(alice, nil, &soon)
+	inactive := newToken(newUser("bob", false, false), nil, nil)
+	mustChange := newToken(newUser("carol", true, true), nil, nil)
+	time.Sleep(time.Until(soon))
+
+	m := NewAuthMiddleware("test-secret", users)
+	m.SetTokenService(tokens)
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		addr   string
+		noAPI  bool // Without a token service
+		status int
+	}{
+		{name: "API request", path: "/api/caddy/instances", token: open, addr: "198.51.100.1:4000", status: http.StatusOK},
+		{name: "page request", path: "/instances", token: open, addr: "198.51.100.1:4000", status: http.StatusUnauthorized},
+		{name: "path only starting like the API", path: "/apix", token: open, addr: "198.51.100.1:4000", status: http.StatusUnauthorized},
+		{name: "tokens not enabled", path: "/api/caddy/instances", token: open, addr: "198.51.100.1:4000", noAPI: true, status: http.StatusUnauthorized},
+		{name: "allowed address", path: "/api/caddy/instances", token: restricted, addr: "203.0.113.7:4000", status: http.StatusOK},
+		{name: "inside allowed range", path: "/api/caddy/instances", token: restricted, addr: "10.1.2.3:4000", status: http.StatusOK},
+		{name: "outside allowlist", path: "/api/caddy/instances", token: restricted, addr: "10.2.0.1:4000", status: http.StatusUnauthorized},
+		{name: "expired", path: "/api/caddy/instances", token: expired, addr: "198.51.100.1:4000", status: http.StatusUnauthorized},
+		{name: "unknown token", path: "/api/caddy/instances", token: services.TokenPrefix + "unknown", addr: "198.51.100.1:4000", status: http.StatusUnauthorized},
+		{name: "inactive user", path: "/api/caddy/instances", token: inactive, addr: "198.51.100.1:4000", status: http.StatusUnauthorized},
+		{name: "password change required", path: "/api/caddy/instances", token: mustChange, addr: "198.51.100.1:4000", status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := m
+			if tt.noAPI {
+				mw = NewAuthMiddleware("test-secret", users)
+			}
+
+			var gotUser *models.User
+			var gotToken *models.APIToken
+			handler := mw.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser, gotToken = GetCurrentUser(r), GetCurrentToken(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.addr
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				if gotUser != nil {
+					t.Error("rejected request reached the handler")
+				}
+				return
+			}
+			if gotUser == nil || gotUser.ID != alice.ID || gotToken == nil {
+				t.Errorf("handler got user %v and token %v, want alice and her token", gotUser, gotToken)
+			}
+		})
+	}
+}
@@ -45,12 +45,13 @@ type SystemStats struct {
 
 // Widget types
 const (
-	WidgetTypeChart     = "chart"
-	WidgetTypeTable     = "table"
-	WidgetTypeMetric    = "metric"
-	WidgetTypeText      = "text"
-	WidgetTypeActivity  = "activity"
-	WidgetTypeProgress  = "progress"
+	WidgetTypeChart    = "chart"
+	WidgetTypeTable    = "table"
+	WidgetTypeMetric   = "metric"
+	WidgetTypeText     = "text"
+	WidgetTypeActivity = "activity"
+	WidgetTypeProgress = "progress"
+	WidgetTypeHeatmap  = "heatmap"
 )
 
 // ChartData represents data for chart widgets
@@ -67,6 +68,14 @@ type Dataset struct {
 	BorderColor     string    `json:"borderColor,omitempty"`
 }
 
+// HeatmapData represents data for heatmap widgets
+type HeatmapData struct {
+	XLabels []string    `json:"x_labels"` // Column labels, usually timestamps
+	YLabels []string    `json:"y_labels"` // Row labels, usually bucket bounds, lowest first
+	Values  [][]float64 `json:"values"`   // Values[x][y]
+	Unit    string      `json:"unit,omitempty"`
+}
+
 // TableData represents data for table widgets
 type TableData struct {
 	Headers []string        `json:"headers"`
@@ -103,4 +112,4 @@ type ProgressData struct {
 	Max         float64 `json:"max"`         // Maximum value
 	Label       string  `json:"label"`       // Progress label
 	Description string  `json:"description"` // Additional description
-}
\ No newline at end of file
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// Permission is a single action a role can grant
+type Permission string
+
+// Permission constants
+const (
+	PermInstanceRead   Permission = "instance.read"   // View instances, their status, metrics and analytics
+	PermInstanceManage Permission = "instance.manage" // Add, edit and delete instances
+	PermConfigRead     Permission = "config.read"     // View configs, history and diffs
+	PermConfigWrite    Permission = "config.write"    // Change configs, sites and routes, and roll back
+	PermServerReload   Permission = "server.reload"   // Reload the config
+	PermServerStop     Permission = "server.stop"     // Stop, start and restart servers
+	PermLogsRead       Permission = "logs.read"       // View and stream logs
+	PermAuditRead      Permission = "audit.read"      // View, export and verify the audit log
+	PermUsersManage    Permission = "users.manage"    // Manage users, roles and role bindings
+)
+
+// AllPermissions lists every permission in display order
+var AllPermissions = []Permission{
+	PermInstanceRead,
+	PermInstanceManage,
+	PermConfigRead,
+	PermConfigWrite,
+	PermServerReload,
+	PermServerStop,
+	PermLogsRead,
+	PermAuditRead,
+	PermUsersManage,
+}
+
+// Valid reports whether p is a known permission
+func (p Permission) Valid() bool {
+	return slices.Contains(AllPermissions, p)
+}
+
+// Global reports whether p applies to the whole dashboard rather than to
+// instances. Scoped role bindings never grant global permissions.
+func (p Permission) Global() bool {
+	return p == PermAuditRead || p == PermUsersManage
+}
+
+// Role is a named set of permissions
+type Role struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Permissions []Permission `json:"permissions"`
+	Builtin     bool         `json:"builtin,omitempty"`
+}
+
+// Has reports whether the role grants p
+func (r *Role) Has(p Permission) bool {
+	return slices.Contains(r.Permissions, p)
+}
+
+// RoleOperator is the built-in role for deployers who change configs and
+// control servers but don't manage instances or users
+const RoleOperator = "operator"
+
+// BuiltinRoles returns the roles every installation has. They can't be
+// changed or deleted.
+func BuiltinRoles() []Role {
+	return []Role{
+		{
+			Name:        RoleAdmin,
+			Description: "Full access, including users and the audit log",
+			Permissions: slices.Clone(AllPermissions),
+			Builtin:     true,
+		},
+		{
+			Name:        RoleOperator,
+			Description: "Change configs and control servers",
+			Permissions: []Permission{PermInstanceRead, PermConfigRead, PermConfigWrite, PermServerReload, PermServerStop, PermLogsRead},
+			Builtin:     true,
+		},
+		{
+			Name:        RoleUser,
+			Description: "Read-only access to instances, configs and logs",
+			Permissions: []Permission{PermInstanceRead, PermConfigRead, PermLogsRead},
+			Builtin:     true,
+		},
+	}
+}
+
+// RoleBinding grants a user a role in addition to their own. A binding
+// with instances or tags only applies to those instances and to instances
+// carrying one of the tags; one without either applies everywhere.
+type RoleBinding struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Role      string    `json:"role"`
+	Instances []string  `json:"instances,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Scoped reports whether the binding is limited to some instances
+func (b *RoleBinding) Scoped() bool {
+	return len(b.Instances) > 0 || len(b.Tags) > 0
+}
+
+// Covers reports whether the binding applies to the instance with the given
+// ID and tags. An empty instanceID stands for the dashboard as a whole,
+// which only unscoped bindings cover.
+func (b *RoleBinding) Covers(instanceID string, tags []string) bool {
+	if !b.Scoped() {
+		return true
+	}
+	if instanceID == "" {
+		return false
+	}
+	if slices.Contains(b.Instances, instanceID) {
+		return true
+	}
+	for _, tag := range tags {
+		if slices.Contains(b.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
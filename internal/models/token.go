@@ -0,0 +1,32 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// APIToken is a personal token for calling the API without a session. It
+// grants its scopes, but never more than its user may do.
+type APIToken struct {
+	ID         string       `json:"id"`
+	UserID     int          `json:"user_id"`
+	Name       string       `json:"name"`
+	Prefix     string       `json:"prefix"` // Start of the token, to tell tokens apart
+	Hash       string       `json:"-"`      // Never include token hashes in JSON output
+	Scopes     []Permission `json:"scopes"`
+	AllowedIPs []string     `json:"allowed_ips,omitempty"` // Addresses and CIDR ranges it may be used from; any if empty
+	ExpiresAt  *time.Time   `json:"expires_at,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastUsedAt *time.Time   `json:"last_used_at,omitempty"`
+	LastUsedIP string       `json:"last_used_ip,omitempty"`
+}
+
+// Has reports whether p is one of the token's scopes
+func (t *APIToken) Has(p Permission) bool {
+	return slices.Contains(t.Scopes, p)
+}
+
+// Expired reports whether the token has expired
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
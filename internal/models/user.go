@@ -6,14 +6,27 @@ import (
 
 // User represents a user in the system
 type User struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"` // Never include password in JSON output
-	Role      string    `json:"role"`
-	Active    bool      `json:"active"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                 int        `json:"id"`
+	Username           string     `json:"username"`
+	Email              string     `json:"email"`
+	PasswordHash       string     `json:"-"` // Never include password hashes in JSON output
+	Role               string     `json:"role"`
+	Active             bool       `json:"active"`
+	MustChangePassword bool       `json:"must_change_password"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+	PasswordChangedAt  *time.Time `json:"password_changed_at,omitempty"`
+	LastLoginAt        *time.Time `json:"last_login_at,omitempty"`
+	InviteTokenHash    string     `json:"-"`
+	InviteExpiresAt    *time.Time `json:"invite_expires_at,omitempty"` // Set while an invitation is pending
+
+	// Two-factor authentication
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPRequired  bool     `json:"totp_required"` // Set by an admin; the user must enroll before doing anything else
+	TOTPSecret    string   `json:"-"`             // Base32; set during enrollment before it is enabled
+	TOTPLastStep  int64    `json:"-"`             // Time step of the last accepted code, so codes can't be replayed
+	RecoveryCodes []string `json:"-"`             // Hashes of the unused recovery codes
+	DeviceEpoch   int      `json:"-"`             // Remembered devices from earlier epochs are forgotten
 }
 
 // UserRole constants
@@ -22,13 +35,13 @@ const (
 	RoleUser  = "user"
 )
 
-// NewUser creates a new user instance
-func NewUser(username, email, password, role string) *User {
+// NewUser creates a new user instance. Its password is set when the user
+// service creates it.
+func NewUser(username, email, role string) *User {
 	now := time.Now()
 	return &User{
 		Username:  username,
 		Email:     email,
-		Password:  password, // Should be hashed before storing
 		Role:      role,
 		Active:    true,
 		CreatedAt: now,
@@ -36,7 +49,12 @@ func NewUser(username, email, password, role string) *User {
 	}
 }
 
+// IsInvited reports whether the user was invited and hasn't set a password yet
+func (u *User) IsInvited() bool {
+	return u.InviteExpiresAt != nil
+}
+
 // IsAdmin checks if the user has admin privileges
 func (u *User) IsAdmin() bool {
 	return u.Role == RoleAdmin
-}
\ No newline at end of file
+}
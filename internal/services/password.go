@@ -0,0 +1,181 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrWeakPassword is returned when a new password doesn't meet the password policy
+var ErrWeakPassword = errors.New("password does not meet the password policy")
+
+// PasswordPolicy is the set of rules new passwords are checked against.
+// Existing passwords keep working when the policy is tightened.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// Requirements describes the policy as a list of rules for display
+func (p PasswordPolicy) Requirements() []string {
+	reqs := []string{fmt.Sprintf("at least %d characters", p.minLength())}
+	if p.RequireUpper {
+		reqs = append(reqs, "an uppercase letter")
+	}
+	if p.RequireLower {
+		reqs = append(reqs, "a lowercase letter")
+	}
+	if p.RequireDigit {
+		reqs = append(reqs, "a digit")
+	}
+	if p.RequireSymbol {
+		reqs = append(reqs, "a symbol")
+	}
+	return append(reqs, "different from the username")
+}
+
+// Validate checks a new password for the given user against the policy. The
+// error wraps ErrWeakPassword and lists every rule the password breaks.
+func (p PasswordPolicy) Validate(password, username string) error {
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	var problems []string
+	if n := len([]rune(password)); n < p.minLength() {
+		problems = append(problems, fmt.Sprintf("be at least %d characters", p.minLength()))
+	}
+	if p.RequireUpper && !upper {
+		problems = append(problems, "contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		problems = append(problems, "contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "contain a symbol")
+	}
+	if username != "" && strings.EqualFold(password, username) {
+		problems = append(problems, "differ from the username")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: the password must %s", ErrWeakPassword, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// minLength is the configured minimum length, never less than 8
+func (p PasswordPolicy) minLength() int {
+	return max(p.MinLength, 8)
+}
+
+// argon2id parameters of new hashes. Hashes made with other parameters, or
+// with bcrypt, verify as before and are rehashed on the next login.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// hashPassword hashes a password with argon2id in the PHC string format,
+// e.g. "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>"
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks a password against a stored hash. rehash is true
+// when the password matched a hash that should be replaced by a current one.
+func verifyPassword(hash, password string) (ok, rehash bool, err error) {
+	switch {
+	case hash == "":
+		// Invited users have no password until they accept the invitation
+		return false, false, nil
+
+	case strings.HasPrefix(hash, "$argon2id$"):
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, false, errors.New("malformed argon2id hash")
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+			return false, false, fmt.Errorf("malformed argon2id hash: %w", err)
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, false, fmt.Errorf("malformed argon2id hash: %w", err)
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false, fmt.Errorf("malformed argon2id salt: %w", err)
+		}
+		want, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false, fmt.Errorf("malformed argon2id hash: %w", err)
+		}
+		if version != argon2.Version {
+			return false, false, fmt.Errorf("unsupported argon2 version %d", version)
+		}
+
+		got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			return false, false, nil
+		}
+		outdated := memory != argonMemory || time != argonTime || threads != argonThreads ||
+			len(salt) != argonSaltLen || len(want) != argonKeyLen
+		return true, outdated, nil
+
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+
+	return false, false, errors.New("unknown password hash format")
+}
+
+// generatePassword returns a random password for bootstrap and reset accounts
+func generatePassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argonHash hashes password with the given argon2id parameters
+func argonHash(password string, memory, time uint32, threads uint8) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestVerifyPassword(t *testing.T) {
+	current, err := hashPassword("s3cret-Pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("s3cret-Pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+		rehash   bool
+		err      bool
+	}{
+		{name: "argon2id", hash: current, password: "s3cret-Pass", ok: true},
+		{name: "argon2id wrong password", hash: current, password: "s3cret-pass"},
+		{name: "argon2id older parameters", hash: argonHash("s3cret-Pass", 32*1024, 2, 1), password: "s3cret-Pass", ok: true, rehash: true},
+		{name: "argon2id older parameters wrong password", hash: argonHash("s3cret-Pass", 32*1024, 2, 1), password: "other"},
+		{name: "bcrypt", hash: string(bcryptHash), password: "s3cret-Pass", ok: true, rehash: true},
+		{name: "bcrypt wrong password", hash: string(bcryptHash), password: "other"},
+		{name: "no password yet", hash: "", password: ""},
+		{name: "malformed argon2id", hash: "$argon2id$v=19$m=65536", password: "s3cret-Pass", err: true},
+		{name: "unsupported argon2 version", hash: strings.Replace(current, "v=19", "v=16", 1), password: "s3cret-Pass", err: true},
+		{name: "unknown format", hash: "plaintext", password: "plaintext", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := verifyPassword(tt.hash, tt.password)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("ok=%v rehash=%v, want ok=%v rehash=%v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	a, err := hashPassword("s3cret-Pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hashPassword("s3cret-Pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a, "$argon2id$") {
+		t.Errorf("hash %q isn't argon2id", a)
+	}
+	if a == b {
+		t.Error("two hashes of the same password are equal; the salt isn't random")
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	strict := PasswordPolicy{MinLength: 12, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		username string
+		problems []string // Substrings of the error, none if valid
+	}{
+		{name: "default minimum of 8", policy: PasswordPolicy{MinLength: 4}, password: "short", problems: []string{"at least 8 characters"}},
+		{name: "long enough", policy: PasswordPolicy{}, password: "longenough"},
+		{name: "strict valid", policy: strict, password: "Correct-Horse-9"},
+		{name: "strict missing classes", policy: strict, password: "correcthorsebattery", problems: []string{"uppercase", "digit", "symbol"}},
+		{name: "length counts runes", policy: PasswordPolicy{}, password: "äöüäöüä", problems: []string{"at least 8 characters"}},
+		{name: "same as username", policy: PasswordPolicy{}, password: "Administrator", username: "administrator", problems: []string{"differ from the username"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate(tt.password, tt.username)
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrWeakPassword) {
+				t.Fatalf("err = %v, want ErrWeakPassword", err)
+			}
+			for _, p := range tt.problems {
+				if !strings.Contains(err.Error(), p) {
+					t.Errorf("error %q doesn't mention %q", err, p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"godash/internal/models"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RBAC errors
+var (
+	ErrRoleNotFound    = errors.New("role not found")
+	ErrBuiltinRole     = errors.New("built-in roles can't be changed")
+	ErrRoleInUse       = errors.New("role is still assigned")
+	ErrBindingNotFound = errors.New("role binding not found")
+	ErrInvalidRole     = errors.New("invalid role")
+	// ErrGrantDenied is returned for granting permissions the granter
+	// doesn't hold
+	ErrGrantDenied = errors.New("you can't grant permissions you don't hold")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// RBACService decides what users may do. A user's own role applies
+// everywhere; role bindings grant further roles, either everywhere or only
+// on some instances and tags. Custom roles and bindings are kept in a JSON
+// file next to the users.
+type RBACService struct {
+	filePath string
+	users    UserStore
+	mu       sync.RWMutex
+	roles    []models.Role // Custom roles; built-in ones aren't stored
+	bindings []models.RoleBinding
+}
+
+// rbacFile is the on-disk layout of the RBAC store
+type rbacFile struct {
+	Roles    []models.Role        `json:"roles"`
+	Bindings []models.RoleBinding `json:"bindings"`
+}
+
+// NewRBACService opens the RBAC store at filePath. users is consulted when
+// bindings are added and roles deleted.
+func NewRBACService(filePath string, users UserStore) (*RBACService, error) {
+	s := &RBACService{
+		filePath: filePath,
+		users:    users,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	if err := s.load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to load roles: %w", err)
+	}
+
+	return s, nil
+}
+
+// load reads the RBAC file
+func (s *RBACService) load() error {
+	data, err := os.ReadFile(s.filePath)
+	if err != nil {
+		return err
+	}
+
+	var file rbacFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse roles file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles = file.Roles
+	s.bindings = file.Bindings
+	return nil
+}
+
+// save writes the RBAC file; callers must hold s.mu
+func (s *RBACService) save() error {
+	data, err := json.MarshalIndent(rbacFile{Roles: s.roles, Bindings: s.bindings}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal roles: %w", err)
+	}
+
+	tmpPath := s.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.filePath); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	return nil
+}
+
+// Roles returns the built-in roles followed by the custom ones by name
+func (s *RBACService) Roles() []models.Role {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	custom := slices.Clone(s.roles)
+	sort.Slice(custom, func(i, j int) bool { return custom[i].Name < custom[j].Name })
+	return append(models.BuiltinRoles(), custom...)
+}
+
+// GetRole returns a role by name
+func (s *RBACService) GetRole(name string) (*models.Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if role := s.role(name); role != nil {
+		return role, nil
+	}
+	return nil, ErrRoleNotFound
+}
+
+// RoleExists reports whether a role is defined
+func (s *RBACService) RoleExists(name string) bool {
+	_, err := s.GetRole(name)
+	return err == nil
+}
+
+// role returns a copy of the named role or nil; callers must hold s.mu
+func (s *RBACService) role(name string) *models.Role {
+	for _, role := range models.BuiltinRoles() {
+		if role.Name == name {
+			return &role
+		}
+	}
+	for _, role := range s.roles {
+		if role.Name == name {
+			role.Permissions = slices.Clone(role.Permissions)
+			return &role
+		}
+	}
+	return nil
+}
+
+// SaveRole creates a custom role or replaces the one with the same name
+func (s *RBACService) SaveRole(role models.Role) (*models.Role, error) {
+	role.Name = strings.TrimSpace(role.Name)
+	role.Description = strings.TrimSpace(role.Description)
+	role.Builtin = false
+	if !roleNamePattern.MatchString(role.Name) {
+		return nil, fmt.Errorf("%w: name must be lowercase letters, digits, _ and -, starting with a letter", ErrInvalidRole)
+	}
+	var perms []models.Permission
+	for _, p := range role.Permissions {
+		if !p.Valid() {
+			return nil, fmt.Errorf("%w: unknown permission %q", ErrInvalidRole, p)
+		}
+		if !slices.Contains(perms, p) {
+			perms = append(perms, p)
+		}
+	}
+	role.Permissions = perms
+	if role.Permissions == nil {
+		role.Permissions = []models.Permission{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, builtin := range models.BuiltinRoles() {
+		if builtin.Name == role.Name {
+			return nil, ErrBuiltinRole
+		}
+	}
+
+	old := slices.Clone(s.roles)
+	i := slices.IndexFunc(s.roles, func(r models.Role) bool { return r.Name == role.Name })
+	if i >= 0 {
+		s.roles[i] = role
+	} else {
+		s.roles = append(s.roles, role)
+	}
+	if err := s.save(); err != nil {
+		s.roles = old
+		return nil, err
+	}
+	return &role, nil
+}
+
+// DeleteRole deletes a custom role that no user or binding refers to
+func (s *RBACService) DeleteRole(name string) error {
+	users, err := s.users.List()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.roles, func(r models.Role) bool { return r.Name == name })
+	if i < 0 {
+		if s.role(name) != nil {
+			return ErrBuiltinRole
+		}
+		return ErrRoleNotFound
+	}
+
+	for _, u := range users {
+		if u.Role == name {
+			return fmt.Errorf("%w: it is the role of %s", ErrRoleInUse, u.Username)
+		}
+	}
+	for _, b := range s.bindings {
+		if b.Role == name {
+			return fmt.Errorf("%w: it is bound to user %d", ErrRoleInUse, b.UserID)
+		}
+	}
+
+	old := slices.Clone(s.roles)
+	s.roles = slices.Delete(s.roles, i, i+1)
+	if err := s.save(); err != nil {
+		s.roles = old
+		return err
+	}
+	return nil
+}
+
+// Bindings returns the role bindings of a user, or all bindings for userID 0
+func (s *RBACService) Bindings(userID int) []models.RoleBinding {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var bindings []models.RoleBinding
+	for _, b := range s.bindings {
+		if userID == 0 || b.UserID == userID {
+			bindings = append(bindings, b)
+		}
+	}
+	return bindings
+}
+
+// AddBinding grants a user a role, optionally limited to instances and tags
+func (s *RBACService) AddBinding(b models.RoleBinding) (*models.RoleBinding, error) {
+	if _, err := s.users.GetByID(b.UserID); err != nil {
+		return nil, err
+	}
+	b.Instances = cleanList(b.Instances)
+	b.Tags = cleanList(b.Tags)
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	b.ID = hex.EncodeToString(id)
+	b.CreatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.role(b.Role) == nil {
+		return nil, ErrRoleNotFound
+	}
+
+	s.bindings = append(s.bindings, b)
+	if err := s.save(); err != nil {
+		s.bindings = s.bindings[:len(s.bindings)-1]
+		return nil, err
+	}
+	return &b, nil
+}
+
+// DeleteBinding removes a role binding
+func (s *RBACService) DeleteBinding(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.bindings, func(b models.RoleBinding) bool { return b.ID == id })
+	if i < 0 {
+		return ErrBindingNotFound
+	}
+
+	old := slices.Clone(s.bindings)
+	s.bindings = slices.Delete(s.bindings, i, i+1)
+	if err := s.save(); err != nil {
+		s.bindings = old
+		return err
+	}
+	return nil
+}
+
+// Can reports whether user holds perm on the instance with the given ID and
+// tags. An empty instanceID asks about the dashboard as a whole, which only
+// the user's own role and unscoped bindings grant.
+func (s *RBACService) Can(user *models.User, perm models.Permission, instanceID string, tags []string) bool {
+	if user == nil || !user.Active {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if role := s.role(user.Role); role != nil && role.Has(perm) {
+		return true
+	}
+	for _, b := range s.bindings {
+		if b.UserID != user.ID || (perm.Global() && b.Scoped()) || !b.Covers(instanceID, tags) {
+			continue
+		}
+		if role := s.role(b.Role); role != nil && role.Has(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAnywhere reports whether user holds perm on at least some instances.
+// It gates lists, which then only show what the user may see.
+func (s *RBACService) CanAnywhere(user *models.User, perm models.Permission) bool {
+	if user == nil || !user.Active {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if role := s.role(user.Role); role != nil && role.Has(perm) {
+		return true
+	}
+	for _, b := range s.bindings {
+		if b.UserID != user.ID || (perm.Global() && b.Scoped()) {
+			continue
+		}
+		if role := s.role(b.Role); role != nil && role.Has(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanGrant returns ErrGrantDenied unless granter holds every permission
+// the binding b would grant, on all of its scope
+func (s *RBACService) CanGrant(granter *models.User, b models.RoleBinding) error {
+	role, err := s.GetRole(b.Role)
+	if err != nil {
+		return err
+	}
+	return s.CanGrantPermissions(granter, role.Permissions, b)
+}
+
+// CanGrantPermissions returns ErrGrantDenied unless granter holds each of
+// perms wherever scope applies: everywhere for an unscoped binding, and on
+// each of its instances and tags otherwise. Held through a binding, an
+// instance or tag has to be listed in that binding; holding a permission on
+// an instance through one of its tags doesn't allow granting it by ID.
+// Global permissions aren't checked for scoped bindings, which never grant
+// them.
+func (s *RBACService) CanGrantPermissions(granter *models.User, perms []models.Permission, scope models.RoleBinding) error {
+	if granter == nil || !granter.Active {
+		return ErrGrantDenied
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, perm := range perms {
+		if perm.Global() && scope.Scoped() {
+			continue
+		}
+		if !s.holds(granter, perm, scope) {
+			return fmt.Errorf("%w: %s", ErrGrantDenied, perm)
+		}
+	}
+	return nil
+}
+
+// holds reports whether user holds perm wherever scope applies; callers
+// must hold s.mu
+func (s *RBACService) holds(user *models.User, perm models.Permission, scope models.RoleBinding) bool {
+	if role := s.role(user.Role); role != nil && role.Has(perm) {
+		return true
+	}
+
+	var held []models.RoleBinding
+	for _, b := range s.bindings {
+		if b.UserID != user.ID || (perm.Global() && b.Scoped()) {
+			continue
+		}
+		if role := s.role(b.Role); role == nil || !role.Has(perm) {
+			continue
+		}
+		if !b.Scoped() {
+			return true
+		}
+		held = append(held, b)
+	}
+	if !scope.Scoped() {
+		return false
+	}
+
+	for _, id := range scope.Instances {
+		if !slices.ContainsFunc(held, func(b models.RoleBinding) bool { return slices.Contains(b.Instances, id) }) {
+			return false
+		}
+	}
+	for _, tag := range scope.Tags {
+		if !slices.ContainsFunc(held, func(b models.RoleBinding) bool { return slices.Contains(b.Tags, tag) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// Permissions returns the permissions user holds on an instance, or on the
+// dashboard as a whole for an empty instanceID
+func (s *RBACService) Permissions(user *models.User, instanceID string, tags []string) []models.Permission {
+	perms := []models.Permission{}
+	for _, p := range models.AllPermissions {
+		if s.Can(user, p, instanceID, tags) {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+// cleanList trims the entries of a list and drops empty and repeated ones
+func cleanList(list []string) []string {
+	var out []string
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v != "" && !slices.Contains(out, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"godash/internal/models"
+	"path/filepath"
+	"testing"
+)
+
+// newTestRBAC returns an RBAC service with a user for each role in roles,
+// and the users by name
+func newTestRBAC(t *testing.T, roles map[string]string) (*RBACService, map[string]*models.User) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := NewFileUserStore(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]*models.User{}
+	for name, role := range roles {
+		u := models.NewUser(name, name+"@example.com", role)
+		if err := store.Create(u); err != nil {
+			t.Fatal(err)
+		}
+		users[name] = u
+	}
+	rbac, err := NewRBACService(filepath.Join(dir, "rbac.json"), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rbac, users
+}
+
+func addTestBinding(t *testing.T, rbac *RBACService, user *models.User, role string, instances, tags []string) {
+	t.Helper()
+	if _, err := rbac.AddBinding(models.RoleBinding{UserID: user.ID, Role: role, Instances: instances, Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCanGrant(t *testing.T) {
+	rbac, users := newTestRBAC(t, map[string]string{
+		"admin":    models.RoleAdmin,
+		"manager":  models.RoleUser,
+		"operator": models.RoleOperator,
+		"inactive": models.RoleAdmin,
+	})
+	if _, err := rbac.SaveRole(models.Role{Name: "user-manager", Permissions: []models.Permission{models.PermUsersManage}}); err != nil {
+		t.Fatal(err)
+	}
+	addTestBinding(t, rbac, users["manager"], "user-manager", nil, nil)
+	addTestBinding(t, rbac, users["manager"], models.RoleOperator, []string{"web1"}, nil)
+	addTestBinding(t, rbac, users["manager"], models.RoleOperator, nil, []string{"staging"})
+	users["inactive"].Active = false
+
+	tests := []struct {
+		granter string
+		role    string
+		scope   models.RoleBinding
+		allowed bool
+	}{
+		{"admin", models.RoleAdmin, models.RoleBinding{}, true},
+		{"admin", models.RoleOperator, models.RoleBinding{Tags: []string{"prod"}}, true},
+		{"inactive", models.RoleUser, models.RoleBinding{}, false},
+
+		// A delegated user manager can't make anyone an admin
+		{"manager", models.RoleAdmin, models.RoleBinding{}, false},
+		{"manager", models.RoleAdmin, models.RoleBinding{Instances: []string{"web1"}}, false},
+		{"manager", "user-manager", models.RoleBinding{}, true},
+		{"manager", models.RoleUser, models.RoleBinding{}, true},
+
+		// Operator is held on web1 and on instances tagged staging only
+		{"manager", models.RoleOperator, models.RoleBinding{}, false},
+		{"manager", models.RoleOperator, models.RoleBinding{Instances: []string{"web1"}}, true},
+		{"manager", models.RoleOperator, models.RoleBinding{Instances: []string{"web1", "web2"}}, false},
+		{"manager", models.RoleOperator, models.RoleBinding{Tags: []string{"staging"}}, true},
+		{"manager", models.RoleOperator, models.RoleBinding{Tags: []string{"prod"}}, false},
+		{"manager", models.RoleOperator, models.RoleBinding{Instances: []string{"web1"}, Tags: []string{"staging"}}, true},
+		{"manager", models.RoleOperator, models.RoleBinding{Instances: []string{"staging"}}, false},
+
+		// Scoped bindings don't grant audit.read or users.manage, so
+		// granting admin on an instance only needs its instance permissions
+		{"operator", models.RoleOperator, models.RoleBinding{Instances: []string{"web1"}}, true},
+		{"operator", models.RoleAdmin, models.RoleBinding{Instances: []string{"web1"}}, false},
+		{"operator", "user-manager", models.RoleBinding{Instances: []string{"web1"}}, true},
+		{"operator", "user-manager", models.RoleBinding{}, false},
+	}
+
+	for _, tt := range tests {
+		scope := tt.scope
+		scope.Role = tt.role
+		t.Run(fmt.Sprintf("%s grants %s on %v %v", tt.granter, tt.role, scope.Instances, scope.Tags), func(t *testing.T) {
+			err := rbac.CanGrant(users[tt.granter], scope)
+			if tt.allowed && err != nil {
+				t.Errorf("denied: %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrGrantDenied) {
+				t.Errorf("got %v, want ErrGrantDenied", err)
+			}
+		})
+	}
+
+	if err := rbac.CanGrant(users["admin"], models.RoleBinding{Role: "missing"}); !errors.Is(err, ErrRoleNotFound) {
+		t.Errorf("unknown role: got %v, want ErrRoleNotFound", err)
+	}
+}
+
+func TestCan(t *testing.T) {
+	rbac, users := newTestRBAC(t, map[string]string{
+		"admin":    models.RoleAdmin,
+		"viewer":   models.RoleUser,
+		"deployer": models.RoleUser,
+		"auditor":  models.RoleUser,
+		"inactive": models.RoleAdmin,
+	})
+	users["inactive"].Active = false
+	if _, err := rbac.SaveRole(models.Role{Name: "auditor", Permissions: []models.Permission{models.PermAuditRead, models.PermInstanceRead}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deployer is an operator on web1 and on instances tagged staging,
+	// and holds admin, which includes audit.read and users.manage, on web2
+	addTestBinding(t, rbac, users["deployer"], models.RoleOperator, []string{"web1"}, nil)
+	addTestBinding(t, rbac, users["deployer"], models.RoleOperator, nil, []string{"staging"})
+	addTestBinding(t, rbac, users["deployer"], models.RoleAdmin, []string{"web2"}, nil)
+	// The auditor reads the audit log everywhere
+	addTestBinding(t, rbac, users["auditor"], "auditor", nil, nil)
+
+	tests := []struct {
+		user     string
+		perm     models.Permission
+		instance string
+		tags     []string
+		can      bool
+	}{
+		{"admin", models.PermUsersManage, "", nil, true},
+		{"admin", models.PermServerStop, "web9", nil, true},
+		{"inactive", models.PermInstanceRead, "web1", nil, false},
+
+		// Own role applies everywhere
+		{"viewer", models.PermConfigRead, "web1", nil, true},
+		{"viewer", models.PermConfigRead, "", nil, true},
+		{"viewer", models.PermConfigWrite, "web1", nil, false},
+
+		// Scoped bindings apply to their instances and tags only
+		{"deployer", models.PermConfigWrite, "web1", nil, true},
+		{"deployer", models.PermConfigWrite, "web3", nil, false},
+		{"deployer", models.PermConfigWrite, "web3", []string{"staging"}, true},
+		{"deployer", models.PermConfigWrite, "web3", []string{"prod"}, false},
+		{"deployer", models.PermConfigWrite, "", nil, false},
+		{"deployer", models.PermInstanceManage, "web2", nil, true},
+		{"deployer", models.PermInstanceManage, "web1", nil, false},
+
+		// and never grant global permissions, even through admin
+		{"deployer", models.PermAuditRead, "web2", nil, false},
+		{"deployer", models.PermUsersManage, "web2", nil, false},
+		{"deployer", models.PermUsersManage, "", nil, false},
+
+		// Unscoped bindings grant global permissions
+		{"auditor", models.PermAuditRead, "", nil, true},
+		{"auditor", models.PermAuditRead, "web1", nil, true},
+		{"auditor", models.PermUsersManage, "", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s on %q %v", tt.user, tt.perm, tt.instance, tt.tags), func(t *testing.T) {
+			if got := rbac.Can(users[tt.user], tt.perm, tt.instance, tt.tags); got != tt.can {
+				t.Errorf("Can = %v, want %v", got, tt.can)
+			}
+		})
+	}
+}
+
+func TestCanAnywhere(t *testing.T) {
+	rbac, users := newTestRBAC(t, map[string]string{
+		"admin":    models.RoleAdmin,
+		"viewer":   models.RoleUser,
+		"deployer": models.RoleUser,
+		"inactive": models.RoleAdmin,
+	})
+	users["inactive"].Active = false
+	if _, err := rbac.SaveRole(models.Role{Name: "user-manager", Permissions: []models.Permission{models.PermUsersManage}}); err != nil {
+		t.Fatal(err)
+	}
+	addTestBinding(t, rbac, users["deployer"], models.RoleAdmin, []string{"web1"}, nil)
+	addTestBinding(t, rbac, users["viewer"], "user-manager", nil, nil)
+
+	tests := []struct {
+		user string
+		perm models.Permission
+		can  bool
+	}{
+		{"admin", models.PermAuditRead, true},
+		{"inactive", models.PermInstanceRead, false},
+		{"viewer", models.PermInstanceRead, true},
+		{"viewer", models.PermServerStop, false},
+		{"viewer", models.PermUsersManage, true},
+		{"deployer", models.PermServerStop, true},
+		{"deployer", models.PermAuditRead, false},
+		{"deployer", models.PermUsersManage, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.user, tt.perm), func(t *testing.T) {
+			if got := rbac.CanAnywhere(users[tt.user], tt.perm); got != tt.can {
+				t.Errorf("CanAnywhere = %v, want %v", got, tt.can)
+			}
+		})
+	}
+}
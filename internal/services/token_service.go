@@ -0,0 +1,298 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"godash/internal/models"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API token errors
+var (
+	ErrTokenNotFound = errors.New("API token not found")
+	// ErrInvalidToken is wrapped by errors about invalid token fields
+	ErrInvalidToken = errors.New("invalid API token")
+	// ErrTokenRejected is wrapped by the reasons a token can't authenticate
+	ErrTokenRejected = errors.New("API token rejected")
+)
+
+// TokenPrefix starts every API token, so leaked tokens are easy to find
+const TokenPrefix = "gdt_"
+
+// lastUsedSaveInterval limits how often the last use of a token is written
+// to disk; in between it is only updated in memory
+const lastUsedSaveInterval = time.Minute
+
+// TokenService issues and checks personal API tokens. Only a SHA-256 hash of
+// each token is stored, in a JSON file next to the users.
+type TokenService struct {
+	filePath string
+	mu       sync.Mutex
+	tokens   []models.APIToken
+	saved    map[string]time.Time // When each token's last use was last written
+}
+
+// tokenRecord is a stored token. Unlike models.APIToken it includes the
+// hash, which is never part of API output.
+type tokenRecord struct {
+	ID         string              `json:"id"`
+	UserID     int                 `json:"user_id"`
+	Name       string              `json:"name"`
+	Prefix     string              `json:"prefix"`
+	Hash       string              `json:"hash"`
+	Scopes     []models.Permission `json:"scopes"`
+	AllowedIPs []string            `json:"allowed_ips,omitempty"`
+	ExpiresAt  *time.Time          `json:"expires_at,omitempty"`
+	CreatedAt  time.Time           `json:"created_at"`
+	LastUsedAt *time.Time          `json:"last_used_at,omitempty"`
+	LastUsedIP string              `json:"last_used_ip,omitempty"`
+}
+
+// NewTokenService opens the token store at filePath
+func NewTokenService(filePath string) (*TokenService, error) {
+	s := &TokenService{
+		filePath: filePath,
+		saved:    make(map[string]time.Time),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	if err := s.load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to load API tokens: %w", err)
+	}
+
+	return s, nil
+}
+
+// load reads the token file
+func (s *TokenService) load() error {
+	data, err := os.ReadFile(s.filePath)
+	if err != nil {
+		return err
+	}
+
+	var records []tokenRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to parse API tokens file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make([]models.APIToken, len(records))
+	for i, rec := range records {
+		s.tokens[i] = models.APIToken(rec)
+	}
+	return nil
+}
+
+// save writes the token file; callers must hold s.mu
+func (s *TokenService) save() error {
+	records := make([]tokenRecord, len(s.tokens))
+	for i, t := range s.tokens {
+		records[i] = tokenRecord(t)
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal API tokens: %w", err)
+	}
+
+	tmpPath := s.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.filePath); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	return nil
+}
+
+// Create issues a token for a user and returns it along with its record.
+// The token itself can't be recovered later. A nil expiresAt never expires.
+func (s *TokenService) Create(userID int, name string, scopes []models.Permission, allowedIPs []string, expiresAt *time.Time) (string, *models.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return "", nil, fmt.Errorf("%w: name must be 1 to 64 characters", ErrInvalidToken)
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidToken)
+	}
+	var cleanScopes []models.Permission
+	for _, p := range scopes {
+		if !p.Valid() {
+			return "", nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidToken, p)
+		}
+		if !slices.Contains(cleanScopes, p) {
+			cleanScopes = append(cleanScopes, p)
+		}
+	}
+	allowedIPs = cleanList(allowedIPs)
+	for _, addr := range allowedIPs {
+		if net.ParseIP(addr) == nil {
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return "", nil, fmt.Errorf("%w: %q is neither an IP address nor a CIDR range", ErrInvalidToken, addr)
+			}
+		}
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "", nil, fmt.Errorf("%w: expiry must be in the future", ErrInvalidToken)
+	}
+
+	secret := make([]byte, 32)
+	id := make([]byte, 8)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+	raw := TokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	token := models.APIToken{
+		ID:         hex.EncodeToString(id),
+		UserID:     userID,
+		Name:       name,
+		Prefix:     raw[:len(TokenPrefix)+6],
+		Hash:       hashToken(raw),
+		Scopes:     cleanScopes,
+		AllowedIPs: allowedIPs,
+		ExpiresAt:  expiresAt,
+		CreatedAt:  time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = append(s.tokens, token)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return "", nil, err
+	}
+	return raw, &token, nil
+}
+
+// List returns the tokens of a user, or all tokens for userID 0, newest first
+func (s *TokenService) List(userID int) []models.APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := []models.APIToken{}
+	for i := len(s.tokens) - 1; i >= 0; i-- {
+		if userID == 0 || s.tokens[i].UserID == userID {
+			tokens = append(tokens, s.tokens[i])
+		}
+	}
+	return tokens
+}
+
+// Get returns a token by ID
+func (s *TokenService) Get(id string) (*models.APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if t.ID == id {
+			return &t, nil
+		}
+	}
+	return nil, ErrTokenNotFound
+}
+
+// Revoke deletes a token; requests made with it fail from then on
+func (s *TokenService) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.tokens, func(t models.APIToken) bool { return t.ID == id })
+	if i < 0 {
+		return ErrTokenNotFound
+	}
+
+	old := slices.Clone(s.tokens)
+	s.tokens = slices.Delete(s.tokens, i, i+1)
+	if err := s.save(); err != nil {
+		s.tokens = old
+		return err
+	}
+	delete(s.saved, id)
+	return nil
+}
+
+// Authenticate checks a token presented from the address ip and records
+// its use. The error wraps ErrTokenRejected with the reason.
+func (s *TokenService) Authenticate(raw, ip string) (*models.APIToken, error) {
+	if !strings.HasPrefix(raw, TokenPrefix) {
+		return nil, fmt.Errorf("%w: malformed token", ErrTokenRejected)
+	}
+	hash := hashToken(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.tokens, func(t models.APIToken) bool { return t.Hash == hash })
+	if i < 0 {
+		return nil, fmt.Errorf("%w: unknown token", ErrTokenRejected)
+	}
+	token := &s.tokens[i]
+	if token.Expired() {
+		return nil, fmt.Errorf("%w: expired", ErrTokenRejected)
+	}
+	if !ipAllowed(token.AllowedIPs, ip) {
+		return nil, fmt.Errorf("%w: not allowed from %s", ErrTokenRejected, ip)
+	}
+
+	now := time.Now()
+	token.LastUsedAt = &now
+	token.LastUsedIP = ip
+	if now.Sub(s.saved[token.ID]) >= lastUsedSaveInterval {
+		if err := s.save(); err == nil {
+			s.saved[token.ID] = now
+		}
+	}
+
+	t := *token
+	return &t, nil
+}
+
+// ipAllowed reports whether ip matches one of the allowed addresses and
+// ranges; an empty list allows every address
+func ipAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, a := range allowed {
+		if _, network, err := net.ParseCIDR(a); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if allowedAddr := net.ParseIP(a); allowedAddr != nil && allowedAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken returns the hex SHA-256 of a token. Tokens are long and random,
+// so unlike passwords they need no slow hash.
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"errors"
+	"godash/internal/models"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestTokenService(t *testing.T) *TokenService {
+	t.Helper()
+	s, err := NewTokenService(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTokenCreate(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		tokenName  string
+		scopes     []models.Permission
+		allowedIPs []string
+		expiresAt  *time.Time
+		ok         bool
+	}{
+		{name: "valid", tokenName: "ci", scopes: []models.Permission{models.PermInstanceRead}, allowedIPs: []string{"10.0.0.1", "192.168.0.0/16", "2001:db8::/32"}, expiresAt: &future, ok: true},
+		{name: "no name", tokenName: "  ", scopes: []models.Permission{models.PermInstanceRead}},
+		{name: "no scopes", tokenName: "ci"},
+		{name: "unknown scope", tokenName: "ci", scopes: []models.Permission{"everything"}},
+		{name: "bad address", tokenName: "ci", scopes: []models.Permission{models.PermInstanceRead}, allowedIPs: []string{"10.0.0.300"}},
+		{name: "bad range", tokenName: "ci", scopes: []models.Permission{models.PermInstanceRead}, allowedIPs: []string{"10.0.0.0/33"}},
+		{name: "expiry in the past", tokenName: "ci", scopes: []models.Permission{models.PermInstanceRead}, expiresAt: &past},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestTokenService(t)
+			raw, token, err := s.Create(1, tt.tokenName, tt.scopes, tt.allowedIPs, tt.expiresAt)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("err = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Hash == raw || token.Hash != hashToken(raw) {
+				t.Error("the token isn't stored as its hash")
+			}
+
+			// The token survives a restart
+			reopened, err := NewTokenService(s.filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := reopened.Authenticate(raw, "10.0.0.1"); err != nil {
+				t.Errorf("after reopening: %v", err)
+			}
+		})
+	}
+}
+
+func TestTokenAuthenticate(t *testing.T) {
+	s := newTestTokenService(t)
+	scopes := []models.Permission{models.PermInstanceRead}
+
+	open, _, err := s.Create(1, "open", scopes, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restricted, _, err := s.Create(1, "restricted", scopes, []string{"203.0.113.7", "10.1.0.0/16", "2001:db8::/32"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	expiring, expiringToken, err := s.Create(1, "expiring", scopes, nil, &future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, expiredToken, err := s.Create(1, "expired", scopes, nil, &future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedToken, err := s.Create(1, "revoked", scopes, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Let one token run out
+	for i := range s.tokens {
+		if s.tokens[i].ID == expiredToken.ID {
+			past := time.Now().Add(-time.Second)
+			s.tokens[i].ExpiresAt = &past
+		}
+	}
+	if err := s.Revoke(revokedToken.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		ip   string
+		ok   bool
+	}{
+		{name: "no allowlist", raw: open, ip: "198.51.100.1", ok: true},
+		{name: "allowed address", raw: restricted, ip: "203.0.113.7", ok: true},
+		{name: "other address", raw: restricted, ip: "203.0.113.8"},
+		{name: "inside allowed range", raw: restricted, ip: "10.1.255.254", ok: true},
+		{name: "outside allowed range", raw: restricted, ip: "10.2.0.1"},
+		{name: "inside allowed IPv6 range", raw: restricted, ip: "2001:db8::1", ok: true},
+		{name: "unparsable address", raw: restricted, ip: "not-an-ip"},
+		{name: "not expired yet", raw: expiring, ip: "198.51.100.1", ok: true},
+		{name: "expired", raw: expired, ip: "198.51.100.1"},
+		{name: "revoked", raw: revoked, ip: "198.51.100.1"},
+		{name: "unknown", raw: TokenPrefix + "unknown", ip: "198.51.100.1"},
+		{name: "malformed", raw: "Bearer-nonsense", ip: "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := s.Authenticate(tt.raw, tt.ip)
+			if !tt.ok {
+				if !errors.Is(err, ErrTokenRejected) {
+					t.Fatalf("err = %v, want ErrTokenRejected", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.LastUsedAt == nil || token.LastUsedIP != tt.ip {
+				t.Errorf("last use = %v from %q, want now from %q", token.LastUsedAt, token.LastUsedIP, tt.ip)
+			}
+		})
+	}
+
+	if _, err := s.Get(expiringToken.ID); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+}
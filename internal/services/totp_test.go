@@ -0,0 +1,93 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors for SHA-1, cut to six digits
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	code := func(step int64) string { return totpCode(key, step) }
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		step     int64 // Step the code is accepted for, 0 if refused
+	}{
+		{name: "current step", code: code(current), step: current},
+		{name: "with spaces", code: code(current)[:3] + " " + code(current)[3:], step: current},
+		{name: "one step behind", code: code(current - 1), step: current - 1},
+		{name: "one step ahead", code: code(current + 1), step: current + 1},
+		{name: "two steps behind", code: code(current - 2)},
+		{name: "two steps ahead", code: code(current + 2)},
+		{name: "replayed", code: code(current), lastStep: current},
+		{name: "older than the last used", code: code(current - 1), lastStep: current},
+		{name: "newer than the last used", code: code(current + 1), lastStep: current, step: current + 1},
+		{name: "lowercase secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: code(current), step: current},
+		{name: "too short", code: code(current)[:5]},
+		{name: "invalid secret", secret: "not base32!", code: code(current)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := secret
+			if tt.secret != "" {
+				s = tt.secret
+			}
+			step, ok := verifyTOTP(s, tt.code, tt.lastStep, now)
+			if ok != (tt.step != 0) || step != tt.step {
+				t.Errorf("step=%d ok=%v, want step %d", step, ok, tt.step)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if seen[code] {
+			t.Errorf("code %s repeats", code)
+		}
+		seen[code] = true
+		if hashes[i] != hashRecoveryCode(code) {
+			t.Errorf("hash %d doesn't match its code", i)
+		}
+	}
+
+	// Case, spaces and dashes don't matter
+	if hashRecoveryCode("ABCD EFGH-ijkl") != hashRecoveryCode("abcd-efgh-ijkl") {
+		t.Error("recovery code hash depends on formatting")
+	}
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"godash/internal/models"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication errors
+var (
+	// ErrInvalidCode is returned for a wrong, reused or expired code
+	ErrInvalidCode        = errors.New("invalid authentication code")
+	ErrTOTPNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotStarted     = errors.New("two-factor setup has not been started")
+	// ErrTOTPRequired is returned when disabling two-factor authentication
+	// that is required for the user
+	ErrTOTPRequired = errors.New("two-factor authentication is required for this account")
+	// ErrTooManyAttempts is returned while a user is locked out after too
+	// many wrong codes
+	ErrTooManyAttempts = errors.New("too many failed attempts, try again later")
+)
+
+// TOTPIssuer names the dashboard in authenticator apps
+const TOTPIssuer = "Godash"
+
+// After maxCodeFailures wrong codes in a row, codes for the user are refused
+// for codeLockout. Six digits are otherwise quick to guess.
+const (
+	maxCodeFailures = 5
+	codeLockout     = 5 * time.Minute
+)
+
+// codeFailures counts a user's wrong codes
+type codeFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// SetRequireTOTP makes every user enroll in two-factor authentication, not
+// only those an admin marked
+func (s *UserService) SetRequireTOTP(required bool) {
+	s.requireTOTP = required
+}
+
+// TOTPRequired reports whether user must use two-factor authentication
+func (s *UserService) TOTPRequired(user *models.User) bool {
+	return s.requireTOTP || user.TOTPRequired
+}
+
+// NeedsTOTPEnrollment reports whether user must set up two-factor
+// authentication before doing anything else
+func (s *UserService) NeedsTOTPEnrollment(user *models.User) bool {
+	return s.TOTPRequired(user) && !user.TOTPEnabled
+}
+
+// BeginTOTPSetup gives a user a new pending secret and returns it with its
+// provisioning URI. It takes effect once EnableTOTP confirms a code from it.
+func (s *UserService) BeginTOTPSetup(id int) (secret, uri string, err error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+
+	secret, err = generateTOTPSecret()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	user.UpdatedAt = time.Now()
+	if err := s.store.Update(user); err != nil {
+		return "", "", err
+	}
+	return secret, totpURI(TOTPIssuer, user.Username, secret), nil
+}
+
+// EnableTOTP turns on two-factor authentication once code shows the user's
+// app has the pending secret, and returns the user's recovery codes
+func (s *UserService) EnableTOTP(id int, code string) ([]string, error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPNotStarted
+	}
+	if err := s.checkTOTP(user, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+	}
+	user.TOTPEnabled = true
+	user.RecoveryCodes = hashes
+	user.DeviceEpoch++
+	user.UpdatedAt = time.Now()
+	if err := s.store.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor checks a code from the user's app or one of their
+// recovery codes, which is used up. recovery reports which it was. Codes
+// are checked and used up under the user's lock, so concurrent requests
+// can't use the same code twice.
+func (s *UserService) VerifySecondFactor(id int, code string) (recovery bool, err error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return false, err
+	}
+	if !user.Active {
+		return false, ErrInvalidCredentials
+	}
+	if !user.TOTPEnabled {
+		return false, ErrTOTPNotEnabled
+	}
+
+	code = strings.TrimSpace(code)
+	if len(strings.ReplaceAll(code, " ", "")) == totpDigits {
+		return false, s.checkTOTP(user, code)
+	}
+
+	if err := s.checkLockout(id); err != nil {
+		return false, err
+	}
+	i := slices.Index(user.RecoveryCodes, hashRecoveryCode(code))
+	if i < 0 {
+		s.recordFailure(id)
+		return false, ErrInvalidCode
+	}
+	user.RecoveryCodes = slices.Delete(slices.Clone(user.RecoveryCodes), i, i+1)
+	user.UpdatedAt = time.Now()
+	if err := s.store.Update(user); err != nil {
+		return false, err
+	}
+	s.clearFailures(id)
+	return true, nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking a
+// code from their app, and returns the new ones
+func (s *UserService) RegenerateRecoveryCodes(id int, code string) ([]string, error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+	if err := s.checkTOTP(user, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+	}
+	user.RecoveryCodes = hashes
+	user.UpdatedAt = time.Now()
+	if err := s.store.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns off a user's own two-factor authentication after
+// checking their password. It can't be turned off while it is required.
+func (s *UserService) DisableTOTP(id int, password string) error {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	ok, _, err := verifyPassword(user.PasswordHash, password)
+	if err != nil || !ok {
+		return ErrInvalidCredentials
+	}
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+	if s.TOTPRequired(user) {
+		return ErrTOTPRequired
+	}
+	return s.clearTOTP(user)
+}
+
+// ResetTOTP turns off a user's two-factor authentication, e.g. when an admin
+// helps a user who lost their device. If it is required, the user enrolls
+// again at the next login.
+func (s *UserService) ResetTOTP(id int) error {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled && user.TOTPSecret == "" {
+		return ErrTOTPNotEnabled
+	}
+	s.clearFailures(id)
+	return s.clearTOTP(user)
+}
+
+// clearTOTP removes the secret and recovery codes of user and forgets their
+// remembered devices
+func (s *UserService) clearTOTP(user *models.User) error {
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	user.DeviceEpoch++
+	user.UpdatedAt = time.Now()
+	return s.store.Update(user)
+}
+
+// ForgetDevices makes every remembered device of a user ask for a code again
+func (s *UserService) ForgetDevices(id int) error {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	user.DeviceEpoch++
+	user.UpdatedAt = time.Now()
+	return s.store.Update(user)
+}
+
+// checkTOTP verifies a code from user's app and records its time step, so
+// the code can't be used again. Callers must hold the user's lock and have
+// read user under it, so two requests can't both use the same code.
+func (s *UserService) checkTOTP(user *models.User, code string) error {
+	if err := s.checkLockout(user.ID); err != nil {
+		return err
+	}
+	step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+	if !ok {
+		s.recordFailure(user.ID)
+		return ErrInvalidCode
+	}
+	s.clearFailures(user.ID)
+
+	user.TOTPLastStep = step
+	user.UpdatedAt = time.Now()
+	return s.store.Update(user)
+}
+
+// checkLockout returns ErrTooManyAttempts while a user is locked out
+func (s *UserService) checkLockout(id int) error {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+
+	if f := s.failures[id]; f != nil && time.Now().Before(f.lockedUntil) {
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+// recordFailure counts a wrong code and locks the user out after too many
+func (s *UserService) recordFailure(id int) {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+
+	f := s.failures[id]
+	if f == nil {
+		f = &codeFailures{}
+		s.failures[id] = f
+	}
+	f.count++
+	if f.count >= maxCodeFailures {
+		f.count = 0
+		f.lockedUntil = time.Now().Add(codeLockout)
+	}
+}
+
+// clearFailures forgets a user's wrong codes after a right one
+func (s *UserService) clearFailures(id int) {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	delete(s.failures, id)
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"errors"
+	"godash/internal/models"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enrollTestUser turns on two-factor authentication for a new user and
+// returns the user, the key of their secret and their recovery codes
+func enrollTestUser(t *testing.T, s *UserService, username string) (*models.User, []byte, []string) {
+	t.Helper()
+	user := addTestUser(t, s, username, "", true)
+	secret, _, err := s.BeginTOTPSetup(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enroll with the previous step's code, so the current one is unused
+	codes, err := s.EnableTOTP(user.ID, totpCode(key, time.Now().Unix()/totpPeriod-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, key, codes
+}
+
+// wrongCode returns a code that isn't valid for key around now
+func wrongCode(key []byte) string {
+	current := time.Now().Unix() / totpPeriod
+	valid := []string{totpCode(key, current-1), totpCode(key, current), totpCode(key, current+1)}
+	for _, code := range []string{"000000", "111111", "222222", "333333"} {
+		if !slices.Contains(valid, code) {
+			return code
+		}
+	}
+	panic("unreachable")
+}
+
+func TestVerifySecondFactorTOTP(t *testing.T) {
+	s := newTestUserService(t)
+	user, key, _ := enrollTestUser(t, s, "alice")
+	current := time.Now().Unix() / totpPeriod
+
+	steps := []struct {
+		name string
+		code string
+		err  error
+	}{
+		{name: "current code", code: totpCode(key, current)},
+		{name: "same code again", code: totpCode(key, current), err: ErrInvalidCode},
+		{name: "earlier step than the last used", code: totpCode(key, current-1), err: ErrInvalidCode},
+		{name: "next step", code: totpCode(key, current+1)},
+		{name: "next step again", code: totpCode(key, current+1), err: ErrInvalidCode},
+	}
+
+	// Each step depends on the ones before
+	for _, step := range steps {
+		recovery, err := s.VerifySecondFactor(user.ID, step.code)
+		if !errors.Is(err, step.err) || (step.err == nil && err != nil) {
+			t.Fatalf("%s: err = %v, want %v", step.name, err, step.err)
+		}
+		if recovery {
+			t.Fatalf("%s: reported as a recovery code", step.name)
+		}
+	}
+
+	stored, err := s.GetByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TOTPLastStep != current+1 {
+		t.Errorf("last step %d, want %d", stored.TOTPLastStep, current+1)
+	}
+}
+
+func TestVerifySecondFactorRecoveryCodes(t *testing.T) {
+	s := newTestUserService(t)
+	user, _, codes := enrollTestUser(t, s, "alice")
+
+	steps := []struct {
+		name string
+		code string
+		err  error
+	}{
+		{name: "first code", code: codes[0]},
+		{name: "first code again", code: codes[0], err: ErrInvalidCode},
+		{name: "second code in capitals without dashes", code: "  " + strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")) + " "},
+		{name: "second code again", code: codes[1], err: ErrInvalidCode},
+		{name: "unknown code", code: "aaaa-bbbb-cccc", err: ErrInvalidCode},
+	}
+	for _, step := range steps {
+		recovery, err := s.VerifySecondFactor(user.ID, step.code)
+		if !errors.Is(err, step.err) || (step.err == nil && err != nil) {
+			t.Fatalf("%s: err = %v, want %v", step.name, err, step.err)
+		}
+		if step.err == nil && !recovery {
+			t.Fatalf("%s: not reported as a recovery code", step.name)
+		}
+	}
+
+	stored, err := s.GetByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.RecoveryCodes) != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes left, want %d", len(stored.RecoveryCodes), recoveryCodeCount-2)
+	}
+}
+
+func TestVerifySecondFactorLockout(t *testing.T) {
+	tests := []struct {
+		name  string
+		wrong func(key []byte) string
+	}{
+		{name: "wrong app codes", wrong: wrongCode},
+		{name: "wrong recovery codes", wrong: func([]byte) string { return "aaaa-bbbb-cccc" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestUserService(t)
+			user, key, codes := enrollTestUser(t, s, "alice")
+			other, _, _ := enrollTestUser(t, s, "bob")
+
+			for i := 1; i <= maxCodeFailures; i++ {
+				if _, err := s.VerifySecondFactor(user.ID, tt.wrong(key)); !errors.Is(err, ErrInvalidCode) {
+					t.Fatalf("failure %d: err = %v, want ErrInvalidCode", i, err)
+				}
+			}
+
+			// Locked out now, even for right codes
+			current := time.Now().Unix() / totpPeriod
+			if _, err := s.VerifySecondFactor(user.ID, totpCode(key, current)); !errors.Is(err, ErrTooManyAttempts) {
+				t.Errorf("right app code: err = %v, want ErrTooManyAttempts", err)
+			}
+			if _, err := s.VerifySecondFactor(user.ID, codes[0]); !errors.Is(err, ErrTooManyAttempts) {
+				t.Errorf("right recovery code: err = %v, want ErrTooManyAttempts", err)
+			}
+
+			// Other users aren't affected
+			if _, err := s.VerifySecondFactor(other.ID, wrongCode(key)); !errors.Is(err, ErrInvalidCode) {
+				t.Errorf("other user: err = %v, want ErrInvalidCode", err)
+			}
+
+			// The lockout ends after a while
+			s.failures[user.ID].lockedUntil = time.Now().Add(-time.Second)
+			if _, err := s.VerifySecondFactor(user.ID, totpCode(key, current)); err != nil {
+				t.Errorf("after the lockout: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFactorFailuresReset(t *testing.T) {
+	s := newTestUserService(t)
+	user, key, _ := enrollTestUser(t, s, "alice")
+
+	// A right code in between starts the count again
+	for i := 1; i < maxCodeFailures; i++ {
+		if _, err := s.VerifySecondFactor(user.ID, wrongCode(key)); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("failure %d: err = %v", i, err)
+		}
+	}
+	if _, err := s.VerifySecondFactor(user.ID, totpCode(key, time.Now().Unix()/totpPeriod)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < maxCodeFailures; i++ {
+		if _, err := s.VerifySecondFactor(user.ID, wrongCode(key)); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("failure %d after a right code: err = %v", i, err)
+		}
+	}
+}
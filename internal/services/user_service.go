@@ -1,143 +1,537 @@
 package services
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"godash/internal/models"
+	"log"
+	"strings"
 	"sync"
+	"time"
 )
 
+// User service errors
+var (
+	// ErrInvalidCredentials is returned for a wrong username or password, or
+	// an inactive user
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrInvalidInvite is returned for an unknown, used or expired invitation
+	ErrInvalidInvite = errors.New("invitation is invalid or has expired")
+	// ErrLastAdmin is returned by changes that would leave no active admin
+	ErrLastAdmin = errors.New("there must be at least one active admin")
+	// ErrInvalidUser is wrapped by errors about invalid user fields
+	ErrInvalidUser = errors.New("invalid user")
+)
+
+// InviteTTL is how long an invitation can be accepted
+const InviteTTL = 7 * 24 * time.Hour
+
 // UserService handles user-related business logic
 type UserService struct {
-	users []models.User
-	mutex sync.RWMutex
-	idCounter int
+	store  UserStore
+	policy PasswordPolicy
+	rbac   *RBACService
+
+	// requireTOTP makes every user enroll in two-factor authentication
+	requireTOTP bool
+
+	// Failed two-factor codes per user, to rate limit guessing
+	failuresMu sync.Mutex
+	failures   map[int]*codeFailures
+
+	// Per-user locks, so that reading, checking and updating a user isn't
+	// interleaved with another change to the same user
+	locksMu   sync.Mutex
+	userLocks map[int]*sync.Mutex
+
+	// dummyHash is verified against when a username doesn't exist, so a login
+	// takes as long for unknown users as for wrong passwords
+	dummyHash string
+}
+
+// NewUserService creates a new user service backed by store
+func NewUserService(store UserStore, policy PasswordPolicy) *UserService {
+	dummyHash, err := hashPassword("godash-dummy-password")
+	if err != nil {
+		log.Printf("Warning: failed to prepare dummy password hash: %v", err)
+	}
+	return &UserService{
+		store:     store,
+		policy:    policy,
+		dummyHash: dummyHash,
+		failures:  make(map[int]*codeFailures),
+		userLocks: make(map[int]*sync.Mutex),
+	}
 }
 
-// NewUserService creates a new user service
-func NewUserService() *UserService {
-	service := &UserService{
-		users: make([]models.User, 0),
-		idCounter: 1,
+// lockUser locks the user with the given ID against other changes through
+// this service and returns the function that unlocks it
+func (s *UserService) lockUser(id int) func() {
+	s.locksMu.Lock()
+	l := s.userLocks[id]
+	if l == nil {
+		l = &sync.Mutex{}
+		s.userLocks[id] = l
 	}
-	
-	// Create default admin user
-	defaultAdmin := models.NewUser("admin", "admin@localhost", "password", models.RoleAdmin)
-	defaultAdmin.ID = service.idCounter
-	service.idCounter++
-	service.users = append(service.users, *defaultAdmin)
-	
-	return service
+	s.locksMu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// SetRBAC lets users be given the custom roles defined in rbac
+func (s *UserService) SetRBAC(rbac *RBACService) {
+	s.rbac = rbac
 }
 
-// Authenticate validates user credentials
+// PasswordPolicy returns the policy new passwords are checked against
+func (s *UserService) PasswordPolicy() PasswordPolicy {
+	return s.policy
+}
+
+// Bootstrap creates the first admin if there are no users yet. Without a
+// password a random one is generated and returned. Either way the admin has
+// to change it at the first login. created is false if users already exist.
+func (s *UserService) Bootstrap(username, email, password string) (generated string, created bool, err error) {
+	users, err := s.store.List()
+	if err != nil {
+		return "", false, err
+	}
+	if len(users) > 0 {
+		return "", false, nil
+	}
+
+	if password == "" {
+		if password, err = generatePassword(); err != nil {
+			return "", false, fmt.Errorf("failed to generate password: %w", err)
+		}
+		generated = password
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", false, err
+	}
+
+	admin := models.NewUser(username, email, models.RoleAdmin)
+	admin.PasswordHash = hash
+	admin.MustChangePassword = true
+	if err := s.store.Create(admin); err != nil {
+		return "", false, fmt.Errorf("failed to create admin: %w", err)
+	}
+
+	return generated, true, nil
+}
+
+// Authenticate validates user credentials. A password stored with an older
+// hash is rehashed with the current one.
 func (s *UserService) Authenticate(username, password string) (*models.User, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	for _, user := range s.users {
-		if user.Username == username && user.Password == password && user.Active {
-			// Return a copy to avoid modifying the original
-			userCopy := user
-			return &userCopy, nil
+	user, err := s.store.GetByUsername(username)
+	if errors.Is(err, ErrUserNotFound) {
+		verifyPassword(s.dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, rehash, err := verifyPassword(user.PasswordHash, password)
+	if err != nil {
+		log.Printf("Cannot verify password of user %s: %v", user.Username, err)
+		return nil, ErrInvalidCredentials
+	}
+	if !ok || !user.Active {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Record the login on the current user, not the one read before the
+	// slow password check
+	defer s.lockUser(user.ID)()
+	if user, err = s.store.GetByID(user.ID); err != nil {
+		return nil, err
+	}
+	if !user.Active {
+		return nil, ErrInvalidCredentials
+	}
+	if rehash {
+		if hash, err := hashPassword(password); err == nil {
+			user.PasswordHash = hash
+		} else {
+			log.Printf("Failed to rehash password of user %s: %v", user.Username, err)
 		}
 	}
-	
-	return nil, errors.New("invalid credentials")
+	now := time.Now()
+	user.LastLoginAt = &now
+	if err := s.store.Update(user); err != nil {
+		log.Printf("Failed to record login of user %s: %v", user.Username, err)
+	}
+
+	return user, nil
 }
 
 // GetByID returns a user by ID
 func (s *UserService) GetByID(id int) (*models.User, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	for _, user := range s.users {
-		if user.ID == id {
-			userCopy := user
-			return &userCopy, nil
-		}
-	}
-	
-	return nil, errors.New("user not found")
+	return s.store.GetByID(id)
 }
 
 // GetByUsername returns a user by username
 func (s *UserService) GetByUsername(username string) (*models.User, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	for _, user := range s.users {
-		if user.Username == username {
-			userCopy := user
-			return &userCopy, nil
-		}
+	return s.store.GetByUsername(username)
+}
+
+// Create creates a new user with the given password, which must meet the
+// password policy
+func (s *UserService) Create(user *models.User, password string) error {
+	if err := s.validateUser(user); err != nil {
+		return err
+	}
+	if err := s.policy.Validate(password, user.Username); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	setPasswordHash(user, hash)
+
+	return s.store.Create(user)
+}
+
+// Invite creates a user without a password and returns a token for the
+// invitation link. The user sets a password with AcceptInvite within
+// InviteTTL.
+func (s *UserService) Invite(user *models.User) (string, error) {
+	if err := s.validateUser(user); err != nil {
+		return "", err
+	}
+
+	token, err := s.newInvite(user)
+	if err != nil {
+		return "", err
 	}
-	
-	return nil, errors.New("user not found")
+	if err := s.store.Create(user); err != nil {
+		return "", err
+	}
+	return token, nil
 }
 
-// Create creates a new user
-func (s *UserService) Create(user *models.User) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
-	// Check if username already exists
-	for _, existingUser := range s.users {
-		if existingUser.Username == user.Username {
-			return errors.New("username already exists")
+// Reinvite issues a new invitation to a user who hasn't accepted theirs, e.g.
+// after it expired. The previous link stops working.
+func (s *UserService) Reinvite(id int) (string, error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return "", err
+	}
+	if !user.IsInvited() {
+		return "", fmt.Errorf("%w: %s has already accepted the invitation", ErrInvalidUser, user.Username)
+	}
+
+	token, err := s.newInvite(user)
+	if err != nil {
+		return "", err
+	}
+	user.UpdatedAt = time.Now()
+	if err := s.store.Update(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// newInvite sets a new invitation on user and returns its token. Only the
+// token's hash is stored.
+func (s *UserService) newInvite(user *models.User) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate invitation: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	expires := time.Now().Add(InviteTTL)
+	user.PasswordHash = ""
+	user.InviteTokenHash = hashInviteToken(token)
+	user.InviteExpiresAt = &expires
+	return token, nil
+}
+
+// GetInvite returns the user an invitation token was issued to
+func (s *UserService) GetInvite(token string) (*models.User, error) {
+	if token == "" {
+		return nil, ErrInvalidInvite
+	}
+
+	users, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	hash := hashInviteToken(token)
+	for _, user := range users {
+		if user.InviteTokenHash == hash && user.IsInvited() {
+			if !user.Active || time.Now().After(*user.InviteExpiresAt) {
+				return nil, ErrInvalidInvite
+			}
+			return &user, nil
 		}
-		if existingUser.Email == user.Email {
-			return errors.New("email already exists")
+	}
+	return nil, ErrInvalidInvite
+}
+
+// AcceptInvite sets the password of an invited user, which ends the
+// invitation
+func (s *UserService) AcceptInvite(token, password string) (*models.User, error) {
+	invited, err := s.GetInvite(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// The invitation can only be accepted once
+	defer s.lockUser(invited.ID)()
+	user, err := s.store.GetByID(invited.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsInvited() || user.InviteTokenHash != invited.InviteTokenHash {
+		return nil, ErrInvalidInvite
+	}
+	if err := s.policy.Validate(password, user.Username); err != nil {
+		return nil, err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	setPasswordHash(user, hash)
+	user.MustChangePassword = false
+
+	if err := s.store.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// hashInviteToken returns the stored form of an invitation token. The token
+// is random, so a fast hash is enough.
+func hashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateUser checks the fields of a new or changed user
+func (s *UserService) validateUser(user *models.User) error {
+	user.Username = strings.TrimSpace(user.Username)
+	user.Email = strings.TrimSpace(user.Email)
+	if user.Username == "" {
+		return fmt.Errorf("%w: username is required", ErrInvalidUser)
+	}
+	if strings.ContainsAny(user.Username, " \t/") {
+		return fmt.Errorf("%w: username must not contain spaces or slashes", ErrInvalidUser)
+	}
+	if user.Email != "" && !strings.Contains(user.Email, "@") {
+		return fmt.Errorf("%w: invalid email address %q", ErrInvalidUser, user.Email)
+	}
+	if s.rbac != nil {
+		if !s.rbac.RoleExists(user.Role) {
+			return fmt.Errorf("%w: invalid role %q", ErrInvalidUser, user.Role)
 		}
+	} else if user.Role != models.RoleAdmin && user.Role != models.RoleUser {
+		return fmt.Errorf("%w: invalid role %q", ErrInvalidUser, user.Role)
 	}
-	
-	user.ID = s.idCounter
-	s.idCounter++
-	s.users = append(s.users, *user)
-	
 	return nil
 }
 
-// Update updates an existing user
+// setPasswordHash gives user a new password hash, ending any invitation
+func setPasswordHash(user *models.User, hash string) {
+	now := time.Now()
+	user.PasswordHash = hash
+	user.PasswordChangedAt = &now
+	user.UpdatedAt = now
+	user.InviteTokenHash = ""
+	user.InviteExpiresAt = nil
+}
+
+// Update updates an existing user. The password is changed through
+// SetPassword or ChangePassword.
 func (s *UserService) Update(user *models.User) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
-	for i, existingUser := range s.users {
-		if existingUser.ID == user.ID {
-			s.users[i] = *user
+	defer s.lockUser(user.ID)()
+	existing, err := s.store.GetByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.validateUser(user); err != nil {
+		return err
+	}
+	if err := s.checkAdminRemains(user); err != nil {
+		return err
+	}
+
+	user.PasswordHash = existing.PasswordHash
+	user.PasswordChangedAt = existing.PasswordChangedAt
+	user.InviteTokenHash = existing.InviteTokenHash
+	user.InviteExpiresAt = existing.InviteExpiresAt
+	user.TOTPEnabled = existing.TOTPEnabled
+	user.TOTPSecret = existing.TOTPSecret
+	user.TOTPLastStep = existing.TOTPLastStep
+	user.RecoveryCodes = existing.RecoveryCodes
+	user.DeviceEpoch = existing.DeviceEpoch
+	user.CreatedAt = existing.CreatedAt
+	user.LastLoginAt = existing.LastLoginAt
+	user.UpdatedAt = time.Now()
+	return s.store.Update(user)
+}
+
+// UpdateEmail changes a user's email, e.g. on their profile
+func (s *UserService) UpdateEmail(id int, email string) (*models.User, error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Email = strings.TrimSpace(email)
+	if err := s.validateUser(user); err != nil {
+		return nil, err
+	}
+	user.UpdatedAt = time.Now()
+	if err := s.store.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkAdminRemains rejects a change to user that would leave no active admin
+func (s *UserService) checkAdminRemains(user *models.User) error {
+	if user.IsAdmin() && user.Active {
+		return nil
+	}
+
+	users, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.ID != user.ID && u.IsAdmin() && u.Active {
 			return nil
 		}
 	}
-	
-	return errors.New("user not found")
+	return ErrLastAdmin
+}
+
+// SetPassword sets a user's password, e.g. as an admin reset. With
+// mustChange the user has to choose a new one at the next login.
+func (s *UserService) SetPassword(id int, password string, mustChange bool) error {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.policy.Validate(password, user.Username); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	setPasswordHash(user, hash)
+	user.MustChangePassword = mustChange
+
+	return s.store.Update(user)
+}
+
+// ChangePassword changes a user's own password after checking the current one
+func (s *UserService) ChangePassword(id int, current, password string) error {
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return err
+	}
+
+	ok, _, err := verifyPassword(user.PasswordHash, current)
+	if err != nil || !ok {
+		return ErrInvalidCredentials
+	}
+	if password == current {
+		return fmt.Errorf("%w: the new password must differ from the current one", ErrWeakPassword)
+	}
+
+	return s.SetPassword(id, password, false)
+}
+
+// ResetPassword replaces a user's password with a generated one that has to
+// be changed at the next login, and returns it
+func (s *UserService) ResetPassword(id int) (string, error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return "", err
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	setPasswordHash(user, hash)
+	user.MustChangePassword = true
+
+	if err := s.store.Update(user); err != nil {
+		return "", err
+	}
+	return password, nil
 }
 
 // Delete deactivates a user (soft delete)
 func (s *UserService) Delete(id int) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
-	for i, user := range s.users {
-		if user.ID == id {
-			s.users[i].Active = false
-			return nil
-		}
+	_, err := s.SetActive(id, false)
+	return err
+}
+
+// SetActive deactivates or reactivates a user. A deactivated user can't log
+// in, and their sessions end with their next request.
+func (s *UserService) SetActive(id int, active bool) (*models.User, error) {
+	defer s.lockUser(id)()
+	user, err := s.store.GetByID(id)
+	if err != nil {
+		return nil, err
 	}
-	
-	return errors.New("user not found")
+
+	user.Active = active
+	if err := s.checkAdminRemains(user); err != nil {
+		return nil, err
+	}
+	user.UpdatedAt = time.Now()
+	if err := s.store.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ListAll returns all users, including deactivated ones
+func (s *UserService) ListAll() ([]models.User, error) {
+	return s.store.List()
 }
 
 // List returns all active users
-func (s *UserService) List() []models.User {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	
-	var activeUsers []models.User
-	for _, user := range s.users {
+func (s *UserService) List() ([]models.User, error) {
+	users, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	activeUsers := make([]models.User, 0, len(users))
+	for _, user := range users {
 		if user.Active {
 			activeUsers = append(activeUsers, user)
 		}
 	}
-	
-	return activeUsers
-}
\ No newline at end of file
+
+	return activeUsers, nil
+}
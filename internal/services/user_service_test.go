@@ -0,0 +1,151 @@
+package services
+
+import (
+	"errors"
+	"godash/internal/models"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestUserService returns a user service backed by a file store in a
+// temporary directory
+func newTestUserService(t *testing.T) *UserService {
+	t.Helper()
+	store, err := NewFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewUserService(store, PasswordPolicy{})
+}
+
+// addTestUser stores a user with the given password hash
+func addTestUser(t *testing.T, s *UserService, username, hash string, active bool) *models.User {
+	t.Helper()
+	u := models.NewUser(username, username+"@example.com", models.RoleUser)
+	u.PasswordHash = hash
+	u.Active = active
+	if err := s.store.Create(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestUserService(t)
+
+	argon, err := hashPassword("argon-Pass-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-Pass-1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestUser(t, s, "argon", argon, true)
+	addTestUser(t, s, "legacy", string(bcryptHash), true)
+	addTestUser(t, s, "older", argonHash("older-Pass-1", 32*1024, 2, 1), true)
+	addTestUser(t, s, "inactive", argon, false)
+	addTestUser(t, s, "invited", "", true)
+	addTestUser(t, s, "corrupt", "plaintext", true)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		ok       bool
+		rehashed bool // The stored hash is replaced by a current argon2id one
+	}{
+		{name: "argon2id", username: "argon", password: "argon-Pass-1", ok: true},
+		{name: "argon2id wrong password", username: "argon", password: "wrong"},
+		{name: "bcrypt rehashed on login", username: "legacy", password: "bcrypt-Pass-1", ok: true, rehashed: true},
+		{name: "bcrypt wrong password not rehashed", username: "legacy", password: "wrong"},
+		{name: "older argon2id parameters rehashed", username: "older", password: "older-Pass-1", ok: true, rehashed: true},
+		{name: "inactive user", username: "inactive", password: "argon-Pass-1"},
+		{name: "invited user without a password", username: "invited", password: ""},
+		{name: "unreadable hash", username: "corrupt", password: "plaintext"},
+		{name: "unknown user", username: "nobody", password: "argon-Pass-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before string
+			if u, err := s.store.GetByUsername(tt.username); err == nil {
+				before = u.PasswordHash
+			}
+
+			user, err := s.Authenticate(tt.username, tt.password)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("err = %v, want ErrInvalidCredentials", err)
+				}
+				if u, err := s.store.GetByUsername(tt.username); err == nil && u.PasswordHash != before {
+					t.Error("failed login changed the stored hash")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.LastLoginAt == nil {
+				t.Error("login wasn't recorded")
+			}
+
+			stored, err := s.store.GetByUsername(tt.username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed := stored.PasswordHash != before; changed != tt.rehashed {
+				t.Fatalf("hash changed = %v, want %v", changed, tt.rehashed)
+			}
+			ok, rehash, err := verifyPassword(stored.PasswordHash, tt.password)
+			if err != nil || !ok || rehash {
+				t.Errorf("stored hash: ok=%v rehash=%v err=%v, want a current hash of the password", ok, rehash, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUnknownUserChecksDummyHash(t *testing.T) {
+	s := newTestUserService(t)
+
+	// Unknown usernames are checked against a real argon2id hash, so they
+	// take as long as a wrong password
+	if !strings.HasPrefix(s.dummyHash, "$argon2id$") {
+		t.Fatalf("dummy hash %q isn't argon2id", s.dummyHash)
+	}
+	if _, _, err := verifyPassword(s.dummyHash, "anything"); err != nil {
+		t.Fatalf("dummy hash doesn't verify: %v", err)
+	}
+
+	// Even its own password doesn't log in
+	if _, err := s.Authenticate("nobody", "godash-dummy-password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("err = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	s := newTestUserService(t)
+
+	generated, created, err := s.Bootstrap("admin", "admin@example.com", "")
+	if err != nil || !created {
+		t.Fatalf("created=%v err=%v", created, err)
+	}
+	if generated == "" {
+		t.Fatal("no password was generated")
+	}
+	admin, err := s.Authenticate("admin", generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Role != models.RoleAdmin || !admin.MustChangePassword {
+		t.Errorf("role=%s must change=%v, want an admin who must change the password", admin.Role, admin.MustChangePassword)
+	}
+
+	// Only the first start creates an admin
+	if _, created, err := s.Bootstrap("other", "other@example.com", "Other-Pass-1"); err != nil || created {
+		t.Errorf("second bootstrap: created=%v err=%v", created, err)
+	}
+}
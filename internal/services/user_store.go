@@ -0,0 +1,232 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"godash/internal/models"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User store errors
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUsernameTaken = errors.New("username already exists")
+	ErrEmailTaken    = errors.New("email already exists")
+)
+
+// UserStore persists users. Usernames and emails are unique regardless of
+// case. Implementations return copies, so callers may modify what they get.
+type UserStore interface {
+	List() ([]models.User, error)
+	GetByID(id int) (*models.User, error)
+	GetByUsername(username string) (*models.User, error)
+	// Create assigns the user an ID and stores it
+	Create(user *models.User) error
+	Update(user *models.User) error
+}
+
+// FileUserStore keeps users in a JSON file, rewritten on every change
+type FileUserStore struct {
+	filePath string
+	mu       sync.RWMutex
+	users    []models.User
+	nextID   int
+}
+
+// userFile is the on-disk layout of the user store
+type userFile struct {
+	NextID int          `json:"next_id"`
+	Users  []userRecord `json:"users"`
+}
+
+// userRecord is a stored user. Unlike models.User it includes the password
+// hash, which is never part of API output.
+type userRecord struct {
+	ID                 int        `json:"id"`
+	Username           string     `json:"username"`
+	Email              string     `json:"email"`
+	PasswordHash       string     `json:"password_hash"`
+	Role               string     `json:"role"`
+	Active             bool       `json:"active"`
+	MustChangePassword bool       `json:"must_change_password,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+	PasswordChangedAt  *time.Time `json:"password_changed_at,omitempty"`
+	LastLoginAt        *time.Time `json:"last_login_at,omitempty"`
+	InviteTokenHash    string     `json:"invite_token_hash,omitempty"`
+	InviteExpiresAt    *time.Time `json:"invite_expires_at,omitempty"`
+	TOTPEnabled        bool       `json:"totp_enabled,omitempty"`
+	TOTPRequired       bool       `json:"totp_required,omitempty"`
+	TOTPSecret         string     `json:"totp_secret,omitempty"`
+	TOTPLastStep       int64      `json:"totp_last_step,omitempty"`
+	RecoveryCodes      []string   `json:"recovery_codes,omitempty"`
+	DeviceEpoch        int        `json:"device_epoch,omitempty"`
+}
+
+// NewFileUserStore opens the user store at filePath, creating its directory
+func NewFileUserStore(filePath string) (*FileUserStore, error) {
+	store := &FileUserStore{
+		filePath: filePath,
+		nextID:   1,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	if err := store.load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to load users: %w", err)
+	}
+
+	return store, nil
+}
+
+// load reads the users file
+func (s *FileUserStore) load() error {
+	data, err := os.ReadFile(s.filePath)
+	if err != nil {
+		return err
+	}
+
+	var file userFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse users file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make([]models.User, 0, len(file.Users))
+	s.nextID = max(file.NextID, 1)
+	for _, rec := range file.Users {
+		s.users = append(s.users, models.User(rec))
+		s.nextID = max(s.nextID, rec.ID+1)
+	}
+
+	return nil
+}
+
+// save writes the users file; callers must hold s.mu
+func (s *FileUserStore) save() error {
+	file := userFile{NextID: s.nextID, Users: make([]userRecord, 0, len(s.users))}
+	for _, u := range s.users {
+		file.Users = append(file.Users, userRecord(u))
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal users: %w", err)
+	}
+
+	// The file holds password hashes, so only the owner may read it
+	tmpPath := s.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.filePath); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	return nil
+}
+
+// List returns all users ordered by ID
+func (s *FileUserStore) List() ([]models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]models.User, len(s.users))
+	copy(users, s.users)
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// GetByID returns a user by ID
+func (s *FileUserStore) GetByID(id int) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.ID == id {
+			return &u, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// GetByUsername returns a user by username
+func (s *FileUserStore) GetByUsername(username string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			return &u, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// Create stores a new user and sets its ID
+func (s *FileUserStore) Create(user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUnique(user); err != nil {
+		return err
+	}
+
+	user.ID = s.nextID
+	s.nextID++
+	s.users = append(s.users, *user)
+
+	if err := s.save(); err != nil {
+		s.users = s.users[:len(s.users)-1]
+		return err
+	}
+	return nil
+}
+
+// Update replaces a stored user
+func (s *FileUserStore) Update(user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUnique(user); err != nil {
+		return err
+	}
+
+	for i, u := range s.users {
+		if u.ID == user.ID {
+			s.users[i] = *user
+			if err := s.save(); err != nil {
+				s.users[i] = u
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+// checkUnique rejects a username or email used by another user; callers
+// must hold s.mu
+func (s *FileUserStore) checkUnique(user *models.User) error {
+	for _, u := range s.users {
+		if u.ID == user.ID {
+			continue
+		}
+		if strings.EqualFold(u.Username, user.Username) {
+			return ErrUsernameTaken
+		}
+		if user.Email != "" && strings.EqualFold(u.Email, user.Email) {
+			return ErrEmailTaken
+		}
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"time"
+)
+
+// Segment file layout:
+//
+//	header:  "GDTS" | version (1 byte) | window start ms (8) | window length ms (8)
+//	records: uvarint payload length | payload | CRC-32 (IEEE) of payload (4)
+//
+// A record payload holds one sample:
+//
+//	timestamp     first record: varint unix ms; later: varint delta-of-delta
+//	new series    uvarint count, then uvarint length + name for each
+//	presence      bitmap over all series defined so far in the segment
+//	values        one XOR-encoded value per present series
+//
+// Values are XORed with the previous value of the same series. The result is
+// written as a header byte (0 when unchanged, else 0x40 | leading zero bytes
+// << 3 | trailing zero bytes) followed by the remaining significant bytes.
+// Counters that barely move therefore cost one or two bytes per sample.
+const (
+	segmentMagic      = "GDTS"
+	segmentVersion    = 1
+	segmentHeaderSize = 4 + 1 + 8 + 8
+	maxRecordSize     = 64 << 20
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+// segmentState is the decoding context shared by readers and writers
+type segmentState struct {
+	names     []string
+	ids       map[string]int
+	prevBits  []uint64
+	present   []bool // Series present in the last record
+	filter    func(string) bool
+	wanted    []bool // Series decoded into samples when filter is set
+	prevTime  int64
+	prevDelta int64
+	records   int
+}
+
+func newSegmentState(filter func(string) bool) *segmentState {
+	return &segmentState{ids: make(map[string]int), filter: filter}
+}
+
+func (st *segmentState) addSeries(name string) {
+	st.ids[name] = len(st.names)
+	st.names = append(st.names, name)
+	st.prevBits = append(st.prevBits, 0)
+	st.present = append(st.present, false)
+	st.wanted = append(st.wanted, st.filter == nil || st.filter(name))
+}
+
+// lastSample rebuilds the most recent sample from the decoding state
+func (st *segmentState) lastSample() Sample {
+	values := make(map[string]float64)
+	for i, ok := range st.present {
+		if ok {
+			values[st.names[i]] = math.Float64frombits(st.prevBits[i])
+		}
+	}
+	return Sample{Time: time.UnixMilli(st.prevTime), Values: values}
+}
+
+// encode appends the payload for s to buf and advances the state
+func (st *segmentState) encode(buf []byte, s Sample) []byte {
+	t := s.Time.UnixMilli()
+	if st.records == 0 {
+		buf = binary.AppendVarint(buf, t)
+		st.prevDelta = 0
+	} else {
+		delta := t - st.prevTime
+		buf = binary.AppendVarint(buf, delta-st.prevDelta)
+		st.prevDelta = delta
+	}
+	st.prevTime = t
+
+	var added []string
+	for name := range s.Values {
+		if _, ok := st.ids[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	buf = binary.AppendUvarint(buf, uint64(len(added)))
+	for _, name := range added {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		st.addSeries(name)
+	}
+
+	bitmap := make([]byte, (len(st.names)+7)/8)
+	for i, name := range st.names {
+		_, ok := s.Values[name]
+		st.present[i] = ok
+		if ok {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	buf = append(buf, bitmap...)
+
+	for i, name := range st.names {
+		v, ok := s.Values[name]
+		if !ok {
+			continue
+		}
+		b := math.Float64bits(v)
+		buf = appendXOR(buf, b^st.prevBits[i])
+		st.prevBits[i] = b
+	}
+
+	st.records++
+	return buf
+}
+
+// decode reads one payload, advancing the state
+func (st *segmentState) decode(payload []byte) (Sample, error) {
+	r := &byteReader{buf: payload}
+
+	v, err := r.varint()
+	if err != nil {
+		return Sample{}, err
+	}
+	if st.records == 0 {
+		st.prevTime = v
+		st.prevDelta = 0
+	} else {
+		st.prevDelta += v
+		st.prevTime += st.prevDelta
+	}
+
+	added, err := r.uvarint()
+	if err != nil {
+		return Sample{}, err
+	}
+	for i := uint64(0); i < added; i++ {
+		n, err := r.uvarint()
+		if err != nil {
+			return Sample{}, err
+		}
+		name, err := r.bytes(int(n))
+		if err != nil {
+			return Sample{}, err
+		}
+		st.addSeries(string(name))
+	}
+
+	bitmap, err := r.bytes((len(st.names) + 7) / 8)
+	if err != nil {
+		return Sample{}, err
+	}
+
+	values := make(map[string]float64)
+	for i := range st.names {
+		st.present[i] = bitmap[i/8]&(1<<(i%8)) != 0
+		if !st.present[i] {
+			continue
+		}
+		x, err := r.xor()
+		if err != nil {
+			return Sample{}, err
+		}
+		st.prevBits[i] ^= x
+		if st.wanted[i] {
+			values[st.names[i]] = math.Float64frombits(st.prevBits[i])
+		}
+	}
+	if r.pos != len(payload) {
+		return Sample{}, errCorrupt
+	}
+
+	st.records++
+	return Sample{Time: time.UnixMilli(st.prevTime), Values: values}, nil
+}
+
+func appendXOR(buf []byte, x uint64) []byte {
+	if x == 0 {
+		return append(buf, 0)
+	}
+	lead := bits.LeadingZeros64(x) / 8
+	trail := bits.TrailingZeros64(x) / 8
+	buf = append(buf, byte(0x40|lead<<3|trail))
+	for i := 7 - lead; i >= trail; i-- {
+		buf = append(buf, byte(x>>(8*i)))
+	}
+	return buf
+}
+
+type byteReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *byteReader) varint() (int64, error) {
+	v, n := binary.Varint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errCorrupt
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *byteReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errCorrupt
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *byteReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.buf) {
+		return nil, errCorrupt
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *byteReader) xor() (uint64, error) {
+	h, err := r.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	if h[0] == 0 {
+		return 0, nil
+	}
+	if h[0]&0xc0 != 0x40 {
+		return 0, errCorrupt
+	}
+	lead, trail := int(h[0]>>3&7), int(h[0]&7)
+	if lead+trail > 7 {
+		return 0, errCorrupt
+	}
+	b, err := r.bytes(8 - lead - trail)
+	if err != nil {
+		return 0, err
+	}
+	var x uint64
+	for _, c := range b {
+		x = x<<8 | uint64(c)
+	}
+	return x << (8 * trail), nil
+}
+
+// segmentHeader describes the time window a segment covers
+type segmentHeader struct {
+	start  time.Time
+	length time.Duration
+}
+
+func (h segmentHeader) end() time.Time {
+	return h.start.Add(h.length)
+}
+
+func (h segmentHeader) encode() []byte {
+	buf := make([]byte, 0, segmentHeaderSize)
+	buf = append(buf, segmentMagic...)
+	buf = append(buf, segmentVersion)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.start.UnixMilli()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.length.Milliseconds()))
+	return buf
+}
+
+func readSegmentHeader(r io.Reader) (segmentHeader, error) {
+	buf := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return segmentHeader{}, fmt.Errorf("failed to read segment header: %w", err)
+	}
+	if string(buf[:4]) != segmentMagic {
+		return segmentHeader{}, fmt.Errorf("not a segment file")
+	}
+	if buf[4] != segmentVersion {
+		return segmentHeader{}, fmt.Errorf("unsupported segment version %d", buf[4])
+	}
+	return segmentHeader{
+		start:  time.UnixMilli(int64(binary.BigEndian.Uint64(buf[5:13]))),
+		length: time.Duration(binary.BigEndian.Uint64(buf[13:21])) * time.Millisecond,
+	}, nil
+}
+
+// scanSegment decodes every intact record of a segment file, calling fn
+// for each until it returns false. Only series accepted by filter (nil for
+// all) are included in the samples. It returns the decoding state and the
+// offset just past the last intact record; a torn or corrupt tail is not
+// an error.
+func scanSegment(path string, filter func(string) bool, fn func(Sample) bool) (*segmentState, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if _, err := readSegmentHeader(br); err != nil {
+		return nil, 0, err
+	}
+
+	st := newSegmentState(filter)
+	offset := int64(segmentHeaderSize)
+	for {
+		payload, n, err := readRecord(br)
+		if err != nil {
+			return st, offset, nil
+		}
+		s, err := st.decode(payload)
+		if err != nil {
+			return st, offset, nil
+		}
+		offset += int64(n)
+		if fn != nil && !fn(s) {
+			return st, offset, nil
+		}
+	}
+}
+
+// readRecord reads one framed record, returning its payload and total size
+func readRecord(br *bufio.Reader) ([]byte, int, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size > maxRecordSize {
+		return nil, 0, errCorrupt
+	}
+	frame := make([]byte, size+4)
+	if _, err := io.ReadFull(br, frame); err != nil {
+		return nil, 0, err
+	}
+	payload := frame[:size]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(frame[size:]) {
+		return nil, 0, errCorrupt
+	}
+	return payload, uvarintLen(size) + int(size) + 4, nil
+}
+
+func appendRecord(buf, payload []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	buf = append(buf, payload...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
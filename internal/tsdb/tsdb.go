@@ -0,0 +1,339 @@
+// Package tsdb is a small append-only time-series store. Each sample is a
+// set of named float values at one timestamp. Samples are written to
+// segment files that each cover a fixed time window, so range queries only
+// open the segments overlapping the range and retention drops whole files.
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".seg"
+
+// ErrOutOfOrder is returned when a sample isn't newer than the last sample
+// in its segment
+var ErrOutOfOrder = errors.New("sample is not newer than the last stored sample")
+
+// Sample is a set of series values at one point in time
+type Sample struct {
+	Time   time.Time
+	Values map[string]float64
+}
+
+// Options configures a database
+type Options struct {
+	SegmentDuration time.Duration // Time window covered by each segment file (default 6h)
+	NoSync          bool          // Skip fsync after each append
+}
+
+// DB stores samples in a directory of segment files
+type DB struct {
+	dir  string
+	opts Options
+
+	mu       sync.RWMutex
+	segments []segmentInfo // Sorted by window start
+	head     *segmentWriter
+	last     *Sample
+}
+
+type segmentInfo struct {
+	path   string
+	header segmentHeader
+}
+
+// segmentWriter appends records to one open segment
+type segmentWriter struct {
+	info  segmentInfo
+	file  *os.File
+	state *segmentState
+}
+
+// Open opens or creates a database in dir. Torn records left at the end of
+// the newest segment by a crash are truncated.
+func Open(dir string, opts Options) (*DB, error) {
+	if opts.SegmentDuration <= 0 {
+		opts.SegmentDuration = 6 * time.Hour
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	db := &DB{dir: dir, opts: opts}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentExt) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		header, err := readSegmentHeader(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		db.segments = append(db.segments, segmentInfo{path: path, header: header})
+	}
+	sort.Slice(db.segments, func(i, j int) bool {
+		return db.segments[i].header.start.Before(db.segments[j].header.start)
+	})
+
+	if len(db.segments) > 0 {
+		head, err := db.openWriter(db.segments[len(db.segments)-1])
+		if err != nil {
+			return nil, err
+		}
+		db.head = head
+	}
+
+	// The newest segment may have been created just before a crash
+	for i := len(db.segments) - 1; i >= 0 && db.last == nil; i-- {
+		state, _, err := scanSegment(db.segments[i].path, nil, nil)
+		if err == nil && state.records > 0 {
+			last := state.lastSample()
+			db.last = &last
+		}
+	}
+
+	return db, nil
+}
+
+// Close flushes and closes the open segment
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.head == nil {
+		return nil
+	}
+	err := db.head.file.Sync()
+	if closeErr := db.head.file.Close(); err == nil {
+		err = closeErr
+	}
+	db.head = nil
+	return err
+}
+
+// Append writes a sample to the segment covering its timestamp
+func (db *DB) Append(s Sample) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	start := s.Time.Truncate(db.opts.SegmentDuration)
+
+	w := db.head
+	temporary := false
+	if w == nil || !w.info.header.start.Equal(start) {
+		var err error
+		if w, err = db.writerFor(start); err != nil {
+			return err
+		}
+		if db.head == nil || start.After(db.head.info.header.start) {
+			if db.head != nil {
+				db.head.file.Close()
+			}
+			db.head = w
+		} else {
+			// Backfilling an older window; don't keep it open
+			temporary = true
+			defer func() {
+				w.file.Sync()
+				w.file.Close()
+			}()
+		}
+	}
+
+	if w.state.records > 0 && s.Time.UnixMilli() <= w.state.prevTime {
+		return ErrOutOfOrder
+	}
+
+	// encode advances the writer's state, so after a failed write it is
+	// ahead of the file and the writer is discarded
+	payload := w.state.encode(nil, s)
+	if _, err := w.file.Write(appendRecord(nil, payload)); err != nil {
+		db.discard(w)
+		return fmt.Errorf("failed to append sample: %w", err)
+	}
+	if !db.opts.NoSync {
+		if err := w.file.Sync(); err != nil {
+			db.discard(w)
+			return fmt.Errorf("failed to sync segment: %w", err)
+		}
+	}
+
+	if !temporary && (db.last == nil || s.Time.After(db.last.Time)) {
+		last := Sample{Time: time.UnixMilli(s.Time.UnixMilli()), Values: copyValues(s.Values)}
+		db.last = &last
+	}
+	return nil
+}
+
+// Query calls fn for every sample with start <= time <= end in time order,
+// stopping early if fn returns false
+func (db *DB) Query(start, end time.Time, fn func(Sample) bool) error {
+	return db.QuerySeries(start, end, nil, fn)
+}
+
+// QuerySeries is like Query but only decodes the series accepted by filter
+// into each sample's values
+func (db *DB) QuerySeries(start, end time.Time, filter func(string) bool, fn func(Sample) bool) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	startMs, endMs := start.UnixMilli(), end.UnixMilli()
+	for _, seg := range db.segments {
+		if !seg.header.end().After(start) || seg.header.start.After(end) {
+			continue
+		}
+
+		stop := false
+		_, _, err := scanSegment(seg.path, filter, func(s Sample) bool {
+			t := s.Time.UnixMilli()
+			if t > endMs {
+				stop = true
+				return false
+			}
+			if t >= startMs && !fn(s) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read segment %s: %w", filepath.Base(seg.path), err)
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Last returns the most recent sample
+func (db *DB) Last() (Sample, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.last == nil {
+		return Sample{}, false
+	}
+	return Sample{Time: db.last.Time, Values: copyValues(db.last.Values)}, true
+}
+
+// DeleteBefore removes segments whose whole window lies before t
+func (db *DB) DeleteBefore(t time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var firstErr error
+	kept := db.segments[:0]
+	for _, seg := range db.segments {
+		if seg.header.end().After(t) {
+			kept = append(kept, seg)
+			continue
+		}
+		if db.head != nil && db.head.info.path == seg.path {
+			db.head.file.Close()
+			db.head = nil
+			db.last = nil
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to remove segment: %w", err)
+			}
+			kept = append(kept, seg)
+		}
+	}
+	db.segments = kept
+	return firstErr
+}
+
+// discard drops a writer whose state may not match its file. The next
+// append reopens the segment, rebuilding the state from the records on disk
+// and cutting off a partly written one. Temporary writers are closed by
+// Append itself.
+func (db *DB) discard(w *segmentWriter) {
+	if db.head == w {
+		w.file.Close()
+		db.head = nil
+	}
+}
+
+// writerFor opens the segment for a window start, creating it if needed
+func (db *DB) writerFor(start time.Time) (*segmentWriter, error) {
+	for _, seg := range db.segments {
+		if seg.header.start.Equal(start) {
+			return db.openWriter(seg)
+		}
+	}
+
+	info := segmentInfo{
+		path:   filepath.Join(db.dir, start.UTC().Format("20060102T150405Z")+segmentExt),
+		header: segmentHeader{start: start, length: db.opts.SegmentDuration},
+	}
+
+	// Write the header to a temporary file and rename it into place so a
+	// segment is never visible without a complete header
+	tmp := info.path + ".tmp"
+	if err := os.WriteFile(tmp, info.header.encode(), 0644); err != nil {
+		return nil, fmt.Errorf("failed to create segment: %w", err)
+	}
+	if err := os.Rename(tmp, info.path); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to create segment: %w", err)
+	}
+
+	db.segments = append(db.segments, info)
+	sort.Slice(db.segments, func(i, j int) bool {
+		return db.segments[i].header.start.Before(db.segments[j].header.start)
+	})
+	return db.openWriter(info)
+}
+
+// openWriter rebuilds the encoder state of a segment and opens it for
+// appending, cutting off any torn tail
+func (db *DB) openWriter(info segmentInfo) (*segmentWriter, error) {
+	state, offset, err := scanSegment(info.path, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %s: %w", filepath.Base(info.path), err)
+	}
+
+	f, err := os.OpenFile(info.path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+	if stat, err := f.Stat(); err == nil && stat.Size() > offset {
+		if err := f.Truncate(offset); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to truncate segment: %w", err)
+		}
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &segmentWriter{info: info, file: f, state: state}, nil
+}
+
+func copyValues(values map[string]float64) map[string]float64 {
+	c := make(map[string]float64, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
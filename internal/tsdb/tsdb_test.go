@@ -0,0 +1,228 @@
+package tsdb
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, dir string) *DB {
+	t.Helper()
+	db, err := Open(dir, Options{SegmentDuration: time.Hour, NoSync: true})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return db
+}
+
+func queryAll(t *testing.T, db *DB) []Sample {
+	t.Helper()
+	var samples []Sample
+	err := db.Query(time.UnixMilli(0), time.UnixMilli(math.MaxInt64/2), func(s Sample) bool {
+		samples = append(samples, s)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	return samples
+}
+
+func TestRoundTrip(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		samples []Sample
+	}{
+		{name: "single", samples: []Sample{
+			{Time: base, Values: map[string]float64{"a": 1}},
+		}},
+		{name: "regular counters", samples: []Sample{
+			{Time: base, Values: map[string]float64{"req": 100, "err": 0}},
+			{Time: base.Add(10 * time.Second), Values: map[string]float64{"req": 105, "err": 0}},
+			{Time: base.Add(20 * time.Second), Values: map[string]float64{"req": 105, "err": 1}},
+			{Time: base.Add(30 * time.Second), Values: map[string]float64{"req": 230.5, "err": 1}},
+		}},
+		{name: "series come and go", samples: []Sample{
+			{Time: base, Values: map[string]float64{"a": 1}},
+			{Time: base.Add(7 * time.Second), Values: map[string]float64{"b": 2}},
+			{Time: base.Add(9 * time.Second), Values: map[string]float64{"a": 3, "c": -4}},
+			{Time: base.Add(30 * time.Second), Values: map[string]float64{}},
+		}},
+		{name: "special values", samples: []Sample{
+			{Time: base, Values: map[string]float64{"x": math.Inf(1), "y": math.MaxFloat64, "z": math.SmallestNonzeroFloat64}},
+			{Time: base.Add(time.Millisecond), Values: map[string]float64{"x": math.Inf(-1), "y": 0, "z": -0.5}},
+		}},
+		{name: "across segments", samples: []Sample{
+			{Time: base.Add(59 * time.Minute), Values: map[string]float64{"a": 1}},
+			{Time: base.Add(61 * time.Minute), Values: map[string]float64{"a": 2}},
+			{Time: base.Add(3 * time.Hour), Values: map[string]float64{"a": 3}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := openTestDB(t, dir)
+			for _, s := range tt.samples {
+				if err := db.Append(s); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			db = openTestDB(t, dir)
+			defer db.Close()
+			got := queryAll(t, db)
+			if len(got) != len(tt.samples) {
+				t.Fatalf("got %d samples, want %d", len(got), len(tt.samples))
+			}
+			for i, want := range tt.samples {
+				if !got[i].Time.Equal(want.Time) || !reflect.DeepEqual(got[i].Values, want.Values) {
+					t.Errorf("sample %d = %v %v, want %v %v", i, got[i].Time, got[i].Values, want.Time, want.Values)
+				}
+			}
+			last, ok := db.Last()
+			want := tt.samples[len(tt.samples)-1]
+			if !ok || !last.Time.Equal(want.Time) || !reflect.DeepEqual(last.Values, want.Values) {
+				t.Errorf("Last() = %v %v, want %v %v", last.Time, last.Values, want.Time, want.Values)
+			}
+		})
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+
+	now := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+	if err := db.Append(Sample{Time: now, Values: map[string]float64{"a": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Append(Sample{Time: now, Values: map[string]float64{"a": 2}}); err != ErrOutOfOrder {
+		t.Errorf("Append of the same time = %v, want ErrOutOfOrder", err)
+	}
+}
+
+func TestTruncatedSegment(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		cut  func(size int64) int64 // New file size
+		keep int                    // Samples left
+	}{
+		{name: "torn last record", cut: func(size int64) int64 { return size - 3 }, keep: 4},
+		{name: "only length of last record", cut: func(size int64) int64 { return size - 1 }, keep: 4},
+		{name: "header only", cut: func(int64) int64 { return segmentHeaderSize }, keep: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := openTestDB(t, dir)
+			for i := range 5 {
+				s := Sample{Time: base.Add(time.Duration(i) * time.Second), Values: map[string]float64{"a": float64(i)}}
+				if err := db.Append(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Close()
+
+			paths, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+			if len(paths) != 1 {
+				t.Fatalf("got %d segments, want 1", len(paths))
+			}
+			stat, err := os.Stat(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(paths[0], tt.cut(stat.Size())); err != nil {
+				t.Fatal(err)
+			}
+
+			db = openTestDB(t, dir)
+			if got := len(queryAll(t, db)); got != tt.keep {
+				t.Fatalf("after truncation got %d samples, want %d", got, tt.keep)
+			}
+
+			// Appending after recovery continues the segment cleanly
+			next := Sample{Time: base.Add(time.Minute), Values: map[string]float64{"a": 42, "b": 1}}
+			if err := db.Append(next); err != nil {
+				t.Fatalf("Append after recovery: %v", err)
+			}
+			db.Close()
+
+			db = openTestDB(t, dir)
+			defer db.Close()
+			got := queryAll(t, db)
+			if len(got) != tt.keep+1 || !reflect.DeepEqual(got[len(got)-1].Values, next.Values) {
+				t.Errorf("after recovery and append got %v", got)
+			}
+		})
+	}
+}
+
+func TestCorruptRecordStopsScan(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		if err := db.Append(Sample{Time: base.Add(time.Duration(i) * time.Second), Values: map[string]float64{"a": float64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-5] ^= 0xff // Last payload byte; its CRC no longer matches
+	if err := os.WriteFile(paths[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	if got := len(queryAll(t, db)); got != 2 {
+		t.Errorf("got %d samples, want the 2 before the corrupt record", got)
+	}
+}
+
+func TestFailedWriteDoesNotCorruptLaterRecords(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := db.Append(Sample{Time: base, Values: map[string]float64{"a": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// Make the next write fail after the encoder state has advanced
+	db.head.file.Close()
+	if err := db.Append(Sample{Time: base.Add(time.Second), Values: map[string]float64{"a": 2, "b": 5}}); err == nil {
+		t.Fatal("Append to a closed file succeeded")
+	}
+	for i, v := range []float64{3, 4} {
+		s := Sample{Time: base.Add(time.Duration(i+2) * time.Second), Values: map[string]float64{"a": v, "b": v}}
+		if err := db.Append(s); err != nil {
+			t.Fatalf("Append after a failed write: %v", err)
+		}
+	}
+	db.Close()
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	got := queryAll(t, db)
+	if len(got) != 3 {
+		t.Fatalf("got %d samples, want 3", len(got))
+	}
+	if want := map[string]float64{"a": 4, "b": 4}; !reflect.DeepEqual(got[2].Values, want) {
+		t.Errorf("last sample = %v, want %v", got[2].Values, want)
+	}
+}
@@ -6,15 +6,41 @@ class CaddyDashboard {
         this.selectedInstance = null;
         this.refreshInterval = null;
         this.activeTag = null;
+        this.permissions = { global: [], instances: {} };
         this.init();
     }
 
-    init() {
+    async init() {
         this.setupEventListeners();
+        await this.loadPermissions();
         this.loadInstances();
         this.startAutoRefresh();
     }
 
+    // loadPermissions fetches what the current user may do, so actions they
+    // can't take are hidden. The API enforces the permissions either way.
+    async loadPermissions() {
+        try {
+            const response = await fetch('/api/account/permissions');
+            if (!response.ok) throw new Error(await response.text());
+            this.permissions = await response.json();
+        } catch (error) {
+            console.error('Failed to load permissions:', error);
+        }
+
+        const addBtn = document.getElementById('add-instance-btn');
+        if (addBtn && !this.can('instance.manage')) {
+            addBtn.style.display = 'none';
+        }
+    }
+
+    // can reports whether the user holds perm on an instance, or on the
+    // dashboard as a whole without an instance ID
+    can(perm, instanceId) {
+        const perms = instanceId ? this.permissions.instances[instanceId] : this.permissions.global;
+        return (perms || []).includes(perm);
+    }
+
     setupEventListeners() {
         // Add instance button
         const addBtn = document.getElementById('add-instance-btn');
@@ -138,11 +164,11 @@ class CaddyDashboard {
             container.innerHTML = `
                 <div class="empty-state">
                     <p>${this.activeTag ? `No instances with tag "${this.activeTag}"` : 'No Caddy instances configured'}</p>
-                    ${!this.activeTag ? `
+                    ${!this.activeTag ? (this.can('instance.manage') ? `
                         <button class="btn btn-primary" onclick="caddyDashboard.showAddInstanceModal()">
                             Add First Instance
                         </button>
-                    ` : `
+                    ` : '') : `
                         <button class="btn btn-secondary" onclick="caddyDashboard.filterByTag('')">
                             Show All Instances
                         </button>
@@ -202,12 +228,16 @@ class CaddyDashboard {
                     <button class="btn btn-sm" data-action="analytics" data-instance-id="${instance.id}" title="Analytics">
                         📊
                     </button>
-                    <button class="btn btn-sm" data-action="config" data-instance-id="${instance.id}" title="Config">
-                        ⚙️
-                    </button>
-                    <button class="btn btn-sm btn-danger" data-action="delete" data-instance-id="${instance.id}" title="Delete">
-                        🗑️
-                    </button>
+                    ${this.can('config.read', instance.id) ? `
+                        <button class="btn btn-sm" data-action="config" data-instance-id="${instance.id}" title="Config">
+                            ⚙️
+                        </button>
+                    ` : ''}
+                    ${this.can('instance.manage', instance.id) ? `
+                        <button class="btn btn-sm btn-danger" data-action="delete" data-instance-id="${instance.id}" title="Delete">
+                            🗑️
+                        </button>
+                    ` : ''}
                 </div>
             </div>
         `;
@@ -387,7 +417,9 @@ document.addEventListener('DOMContentLoaded', () => {
                 name: document.getElementById('instance-name').value,
                 url: document.getElementById('instance-url').value,
                 api_key_file: document.getElementById('instance-api-key-file').value,
-                tags: document.getElementById('instance-tags').value.split(',').map(t => t.trim()).filter(t => t)
+                tags: document.getElementById('instance-tags').value.split(',').map(t => t.trim()).filter(t => t),
+                log_file: document.getElementById('instance-log-file').value,
+                log_source: document.getElementById('instance-log-source').value
             };
             await window.caddyDashboard.addInstance(formData);
         });
@@ -5,6 +5,7 @@ class ConfigEditor {
         this.currentFormat = 'json';
         this.originalConfig = '';
         this.unsavedChanges = false;
+        this.permissions = [];
 
         if (!this.instanceId) {
             this.showToast('No instance specified', 'error');
@@ -28,12 +29,39 @@ class ConfigEditor {
 
     async init() {
         this.setupEditor();
+        await this.loadPermissions();
         await this.loadInstance();
         await this.loadConfig();
         await this.loadSites();
+        await this.loadHistory();
         this.setupAutoRefresh();
     }
 
+    // loadPermissions fetches what the current user may do on this instance
+    // and hides the controls marked with a data-permission they don't hold.
+    // The API enforces the permissions either way.
+    async loadPermissions() {
+        try {
+            const response = await fetch('/api/account/permissions');
+            if (!response.ok) throw new Error(await response.text());
+            const data = await response.json();
+            this.permissions = data.instances[this.instanceId] || [];
+        } catch (error) {
+            console.error('Failed to load permissions:', error);
+        }
+
+        document.querySelectorAll('[data-permission]').forEach(el => {
+            if (!this.can(el.dataset.permission)) el.style.display = 'none';
+        });
+        if (!this.can('config.write')) {
+            document.getElementById('config-editor').readOnly = true;
+        }
+    }
+
+    can(perm) {
+        return this.permissions.includes(perm);
+    }
+
     setupEditor() {
         const editor = document.getElementById('config-editor');
         const lineNumbers = document.getElementById('line-numbers');
@@ -51,9 +79,13 @@ class ConfigEditor {
             }
         });
 
-        // Detect unsaved changes
+        // Detect unsaved changes, and lint Caddyfiles as they are typed
         editor.addEventListener('input', () => {
             this.markUnsaved();
+            if (this.currentFormat === 'caddyfile') {
+                clearTimeout(this.lintTimer);
+                this.lintTimer = setTimeout(() => this.lintCaddyfile(editor.value), 600);
+            }
         });
 
         // Update line numbers on scroll
@@ -118,6 +150,11 @@ class ConfigEditor {
             this.currentFormat = format;
 
             document.getElementById('config-format').value = format;
+            if (format === 'caddyfile') {
+                await this.lintCaddyfile(config);
+            } else {
+                this.renderDiagnostics([]);
+            }
         } catch (error) {
             console.error('Failed to load config:', error);
             this.showToast('Failed to load configuration', 'error');
@@ -132,9 +169,10 @@ class ConfigEditor {
             const container = document.getElementById('sites-container');
             if (sites && sites.length > 0) {
                 container.innerHTML = sites.map(site => `
-                    <div class="site-item" onclick="navigateToSite('${site.name}')">
+                    <div class="site-item" onclick="navigateToSite('${this.escapeHtml(site.name)}')">
                         <div class="site-name">${this.escapeHtml(site.name)}</div>
                         <div class="site-address">${site.listen ? site.listen.join(', ') : 'No addresses'}</div>
+                        <div class="site-address">${site.hosts && site.hosts.length > 0 ? this.escapeHtml(site.hosts.join(', ')) : 'Any host'} · ${site.routes ? site.routes.length : 0} routes</div>
                     </div>
                 `).join('');
             } else {
@@ -146,60 +184,235 @@ class ConfigEditor {
     }
 
     async saveConfig() {
-        const config = document.getElementById('config-editor').value;
+        let text = document.getElementById('config-editor').value;
+        let config = text;
+        let adapted = null;
+
+        // A Caddyfile is formatted and linted, then adapted to JSON so its
+        // effect can be reviewed
+        if (this.currentFormat === 'caddyfile') {
+            text = await this.formatCaddyfile(text);
+            if (text === null) return;
+            const diagnostics = await this.lintCaddyfile(text);
+            const errors = diagnostics.filter(d => d.severity === 'error').length;
+            if (errors > 0) {
+                this.showToast(`Fix ${errors} error${errors === 1 ? '' : 's'} before saving`, 'error');
+                return;
+            }
+            adapted = await this.adaptCaddyfile(text);
+            if (!adapted) return;
+            config = JSON.stringify(adapted.config);
+        }
 
-        try {
-            const response = await fetch(`/api/caddy/instances/${this.instanceId}/reload`, {
+        // Show what the reload would change and wait for confirmation
+        const plan = await this.planConfig(config);
+        if (!plan) return;
+
+        this.pendingConfig = text;
+        document.getElementById('diff-title').textContent = 'Review changes before reloading';
+        this.renderSummary(plan.summary);
+        this.renderWarnings(adapted ? adapted.warnings : []);
+        this.renderChanges(plan.changes);
+        const adaptedJSON = document.getElementById('adapted-json');
+        if (adapted) {
+            document.getElementById('adapted-json-content').textContent = JSON.stringify(adapted.config, null, 2);
+            adaptedJSON.style.display = 'block';
+        } else {
+            adaptedJSON.style.display = 'none';
+        }
+        document.getElementById('plan-actions').style.display = 'flex';
+        document.getElementById('diff-panel').style.display = 'block';
+    }
+
+    async applyPlan() {
+        if (this.pendingSite) {
+            await this.createSite();
+            return;
+        }
+
+        const config = this.pendingConfig;
+        const message = prompt('Describe this change (optional):', '');
+        if (message === null) return;
+
+        const query = `?message=${encodeURIComponent(message)}`;
+        const request = this.currentFormat === 'caddyfile'
+            ? fetch(`/api/caddy/instances/${this.instanceId}/config/caddyfile${query}`, {
+                method: 'PUT',
+                headers: { 'Content-Type': 'text/caddyfile' },
+                body: config
+            })
+            : fetch(`/api/caddy/instances/${this.instanceId}/reload${query}`, {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({ config })
+                body: config
             });
 
+        try {
+            const response = await request;
             if (!response.ok) {
-                const error = await response.json();
-                throw new Error(error.error || 'Failed to save config');
+                throw new Error(await response.text() || 'Failed to save config');
             }
 
             this.originalConfig = config;
             this.unsavedChanges = false;
+            this.closeDiff();
             this.showToast('Configuration saved and reloaded', 'success');
+            await this.loadHistory();
         } catch (error) {
             console.error('Failed to save config:', error);
             this.showToast(error.message, 'error');
         }
     }
 
-    async validateConfig() {
-        const config = document.getElementById('config-editor').value;
+    // adaptCaddyfile converts a Caddyfile to JSON with the instance's adapter
+    async adaptCaddyfile(caddyfile) {
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/config/caddyfile/adapt`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'text/caddyfile' },
+                body: caddyfile,
+                signal: AbortSignal.timeout(10000)
+            });
 
+            if (!response.ok) {
+                const message = (await response.text()).trim();
+                const line = message.match(/^caddyfile adapt failed: \S+:(\d+)\b/);
+                if (line) this.selectLine(parseInt(line[1], 10));
+                throw new Error(message);
+            }
+            return await response.json();
+        } catch (error) {
+            console.error('Failed to adapt Caddyfile:', error);
+            this.showToast(error.name === 'TimeoutError' ? 'Adapting timed out' : error.message, 'error');
+            return null;
+        }
+    }
+
+    // planConfig asks the server what loading config would change, without applying it
+    async planConfig(config) {
         try {
-            // Try to reload - if it succeeds, config is valid
-            const response = await fetch(`/api/caddy/instances/${this.instanceId}/reload`, {
+            JSON.parse(config);
+        } catch (e) {
+            this.showToast(`Invalid JSON: ${e.message}`, 'error');
+            return null;
+        }
+
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/config/plan`, {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify({ config }),
-                signal: AbortSignal.timeout(5000) // 5 second timeout
+                body: config,
+                signal: AbortSignal.timeout(10000)
             });
 
-            if (response.ok) {
-                this.showToast('Configuration is valid', 'success');
-            } else {
-                const error = await response.json();
-                this.showToast(`Validation failed: ${error.error}`, 'error');
+            if (!response.ok) {
+                throw new Error(await response.text());
             }
+            return await response.json();
         } catch (error) {
-            if (error.name === 'TimeoutError') {
-                this.showToast('Validation timed out', 'error');
+            console.error('Failed to plan config:', error);
+            this.showToast(error.name === 'TimeoutError' ? 'Planning timed out' : `Failed to plan changes: ${error.message}`, 'error');
+            return null;
+        }
+    }
+
+    async validateConfig() {
+        const config = document.getElementById('config-editor').value;
+
+        if (this.currentFormat === 'caddyfile') {
+            const adapted = await this.adaptCaddyfile(config);
+            if (!adapted) return;
+            if (adapted.warnings.length > 0) {
+                this.showToast(`Caddyfile is valid with ${adapted.warnings.length} warning(s); see Save & Reload for details`, 'info');
             } else {
-                this.showToast('Validation failed', 'error');
+                this.showToast('Caddyfile is valid', 'success');
             }
+            return;
+        }
+
+        const plan = await this.planConfig(config);
+        if (plan) {
+            const count = plan.changes.length;
+            this.showToast(`Configuration is valid JSON (${count} change${count === 1 ? '' : 's'})`, 'success');
         }
     }
 
-    formatConfig() {
+    // formatCaddyfile formats a Caddyfile in the editor and returns the result,
+    // or null if it has a syntax error
+    async formatCaddyfile(caddyfile) {
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/config/caddyfile/format`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'text/caddyfile' },
+                body: caddyfile
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            const result = await response.json();
+            if (result.changed) {
+                document.getElementById('config-editor').value = result.caddyfile;
+                this.updateLineNumbers();
+                this.markUnsaved();
+            }
+            return result.caddyfile;
+        } catch (error) {
+            console.error('Failed to format Caddyfile:', error);
+            await this.lintCaddyfile(caddyfile);
+            this.showToast(`Cannot format: ${error.message}`, 'error');
+            return null;
+        }
+    }
+
+    // lintCaddyfile shows the diagnostics for a Caddyfile below the editor
+    async lintCaddyfile(caddyfile) {
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/config/caddyfile/lint`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'text/caddyfile' },
+                body: caddyfile
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            const diagnostics = await response.json();
+            this.renderDiagnostics(diagnostics);
+            return diagnostics;
+        } catch (error) {
+            console.error('Failed to lint Caddyfile:', error);
+            return [];
+        }
+    }
+
+    renderDiagnostics(diagnostics) {
+        const container = document.getElementById('diagnostics');
+        if (diagnostics.length === 0) {
+            container.style.display = 'none';
+            container.innerHTML = '';
+            return;
+        }
+
+        container.innerHTML = diagnostics.map(d => `
+            <div class="diagnostic ${d.severity}" onclick="configEditor.selectLine(${d.line})">
+                <span class="diagnostic-severity">${d.severity}</span>
+                ${d.line}:${d.column} ${this.escapeHtml(d.message)}
+            </div>
+        `).join('');
+        container.style.display = 'block';
+    }
+
+    async formatConfig() {
         const editor = document.getElementById('config-editor');
         const config = editor.value;
 
+        if (this.currentFormat === 'caddyfile') {
+            const formatted = await this.formatCaddyfile(config);
+            if (formatted !== null) await this.lintCaddyfile(formatted);
+            return;
+        }
+
         try {
             // Try to parse as JSON and reformat
             const parsed = JSON.parse(config);
@@ -236,6 +449,462 @@ class ConfigEditor {
         this.showToast('Configuration reset', 'info');
     }
 
+    async openSiteWizard() {
+        try {
+            if (!this.siteTemplates) {
+                const response = await fetch('/api/caddy/site-templates');
+                if (!response.ok) {
+                    throw new Error(await response.text());
+                }
+                this.siteTemplates = await response.json();
+                document.getElementById('site-template').innerHTML = this.siteTemplates.map(t => `
+                    <option value="${this.escapeHtml(t.name)}">${this.escapeHtml(t.title)}${t.builtin ? '' : ' (custom)'}</option>
+                `).join('');
+            }
+            this.renderSiteParams();
+            document.getElementById('site-wizard').style.display = 'block';
+        } catch (error) {
+            console.error('Failed to load site templates:', error);
+            this.showToast(`Failed to load site templates: ${error.message}`, 'error');
+        }
+    }
+
+    closeSiteWizard() {
+        document.getElementById('site-wizard').style.display = 'none';
+    }
+
+    selectedSiteTemplate() {
+        const name = document.getElementById('site-template').value;
+        return this.siteTemplates.find(t => t.name === name);
+    }
+
+    renderSiteParams() {
+        const template = this.selectedSiteTemplate();
+        document.getElementById('site-template-description').textContent = template.description || '';
+        document.getElementById('site-params').innerHTML = template.params.map(p => {
+            const id = `site-param-${p.name}`;
+            const label = `${this.escapeHtml(p.label)}${p.required ? ' *' : ''}`;
+            switch (p.type) {
+            case 'bool':
+                return `<label><span><input type="checkbox" id="${id}"> ${label}</span></label>`;
+            case 'choice':
+                return `<label>${label}<select id="${id}" class="select-input">${p.options.map(o => `
+                    <option value="${this.escapeHtml(o)}" ${o === p.default ? 'selected' : ''}>${this.escapeHtml(o)}</option>
+                `).join('')}</select></label>`;
+            case 'list':
+                return `<label>${label} (comma-separated)<input type="text" id="${id}"></label>`;
+            default:
+                return `<label>${label}<input type="text" id="${id}"></label>`;
+            }
+        }).join('');
+    }
+
+    // siteParams reads the wizard's fields into the template's parameters
+    siteParams() {
+        const params = {};
+        for (const p of this.selectedSiteTemplate().params) {
+            const field = document.getElementById(`site-param-${p.name}`);
+            if (p.type === 'bool') {
+                params[p.name] = field.checked;
+            } else if (p.type === 'list') {
+                params[p.name] = field.value.split(',').map(v => v.trim()).filter(v => v);
+            } else if (p.name === 'redirect_code') {
+                params[p.name] = Number(field.value);
+            } else if (field.value.trim() !== '') {
+                params[p.name] = field.value.trim();
+            }
+        }
+        return params;
+    }
+
+    async previewSite() {
+        const site = { template: this.selectedSiteTemplate().name, params: this.siteParams() };
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/sites/preview`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(site)
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            const preview = await response.json();
+            this.closeDiff();
+            this.pendingSite = site;
+            document.getElementById('diff-title').textContent =
+                `Review new site in ${preview.server}${preview.new_server ? ' (new server)' : ''}`;
+            this.renderSummary(preview.plan.summary);
+            this.renderChanges(preview.plan.changes);
+            document.getElementById('adapted-json-content').textContent = JSON.stringify(preview.route, null, 2) +
+                (preview.tls_policy ? '\n\nTLS policy:\n' + JSON.stringify(preview.tls_policy, null, 2) : '');
+            document.getElementById('adapted-json').style.display = 'block';
+            document.getElementById('plan-actions').style.display = 'flex';
+            document.getElementById('diff-panel').style.display = 'block';
+        } catch (error) {
+            console.error('Failed to preview site:', error);
+            this.showToast(`Cannot create site: ${error.message}`, 'error');
+        }
+    }
+
+    async createSite() {
+        const message = prompt('Describe this change (optional):', '');
+        if (message === null) return;
+
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/sites`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ ...this.pendingSite, message })
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            this.closeDiff();
+            this.closeSiteWizard();
+            this.showToast('Site created', 'success');
+            await this.loadSites();
+            await this.loadHistory();
+            if (!this.unsavedChanges) {
+                await this.loadConfig(this.currentFormat);
+            }
+        } catch (error) {
+            console.error('Failed to create site:', error);
+            this.showToast(`Failed to create site: ${error.message}`, 'error');
+        }
+    }
+
+    async openRoutes(site) {
+        this.routesSite = site;
+        document.getElementById('routes-title').textContent = `Routes of ${site}`;
+        document.getElementById('routes-panel').style.display = 'block';
+        this.cancelRoute();
+        await this.loadRoutes();
+    }
+
+    closeRoutes() {
+        document.getElementById('routes-panel').style.display = 'none';
+        this.routesSite = null;
+    }
+
+    async loadRoutes() {
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/sites/${encodeURIComponent(this.routesSite)}/routes`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            this.routesETag = response.headers.get('ETag');
+            this.routes = await response.json();
+            this.renderRoutes();
+        } catch (error) {
+            console.error('Failed to load routes:', error);
+            this.showToast(`Failed to load routes: ${error.message}`, 'error');
+        }
+    }
+
+    renderRoutes() {
+        const tbody = document.getElementById('routes-body');
+        if (this.routes.length === 0) {
+            tbody.innerHTML = '<tr><td colspan="5" style="color: #64748b;">No routes</td></tr>';
+            return;
+        }
+
+        tbody.innerHTML = this.routes.map((route, i) => {
+            const match = route.match || [];
+            const hosts = match.flatMap(m => m.host || []);
+            const conditions = match.map(m => [
+                ...(m.path || []),
+                ...(m.method || []),
+                ...Object.entries(m.header || {}).map(([name, values]) => `${name}: ${values.join(', ')}`),
+                ...(m.remote_ip || []).map(ip => `from ${ip}`),
+                ...Object.keys(m.other || {})
+            ].join(' ')).filter(c => c).join(' or ');
+            const handlers = route.handle.map(h => h.handler).join(' → ');
+            return `
+                <tr class="${route.disabled ? 'disabled' : ''}">
+                    <td>${i}</td>
+                    <td>${this.escapeHtml(hosts.join(', ') || 'any')}</td>
+                    <td>${this.escapeHtml(conditions || 'all requests')}${route.terminal ? ' (terminal)' : ''}</td>
+                    <td>${this.escapeHtml(handlers || 'none')}</td>
+                    <td class="history-actions" style="margin-top: 0;">
+                        ${this.can('config.write') ? `<button class="btn btn-secondary" onclick="configEditor.moveRoute(${i}, -1)" ${i === 0 ? 'disabled' : ''}>↑</button>
+                        <button class="btn btn-secondary" onclick="configEditor.moveRoute(${i}, 1)" ${i === this.routes.length - 1 ? 'disabled' : ''}>↓</button>
+                        <button class="btn btn-secondary" onclick="configEditor.editRoute(${i})">Edit</button>
+                        <button class="btn btn-secondary" onclick="configEditor.toggleRoute(${i})">${route.disabled ? 'Enable' : 'Disable'}</button>
+                        <button class="btn btn-secondary" onclick="configEditor.deleteRoute(${i})">Delete</button>` : ''}
+                    </td>
+                </tr>
+            `;
+        }).join('');
+    }
+
+    // editRoute fills the route form from a route, or empties it for a new
+    // route. The form edits the first matcher set; any others are kept.
+    editRoute(index) {
+        this.editingRoute = index;
+        const route = index === null ? { match: [], handle: [] } : this.routes[index];
+        const match = (route.match && route.match[0]) || {};
+        const list = values => (values || []).join(', ');
+
+        document.getElementById('route-hosts').value = list(match.host);
+        document.getElementById('route-paths').value = list(match.path);
+        document.getElementById('route-methods').value = list(match.method);
+        document.getElementById('route-remote-ips').value = list(match.remote_ip);
+        document.getElementById('route-headers').value = Object.entries(match.header || {})
+            .flatMap(([name, values]) => values.map(v => `${name}: ${v}`)).join('\n');
+        document.getElementById('route-handlers').value = JSON.stringify(route.handle, null, 2);
+        document.getElementById('route-terminal').checked = !!route.terminal;
+        document.getElementById('route-form').style.display = 'grid';
+    }
+
+    cancelRoute() {
+        this.editingRoute = undefined;
+        document.getElementById('route-form').style.display = 'none';
+    }
+
+    async saveRoute() {
+        const split = id => document.getElementById(id).value.split(',').map(v => v.trim()).filter(v => v);
+
+        let handle;
+        try {
+            handle = JSON.parse(document.getElementById('route-handlers').value || '[]');
+            if (!Array.isArray(handle)) throw new Error('handlers must be an array');
+        } catch (error) {
+            this.showToast(`Invalid handlers: ${error.message}`, 'error');
+            return;
+        }
+
+        const header = {};
+        for (const line of document.getElementById('route-headers').value.split('\n')) {
+            const i = line.indexOf(':');
+            if (i <= 0) continue;
+            const name = line.slice(0, i).trim();
+            (header[name] = header[name] || []).push(line.slice(i + 1).trim());
+        }
+
+        const existing = this.editingRoute === null ? {} : this.routes[this.editingRoute];
+        const first = {
+            ...((existing.match && existing.match[0]) || {}),
+            host: split('route-hosts'),
+            path: split('route-paths'),
+            method: split('route-methods').map(m => m.toUpperCase()),
+            remote_ip: split('route-remote-ips'),
+            header
+        };
+        const hasMatchers = first.host.length || first.path.length || first.method.length ||
+            first.remote_ip.length || Object.keys(header).length || Object.keys(first.other || {}).length;
+        const rest = (existing.match || []).slice(1);
+        const route = {
+            ...existing,
+            match: hasMatchers || rest.length ? [first, ...rest] : [],
+            handle,
+            terminal: document.getElementById('route-terminal').checked
+        };
+
+        const base = `/api/caddy/instances/${this.instanceId}/sites/${encodeURIComponent(this.routesSite)}/routes`;
+        const ok = this.editingRoute === null
+            ? await this.routeRequest(base, 'POST', route)
+            : await this.routeRequest(`${base}/${this.editingRoute}`, 'PUT', route);
+        if (ok) {
+            this.cancelRoute();
+            this.showToast('Route saved', 'success');
+        }
+    }
+
+    async moveRoute(index, delta) {
+        await this.routeRequest(`/api/caddy/instances/${this.instanceId}/sites/${encodeURIComponent(this.routesSite)}/routes/${index}/move`,
+            'POST', { to: index + delta });
+    }
+
+    async toggleRoute(index) {
+        const action = this.routes[index].disabled ? 'enable' : 'disable';
+        await this.routeRequest(`/api/caddy/instances/${this.instanceId}/sites/${encodeURIComponent(this.routesSite)}/routes/${index}/${action}`, 'POST');
+    }
+
+    async deleteRoute(index) {
+        if (!confirm(`Delete route ${index}?`)) return;
+        await this.routeRequest(`/api/caddy/instances/${this.instanceId}/sites/${encodeURIComponent(this.routesSite)}/routes/${index}`, 'DELETE');
+    }
+
+    // routeRequest sends a route change guarded by the ETag of the route list,
+    // then reloads the routes. A conflict means someone else changed them.
+    async routeRequest(url, method, body) {
+        try {
+            const headers = { 'Content-Type': 'application/json' };
+            if (this.routesETag) headers['If-Match'] = this.routesETag;
+
+            const response = await fetch(url, {
+                method,
+                headers,
+                body: body === undefined ? undefined : JSON.stringify(body)
+            });
+            if (response.status === 412) {
+                this.showToast('The routes were changed by someone else; reloaded them', 'error');
+                await this.loadRoutes();
+                return false;
+            }
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            await this.loadRoutes();
+            await this.loadSites();
+            await this.loadHistory();
+            return true;
+        } catch (error) {
+            console.error('Route change failed:', error);
+            this.showToast(`Route change failed: ${error.message}`, 'error');
+            return false;
+        }
+    }
+
+    async loadHistory() {
+        const container = document.getElementById('history-container');
+
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/config/versions`);
+            if (!response.ok) {
+                container.innerHTML = '<p style="color: #64748b; font-size: 0.9rem;">History not available</p>';
+                return;
+            }
+            const versions = await response.json();
+
+            if (!versions || versions.length === 0) {
+                container.innerHTML = '<p style="color: #64748b; font-size: 0.9rem;">No changes recorded yet</p>';
+                return;
+            }
+
+            // Versions are newest first; each is diffed against the one before it
+            container.innerHTML = versions.slice(0, 20).map((v, i) => {
+                const previous = versions[i + 1];
+                return `
+                    <div class="site-item">
+                        <div class="site-name">v${v.version} · ${this.escapeHtml(v.action.replace('_', ' '))} (${v.stage})</div>
+                        <div class="site-address">${new Date(v.timestamp).toLocaleString()}${v.author ? ' · ' + this.escapeHtml(v.author) : ''}</div>
+                        ${v.message ? `<div class="site-address">${this.escapeHtml(v.message)}</div>` : ''}
+                        <div class="history-actions">
+                            ${previous ? `<button class="btn btn-secondary" onclick="configEditor.showDiff(${previous.version}, ${v.version})">Diff</button>` : ''}
+                            ${i > 0 && this.can('config.write') ? `<button class="btn btn-secondary" onclick="configEditor.rollback(${v.version})">Restore</button>` : ''}
+                        </div>
+                    </div>
+                `;
+            }).join('');
+        } catch (error) {
+            console.error('Failed to load history:', error);
+        }
+    }
+
+    async showDiff(from, to) {
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/config/diff?from=${from}&to=${to}`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const diff = await response.json();
+
+            document.getElementById('diff-title').textContent = `Changes from v${from} to v${to}`;
+            document.getElementById('diff-summary').innerHTML = '';
+            document.getElementById('diff-warnings').innerHTML = '';
+            document.getElementById('adapted-json').style.display = 'none';
+            document.getElementById('plan-actions').style.display = 'none';
+            this.renderChanges(diff.changes);
+            document.getElementById('diff-panel').style.display = 'block';
+        } catch (error) {
+            console.error('Failed to load diff:', error);
+            this.showToast('Failed to load diff', 'error');
+        }
+    }
+
+    renderChanges(changes) {
+        const container = document.getElementById('diff-container');
+        if (changes.length === 0) {
+            container.innerHTML = '<p style="color: #64748b; font-size: 0.9rem;">No differences</p>';
+            return;
+        }
+
+        container.innerHTML = changes.map(c => {
+            const format = value => this.escapeHtml(JSON.stringify(value));
+            let text = `${c.op} ${this.escapeHtml(c.path || '/')}`;
+            if (c.op === 'change') text += `: ${format(c.old)} → ${format(c.new)}`;
+            else if (c.op === 'add') text += `: ${format(c.new)}`;
+            else text += `: ${format(c.old)}`;
+            return `<div class="diff-change ${c.op}">${text}</div>`;
+        }).join('');
+    }
+
+    renderSummary(summary) {
+        const items = [`${summary.added} added`, `${summary.removed} removed`, `${summary.changed} changed`];
+        const list = (label, values) => {
+            if (values && values.length > 0) items.push(`${label}: ${values.join(', ')}`);
+        };
+        list('Servers added', summary.servers_added);
+        list('Servers removed', summary.servers_removed);
+        list('Servers changed', summary.servers_changed);
+        list('Hosts added', summary.hosts_added);
+        list('Hosts removed', summary.hosts_removed);
+        list('Upstreams added', summary.upstreams_added);
+        list('Upstreams removed', summary.upstreams_removed);
+        list('TLS policies touched', summary.tls_policies);
+
+        document.getElementById('diff-summary').innerHTML = items
+            .map(item => `<span>${this.escapeHtml(item)}</span>`)
+            .join('');
+    }
+
+    renderWarnings(warnings) {
+        document.getElementById('diff-warnings').innerHTML = warnings.map(w => {
+            const location = w.line ? `${w.file || 'Caddyfile'}:${w.line}` : (w.file || 'Caddyfile');
+            const directive = w.directive ? ` (${w.directive})` : '';
+            return `<div class="adapt-warning">⚠ ${this.escapeHtml(location + directive + ': ' + w.message)}</div>`;
+        }).join('');
+    }
+
+    // selectLine highlights a line of the editor, e.g. one an error refers to
+    selectLine(line) {
+        const editor = document.getElementById('config-editor');
+        const lines = editor.value.split('\n');
+        if (line < 1 || line > lines.length) return;
+
+        const start = lines.slice(0, line - 1).reduce((n, l) => n + l.length + 1, 0);
+        editor.focus();
+        editor.setSelectionRange(start, start + lines[line - 1].length);
+    }
+
+    closeDiff() {
+        this.pendingConfig = null;
+        this.pendingSite = null;
+        document.getElementById('diff-warnings').innerHTML = '';
+        document.getElementById('adapted-json').style.display = 'none';
+        document.getElementById('plan-actions').style.display = 'none';
+        document.getElementById('diff-panel').style.display = 'none';
+    }
+
+    async rollback(version) {
+        if (!confirm(`Restore version ${version}? The instance will be reloaded with that config.`)) return;
+        const message = prompt('Reason for the rollback (optional):', '');
+        if (message === null) return;
+
+        try {
+            const response = await fetch(`/api/caddy/instances/${this.instanceId}/config/versions/${version}/rollback`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ message })
+            });
+
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            this.showToast(`Restored version ${version}`, 'success');
+            await this.loadConfig(this.currentFormat);
+            await this.loadHistory();
+        } catch (error) {
+            console.error('Rollback failed:', error);
+            this.showToast(`Rollback failed: ${error.message}`, 'error');
+        }
+    }
+
     async reloadConfig() {
         this.showToast('Reloading configuration...', 'info');
 
@@ -302,6 +971,7 @@ class ConfigEditor {
                 return;
             }
         }
+        this.closeDiff();
         await this.loadConfig(format);
     }
 
@@ -340,8 +1010,7 @@ class ConfigEditor {
 
 // Helper function to navigate to site
 function navigateToSite(siteName) {
-    // Could open site config in editor
-    console.log('Navigate to site:', siteName);
+    window.configEditor.openRoutes(siteName);
 }
 
 // Initialize when DOM is ready
@@ -118,6 +118,9 @@ class Dashboard {
             case 'text':
                 this.renderText(widget, content);
                 break;
+            case 'heatmap':
+                this.renderHeatmap(widget, content);
+                break;
         }
     }
 
@@ -187,6 +190,15 @@ class Dashboard {
         });
     }
 
+    renderHeatmap(widget, container) {
+        const containerId = `heatmap-${widget.id}`;
+        container.innerHTML = `<div id="${containerId}" class="chart-container"></div>`;
+
+        if (typeof createChart === 'function') {
+            createChart(containerId, 'heatmap', widget.data, widget.config || {});
+        }
+    }
+
     renderTable(widget, container) {
         const data = widget.data;
         if (!data.headers || !data.rows) return;
@@ -264,6 +264,73 @@ class MetricsChart {
         this.drawLegend(data, colors, width);
     }
 
+    // Draw a heatmap; data is { x_labels, y_labels, values[x][y] } with the
+    // lowest row first
+    drawHeatmap(data, options = {}) {
+        if (!data || !data.values || data.values.length === 0 || !data.y_labels || data.y_labels.length === 0) {
+            this.drawEmptyState('No data available');
+            return;
+        }
+
+        const ctx = this.ctx;
+        const width = this.canvas.width;
+        const height = this.canvas.height;
+        const padding = { top: 10, right: 20, bottom: 40, left: 60 };
+
+        const chartWidth = width - padding.left - padding.right;
+        const chartHeight = height - padding.top - padding.bottom;
+        const cols = data.values.length;
+        const rows = data.y_labels.length;
+        const cellWidth = chartWidth / cols;
+        const cellHeight = chartHeight / rows;
+
+        // Clear canvas
+        ctx.clearRect(0, 0, width, height);
+
+        // Log scale keeps sparse tail buckets visible next to busy ones
+        const max = Math.max(...data.values.flat());
+        const scale = Math.log1p(max) || 1;
+        const color = options.color || this.options.color;
+
+        data.values.forEach((column, x) => {
+            column.forEach((value, y) => {
+                if (value <= 0) return;
+                ctx.globalAlpha = 0.15 + 0.85 * (Math.log1p(value) / scale);
+                ctx.fillStyle = color;
+                ctx.fillRect(
+                    padding.left + x * cellWidth,
+                    padding.top + chartHeight - (y + 1) * cellHeight,
+                    Math.max(cellWidth - 1, 1),
+                    Math.max(cellHeight - 1, 1)
+                );
+            });
+        });
+        ctx.globalAlpha = 1;
+
+        // Y-axis labels
+        ctx.fillStyle = '#64748b';
+        ctx.font = '11px system-ui';
+        ctx.textAlign = 'right';
+        const rowInterval = Math.ceil(rows / 8);
+        data.y_labels.forEach((label, y) => {
+            if (y % rowInterval === 0 || y === rows - 1) {
+                const labelY = padding.top + chartHeight - (y + 0.5) * cellHeight + 4;
+                ctx.fillText(`${label}${data.unit ? ' ' + data.unit : ''}`, padding.left - 6, labelY);
+            }
+        });
+
+        // X-axis labels
+        ctx.textAlign = 'center';
+        const labelInterval = Math.ceil(cols / 6);
+        (data.x_labels || []).forEach((label, x) => {
+            if (x % labelInterval === 0) {
+                const date = new Date(label);
+                const text = isNaN(date) ? label : date.toLocaleTimeString();
+                ctx.fillText(text, padding.left + (x + 0.5) * cellWidth, height - padding.bottom + 20);
+            }
+        });
+    }
+
     drawLegend(data, colors, width) {
         const ctx = this.ctx;
         const legendX = 10;
@@ -332,6 +399,9 @@ function createChart(containerId, type, data, options = {}) {
         case 'pie':
             chart.drawPieChart(data, options);
             break;
+        case 'heatmap':
+            chart.drawHeatmap(data, options);
+            break;
         case 'line':
         default:
             chart.drawLineChart(data, options);
@@ -0,0 +1,449 @@
+// UserManager - Admin page for managing users
+class UserManager {
+    constructor() {
+        this.users = [];
+        this.policy = [];
+        this.editing = null;
+        this.roles = [];
+        this.permissions = [];
+        this.editingRole = null;
+        this.instances = [];
+        this.accessUser = null;
+        this.init();
+    }
+
+    init() {
+        this.setupEventListeners();
+        this.loadRoles();
+        this.loadUsers();
+        this.loadInstances();
+    }
+
+    setupEventListeners() {
+        document.getElementById('add-user-btn').addEventListener('click', () => this.showUserModal(null));
+
+        document.getElementById('user-invite').addEventListener('change', (e) => {
+            document.getElementById('user-password-group').style.display = e.target.checked ? 'none' : 'block';
+        });
+
+        document.getElementById('user-form').addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.saveUser();
+        });
+
+        document.getElementById('roles-btn').addEventListener('click', () => {
+            this.editRole(null);
+            document.getElementById('roles-modal').style.display = 'block';
+        });
+
+        document.getElementById('role-form').addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.saveRole();
+        });
+
+        document.getElementById('role-cancel').addEventListener('click', () => this.editRole(null));
+
+        document.getElementById('roles-body').addEventListener('click', (e) => {
+            const btn = e.target.closest('button[data-action]');
+            if (!btn) return;
+            const role = this.roles.find(r => r.name === btn.dataset.role);
+            if (!role) return;
+            if (btn.dataset.action === 'edit-role') this.editRole(role);
+            if (btn.dataset.action === 'delete-role') this.deleteRole(role);
+        });
+
+        document.getElementById('binding-form').addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.addBinding();
+        });
+
+        document.getElementById('bindings-body').addEventListener('click', (e) => {
+            const btn = e.target.closest('button[data-binding]');
+            if (btn) this.deleteBinding(btn.dataset.binding);
+        });
+
+        document.getElementById('secret-copy').addEventListener('click', () => {
+            navigator.clipboard.writeText(document.getElementById('secret-value').textContent);
+        });
+
+        // Row actions
+        document.getElementById('users-body').addEventListener('click', (e) => {
+            const btn = e.target.closest('button[data-action]');
+            if (!btn) return;
+            const user = this.users.find(u => u.id === Number(btn.dataset.id));
+            if (user) this.runAction(btn.dataset.action, user);
+        });
+
+        // Modal close buttons
+        document.querySelectorAll('.modal-close, .modal-cancel').forEach(btn => {
+            btn.addEventListener('click', (e) => {
+                const modal = e.target.closest('.modal');
+                if (modal) modal.style.display = 'none';
+            });
+        });
+
+        // Click outside modal to close
+        window.addEventListener('click', (e) => {
+            if (e.target.classList.contains('modal')) {
+                e.target.style.display = 'none';
+            }
+        });
+    }
+
+    async loadUsers() {
+        try {
+            const response = await fetch('/api/admin/users');
+            if (!response.ok) throw new Error(await response.text());
+            const data = await response.json();
+            this.users = data.users || [];
+            this.policy = data.password_policy || [];
+            this.renderUsers();
+        } catch (error) {
+            console.error('Failed to load users:', error);
+            this.showError('Failed to load users');
+        }
+    }
+
+    async loadRoles() {
+        const data = await this.request('GET', '/api/admin/roles');
+        if (!data) return;
+        this.roles = data.roles || [];
+        this.permissions = data.permissions || [];
+        this.renderRoles();
+        this.renderUsers();
+    }
+
+    async loadInstances() {
+        try {
+            const response = await fetch('/api/caddy/instances');
+            if (!response.ok) return;
+            const data = await response.json();
+            this.instances = data.instances || [];
+        } catch (error) {
+            console.error('Failed to load instances:', error);
+        }
+    }
+
+    roleLabel(name) {
+        return name.charAt(0).toUpperCase() + name.slice(1);
+    }
+
+    renderRoles() {
+        document.getElementById('roles-body').innerHTML = this.roles.map(role => `
+            <tr>
+                <td>
+                    <strong>${this.escapeHtml(this.roleLabel(role.name))}</strong>${role.builtin ? ' (built-in)' : ''}
+                    <div class="binding-scope">${this.escapeHtml(role.description || '')}</div>
+                </td>
+                <td>${role.permissions.map(p => this.escapeHtml(p)).join(', ') || 'none'}</td>
+                <td>${role.builtin ? '' : `
+                    <div class="user-actions">
+                        <button class="btn btn-secondary btn-sm" data-action="edit-role" data-role="${this.escapeHtml(role.name)}">Edit</button>
+                        <button class="btn btn-danger btn-sm" data-action="delete-role" data-role="${this.escapeHtml(role.name)}">Delete</button>
+                    </div>
+                `}</td>
+            </tr>
+        `).join('');
+
+        const options = this.roles.map(role =>
+            `<option value="${this.escapeHtml(role.name)}">${this.escapeHtml(this.roleLabel(role.name))}</option>`
+        ).join('');
+        document.getElementById('user-role').innerHTML = options;
+        document.getElementById('binding-role').innerHTML = options;
+    }
+
+    // editRole fills the role form from a custom role, or empties it for a
+    // new one
+    editRole(role) {
+        this.editingRole = role;
+        document.getElementById('role-form-title').textContent = role ? `Edit ${role.name}` : 'New Role';
+        document.getElementById('role-name').value = role ? role.name : '';
+        document.getElementById('role-name').disabled = !!role;
+        document.getElementById('role-description').value = role ? role.description || '' : '';
+        document.getElementById('role-permissions').innerHTML = this.permissions.map(p => `
+            <label><input type="checkbox" value="${this.escapeHtml(p)}" ${role && role.permissions.includes(p) ? 'checked' : ''}> ${this.escapeHtml(p)}</label>
+        `).join('');
+    }
+
+    async saveRole() {
+        const body = {
+            name: document.getElementById('role-name').value.trim(),
+            description: document.getElementById('role-description').value.trim(),
+            permissions: Array.from(document.querySelectorAll('#role-permissions input:checked')).map(el => el.value)
+        };
+
+        const data = this.editingRole
+            ? await this.request('PUT', `/api/admin/roles/${encodeURIComponent(this.editingRole.name)}`, body)
+            : await this.request('POST', '/api/admin/roles', body);
+        if (!data) return;
+
+        this.editRole(null);
+        this.loadRoles();
+    }
+
+    async deleteRole(role) {
+        if (!confirm(`Delete the role ${role.name}?`)) return;
+        const data = await this.request('DELETE', `/api/admin/roles/${encodeURIComponent(role.name)}`);
+        if (data) this.loadRoles();
+    }
+
+    async showAccess(user) {
+        this.accessUser = user;
+        document.getElementById('access-title').textContent = `Access of ${user.username}`;
+        document.getElementById('binding-form').reset();
+        document.getElementById('binding-instances').innerHTML = this.instances.map(inst => `
+            <label><input type="checkbox" value="${this.escapeHtml(inst.id)}"> ${this.escapeHtml(inst.name)}</label>
+        `).join('') || '<span class="binding-scope">No instances</span>';
+        await this.loadBindings();
+        document.getElementById('access-modal').style.display = 'block';
+    }
+
+    async loadBindings() {
+        const bindings = await this.request('GET', `/api/admin/users/${this.accessUser.id}/bindings`);
+        if (!bindings) return;
+
+        const body = document.getElementById('bindings-body');
+        const own = `
+            <tr>
+                <td>${this.escapeHtml(this.roleLabel(this.accessUser.role))}</td>
+                <td>Everywhere (own role)</td>
+                <td></td>
+            </tr>
+        `;
+        body.innerHTML = own + bindings.map(b => {
+            const scope = [];
+            if (b.instances) {
+                scope.push('instances ' + b.instances.map(id => {
+                    const inst = this.instances.find(i => i.id === id);
+                    return this.escapeHtml(inst ? inst.name : id);
+                }).join(', '));
+            }
+            if (b.tags) {
+                scope.push('tags ' + b.tags.map(t => this.escapeHtml(t)).join(', '));
+            }
+            return `
+                <tr>
+                    <td>${this.escapeHtml(this.roleLabel(b.role))}</td>
+                    <td>${scope.length > 0 ? scope.join('; ') : 'Everywhere'}</td>
+                    <td><button class="btn btn-danger btn-sm" data-binding="${this.escapeHtml(b.id)}">Remove</button></td>
+                </tr>
+            `;
+        }).join('');
+    }
+
+    async addBinding() {
+        const body = {
+            role: document.getElementById('binding-role').value,
+            instances: Array.from(document.querySelectorAll('#binding-instances input:checked')).map(el => el.value),
+            tags: document.getElementById('binding-tags').value.split(',').map(t => t.trim()).filter(t => t)
+        };
+
+        const data = await this.request('POST', `/api/admin/users/${this.accessUser.id}/bindings`, body);
+        if (!data) return;
+
+        document.getElementById('binding-form').reset();
+        this.loadBindings();
+    }
+
+    async deleteBinding(id) {
+        const data = await this.request('DELETE', `/api/admin/bindings/${id}`);
+        if (data) this.loadBindings();
+    }
+
+    renderUsers() {
+        const body = document.getElementById('users-body');
+        if (this.users.length === 0) {
+            body.innerHTML = '<tr><td colspan="6">No users</td></tr>';
+            return;
+        }
+
+        body.innerHTML = this.users.map(user => {
+            let status = '<span class="status-badge status-success">Active</span>';
+            if (!user.active) {
+                status = '<span class="status-badge status-error">Deactivated</span>';
+            } else if (user.invite_expires_at) {
+                const expired = new Date(user.invite_expires_at) < new Date();
+                status = `<span class="status-badge status-warning">${expired ? 'Invitation expired' : 'Invited'}</span>`;
+            } else if (user.must_change_password) {
+                status = '<span class="status-badge status-warning">Must change password</span>';
+            }
+            if (user.totp_enabled) {
+                status += ' <span class="status-badge status-success">2FA</span>';
+            } else if (user.totp_required) {
+                status += ' <span class="status-badge status-warning">2FA required</span>';
+            }
+
+            const actions = [
+                `<button class="btn btn-secondary btn-sm" data-action="edit" data-id="${user.id}">Edit</button>`,
+                `<button class="btn btn-secondary btn-sm" data-action="access" data-id="${user.id}">Access</button>`
+            ];
+            if (user.invite_expires_at) {
+                actions.push(`<button class="btn btn-secondary btn-sm" data-action="invite" data-id="${user.id}">New Invitation</button>`);
+            } else {
+                actions.push(`<button class="btn btn-secondary btn-sm" data-action="reset" data-id="${user.id}">Reset Password</button>`);
+            }
+            if (user.totp_enabled) {
+                actions.push(`<button class="btn btn-secondary btn-sm" data-action="reset-2fa" data-id="${user.id}">Reset 2FA</button>`);
+            }
+            if (user.active && user.id !== window.currentUserID) {
+                actions.push(`<button class="btn btn-danger btn-sm" data-action="deactivate" data-id="${user.id}">Deactivate</button>`);
+            } else if (!user.active) {
+                actions.push(`<button class="btn btn-primary btn-sm" data-action="activate" data-id="${user.id}">Reactivate</button>`);
+            }
+
+            return `
+                <tr class="${user.active ? '' : 'inactive'}">
+                    <td>${this.escapeHtml(user.username)}</td>
+                    <td>${this.escapeHtml(user.email || '')}</td>
+                    <td>${this.escapeHtml(this.roleLabel(user.role))}</td>
+                    <td>${status}</td>
+                    <td>${user.last_login_at ? new Date(user.last_login_at).toLocaleString() : 'Never'}</td>
+                    <td><div class="user-actions">${actions.join('')}</div></td>
+                </tr>
+            `;
+        }).join('');
+    }
+
+    showUserModal(user) {
+        this.editing = user;
+        document.getElementById('user-modal-title').textContent = user ? `Edit ${user.username}` : 'Add User';
+        document.getElementById('user-form').reset();
+        document.getElementById('user-username').value = user ? user.username : '';
+        document.getElementById('user-email').value = user ? user.email || '' : '';
+        document.getElementById('user-role').value = user ? user.role : 'user';
+        document.getElementById('user-require-2fa').checked = user ? user.totp_required : false;
+        document.getElementById('user-new-fields').style.display = user ? 'none' : 'block';
+        document.getElementById('user-password-group').style.display = 'none';
+        document.getElementById('user-policy').innerHTML = this.policy.map(p => `<li>${this.escapeHtml(p)}</li>`).join('');
+        document.getElementById('user-modal').style.display = 'block';
+    }
+
+    async saveUser() {
+        const body = {
+            username: document.getElementById('user-username').value.trim(),
+            email: document.getElementById('user-email').value.trim(),
+            role: document.getElementById('user-role').value,
+            require_2fa: document.getElementById('user-require-2fa').checked
+        };
+
+        let url = '/api/admin/users';
+        let method = 'POST';
+        if (this.editing) {
+            url += `/${this.editing.id}`;
+            method = 'PUT';
+        } else {
+            body.invite = document.getElementById('user-invite').checked;
+            if (!body.invite) {
+                body.password = document.getElementById('user-password').value;
+                body.must_change_password = document.getElementById('user-must-change').checked;
+            }
+        }
+
+        const data = await this.request(method, url, body);
+        if (!data) return;
+
+        document.getElementById('user-modal').style.display = 'none';
+        if (data.invite_url) {
+            const expires = new Date(data.user.invite_expires_at).toLocaleString();
+            this.showSecret('Invitation Link', `Send this link to ${body.username}. It can be used once and expires on ${expires}.`, data.invite_url);
+        }
+        this.loadUsers();
+    }
+
+    async runAction(action, user) {
+        let data;
+        switch (action) {
+        case 'edit':
+            this.showUserModal(user);
+            return;
+        case 'access':
+            this.showAccess(user);
+            return;
+        case 'deactivate':
+            if (!confirm(`Deactivate ${user.username}? They are signed out and can't log in until reactivated.`)) return;
+            data = await this.request('POST', `/api/admin/users/${user.id}/deactivate`);
+            break;
+        case 'activate':
+            data = await this.request('POST', `/api/admin/users/${user.id}/activate`);
+            break;
+        case 'reset':
+            if (!confirm(`Reset the password of ${user.username}? A new password is generated that they have to change at the next login.`)) return;
+            data = await this.request('POST', `/api/admin/users/${user.id}/reset-password`);
+            if (data && data.password) {
+                this.showSecret('New Password', `Pass this password on to ${user.username}. It is shown only once.`, data.password);
+            }
+            break;
+        case 'reset-2fa':
+            if (!confirm(`Turn off two-factor authentication for ${user.username}, e.g. after they lost their device? If it is required, they set it up again at the next login.`)) return;
+            data = await this.request('POST', `/api/admin/users/${user.id}/reset-2fa`);
+            break;
+        case 'invite':
+            data = await this.request('POST', `/api/admin/users/${user.id}/invite`);
+            if (data && data.invite_url) {
+                this.showSecret('Invitation Link', `Send this link to ${user.username}. Earlier links no longer work.`, data.invite_url);
+            }
+            break;
+        }
+        if (data) this.loadUsers();
+    }
+
+    // request sends a JSON request and returns the decoded response, or
+    // null after showing the error
+    async request(method, url, body) {
+        try {
+            const options = { method, headers: { 'Content-Type': 'application/json' } };
+            if (body) options.body = JSON.stringify(body);
+            const response = await fetch(url, options);
+            if (!response.ok) {
+                this.showError((await response.text()).trim() || 'Request failed');
+                return null;
+            }
+            return await response.json();
+        } catch (error) {
+            console.error(`${method} ${url} failed:`, error);
+            this.showError('Request failed');
+            return null;
+        }
+    }
+
+    showSecret(title, text, value) {
+        document.getElementById('secret-title').textContent = title;
+        document.getElementById('secret-text').textContent = text;
+        document.getElementById('secret-value').textContent = value;
+        document.getElementById('secret-modal').style.display = 'block';
+    }
+
+    showError(message) {
+        const errorDiv = document.createElement('div');
+        errorDiv.className = 'error-notification';
+        errorDiv.textContent = message;
+        errorDiv.style.cssText = `
+            position: fixed;
+            top: 20px;
+            right: 20px;
+            background: #fee2e2;
+            color: #dc2626;
+            padding: 1rem;
+            border-radius: 6px;
+            box-shadow: 0 4px 6px rgba(0, 0, 0, 0.1);
+            z-index: 1000;
+        `;
+
+        document.body.appendChild(errorDiv);
+
+        setTimeout(() => {
+            errorDiv.remove();
+        }, 5000);
+    }
+
+    escapeHtml(text) {
+        const div = document.createElement('div');
+        div.textContent = text;
+        return div.innerHTML;
+    }
+}
+
+// Initialize when DOM is ready
+document.addEventListener('DOMContentLoaded', () => {
+    window.userManager = new UserManager();
+});